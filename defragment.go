@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/provider"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// newDefragmentCommand returns the defragment command, which prints the moves that pack the addresses of a pool as
+// json and only applies them with --apply
+func newDefragmentCommand() *cobra.Command {
+	var (
+		kubeconfig  string
+		cmName      string
+		cmNamespace string
+		apply       bool
+	)
+	command := &cobra.Command{
+		Use:   "defragment <pool key>",
+		Short: "Plan, and with --apply perform, the moves that pack the addresses of the services of a pool at its lowest free addresses",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+			loadingRules.ExplicitPath = kubeconfig
+			cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+			if err != nil {
+				return fmt.Errorf("error creating kubernetes client config: %v", err)
+			}
+			kubeClient, err := kubernetes.NewForConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("error creating kubernetes client: %v", err)
+			}
+
+			moves, err := provider.DefragmentPool(cmd.Context(), kubeClient, cmName, cmNamespace, args[0], apply)
+			if err != nil {
+				return err
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(moves)
+		},
+	}
+	command.Flags().StringVar(&kubeconfig, "kubeconfig", "", "Path to the kubeconfig, the in-cluster config or the default kubeconfig is used if empty")
+	command.Flags().StringVar(&cmName, "configmap", provider.KubeVipClientConfig, "Name of the pool configmap")
+	command.Flags().StringVar(&cmNamespace, "namespace", provider.KubeVipClientConfigNamespace, "Namespace of the pool configmap")
+	command.Flags().BoolVar(&apply, "apply", false, "Move the addresses of the services, the moves are only printed otherwise")
+	command.Flags().BoolVar(&provider.EnableAllocationLedger, "allocation-ledger", false, "Update the moved addresses in the allocation ledger, set if the controller runs with --allocation-ledger")
+	return command
+}
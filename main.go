@@ -21,6 +21,7 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/provider"
 	"github.com/spf13/pflag"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -33,7 +34,7 @@ import (
 	"k8s.io/component-base/logs"
 	_ "k8s.io/component-base/metrics/prometheus/clientgo" // for client metric registration
 	_ "k8s.io/component-base/metrics/prometheus/version"  // for version metric registration
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 )
 
 func main() {
@@ -66,6 +67,49 @@ func main() {
 	command := app.NewCloudControllerManagerCommand(opts, cloudInitializer, controllerInitializers, names.CCMControllerAliases(), fss, wait.NeverStop)
 
 	command.Flags().BoolVar(&provider.OutSideCluster, "OutSideCluster", false, "Start Controller outside of cluster")
+	command.Flags().BoolVar(&provider.EnablePoolMetrics, "enable-pool-metrics", false, "Expose the pool utilization and latency metrics on the metrics endpoint")
+	command.Flags().BoolVar(&provider.RefuseDuplicateIPs, "refuse-duplicate-ips", false, "Refuse to allocate from a pool while one of its addresses is assigned to more than one service")
+	command.Flags().BoolVar(&provider.AutoCreateConfigMap, "auto-create-configmap", false, "Create an empty pool configmap if it doesn't exist")
+	command.Flags().BoolVar(&provider.ValidateConfigOnStart, "validate-config-on-start", false, "Exit if the pool configuration is invalid when the controller starts")
+	command.Flags().BoolVar(&provider.EnableAllocationLedger, "allocation-ledger", false, "Record the allocated addresses in the kube-vip-allocations configmap and treat them as in use")
+	command.Flags().DurationVar(&provider.LedgerReclaimInterval, "ledger-reclaim-interval", 0, "Interval to remove the addresses of services that no longer exist from the allocation ledger, and of namespaces that no longer exist from the address affinity configmap, 0 disables the reclaim")
+	command.Flags().IntVar(&ipam.MaxProbeAttempts, "ipv6-probe-attempts", ipam.MaxProbeAttempts, "Number of random addresses probed in a large IPv6 cidr before it is considered out of addresses")
+	command.Flags().DurationVar(&provider.OrphanedAnnotationSweepInterval, "orphaned-annotation-sweep-interval", 0, "Interval to label services that have an address annotation but lost the implementation label, 0 disables the sweep")
+	command.Flags().DurationVar(&provider.ResyncInterval, "resync-interval", 0, "Interval to sync the load balancer services missing the implementation label or the address annotation, extended by a random jitter, 0 disables the resync")
+	command.Flags().BoolVar(&provider.WriteLegacyLoadBalancerIP, "write-legacy-loadbalancer-ip", provider.WriteLegacyLoadBalancerIP, "Set the deprecated spec.loadBalancerIP of a service to its first address, disable it if kube-vip reads the kube-vip.io/loadbalancerIPs annotation")
+	command.Flags().DurationVar(&provider.ReleaseGracePeriod, "release-grace-period", 0, "Time the address(es) of a deleted service are withheld before they can be allocated to another service, 0 frees them immediately")
+	command.Flags().DurationVar(&provider.OutOfIPsRetryInterval, "out-of-ips-retry-interval", provider.OutOfIPsRetryInterval, "Delay before a service is retried when its pool is out of addresses, 0 uses the exponential backoff of the controller")
+	command.Flags().BoolVar(&provider.ReallocateOutOfPool, "reallocate-out-of-pool", false, "Reallocate the address(es) of a service that are no longer part of its pool after the pool was reconfigured")
+	command.Flags().BoolVar(&provider.Deterministic, "deterministic", false, "Always allocate the numerically lowest free address of a pool, ignoring the search order, for reproducible allocations")
+	command.Flags().BoolVar(&provider.VerifyAllocation, "verify-allocation", false, "Check that the allocated address(es) are still free right before the service is updated, and allocate again if they were assigned concurrently")
+	command.Flags().BoolVar(&provider.PopulateIngressStatus, "populate-ingress-status", false, "Set the ingress of the load balancer status of a service to its address(es) instead of leaving the status to kube-vip")
+	command.Flags().BoolVar(&provider.ZonePools, "zone-pools", false, "Allocate the address(es) of a service from the pool of the topology zone most of its nodes are in, i.e. cidr-zone-<zone>, if it exists")
+	command.Flags().BoolVar(&provider.RequireReadyNodes, "require-ready-nodes", false, "Defer the allocation of a service until one of its nodes is ready and schedulable")
+	command.Flags().StringVar(&provider.LoadBalancerIPConflictWinner, "loadbalancer-ip-conflict-winner", provider.LoadBalancerIPConflictWinner, "Address kept when spec.loadBalancerIP of a service isn't one of the addresses of its annotation, annotation or spec")
+	command.Flags().StringVar(&provider.DefaultIPFamilyPolicy, "default-ip-family-policy", "", "IP family policy, SingleStack, PreferDualStack or RequireDualStack, of the services without spec.ipFamilyPolicy, empty allocates a single address")
+	command.Flags().IntVar(&provider.ConfigMapFailureThreshold, "configmap-failure-threshold", provider.ConfigMapFailureThreshold, "Consecutive failed reads of the configmap after which it is read with an exponential backoff until a read succeeds, 0 disables the backoff")
+	command.Flags().DurationVar(&provider.ConfigMapMaxBackoff, "configmap-max-backoff", provider.ConfigMapMaxBackoff, "Longest delay the reads of the configmap are backed off for")
+	command.Flags().BoolVar(&provider.EnableDNSExclusions, "dns-exclusions", false, "Exclude the addresses of the pools that resolve in DNS, i.e. hosts assigned an address of the subnet statically")
+	command.Flags().StringVar(&provider.DNSExclusionDomain, "dns-exclusion-domain", "", "Only exclude the addresses whose names end with the domain, empty excludes every address with a name")
+	command.Flags().IntVar(&provider.DNSExclusionMaxLookups, "dns-exclusion-max-lookups", provider.DNSExclusionMaxLookups, "Maximum number of addresses looked up in DNS per allocation")
+	command.Flags().StringVar(&provider.ExternalReservationsEndpoint, "external-reservations-endpoint", "", "URL queried for the addresses another allocator reserved in a pool, they are treated as in use, empty disables the query")
+	command.Flags().StringSliceVar(&provider.ManagedNamespaces, "managed-namespaces", nil, "Comma separated namespaces whose services are the only ones allocated addresses, empty manages all namespaces")
+	command.Flags().StringSliceVar(&provider.ExcludedNamespaces, "excluded-namespaces", nil, "Comma separated namespaces whose services are never allocated addresses")
+	command.Flags().BoolVar(&provider.NamespacePoolOverflowToGlobal, "namespace-pool-overflow-to-global", false, "Allocate the address(es) of a service from the global pool once the pool of its namespace is out of addresses")
+	command.Flags().BoolVar(&provider.AddressAffinity, "address-affinity", false, "Allocate the previous address of a service that is deleted and created again with the same namespace and name, if it is still free")
+	command.Flags().BoolVar(&provider.AlignDualStackOffsets, "align-dualstack-offsets", false, "Allocate the second address of a dual-stack service at the host offset of its first address, if it is free")
+	command.Flags().BoolVar(&provider.IPPoolCRD, "ippool-crd", false, "Allocate the address(es) of a service from its IPPool custom resource, if there is one, rather than from the pools of the configmap")
+	command.Flags().BoolVar(&provider.WriteIPFamilies, "write-ip-families", false, "Set spec.ipFamilies of a single stack service without IP families to the family of the address allocated to it, the API server fills in the IP families of most services on create, so they are left unchanged")
+	command.Flags().BoolVar(&provider.Tracing, "tracing", false, "Export OpenTelemetry spans of the allocations with OTLP over gRPC, configured with the OTEL_EXPORTER_OTLP_* environment variables")
+	command.Flags().StringVar(&provider.HealthzBindAddress, "healthz-bind-address", "", "Address to serve the /healthz endpoint on, i.e. :10261, empty disables the endpoint")
+	command.Flags().StringVar(&provider.PoolsDebugBindAddress, "pools-debug-bind-address", "", "Address to serve the /pools debug endpoint on, i.e. 127.0.0.1:10260, empty disables the endpoint")
+	command.Flags().StringVar(&provider.IPsAnnotation, "loadbalancer-ips-annotation", provider.IPsAnnotation, "Annotation the address(es) of a service are written to and read from, for kube-vip builds reading a different key")
+	command.Flags().StringVar(&provider.ImplementationLabel, "implementation-label-key", provider.ImplementationLabel, "Label key marking the services implemented by kube-vip, for kube-vip builds using a different label")
+	command.Flags().StringVar(&provider.ImplementationValue, "implementation-label-value", provider.ImplementationValue, "Label value marking the services implemented by kube-vip, for kube-vip builds using a different label")
+	command.Flags().IntVar(&provider.ServiceUpdateRetry.Steps, "service-update-retry-steps", provider.ServiceUpdateRetry.Steps, "Number of attempts to update a service when it conflicts with another update")
+	command.Flags().DurationVar(&provider.ServiceUpdateRetry.Duration, "service-update-retry-duration", provider.ServiceUpdateRetry.Duration, "Initial wait before retrying a conflicting service update")
+	command.Flags().Float64Var(&provider.ServiceUpdateRetry.Factor, "service-update-retry-factor", provider.ServiceUpdateRetry.Factor, "Factor the wait is multiplied by for every retry of a conflicting service update")
+	command.Flags().Float64Var(&provider.ServiceUpdateRetry.Jitter, "service-update-retry-jitter", provider.ServiceUpdateRetry.Jitter, "Random jitter added to the wait before retrying a conflicting service update")
 
 	// Set static flags for which we know the values.
 	command.Flags().VisitAll(func(fl *pflag.Flag) {
@@ -94,6 +138,8 @@ func main() {
 		}
 	})
 
+	command.AddCommand(newDefragmentCommand())
+
 	if err := command.Execute(); err != nil {
 		os.Exit(1)
 	}
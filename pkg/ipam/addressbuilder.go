@@ -2,8 +2,10 @@ package ipam
 
 import (
 	"fmt"
+	"math/big"
 	"net/netip"
 	"strings"
+	"unicode"
 
 	"go4.org/netipx"
 )
@@ -23,7 +25,39 @@ func parseCidrs(cidr string) (*netipx.IPSet, error) {
 		if err != nil {
 			return nil, err
 		}
-		builder.AddPrefix(prefix)
+		builder.AddPrefix(unmapPrefix(prefix))
+	}
+	return builder.IPSet()
+}
+
+// unmapPrefix - Returns the IPv4 prefix of an IPv4-mapped IPv6 prefix, i.e. 10.0.0.0/24 for ::ffff:10.0.0.0/120,
+// so that it is treated as IPv4. Other prefixes are returned as is.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+}
+
+// BuildAddressSet - Builds an IPSet from a comma separated list of addresses and cidrs,
+// the cidrs are added as a whole including their network and broadcast addresses
+func BuildAddressSet(addresses string) (*netipx.IPSet, error) {
+	builder := &netipx.IPSetBuilder{}
+
+	for _, address := range strings.Split(addresses, ",") {
+		if strings.Contains(address, "/") {
+			prefix, err := netip.ParsePrefix(address)
+			if err != nil {
+				return nil, err
+			}
+			builder.AddPrefix(unmapPrefix(prefix))
+			continue
+		}
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return nil, err
+		}
+		builder.Add(addr.Unmap())
 	}
 	return builder.IPSet()
 }
@@ -59,6 +93,23 @@ func buildHostsFromCidr(cidr string) (*netipx.IPSet, error) {
 	return builder.IPSet()
 }
 
+// buildPointToPointHosts - Builds an IPSet of the addresses of the IPv4 /31 and /32 cidrs, which are all
+// hosts as these cidrs have no network and broadcast address
+func buildPointToPointHosts(cidr string) (*netipx.IPSet, error) {
+	builder := &netipx.IPSetBuilder{}
+	for _, c := range strings.Split(cidr, ",") {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		prefix = unmapPrefix(prefix)
+		if prefix.Addr().Is4() && prefix.Bits() >= 31 {
+			builder.AddPrefix(prefix)
+		}
+	}
+	return builder.IPSet()
+}
+
 // buildHostsFromRange - Builds a IPSet constructed from the Range
 func buildAddressesFromRange(ipRangeString string) (*netipx.IPSet, error) {
 	// Split the ipranges (comma separated)
@@ -71,37 +122,104 @@ func buildAddressesFromRange(ipRangeString string) (*netipx.IPSet, error) {
 	builder := &netipx.IPSetBuilder{}
 
 	for x := range ranges {
-		ipRange := strings.Split(ranges[x], "-")
-		// Make sure we have x.x.x.x-x.x.x.x or x:x:x:x:x:x:x:x:x-x:x:x:x:x:x:x:x:x
-		if len(ipRange) != 2 {
-			return nil, fmt.Errorf("unable to parse IP range [%s]", ranges[x])
+		ipRange, err := parseRange(ranges[x])
+		if err != nil {
+			return nil, err
 		}
+		builder.AddRange(ipRange)
+	}
+
+	return builder.IPSet()
+}
 
-		start, err := netip.ParseAddr(ipRange[0])
+// IsHostList - Returns true if the comma separated pool is a list of addresses rather than cidrs or ranges
+func IsHostList(pool string) bool {
+	return !strings.Contains(pool, "/") && !strings.Contains(pool, "-")
+}
+
+// parseHosts - Parses the comma separated addresses of a host list, keeping the order in which they are configured
+func parseHosts(hosts string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, host := range strings.Split(hosts, ",") {
+		addr, err := netip.ParseAddr(host)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("unable to parse host [%s]: %v", host, err)
 		}
-		end, err := netip.ParseAddr(ipRange[1])
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
+
+// buildAddressesFromHosts - Builds a IPSet constructed from the addresses of the host list
+func buildAddressesFromHosts(hosts string) (*netipx.IPSet, error) {
+	addrs, err := parseHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+	builder := &netipx.IPSetBuilder{}
+	for _, addr := range addrs {
+		builder.Add(addr)
+	}
+	return builder.IPSet()
+}
+
+// BuildRangeEndpointsSet - Builds an IPSet of the first and last address of each of the comma separated ranges
+func BuildRangeEndpointsSet(ipRangeString string) (*netipx.IPSet, error) {
+	builder := &netipx.IPSetBuilder{}
+	for _, r := range strings.Split(ipRangeString, ",") {
+		ipRange, err := parseRange(r)
 		if err != nil {
 			return nil, err
 		}
+		builder.Add(ipRange.From())
+		builder.Add(ipRange.To())
+	}
+	return builder.IPSet()
+}
 
-		builder.AddRange(netipx.IPRangeFrom(start, end))
+// parseRange - Parses a single x.x.x.x-x.x.x.x or x:x:x:x:x:x:x:x:x-x:x:x:x:x:x:x:x:x range, both
+// addresses must be of the same IP family and the start address must not be after the end address
+func parseRange(ipRangeString string) (netipx.IPRange, error) {
+	if strings.ContainsFunc(ipRangeString, unicode.IsSpace) {
+		return netipx.IPRange{}, fmt.Errorf("unable to parse IP range [%s]: range must not contain whitespace", ipRangeString)
+	}
+	ipRange := strings.Split(ipRangeString, "-")
+	// Make sure we have x.x.x.x-x.x.x.x or x:x:x:x:x:x:x:x:x-x:x:x:x:x:x:x:x:x
+	if len(ipRange) != 2 {
+		return netipx.IPRange{}, fmt.Errorf("unable to parse IP range [%s]: expected format is <start address>-<end address>", ipRangeString)
 	}
 
-	return builder.IPSet()
+	start, err := netip.ParseAddr(ipRange[0])
+	if err != nil {
+		return netipx.IPRange{}, fmt.Errorf("unable to parse IP range [%s]: %v", ipRangeString, err)
+	}
+	end, err := netip.ParseAddr(ipRange[1])
+	if err != nil {
+		return netipx.IPRange{}, fmt.Errorf("unable to parse IP range [%s]: %v", ipRangeString, err)
+	}
+	// IPv4-mapped IPv6 addresses are IPv4 addresses
+	start, end = start.Unmap(), end.Unmap()
+	if start.Is4() != end.Is4() {
+		return netipx.IPRange{}, fmt.Errorf("unable to parse IP range [%s]: start and end address are of different IP families", ipRangeString)
+	}
+	if end.Less(start) {
+		return netipx.IPRange{}, fmt.Errorf("unable to parse IP range [%s]: start address is after the end address", ipRangeString)
+	}
+
+	return netipx.IPRangeFrom(start, end), nil
 }
 
 // SplitCIDRsByIPFamily splits the cidrs into separate lists of ipv4
-// and ipv6 CIDRs
+// and ipv6 CIDRs, keeping the order in which they are configured
 func SplitCIDRsByIPFamily(cidrs string) (ipv4 string, ipv6 string, err error) {
-	ipPools, err := parseCidrs(cidrs)
-	if err != nil {
-		return "", "", err
-	}
 	ipv4Cidrs := strings.Builder{}
 	ipv6Cidrs := strings.Builder{}
-	for _, prefix := range ipPools.Prefixes() {
+	for _, cidr := range strings.Split(cidrs, ",") {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return "", "", err
+		}
+		prefix = unmapPrefix(prefix)
 		cidrsToEdit := &ipv4Cidrs
 		if prefix.Addr().Is6() {
 			cidrsToEdit = &ipv6Cidrs
@@ -115,15 +233,15 @@ func SplitCIDRsByIPFamily(cidrs string) (ipv4 string, ipv6 string, err error) {
 }
 
 // SplitRangesByIPFamily splits the ipRangeString into separate lists of ipv4
-// and ipv6 ranges
+// and ipv6 ranges, keeping the order in which they are configured
 func SplitRangesByIPFamily(ipRangeString string) (ipv4 string, ipv6 string, err error) {
-	ipPools, err := buildAddressesFromRange(ipRangeString)
-	if err != nil {
-		return "", "", err
-	}
 	ipv4Ranges := strings.Builder{}
 	ipv6Ranges := strings.Builder{}
-	for _, ipRange := range ipPools.Ranges() {
+	for _, r := range strings.Split(ipRangeString, ",") {
+		ipRange, err := parseRange(r)
+		if err != nil {
+			return "", "", err
+		}
 		rangeToEdit := &ipv4Ranges
 		if ipRange.From().Is6() {
 			rangeToEdit = &ipv6Ranges
@@ -137,3 +255,47 @@ func SplitRangesByIPFamily(ipRangeString string) (ipv4 string, ipv6 string, err
 	}
 	return ipv4Ranges.String(), ipv6Ranges.String(), nil
 }
+
+// SplitHostsByIPFamily splits the host list into separate lists of ipv4
+// and ipv6 addresses, keeping the order in which they are configured
+func SplitHostsByIPFamily(hosts string) (ipv4 string, ipv6 string, err error) {
+	addrs, err := parseHosts(hosts)
+	if err != nil {
+		return "", "", err
+	}
+	var ipv4Hosts, ipv6Hosts []string
+	for _, addr := range addrs {
+		if addr.Is4() {
+			ipv4Hosts = append(ipv4Hosts, addr.String())
+		} else {
+			ipv6Hosts = append(ipv6Hosts, addr.String())
+		}
+	}
+	return strings.Join(ipv4Hosts, ","), strings.Join(ipv6Hosts, ","), nil
+}
+
+// BuildPoolSet - Builds an IPSet of the addresses that can be allocated from the
+// comma separated cidrs, ranges or hosts of a pool
+func BuildPoolSet(pool string) (*netipx.IPSet, error) {
+	// Check if ip pool contains a cidr, if not assume it is a range unless it only lists addresses
+	if strings.Contains(pool, "/") {
+		return buildHostsFromCidr(pool)
+	}
+	if IsHostList(pool) {
+		return buildAddressesFromHosts(pool)
+	}
+	return buildAddressesFromRange(pool)
+}
+
+// CountAddresses - Returns the number of addresses in the IPSet, a big.Int is used
+// as IPv6 sets can easily hold more addresses than fit into an uint64
+func CountAddresses(set *netipx.IPSet) *big.Int {
+	count := new(big.Int)
+	for _, r := range set.Ranges() {
+		from := new(big.Int).SetBytes(r.From().AsSlice())
+		to := new(big.Int).SetBytes(r.To().AsSlice())
+		count.Add(count, to.Sub(to, from))
+		count.Add(count, big.NewInt(1))
+	}
+	return count
+}
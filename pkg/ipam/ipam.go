@@ -1,12 +1,18 @@
 package ipam
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/big"
+	"math/rand/v2"
 	"net/netip"
+	"slices"
+	"strings"
 
 	"go4.org/netipx"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 )
 
 // OutOfIPsError stores informations that are required to return out of ip error
@@ -16,14 +22,37 @@ type OutOfIPsError struct {
 	isCidr    bool
 }
 
+// NewOutOfIPsError returns an OutOfIPsError for the pool of the namespace
+func NewOutOfIPsError(namespace, pool string, isCidr bool) *OutOfIPsError {
+	return &OutOfIPsError{namespace: namespace, pool: pool, isCidr: isCidr}
+}
+
 func (e *OutOfIPsError) Error() string {
 	what := "range"
 	if e.isCidr {
 		what = "cidr"
+	} else if IsHostList(e.pool) {
+		what = "hosts"
 	}
 	return fmt.Sprintf("no addresses available in [%s] %s [%s]", e.namespace, what, e.pool)
 }
 
+// NoContiguousBlockError is returned when the pool has no run of contiguous free addresses of the requested size
+type NoContiguousBlockError struct {
+	namespace string
+	pool      string
+	count     int
+}
+
+// NewNoContiguousBlockError returns a NoContiguousBlockError for the pool of the namespace
+func NewNoContiguousBlockError(namespace, pool string, count int) *NoContiguousBlockError {
+	return &NoContiguousBlockError{namespace: namespace, pool: pool, count: count}
+}
+
+func (e *NoContiguousBlockError) Error() string {
+	return fmt.Sprintf("no block of %d contiguous addresses available in [%s] pool [%s]", e.count, e.namespace, e.pool)
+}
+
 // Manager - handles the addresses for each namespace/vip
 var Manager []ipManager
 
@@ -41,7 +70,7 @@ type ipManager struct {
 }
 
 // FindAvailableHostFromRange - will look through the cidr and the address Manager and find a free address (if possible)
-func FindAvailableHostFromRange(namespace, ipRange string, inUseIPSet *netipx.IPSet, descOrder bool) (string, error) {
+func FindAvailableHostFromRange(ctx context.Context, namespace, ipRange string, inUseIPSet *netipx.IPSet, descOrder bool) (string, error) {
 	// Look through namespaces and update one if it exists
 	for x := range Manager {
 		if Manager[x].namespace == namespace {
@@ -56,12 +85,17 @@ func FindAvailableHostFromRange(namespace, ipRange string, inUseIPSet *netipx.IP
 				}
 				Manager[x].poolIPSet = poolIPSet
 				Manager[x].ipRange = ipRange
+				// The pool set no longer holds the hosts of the cidr
+				Manager[x].cidr = ""
 			}
 
-			addr, err := FindFreeAddress(Manager[x].poolIPSet, inUseIPSet, descOrder)
-			if err != nil {
+			addr, err := FindFreeAddress(ctx, Manager[x].poolIPSet, inUseIPSet, descOrder)
+			if errors.Is(err, errNoFreeAddress) {
 				return "", &OutOfIPsError{namespace: namespace, pool: ipRange, isCidr: false}
 			}
+			if err != nil {
+				return "", err
+			}
 			return addr.String(), nil
 		}
 	}
@@ -79,15 +113,23 @@ func FindAvailableHostFromRange(namespace, ipRange string, inUseIPSet *netipx.IP
 
 	Manager = append(Manager, newManager)
 
-	addr, err := FindFreeAddress(poolIPSet, inUseIPSet, descOrder)
-	if err != nil {
+	addr, err := FindFreeAddress(ctx, poolIPSet, inUseIPSet, descOrder)
+	if errors.Is(err, errNoFreeAddress) {
 		return "", &OutOfIPsError{namespace: namespace, pool: ipRange, isCidr: false}
 	}
+	if err != nil {
+		return "", err
+	}
 	return addr.String(), nil
 }
 
 // FindAvailableHostFromCidr - will look through the cidr and the address Manager and find a free address (if possible)
-func FindAvailableHostFromCidr(namespace, cidr string, inUseIPSet *netipx.IPSet, descOrder bool) (string, error) {
+func FindAvailableHostFromCidr(ctx context.Context, namespace, cidr string, inUseIPSet *netipx.IPSet, descOrder bool) (string, error) {
+	// Both addresses of a point-to-point cidr are hosts, even if they end in .0 or .255
+	pointToPointIPSet, err := buildPointToPointHosts(cidr)
+	if err != nil {
+		return "", err
+	}
 	// Look through namespaces and update one if it exists
 	for x := range Manager {
 		if Manager[x].namespace == namespace {
@@ -100,12 +142,16 @@ func FindAvailableHostFromCidr(namespace, cidr string, inUseIPSet *netipx.IPSet,
 				}
 				Manager[x].poolIPSet = poolIPSet
 				Manager[x].cidr = cidr
-
+				// The pool set no longer holds the addresses of the range
+				Manager[x].ipRange = ""
 			}
-			addr, err := FindFreeAddress(Manager[x].poolIPSet, inUseIPSet, descOrder)
-			if err != nil {
+			addr, err := findFreeAddress(ctx, Manager[x].poolIPSet, inUseIPSet, pointToPointIPSet, descOrder)
+			if errors.Is(err, errNoFreeAddress) {
 				return "", &OutOfIPsError{namespace: namespace, pool: cidr, isCidr: true}
 			}
+			if err != nil {
+				return "", err
+			}
 			return addr.String(), nil
 
 		}
@@ -122,13 +168,354 @@ func FindAvailableHostFromCidr(namespace, cidr string, inUseIPSet *netipx.IPSet,
 	}
 	Manager = append(Manager, newManager)
 
-	addr, err := FindFreeAddress(poolIPSet, inUseIPSet, descOrder)
+	addr, err := findFreeAddress(ctx, poolIPSet, inUseIPSet, pointToPointIPSet, descOrder)
+	if errors.Is(err, errNoFreeAddress) {
+		return "", &OutOfIPsError{namespace: namespace, pool: cidr, isCidr: true}
+	}
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// FindAvailableHostFromList - will look through the addresses of the host list in the order they are configured,
+// or from the last to the first in descending order, and return the first address that isn't in use. Unlike
+// cidrs and ranges no IPv4 address is skipped, as every address of the list was chosen explicitly.
+func FindAvailableHostFromList(ctx context.Context, namespace, hosts string, inUseIPSet *netipx.IPSet, descOrder bool) (string, error) {
+	addrs, err := parseHosts(hosts)
+	if err != nil {
+		return "", err
+	}
+	if descOrder {
+		slices.Reverse(addrs)
+	}
+	for searched, addr := range addrs {
+		if err := checkContext(ctx, searched); err != nil {
+			return "", err
+		}
+		if !inUseIPSet.Contains(addr) {
+			return addr.String(), nil
+		}
+	}
+	return "", &OutOfIPsError{namespace: namespace, pool: hosts, isCidr: false}
+}
+
+// FindAvailableSteppedHostFromCidr - will look through the cidr and find a free address at an offset from the
+// network address that is a multiple of step. The slots of large IPv6 cidrs are only searched up to
+// MaxProbeAttempts addresses, as they hold too many addresses to be searched completely
+func FindAvailableSteppedHostFromCidr(ctx context.Context, namespace, cidr string, step int, inUseIPSet *netipx.IPSet, descOrder bool) (string, error) {
+	if step < 1 {
+		return "", fmt.Errorf("invalid step [%d] for cidr [%s], must be a positive integer", step, cidr)
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	prefix = prefix.Masked()
+	hosts, err := buildHostsFromCidr(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	// slots is the number of addresses of the cidr at a multiple of step, rounded up
+	size := new(big.Int).Lsh(big.NewInt(1), uint(prefix.Addr().BitLen()-prefix.Bits()))
+	bigStep := big.NewInt(int64(step))
+	slots := new(big.Int).Add(size, big.NewInt(int64(step-1)))
+	slots.Div(slots, bigStep)
+
+	limit := slots
+	if IsLargeIPv6Cidr(cidr) && slots.Cmp(big.NewInt(int64(MaxProbeAttempts))) > 0 {
+		limit = big.NewInt(int64(MaxProbeAttempts))
+	}
+
+	one := big.NewInt(1)
+	for i, searched := new(big.Int), 0; i.Cmp(limit) < 0; i, searched = i.Add(i, one), searched+1 {
+		if err := checkContext(ctx, searched); err != nil {
+			return "", err
+		}
+		slot := new(big.Int).Set(i)
+		if descOrder {
+			slot.Sub(slots, one).Sub(slot, i)
+		}
+		addr := addrAtOffset(prefix.Addr(), slot.Mul(slot, bigStep))
+		if hosts.Contains(addr) && !inUseIPSet.Contains(addr) && (!addr.Is4() || !isNetworkIDOrBroadcastIP(addr.As4())) {
+			return addr.String(), nil
+		}
+	}
+	return "", &OutOfIPsError{namespace: namespace, pool: cidr, isCidr: true}
+}
+
+// FindAvailableBlock - will look through the cidr or range and find the first run of count contiguous free
+// addresses, which are returned in ascending order. The IPv4 addresses skipped by FindFreeAddress break a run.
+func FindAvailableBlock(ctx context.Context, namespace, pool string, count int, inUseIPSet *netipx.IPSet, descOrder bool) ([]netip.Addr, error) {
+	var poolIPSet *netipx.IPSet
+	var err error
+	if strings.Contains(pool, "/") {
+		poolIPSet, err = buildHostsFromCidr(pool)
+	} else {
+		poolIPSet, err = buildAddressesFromRange(pool)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ipranges := poolIPSet.Ranges()
+	searched := 0
+	for i := range len(ipranges) {
+		iprange := ipranges[i]
+		ip, last := iprange.From(), iprange.To()
+		if descOrder {
+			iprange = ipranges[len(ipranges)-1-i]
+			ip, last = iprange.To(), iprange.From()
+		}
+		var block []netip.Addr
+		for {
+			if err := checkContext(ctx, searched); err != nil {
+				return nil, err
+			}
+			searched++
+			if !inUseIPSet.Contains(ip) && (!ip.Is4() || !isNetworkIDOrBroadcastIP(ip.As4())) {
+				block = append(block, ip)
+				if len(block) == count {
+					if descOrder {
+						slices.Reverse(block)
+					}
+					return block, nil
+				}
+			} else {
+				block = block[:0]
+			}
+			if ip == last {
+				break
+			}
+			if descOrder {
+				ip = ip.Prev()
+			} else {
+				ip = ip.Next()
+			}
+		}
+	}
+	return nil, NewNoContiguousBlockError(namespace, pool, count)
+}
+
+// CidrHostWindow - returns the range of addresses of the cidr between min and max. Both are either an offset from
+// the network address of the cidr, written as .N, or an address. An empty min or max doesn't restrict the start or
+// end of the cidr, and addresses of the other IP family don't restrict it either: ok is false if the cidr isn't
+// restricted at all. min and max must be addresses of the cidr, and min must not be after max.
+func CidrHostWindow(cidr, min, max string) (window netipx.IPRange, ok bool, err error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netipx.IPRange{}, false, err
+	}
+	prefix = unmapPrefix(prefix).Masked()
+
+	resolve := func(value string, unrestricted netip.Addr) (netip.Addr, bool, error) {
+		if len(value) == 0 {
+			return unrestricted, false, nil
+		}
+		var addr netip.Addr
+		if offset, isOffset := strings.CutPrefix(value, "."); isOffset {
+			n, ok := new(big.Int).SetString(offset, 10)
+			if !ok || n.Sign() < 0 {
+				return netip.Addr{}, false, fmt.Errorf("invalid offset [%s], must be a non-negative integer", value)
+			}
+			addr = addrAtOffset(prefix.Addr(), n)
+		} else {
+			addr, err = netip.ParseAddr(value)
+			if err != nil {
+				return netip.Addr{}, false, err
+			}
+			addr = addr.Unmap()
+			if addr.Is4() != prefix.Addr().Is4() {
+				return unrestricted, false, nil
+			}
+		}
+		if !addr.IsValid() || !prefix.Contains(addr) {
+			return netip.Addr{}, false, fmt.Errorf("[%s] is not an address of cidr [%s]", value, cidr)
+		}
+		return addr, true, nil
+	}
+
+	from, fromRestricted, err := resolve(min, prefix.Addr())
+	if err != nil {
+		return netipx.IPRange{}, false, err
+	}
+	to, toRestricted, err := resolve(max, netipx.PrefixLastIP(prefix))
+	if err != nil {
+		return netipx.IPRange{}, false, err
+	}
+	if !fromRestricted && !toRestricted {
+		return netipx.IPRange{}, false, nil
+	}
+	if to.Less(from) {
+		return netipx.IPRange{}, false, fmt.Errorf("min [%s] is after max [%s] in cidr [%s]", from, to, cidr)
+	}
+	return netipx.IPRangeFrom(from, to), true, nil
+}
+
+// FindAvailableHostInWindow - will look through the hosts of the cidr within the window and find a free address
+// (if possible), the addresses of the cidr outside of the window are never returned
+func FindAvailableHostInWindow(ctx context.Context, namespace, cidr string, window netipx.IPRange, inUseIPSet *netipx.IPSet, descOrder bool) (string, error) {
+	hosts, err := buildHostsFromCidr(cidr)
+	if err != nil {
+		return "", err
+	}
+	windowBuilder := &netipx.IPSetBuilder{}
+	windowBuilder.AddRange(window)
+	windowSet, err := windowBuilder.IPSet()
 	if err != nil {
+		return "", err
+	}
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(hosts)
+	builder.Intersect(windowSet)
+	poolIPSet, err := builder.IPSet()
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := FindFreeAddress(ctx, poolIPSet, inUseIPSet, descOrder)
+	if errors.Is(err, errNoFreeAddress) {
 		return "", &OutOfIPsError{namespace: namespace, pool: cidr, isCidr: true}
 	}
+	if err != nil {
+		return "", err
+	}
 	return addr.String(), nil
 }
 
+// addrAtOffset - returns the address offset addresses after base
+func addrAtOffset(base netip.Addr, offset *big.Int) netip.Addr {
+	i := new(big.Int).SetBytes(base.AsSlice())
+	i.Add(i, offset)
+	addr, _ := netip.AddrFromSlice(i.FillBytes(make([]byte, base.BitLen()/8)))
+	return addr
+}
+
+// HostOffset - returns the offset of the address from the first address of the cidr or range of the pool that holds
+// it, ok is false if no cidr or range of the pool holds the address. The hosts of a host list have no offset.
+func HostOffset(pool string, addr netip.Addr) (offset *big.Int, ok bool) {
+	for _, subPool := range strings.Split(pool, ",") {
+		base, hosts, _, err := subPoolHosts(subPool)
+		if err != nil || !hosts.Contains(addr) {
+			continue
+		}
+		offset = new(big.Int).SetBytes(addr.AsSlice())
+		return offset.Sub(offset, new(big.Int).SetBytes(base.AsSlice())), true
+	}
+	return nil, false
+}
+
+// FindHostAtOffset - returns the address at the offset from the first address of the first cidr or range of the pool
+// where that address is a free host, ok is false if there is none. Like FindFreeAddress, IPv4 addresses ending in
+// .0 or .255 are skipped unless they are part of a point-to-point cidr.
+func FindHostAtOffset(pool string, offset *big.Int, inUseIPSet *netipx.IPSet) (addr netip.Addr, ok bool) {
+	for _, subPool := range strings.Split(pool, ",") {
+		base, hosts, keep, err := subPoolHosts(subPool)
+		if err != nil {
+			continue
+		}
+		addr = addrAtOffset(base, offset)
+		if !addr.IsValid() || !hosts.Contains(addr) || inUseIPSet.Contains(addr) {
+			continue
+		}
+		if addr.Is4() && isNetworkIDOrBroadcastIP(addr.As4()) && !keep.Contains(addr) {
+			continue
+		}
+		return addr, true
+	}
+	return netip.Addr{}, false
+}
+
+// subPoolHosts - returns the first address and the hosts of a single cidr or range of a pool, together with
+// the hosts of the cidr that are never skipped as assumed gateway or broadcast ip
+func subPoolHosts(subPool string) (base netip.Addr, hosts, keep *netipx.IPSet, err error) {
+	if strings.Contains(subPool, "/") {
+		prefix, err := netip.ParsePrefix(subPool)
+		if err != nil {
+			return netip.Addr{}, nil, nil, err
+		}
+		if hosts, err = buildHostsFromCidr(subPool); err != nil {
+			return netip.Addr{}, nil, nil, err
+		}
+		if keep, err = buildPointToPointHosts(subPool); err != nil {
+			return netip.Addr{}, nil, nil, err
+		}
+		return unmapPrefix(prefix).Masked().Addr(), hosts, keep, nil
+	}
+	if IsHostList(subPool) {
+		return netip.Addr{}, nil, nil, fmt.Errorf("[%s] is a host, not a cidr or range", subPool)
+	}
+	hosts, err = buildAddressesFromRange(subPool)
+	if err != nil {
+		return netip.Addr{}, nil, nil, err
+	}
+	return hosts.Ranges()[0].From(), hosts, &netipx.IPSet{}, nil
+}
+
+// LargeIPv6PrefixBits - IPv6 cidrs with a prefix length up to this value hold too many addresses
+// to be searched linearly, addresses are taken from them by random probing instead
+const LargeIPv6PrefixBits = 96
+
+// MaxProbeAttempts - the number of random addresses probed in a large IPv6 cidr before giving up
+var MaxProbeAttempts = 1024
+
+// IsLargeIPv6Cidr - returns true if the cidr is a single IPv6 prefix of length LargeIPv6PrefixBits or shorter
+func IsLargeIPv6Cidr(cidr string) bool {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return false
+	}
+	return prefix.Addr().Is6() && prefix.Bits() <= LargeIPv6PrefixBits
+}
+
+// FindRandomHostFromCidr - will probe random addresses of a large IPv6 cidr until it finds one that isn't in
+// use, an OutOfIPsError is returned after MaxProbeAttempts addresses were found to be in use
+func FindRandomHostFromCidr(ctx context.Context, namespace, cidr string, inUseIPSet *netipx.IPSet) (string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	prefix = prefix.Masked()
+
+	for searched := range MaxProbeAttempts {
+		if err := checkContext(ctx, searched); err != nil {
+			return "", err
+		}
+		addr := randomAddressInPrefix(prefix)
+		// The subnet-router anycast address is never handed out
+		if addr == prefix.Addr() || inUseIPSet.Contains(addr) {
+			continue
+		}
+		return addr.String(), nil
+	}
+	return "", &OutOfIPsError{namespace: namespace, pool: cidr, isCidr: true}
+}
+
+// randomAddressInPrefix - returns a random address of the prefix
+func randomAddressInPrefix(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().As16()
+	var random [16]byte
+	// #nosec G404 -- the addresses don't need to be unpredictable, only spread over the prefix
+	binary.BigEndian.PutUint64(random[:8], rand.Uint64())
+	// #nosec G404
+	binary.BigEndian.PutUint64(random[8:], rand.Uint64())
+
+	for i := range addr {
+		// Only the bits of the byte that are not part of the prefix are randomised
+		prefixBits := prefix.Bits() - i*8
+		switch {
+		case prefixBits >= 8:
+			continue
+		case prefixBits <= 0:
+			addr[i] = random[i]
+		default:
+			addr[i] |= random[i] & (0xff >> prefixBits)
+		}
+	}
+	return netip.AddrFrom16(addr)
+}
+
 // // RenewAddress - removes the mark on an address
 // func RenewAddress(namespace, address string) {
 // 	for x := range Manager {
@@ -150,16 +537,31 @@ func FindAvailableHostFromCidr(namespace, cidr string, inUseIPSet *netipx.IPSet,
 // 	return fmt.Errorf("unable to release address [%s] in namespace [%s]", address, namespace)
 // }
 
+// errNoFreeAddress is returned by FindFreeAddress when every address of the pool is in use
+var errNoFreeAddress = errors.New("no address available")
+
 // FindFreeAddress returns the next free IP Address in a range based on a set of existing addresses.
-// It will skip assumed gateway ip or broadcast ip for IPv4 address
-func FindFreeAddress(poolIPSet *netipx.IPSet, inUseIPSet *netipx.IPSet, descOrder bool) (netip.Addr, error) {
+// It will skip assumed gateway ip or broadcast ip for IPv4 address, and stops with the error of the
+// context once it is cancelled
+func FindFreeAddress(ctx context.Context, poolIPSet *netipx.IPSet, inUseIPSet *netipx.IPSet, descOrder bool) (netip.Addr, error) {
+	return findFreeAddress(ctx, poolIPSet, inUseIPSet, &netipx.IPSet{}, descOrder)
+}
+
+// findFreeAddress returns the next free IP Address like FindFreeAddress, the addresses of the keep set are
+// never skipped as assumed gateway or broadcast ip
+func findFreeAddress(ctx context.Context, poolIPSet, inUseIPSet, keepIPSet *netipx.IPSet, descOrder bool) (netip.Addr, error) {
+	searched := 0
 	if descOrder {
 		ipranges := poolIPSet.Ranges()
 		for i := range len(ipranges) {
 			iprange := ipranges[len(ipranges)-1-i]
 			ip := iprange.To()
 			for {
-				if !inUseIPSet.Contains(ip) && (!ip.Is4() || !isNetworkIDOrBroadcastIP(ip.As4())) {
+				if err := checkContext(ctx, searched); err != nil {
+					return netip.Addr{}, err
+				}
+				searched++
+				if !inUseIPSet.Contains(ip) && (!ip.Is4() || !isNetworkIDOrBroadcastIP(ip.As4()) || keepIPSet.Contains(ip)) {
 					return ip, nil
 				}
 				if ip == iprange.From() {
@@ -172,7 +574,11 @@ func FindFreeAddress(poolIPSet *netipx.IPSet, inUseIPSet *netipx.IPSet, descOrde
 		for _, iprange := range poolIPSet.Ranges() {
 			ip := iprange.From()
 			for {
-				if !inUseIPSet.Contains(ip) && (!ip.Is4() || !isNetworkIDOrBroadcastIP(ip.As4())) {
+				if err := checkContext(ctx, searched); err != nil {
+					return netip.Addr{}, err
+				}
+				searched++
+				if !inUseIPSet.Contains(ip) && (!ip.Is4() || !isNetworkIDOrBroadcastIP(ip.As4()) || keepIPSet.Contains(ip)) {
 					return ip, nil
 				}
 				if ip == iprange.To() {
@@ -182,7 +588,19 @@ func FindFreeAddress(poolIPSet *netipx.IPSet, inUseIPSet *netipx.IPSet, descOrde
 			}
 		}
 	}
-	return netip.Addr{}, errors.New("no address available")
+	return netip.Addr{}, errNoFreeAddress
+}
+
+// contextCheckInterval - the number of addresses searched between two checks of the context
+const contextCheckInterval = 1024
+
+// checkContext - returns the error of the context every contextCheckInterval searched addresses, so that
+// the search of a large pool stops promptly once the context is cancelled
+func checkContext(ctx context.Context, searched int) error {
+	if searched%contextCheckInterval != 0 {
+		return nil
+	}
+	return ctx.Err()
 }
 
 func isNetworkIDOrBroadcastIP(ip [4]byte) bool {
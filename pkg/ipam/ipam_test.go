@@ -1,8 +1,13 @@
 package ipam
 
 import (
+	"context"
+	"errors"
+	"math/big"
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"go4.org/netipx"
 )
@@ -201,6 +206,118 @@ func Test_buildHostsFromCidr(t *testing.T) {
 	}
 }
 
+func TestBuildAddressSet(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses string
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "single address",
+			addresses: "192.168.0.1",
+			want:      []string{"192.168.0.1"},
+		},
+		{
+			name:      "addresses and cidr",
+			addresses: "192.168.0.1,192.168.0.8/30,fe80::1",
+			want:      []string{"192.168.0.1", "192.168.0.8", "192.168.0.9", "192.168.0.10", "192.168.0.11", "fe80::1"},
+		},
+		{
+			name:      "ipv6 cidr",
+			addresses: "fe80::10/127",
+			want:      []string{"fe80::10", "fe80::11"},
+		},
+		{
+			name:      "ipv4-mapped ipv6 address and cidr",
+			addresses: "::ffff:192.168.0.1,::ffff:192.168.0.8/127",
+			want:      []string{"192.168.0.1", "192.168.0.8", "192.168.0.9"},
+		},
+		{
+			name:      "malformed address",
+			addresses: "192.168.0.1,192.168.0",
+			wantErr:   true,
+		},
+		{
+			name:      "malformed cidr",
+			addresses: "192.168.0.1/33",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildAddressSet(tt.addresses)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("BuildAddressSet() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+
+			builder := &netipx.IPSetBuilder{}
+			for i := range tt.want {
+				builder.Add(netip.MustParseAddr(tt.want[i]))
+			}
+			s, err := builder.IPSet()
+			if err != nil {
+				t.Errorf("BuildAddressSet() error = %v", err)
+				return
+			}
+
+			if !got.Equal(s) {
+				t.Errorf("BuildAddressSet() = %v, want %v", got.Ranges(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCountAddresses(t *testing.T) {
+	tests := []struct {
+		name string
+		pool string
+		want string
+	}{
+		{
+			name: "ipv4 cidr without network and broadcast address",
+			pool: "192.168.0.200/29",
+			want: "6",
+		},
+		{
+			name: "multiple ipv4 cidrs",
+			pool: "192.168.0.200/29,192.168.0.210/31",
+			want: "8",
+		},
+		{
+			name: "ipv4 range",
+			pool: "192.168.0.10-192.168.0.20",
+			want: "11",
+		},
+		{
+			name: "overlapping ranges",
+			pool: "192.168.0.10-192.168.0.12,192.168.0.11-192.168.0.13",
+			want: "4",
+		},
+		{
+			name: "ipv6 cidr larger than uint64",
+			pool: "fe80::/56",
+			want: "4722366482869645213696",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := BuildPoolSet(tt.pool)
+			if err != nil {
+				t.Errorf("BuildPoolSet() error = %v", err)
+				return
+			}
+			if got := CountAddresses(set).String(); got != tt.want {
+				t.Errorf("CountAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestSplitCIDRsByIPFamily(t *testing.T) {
 	type args struct {
 		cidrs string
@@ -226,6 +343,17 @@ func TestSplitCIDRsByIPFamily(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "ipv4-mapped ipv6 cidr",
+			args: args{
+				"::ffff:192.168.0.200/126,fe80::10/127",
+			},
+			want: output{
+				ipv4Cidrs: "192.168.0.200/30",
+				ipv6Cidrs: "fe80::10/127",
+			},
+			wantErr: false,
+		},
 		{
 			name: "multiple ipv4 cidrs",
 			args: args{
@@ -237,6 +365,17 @@ func TestSplitCIDRsByIPFamily(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "multiple ipv4 cidrs keep configured order",
+			args: args{
+				"192.168.1.200/30,192.168.0.200/30",
+			},
+			want: output{
+				ipv4Cidrs: "192.168.1.200/30,192.168.0.200/30",
+				ipv6Cidrs: "",
+			},
+			wantErr: false,
+		},
 		{
 			name: "single ipv6 cidr",
 			args: args{
@@ -322,6 +461,17 @@ func TestSplitRangesByIPFamily(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "ipv4-mapped ipv6 range",
+			args: args{
+				"::ffff:192.168.0.10-192.168.0.12",
+			},
+			want: output{
+				ipv4Ranges: "192.168.0.10-192.168.0.12",
+				ipv6Ranges: "",
+			},
+			wantErr: false,
+		},
 		{
 			name: "multiple ipv4 ranges",
 			args: args{
@@ -333,6 +483,17 @@ func TestSplitRangesByIPFamily(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "multiple ipv4 ranges keep configured order",
+			args: args{
+				"192.168.0.100-192.168.0.120,192.168.0.10-192.168.0.12",
+			},
+			want: output{
+				ipv4Ranges: "192.168.0.100-192.168.0.120,192.168.0.10-192.168.0.12",
+				ipv6Ranges: "",
+			},
+			wantErr: false,
+		},
 		{
 			name: "single ipv6 range",
 			args: args{
@@ -377,6 +538,64 @@ func TestSplitRangesByIPFamily(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "single address range",
+			args: args{
+				"192.168.0.10-192.168.0.10",
+			},
+			want: output{
+				ipv4Ranges: "192.168.0.10-192.168.0.10",
+			},
+		},
+		{
+			name: "start after end",
+			args: args{
+				"192.168.0.20-192.168.0.10",
+			},
+			wantErr: true,
+		},
+		{
+			name: "start and end of different families",
+			args: args{
+				"192.168.0.10-fe80::10",
+			},
+			wantErr: true,
+		},
+		{
+			name: "second segment of different families",
+			args: args{
+				"192.168.0.10-192.168.0.20,192.168.0.40-fe80::50",
+			},
+			wantErr: true,
+		},
+		{
+			name: "whitespace around the separator",
+			args: args{
+				"192.168.0.10 - 192.168.0.20",
+			},
+			wantErr: true,
+		},
+		{
+			name: "whitespace after the comma",
+			args: args{
+				"192.168.0.10-192.168.0.20, 192.168.0.30-192.168.0.40",
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing end address",
+			args: args{
+				"192.168.0.10-",
+			},
+			wantErr: true,
+		},
+		{
+			name: "cidr instead of a range",
+			args: args{
+				"192.168.0.10/24-192.168.0.20",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -539,6 +758,24 @@ func TestFindAvailableHostFromRange(t *testing.T) {
 			},
 			want: "fe80::ffff",
 		},
+		{
+			name: "two segments, first segment exhausted",
+			args: args{
+				namespace:        "default2",
+				ipRange:          "10.0.0.10-10.0.0.11,10.0.0.40-10.0.0.41",
+				existingServices: []string{"10.0.0.10", "10.0.0.11"},
+			},
+			want: "10.0.0.40",
+		},
+		{
+			name: "two segments, every segment exhausted",
+			args: args{
+				namespace:        "default2",
+				ipRange:          "10.0.0.10-10.0.0.11,10.0.0.40-10.0.0.41",
+				existingServices: []string{"10.0.0.10", "10.0.0.11", "10.0.0.40", "10.0.0.41"},
+			},
+			wantErr: true,
+		},
 		{
 			name: "ipv6, two ranges, 5 addresses",
 			args: args{
@@ -566,24 +803,24 @@ func TestFindAvailableHostFromRange(t *testing.T) {
 			for i := range tt.args.existingServices {
 				addr, err := netip.ParseAddr(tt.args.existingServices[i])
 				if err != nil {
-					t.Errorf("FindAvailableHostFromRange() error = %v", err)
+					t.Errorf("FindAvailableHostFromRange(context.Background(), ) error = %v", err)
 					return
 				}
 				builder.Add(addr)
 			}
 			s, err := builder.IPSet()
 			if err != nil {
-				t.Errorf("FindAvailableHostFromRange() error = %v", err)
+				t.Errorf("FindAvailableHostFromRange(context.Background(), ) error = %v", err)
 				return
 			}
 
-			got, err := FindAvailableHostFromRange(tt.args.namespace, tt.args.ipRange, s, tt.args.descOrder)
+			got, err := FindAvailableHostFromRange(context.Background(), tt.args.namespace, tt.args.ipRange, s, tt.args.descOrder)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("FindAvailableHostFromRange() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("FindAvailableHostFromRange(context.Background(), ) error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if got != tt.want {
-				t.Errorf("FindAvailableHostFromRange() = %v, want %v", got, tt.want)
+				t.Errorf("FindAvailableHostFromRange(context.Background(), ) = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -678,6 +915,25 @@ func TestFindAvailableHostFromCIDR(t *testing.T) {
 			},
 			want: "192.168.0.206",
 		},
+		{
+			name: "point-to-point cidr, network address is a host",
+			args: args{
+				namespace:        "default2",
+				cidr:             "192.168.1.0/31",
+				existingServices: []string{},
+			},
+			want: "192.168.1.0",
+		},
+		{
+			name: "point-to-point cidr, broadcast address is a host, revert",
+			args: args{
+				namespace:        "default2",
+				cidr:             "192.168.0.254/31",
+				existingServices: []string{},
+				descOrder:        true,
+			},
+			want: "192.168.0.255",
+		},
 		{
 			name: "ipv6, single entry, two address",
 			args: args{
@@ -743,24 +999,648 @@ func TestFindAvailableHostFromCIDR(t *testing.T) {
 			for i := range tt.args.existingServices {
 				addr, err := netip.ParseAddr(tt.args.existingServices[i])
 				if err != nil {
-					t.Errorf("FindAvailableHostFromCIDR() error = %v", err)
+					t.Errorf("FindAvailableHostFromCIDR(context.Background(), ) error = %v", err)
 					return
 				}
 				builder.Add(addr)
 			}
 			s, err := builder.IPSet()
 			if err != nil {
-				t.Errorf("FindAvailableHostFromCIDR() error = %v", err)
+				t.Errorf("FindAvailableHostFromCIDR(context.Background(), ) error = %v", err)
+				return
+			}
+
+			got, err := FindAvailableHostFromCidr(context.Background(), tt.args.namespace, tt.args.cidr, s, tt.args.descOrder)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FindAvailableHostFromCIDR(context.Background(), ) error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("FindAvailableHostFromCIDR(context.Background(), ) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostFromPointToPointCidr(t *testing.T) {
+	for _, cidr := range []string{"192.168.1.0/31", "192.168.0.254/31", "10.0.0.2/31", "::ffff:192.168.2.0/127", "2001::49fe/127"} {
+		t.Run(cidr, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for i := 0; i < 2; i++ {
+				inUseIPSet, err := builder.IPSet()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := FindAvailableHostFromCidr(context.Background(), "point-to-point", cidr, inUseIPSet, false)
+				if err != nil {
+					t.Fatalf("FindAvailableHostFromCidr() allocation %d error = %v", i+1, err)
+				}
+				builder.Add(netip.MustParseAddr(got))
+			}
+			inUseIPSet, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := FindAvailableHostFromCidr(context.Background(), "point-to-point", cidr, inUseIPSet, false); !errors.As(err, new(*OutOfIPsError)) {
+				t.Errorf("FindAvailableHostFromCidr() error = %v, want OutOfIPsError", err)
+			}
+		})
+	}
+}
+
+func TestFindRandomHostFromCidr(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidr    string
+		inUse   []string
+		wantErr bool
+	}{
+		{
+			name: "empty /64",
+			cidr: "2001:db8::/64",
+		},
+		{
+			name:  "first half of the /64 in use",
+			cidr:  "2001:db8::/64",
+			inUse: []string{"2001:db8::/65"},
+		},
+		{
+			name:  "seven eighths of the /64 in use",
+			cidr:  "2001:db8::/64",
+			inUse: []string{"2001:db8::/65", "2001:db8::8000:0:0:0/66", "2001:db8::c000:0:0:0/67"},
+		},
+		{
+			name:    "every address in use",
+			cidr:    "2001:db8::/96",
+			inUse:   []string{"2001:db8::/96"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for _, cidr := range tt.inUse {
+				builder.AddPrefix(netip.MustParsePrefix(cidr))
+			}
+			inUseIPSet, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			got, err := FindRandomHostFromCidr(context.Background(), "random", tt.cidr, inUseIPSet)
+			elapsed := time.Since(start)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FindRandomHostFromCidr(context.Background(), ) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, ok := err.(*OutOfIPsError); !ok {
+					t.Errorf("FindRandomHostFromCidr(context.Background(), ) error = %v, want OutOfIPsError", err)
+				}
 				return
 			}
 
-			got, err := FindAvailableHostFromCidr(tt.args.namespace, tt.args.cidr, s, tt.args.descOrder)
+			addr := netip.MustParseAddr(got)
+			if !netip.MustParsePrefix(tt.cidr).Contains(addr) {
+				t.Errorf("FindRandomHostFromCidr(context.Background(), ) = %v, not in %s", got, tt.cidr)
+			}
+			if inUseIPSet.Contains(addr) {
+				t.Errorf("FindRandomHostFromCidr(context.Background(), ) = %v, which is in use", got)
+			}
+			// The probing must not enumerate the hosts of the prefix
+			if elapsed > 10*time.Millisecond {
+				t.Errorf("FindRandomHostFromCidr(context.Background(), ) took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestIsLargeIPv6Cidr(t *testing.T) {
+	tests := map[string]bool{
+		"2001:db8::/64":    true,
+		"2001:db8::/96":    true,
+		"2001:db8::/97":    false,
+		"2001:db8::10/127": false,
+		"10.0.0.0/8":       false,
+		"not-a-cidr":       false,
+	}
+	for cidr, want := range tests {
+		if got := IsLargeIPv6Cidr(cidr); got != want {
+			t.Errorf("IsLargeIPv6Cidr(%s) = %v, want %v", cidr, got, want)
+		}
+	}
+}
+
+func BenchmarkFindRandomHostFromCidr(b *testing.B) {
+	builder := &netipx.IPSetBuilder{}
+	builder.AddPrefix(netip.MustParsePrefix("2001:db8::/65"))
+	inUseIPSet, err := builder.IPSet()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for range b.N {
+		if _, err := FindRandomHostFromCidr(context.Background(), "benchmark", "2001:db8::/64", inUseIPSet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFindAvailableSteppedHostFromCidr(t *testing.T) {
+	tests := []struct {
+		name      string
+		cidr      string
+		step      int
+		inUse     []string
+		descOrder bool
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "network address is skipped",
+			cidr: "10.0.0.0/24",
+			step: 4,
+			want: "10.0.0.4",
+		},
+		{
+			name:  "in use stepped addresses are skipped",
+			cidr:  "10.0.0.0/24",
+			step:  4,
+			inUse: []string{"10.0.0.4", "10.0.0.8"},
+			want:  "10.0.0.12",
+		},
+		{
+			name:      "descending order",
+			cidr:      "10.0.0.0/24",
+			step:      4,
+			descOrder: true,
+			want:      "10.0.0.252",
+		},
+		{
+			name:      "descending order with a step that doesn't divide the cidr",
+			cidr:      "10.0.0.0/29",
+			step:      3,
+			descOrder: true,
+			want:      "10.0.0.6",
+		},
+		{
+			name:    "every stepped address in use",
+			cidr:    "10.0.0.0/28",
+			step:    4,
+			inUse:   []string{"10.0.0.4", "10.0.0.8", "10.0.0.12"},
+			wantErr: true,
+		},
+		{
+			name: "ipv6",
+			cidr: "2001:db8::/120",
+			step: 16,
+			want: "2001:db8::",
+		},
+		{
+			name:  "large ipv6",
+			cidr:  "2001:db8::/64",
+			step:  256,
+			inUse: []string{"2001:db8::/120"},
+			want:  "2001:db8::100",
+		},
+		{
+			name:    "invalid step",
+			cidr:    "10.0.0.0/24",
+			step:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for _, address := range tt.inUse {
+				if strings.Contains(address, "/") {
+					builder.AddPrefix(netip.MustParsePrefix(address))
+				} else {
+					builder.Add(netip.MustParseAddr(address))
+				}
+			}
+			inUseIPSet, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := FindAvailableSteppedHostFromCidr(context.Background(), "stepped", tt.cidr, tt.step, inUseIPSet, tt.descOrder)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("FindAvailableHostFromCIDR() error = %v, wantErr %v", err, tt.wantErr)
+				t.Fatalf("FindAvailableSteppedHostFromCidr(context.Background(), ) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("FindAvailableSteppedHostFromCidr(context.Background(), ) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostSwitchingPoolKind(t *testing.T) {
+	// The cidr and range of a namespace share the cached pool set, switching between them must rebuild it
+	for range 2 {
+		got, err := FindAvailableHostFromCidr(context.Background(), "switching", "10.0.0.0/30", &netipx.IPSet{}, false)
+		if err != nil || got != "10.0.0.1" {
+			t.Fatalf("FindAvailableHostFromCidr(context.Background(), ) = %v, %v, want 10.0.0.1", got, err)
+		}
+		got, err = FindAvailableHostFromRange(context.Background(), "switching", "10.0.1.1-10.0.1.2", &netipx.IPSet{}, false)
+		if err != nil || got != "10.0.1.1" {
+			t.Fatalf("FindAvailableHostFromRange(context.Background(), ) = %v, %v, want 10.0.1.1", got, err)
+		}
+	}
+}
+
+func TestFindAvailableBlock(t *testing.T) {
+	tests := []struct {
+		name           string
+		pool           string
+		count          int
+		inUse          []string
+		descOrder      bool
+		want           string
+		wantNoBlockErr bool
+	}{
+		{
+			name:  "block at the start of the cidr",
+			pool:  "10.0.0.0/24",
+			count: 4,
+			want:  "10.0.0.1,10.0.0.2,10.0.0.3,10.0.0.4",
+		},
+		{
+			name:  "block after a gap",
+			pool:  "10.0.0.10-10.0.0.20",
+			count: 3,
+			inUse: []string{"10.0.0.10", "10.0.0.12"},
+			want:  "10.0.0.13,10.0.0.14,10.0.0.15",
+		},
+		{
+			name:      "descending order",
+			pool:      "10.0.0.10-10.0.0.20",
+			count:     3,
+			inUse:     []string{"10.0.0.19"},
+			descOrder: true,
+			want:      "10.0.0.16,10.0.0.17,10.0.0.18",
+		},
+		{
+			name:  "block spanning the ranges of a cidr",
+			pool:  "10.0.0.0/29",
+			count: 6,
+			want:  "10.0.0.1,10.0.0.2,10.0.0.3,10.0.0.4,10.0.0.5,10.0.0.6",
+		},
+		{
+			name:           "fragmented pool",
+			pool:           "10.0.0.10-10.0.0.20",
+			count:          3,
+			inUse:          []string{"10.0.0.12", "10.0.0.15", "10.0.0.18"},
+			wantNoBlockErr: true,
+		},
+		{
+			name:           "broadcast address breaks the block",
+			pool:           "10.0.0.252-10.0.1.2",
+			count:          4,
+			wantNoBlockErr: true,
+		},
+		{
+			name:  "ipv6",
+			pool:  "2001:db8::/64",
+			count: 2,
+			inUse: []string{"2001:db8::1"},
+			want:  "2001:db8::2,2001:db8::3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for _, address := range tt.inUse {
+				builder.Add(netip.MustParseAddr(address))
+			}
+			inUseIPSet, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block, err := FindAvailableBlock(context.Background(), "block", tt.pool, tt.count, inUseIPSet, tt.descOrder)
+			if tt.wantNoBlockErr {
+				if _, ok := err.(*NoContiguousBlockError); !ok {
+					t.Fatalf("FindAvailableBlock(context.Background(), ) error = %v, want NoContiguousBlockError", err)
+				}
 				return
 			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(block))
+			for _, addr := range block {
+				got = append(got, addr.String())
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("FindAvailableBlock(context.Background(), ) = %v, want %v", strings.Join(got, ","), tt.want)
+			}
+		})
+	}
+}
+
+func TestCidrHostWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		cidr      string
+		min       string
+		max       string
+		want      string
+		wantOk    bool
+		wantError bool
+	}{
+		{
+			name:   "offsets",
+			cidr:   "10.0.0.0/24",
+			min:    ".100",
+			max:    ".200",
+			want:   "10.0.0.100-10.0.0.200",
+			wantOk: true,
+		},
+		{
+			name:   "only min",
+			cidr:   "10.0.0.0/24",
+			min:    "10.0.0.250",
+			want:   "10.0.0.250-10.0.0.255",
+			wantOk: true,
+		},
+		{
+			name:   "ipv6 offset",
+			cidr:   "2001:db8::/64",
+			max:    ".16",
+			want:   "2001:db8::-2001:db8::10",
+			wantOk: true,
+		},
+		{
+			name: "address of the other family",
+			cidr: "2001:db8::/64",
+			min:  "10.0.0.100",
+		},
+		{
+			name:      "min after max",
+			cidr:      "10.0.0.0/24",
+			min:       ".200",
+			max:       "10.0.0.100",
+			wantError: true,
+		},
+		{
+			name:      "outside of the cidr",
+			cidr:      "10.0.0.0/24",
+			max:       ".256",
+			wantError: true,
+		},
+		{
+			name:      "invalid offset",
+			cidr:      "10.0.0.0/24",
+			min:       ".-1",
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, ok, err := CidrHostWindow(tt.cidr, tt.min, tt.max)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("CidrHostWindow() error = %v, wantError %v", err, tt.wantError)
+			}
+			if ok != tt.wantOk {
+				t.Fatalf("CidrHostWindow() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && window.String() != tt.want {
+				t.Errorf("CidrHostWindow() = %v, want %v", window.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostInWindow(t *testing.T) {
+	window := netipx.IPRangeFrom(netip.MustParseAddr("10.0.0.254"), netip.MustParseAddr("10.0.1.1"))
+	builder := &netipx.IPSetBuilder{}
+	builder.Add(netip.MustParseAddr("10.0.0.254"))
+	inUseIPSet, err := builder.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The broadcast address of the cidr is skipped even inside of the window
+	got, err := FindAvailableHostInWindow(context.Background(), "window", "10.0.0.0/24", window, inUseIPSet, false)
+	if _, ok := err.(*OutOfIPsError); !ok {
+		t.Fatalf("FindAvailableHostInWindow(context.Background(), ) = %v, %v, want OutOfIPsError", got, err)
+	}
+
+	got, err = FindAvailableHostInWindow(context.Background(), "window", "10.0.0.0/23", window, inUseIPSet, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "10.0.1.1" {
+		t.Errorf("FindAvailableHostInWindow(context.Background(), ) = %v, want 10.0.1.1", got)
+	}
+}
+
+func TestSearchCancelled(t *testing.T) {
+	// Every address of the /8 is in use, searching it completely takes far longer than the timeout
+	inUseIPSet, err := buildAddressesFromRange("10.0.0.0-10.255.255.255")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		search func(ctx context.Context) error
+	}{
+		{
+			name: "cidr",
+			search: func(ctx context.Context) error {
+				_, err := FindAvailableHostFromCidr(ctx, "cancelled-cidr", "10.0.0.0/8", inUseIPSet, false)
+				return err
+			},
+		},
+		{
+			name: "range in descending order",
+			search: func(ctx context.Context) error {
+				_, err := FindAvailableHostFromRange(ctx, "cancelled-range", "10.0.0.0-10.255.255.255", inUseIPSet, true)
+				return err
+			},
+		},
+		{
+			name: "block",
+			search: func(ctx context.Context) error {
+				_, err := FindAvailableBlock(ctx, "cancelled-block", "10.0.0.0/8", 2, inUseIPSet, false)
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := tt.search(ctx)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("search error = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("search returned %v after the context was cancelled", elapsed)
+			}
+		})
+	}
+}
+
+func TestFindAvailableHostFromList(t *testing.T) {
+	tests := []struct {
+		name       string
+		hosts      string
+		inUse      []string
+		descOrder  bool
+		want       string
+		wantOutErr bool
+	}{
+		{
+			name:  "first free host in the configured order",
+			hosts: "10.0.0.17,10.0.0.5,10.0.0.9",
+			inUse: []string{"10.0.0.17"},
+			want:  "10.0.0.5",
+		},
+		{
+			name:      "descending order starts at the last host",
+			hosts:     "10.0.0.5,10.0.0.9,10.0.0.17",
+			inUse:     []string{"10.0.0.17"},
+			descOrder: true,
+			want:      "10.0.0.9",
+		},
+		{
+			name:  "network address listed explicitly",
+			hosts: "10.0.0.0,10.0.0.255",
+			want:  "10.0.0.0",
+		},
+		{
+			name:  "ipv6",
+			hosts: "fe80::5,fe80::9",
+			inUse: []string{"fe80::5"},
+			want:  "fe80::9",
+		},
+		{
+			name:       "every host in use",
+			hosts:      "10.0.0.5,10.0.0.9",
+			inUse:      []string{"10.0.0.5", "10.0.0.9"},
+			wantOutErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for _, address := range tt.inUse {
+				builder.Add(netip.MustParseAddr(address))
+			}
+			inUseIPSet, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := FindAvailableHostFromList(context.Background(), "hosts", tt.hosts, inUseIPSet, tt.descOrder)
+			if tt.wantOutErr {
+				if _, ok := err.(*OutOfIPsError); !ok {
+					t.Fatalf("FindAvailableHostFromList() error = %v, want OutOfIPsError", err)
+				}
+				if !strings.Contains(err.Error(), "hosts") {
+					t.Errorf("FindAvailableHostFromList() error = %v, want the hosts to be named", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
 			if got != tt.want {
-				t.Errorf("FindAvailableHostFromCIDR() = %v, want %v", got, tt.want)
+				t.Errorf("FindAvailableHostFromList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitHostsByIPFamily(t *testing.T) {
+	ipv4, ipv6, err := SplitHostsByIPFamily("10.0.0.9,fe80::9,10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv4 != "10.0.0.9,10.0.0.5" || ipv6 != "fe80::9" {
+		t.Errorf("SplitHostsByIPFamily() = %v, %v, want 10.0.0.9,10.0.0.5, fe80::9", ipv4, ipv6)
+	}
+	// IPv4-mapped IPv6 addresses are IPv4 addresses
+	ipv4, ipv6, err = SplitHostsByIPFamily("::ffff:10.0.0.9,fe80::9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv4 != "10.0.0.9" || ipv6 != "fe80::9" {
+		t.Errorf("SplitHostsByIPFamily() = %v, %v, want 10.0.0.9, fe80::9", ipv4, ipv6)
+	}
+	if _, _, err := SplitHostsByIPFamily("10.0.0.5,10.0.0"); err == nil {
+		t.Error("SplitHostsByIPFamily() expected an error for an invalid host")
+	}
+}
+
+func TestHostOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		pool   string
+		addr   string
+		want   int64
+		wantOk bool
+	}{
+		{name: "cidr", pool: "10.0.0.0/24", addr: "10.0.0.50", want: 50, wantOk: true},
+		{name: "unmasked cidr", pool: "10.0.0.16/24", addr: "10.0.0.50", want: 50, wantOk: true},
+		{name: "second range", pool: "10.0.0.10-10.0.0.20,10.0.1.10-10.0.1.20", addr: "10.0.1.15", want: 5, wantOk: true},
+		{name: "ipv6", pool: "fd00::/120", addr: "fd00::32", want: 50, wantOk: true},
+		{name: "host list", pool: "10.0.0.5,10.0.0.9", addr: "10.0.0.9"},
+		{name: "not in the pool", pool: "10.0.0.0/24", addr: "10.0.1.50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := HostOffset(tt.pool, netip.MustParseAddr(tt.addr))
+			if ok != tt.wantOk {
+				t.Fatalf("HostOffset() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && got.Int64() != tt.want {
+				t.Errorf("HostOffset() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindHostAtOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		pool   string
+		offset int64
+		inUse  []string
+		want   string
+	}{
+		{name: "cidr", pool: "fd00::/120", offset: 50, want: "fd00::32"},
+		{name: "range", pool: "fd00::10-fd00::20", offset: 2, want: "fd00::12"},
+		{name: "next cidr when the address is in use", pool: "10.0.0.0/24,10.0.1.0/24", offset: 50, inUse: []string{"10.0.0.50"}, want: "10.0.1.50"},
+		{name: "outside of the cidr", pool: "10.0.0.0/28", offset: 50},
+		{name: "network address", pool: "10.0.0.0/24", offset: 0},
+		{name: "network address of a point-to-point cidr", pool: "10.0.0.0/31", offset: 0, want: "10.0.0.0"},
+		{name: "in use", pool: "fd00::/120", offset: 50, inUse: []string{"fd00::32"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for _, address := range tt.inUse {
+				builder.Add(netip.MustParseAddr(address))
+			}
+			inUseIPSet, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok := FindHostAtOffset(tt.pool, big.NewInt(tt.offset), inUseIPSet)
+			if len(tt.want) == 0 {
+				if ok {
+					t.Errorf("FindHostAtOffset() = %v, want no address", got)
+				}
+				return
+			}
+			if !ok || got.String() != tt.want {
+				t.Errorf("FindHostAtOffset() = %v, %v, want %v", got, ok, tt.want)
 			}
 		})
 	}
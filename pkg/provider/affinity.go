@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// AffinityConfigMap is the name of the configmap, in the namespace of the pool configmap, that records the address
+// last allocated to every service by namespace and name, so a service that is deleted and created again is allocated
+// the same address if it is still free
+const AffinityConfigMap = "kube-vip-affinity"
+
+// affinityKey returns the configmap key of the service, namespaces and service names can't contain dots
+// Example: kube-system.kube-dns
+func affinityKey(service *v1.Service) string {
+	return fmt.Sprintf("%s.%s", service.Namespace, service.Name)
+}
+
+// recordAffinity records the address(es) allocated to the service in the affinity configmap
+func (k *kubevipLoadBalancerManager) recordAffinity(ctx context.Context, service *v1.Service, addresses string) error {
+	return k.updateConfigMapData(ctx, AffinityConfigMap, func(data map[string]string) {
+		data[affinityKey(service)] = addresses
+	})
+}
+
+// pruneAffinity removes the entries of the affinity configmap whose namespace no longer exists, so the configmap
+// doesn't grow with every short-lived namespace, i.e. of preview environments. The configmap is read before the
+// namespaces are listed, an entry recorded in the meantime belongs to a namespace that is listed.
+func (k *kubevipLoadBalancerManager) pruneAffinity(ctx context.Context) error {
+	cm, err := getConfigMap(ctx, k.kubeClient, AffinityConfigMap, k.namespace)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read configMap [%s]: %v", AffinityConfigMap, err)
+	}
+	namespaces, err := k.kubeClient.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list namespaces: %v", err)
+	}
+	exists := make(map[string]bool, len(namespaces.Items))
+	for x := range namespaces.Items {
+		exists[namespaces.Items[x].Name] = true
+	}
+
+	var stale []string
+	for key := range cm.Data {
+		if namespace, _, _ := strings.Cut(key, "."); !exists[namespace] {
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	pruned := 0
+	err = k.updateConfigMapData(ctx, AffinityConfigMap, func(data map[string]string) {
+		pruned = 0
+		for _, key := range stale {
+			if _, ok := data[key]; ok {
+				delete(data, key)
+				pruned++
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	klog.InfoS("Pruned the previous addresses of the services of deleted namespaces", "configMap", AffinityConfigMap, "count", pruned)
+	return nil
+}
+
+// affinityAddress returns the address previously allocated to a service of the same namespace and name if it can be
+// allocated again from the pool: it must be part of the pool, free, and of the IP family of the service. Like the
+// preferred address, only single stack services allocated a single address are considered. Any other case is no
+// error, the address is then allocated normally.
+func (k *kubevipLoadBalancerManager) affinityAddress(ctx context.Context, service *v1.Service, pool *ipPool, inUseSet *netipx.IPSet,
+	ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily, count int) (string, bool) {
+	if !k.addressAffinity || isDHCPPool(pool.addresses) || count > 1 ||
+		(ipFamilyPolicy != nil && *ipFamilyPolicy != v1.IPFamilyPolicySingleStack) {
+		return "", false
+	}
+	cm, err := getConfigMap(ctx, k.kubeClient, AffinityConfigMap, k.namespace)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.ErrorS(err, "Unable to read the previous address of the service, allocating from the pool", "service", klog.KObj(service))
+		}
+		return "", false
+	}
+	previous, ok := cm.Data[affinityKey(service)]
+	if !ok {
+		return "", false
+	}
+	addrs, err := parseAddresses(previous)
+	if err != nil {
+		klog.InfoS("Ignoring invalid previous address of the service", "service", klog.KObj(service), "configMap", AffinityConfigMap, "address", previous)
+		return "", false
+	}
+	poolSet, err := ipam.BuildPoolSet(pool.addresses)
+	if err != nil {
+		return "", false
+	}
+	for _, addr := range addrs {
+		if len(ipFamilies) != 0 && (ipFamilies[0] == v1.IPv6Protocol) != addr.Is6() {
+			continue
+		}
+		if !poolSet.Contains(addr) {
+			klog.InfoS("Previous address of the service isn't part of the pool, allocating from the pool", "service", klog.KObj(service), "address", addr, "pool", pool.key)
+			return "", false
+		}
+		if inUseSet.Contains(addr) {
+			klog.InfoS("Previous address of the service is in use, allocating from the pool", "service", klog.KObj(service), "address", addr, "pool", pool.key)
+			return "", false
+		}
+		return addr.String(), true
+	}
+	return "", false
+}
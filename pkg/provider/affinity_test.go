@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_syncLoadBalancerAddressAffinity(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	mgr.addressAffinity = true
+
+	create := func(name, want string) {
+		t.Helper()
+		got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+	}
+	remove := func(name string) {
+		t.Helper()
+		svc, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.deleteLoadBalancer(context.Background(), svc); err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.kubeClient.CoreV1().Services("test").Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	create("first", "10.0.0.1")
+	create("web", "10.0.0.2")
+	cm, err := mgr.kubeClient.CoreV1().ConfigMaps(mgr.namespace).Get(context.Background(), AffinityConfigMap, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"test.first": "10.0.0.1", "test.web": "10.0.0.2"}, cm.Data)
+
+	// The service created again takes its previous address back, rather than the lowest free address
+	remove("first")
+	remove("web")
+	create("web", "10.0.0.2")
+
+	// The previous address was taken in the meantime, the service is allocated from the pool
+	remove("web")
+	create("second", "10.0.0.1")
+	create("third", "10.0.0.2")
+	create("web", "10.0.0.3")
+}
+
+func Test_pruneAffinity(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	mgr.addressAffinity = true
+
+	// Nothing to prune without the configmap
+	if err := mgr.pruneAffinity(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mgr.kubeClient.CoreV1().Namespaces().Create(context.Background(), &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, svc := range []*v1.Service{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "web"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "preview-42", Name: "web"}},
+	} {
+		if _, err := syncNewService(t, mgr, svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The namespace of the preview environment was deleted
+	if err := mgr.pruneAffinity(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := mgr.kubeClient.CoreV1().ConfigMaps(mgr.namespace).Get(context.Background(), AffinityConfigMap, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"test.web": "10.0.0.1"}, cm.Data)
+}
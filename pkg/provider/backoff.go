@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// configMapBackoffBase is the first delay the reads of the configmap are backed off for, it doubles with every
+// further failure up to the maximum backoff
+const configMapBackoffBase = time.Second
+
+// configMapBackoff stops reading the configmap for a growing delay once its reads failed the threshold consecutive
+// times, i.e. without the RBAC permissions to read it, so the syncs of all services don't keep hitting the API server.
+// The failures are logged once when the reads are backed off and once they succeed again.
+type configMapBackoff struct {
+	mu         sync.Mutex
+	clock      clock.PassiveClock
+	threshold  int
+	maxBackoff time.Duration
+	// failures is the number of consecutive failed reads, skipped the number of reads backed off since
+	failures, skipped int
+	lastErr           error
+	retryAt           time.Time
+}
+
+// configMapBackoffError is returned for the reads of the configmap while they are backed off, the failures were
+// already logged
+type configMapBackoffError struct {
+	failures int
+	retryAt  time.Time
+	err      error
+}
+
+func (e *configMapBackoffError) Error() string {
+	return fmt.Sprintf("reads backed off until %s after %d consecutive failures: %v", e.retryAt.Format(time.RFC3339), e.failures, e.err)
+}
+
+func (e *configMapBackoffError) Unwrap() error {
+	return e.err
+}
+
+func newConfigMapBackoff(c clock.PassiveClock, threshold int, maxBackoff time.Duration) *configMapBackoff {
+	return &configMapBackoff{clock: c, threshold: threshold, maxBackoff: maxBackoff}
+}
+
+// allow returns nil if the configmap can be read, and the error of the last read while the reads are backed off
+func (b *configMapBackoff) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold || !b.clock.Now().Before(b.retryAt) {
+		return nil
+	}
+	b.skipped++
+	return &configMapBackoffError{failures: b.failures, retryAt: b.retryAt, err: b.lastErr}
+}
+
+// done records the result of a read of the configmap, a failed read is returned as a configMapBackoffError once the
+// reads are backed off
+func (b *configMapBackoff) done(name, namespace string, err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.failures >= b.threshold {
+			klog.InfoS("Reading the configmap succeeded again", "configMap", klog.KRef(namespace, name), "failures", b.failures, "skipped", b.skipped)
+		}
+		b.failures, b.skipped, b.lastErr = 0, 0, nil
+		return nil
+	}
+	b.failures++
+	b.lastErr = err
+	if b.failures < b.threshold {
+		return err
+	}
+	delay := b.maxBackoff
+	if shift := b.failures - b.threshold; shift < 32 && configMapBackoffBase<<shift < b.maxBackoff {
+		delay = configMapBackoffBase << shift
+	}
+	b.retryAt = b.clock.Now().Add(delay)
+	if b.failures == b.threshold {
+		klog.ErrorS(err, "Reading the configmap keeps failing, backing off until a read succeeds", "configMap", klog.KRef(namespace, name), "failures", b.failures)
+	} else {
+		klog.V(4).InfoS("Reading the configmap failed again, backing off", "configMap", klog.KRef(namespace, name), "failures", b.failures, "delay", delay)
+	}
+	return &configMapBackoffError{failures: b.failures, retryAt: b.retryAt, err: err}
+}
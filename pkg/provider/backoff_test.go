@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/ptr"
+
+	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
+)
+
+func Test_syncLoadBalancerConfigMapBackoff(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	mgr.configMapBackoff = newConfigMapBackoff(fakeClock, 3, time.Minute)
+
+	// The configmap can't be read until the permissions are fixed
+	forbidden := true
+	reads := 0
+	mgr.kubeClient.(*fake.Clientset).PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() != KubeVipClientConfig {
+			return false, nil, nil
+		}
+		reads++
+		if forbidden {
+			return true, nil, apierrors.NewForbidden(v1.Resource("configmaps"), KubeVipClientConfig, errors.New("missing permissions"))
+		}
+		return false, nil, nil
+	})
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+	if _, err := mgr.kubeClient.CoreV1().Services("test").Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sync := func() error {
+		t.Helper()
+		_, err := mgr.syncLoadBalancer(context.Background(), svc, nil)
+		return err
+	}
+
+	// Only the reads up to the threshold reach the API server, the others are backed off
+	for i := 0; i < 10; i++ {
+		assert.Error(t, sync())
+	}
+	assert.Equal(t, 3, reads)
+
+	// Once the backoff elapsed the configmap is read again, and backed off for twice as long after another failure
+	fakeClock.Step(time.Second)
+	assert.Error(t, sync())
+	assert.Error(t, sync())
+	assert.Equal(t, 4, reads)
+	fakeClock.Step(time.Second)
+	assert.Error(t, sync())
+	assert.Equal(t, 4, reads)
+
+	// A successful read ends the backoff
+	forbidden = false
+	fakeClock.Step(time.Second)
+	if err := sync(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 5, reads)
+	got, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "name", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.1", got.Annotations[IPsAnnotation])
+
+	// Later failures start counting from zero again
+	forbidden = true
+	assert.Error(t, sync())
+	assert.Equal(t, 6, reads)
+}
+
+func Test_configMapBackoffSharedByControllers(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	mgr.configMapBackoff = newConfigMapBackoff(clocktesting.NewFakeClock(time.Now()), 2, time.Minute)
+	client := mgr.kubeClient.(*fake.Clientset)
+	c := newLoadbalancerClassServiceController(informers.NewSharedInformerFactory(client, 0), client, mgr)
+
+	reads := 0
+	client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() != KubeVipClientConfig {
+			return false, nil, nil
+		}
+		reads++
+		return true, nil, apierrors.NewForbidden(v1.Resource("configmaps"), KubeVipClientConfig, errors.New("missing permissions"))
+	})
+	classSvc := tu.NewService("class", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+	for _, s := range []*v1.Service{classSvc, svc} {
+		if _, err := client.CoreV1().Services(s.Namespace).Create(context.Background(), s, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The failures of the loadBalancerClass controller back off the reads of the service controller too
+	for i := 0; i < 2; i++ {
+		assert.Error(t, c.processServiceCreateOrUpdate(classSvc))
+	}
+	assert.Equal(t, 2, reads)
+	_, err := mgr.EnsureLoadBalancer(context.Background(), "", svc, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 2, reads)
+}
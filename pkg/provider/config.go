@@ -2,12 +2,22 @@ package provider
 
 import (
 	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
 
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 )
 
+// AutoGeneratedConfigMapAnnotation marks a configmap that was created by the provider because it didn't exist
+const AutoGeneratedConfigMapAnnotation = "kube-vip.io/auto-generated"
+
 // Services functions - once the service data is taken from the configMap, these functions will interact with the data
 
 // func (s *kubevipServices) addService(newSvc services) {
@@ -46,17 +56,133 @@ import (
 // 	return
 // }
 
+// validatePoolConfig loads the configmap once and validates its pools, overlapping pools are logged
+func validatePoolConfig(ctx context.Context, kubeClient kubernetes.Interface, cm, nm string) error {
+	controllerCM, err := getConfigMap(ctx, kubeClient, cm, nm)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve kube-vip ipam config from configMap [%s] in namespace [%s]: %v", cm, nm, err)
+	}
+	if err := validateConfigMap(controllerCM); err != nil {
+		return err
+	}
+	warnOverlappingPools(controllerCM)
+	return nil
+}
+
+// validateConfigMap parses every pool and exclusion of the configmap the same way they are parsed when
+// an address is allocated, and returns the errors of all invalid keys together
+func validateConfigMap(cm *v1.ConfigMap) error {
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		value := cm.Data[key]
+		// Internal pools are validated like the pools they mirror
+		poolKey := key
+		if internalKey, ok := strings.CutPrefix(key, "internal-"); ok {
+			poolKey = internalKey
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(poolKey, "cidr-"):
+			var addresses string
+			addresses, _, err = parsePoolOptions(key, value)
+			// The special DHCP cidr is valid as is
+			if err == nil && addresses != "0.0.0.0/32" {
+				_, _, err = ipam.SplitCIDRsByIPFamily(addresses)
+			}
+		case strings.HasPrefix(poolKey, "range-"):
+			var addresses string
+			addresses, _, err = parsePoolOptions(key, value)
+			if err == nil {
+				_, _, err = ipam.SplitRangesByIPFamily(addresses)
+			}
+		case strings.HasPrefix(poolKey, "hosts-"):
+			var addresses string
+			addresses, _, err = parsePoolOptions(key, value)
+			if err == nil {
+				_, _, err = ipam.SplitHostsByIPFamily(addresses)
+			}
+		case strings.HasPrefix(key, "exclude-reserved-"):
+			// exclude-reserved-<pool key without its kind> holds the addresses reserved in the pool, i.e.
+			// exclude-reserved-prod for cidr-prod
+			if len(strings.TrimPrefix(key, "exclude-reserved-")) == 0 {
+				err = fmt.Errorf("the key must name a pool without its kind, i.e. exclude-reserved-prod for cidr-prod")
+			} else {
+				_, err = parseAddresses(strings.ReplaceAll(value, " ", ""))
+			}
+		case strings.HasPrefix(key, "exclude-"):
+			_, err = ipam.BuildAddressSet(value)
+		case strings.HasPrefix(key, "drain-"):
+			_, err = ipam.BuildPoolSet(value)
+		case strings.HasPrefix(key, "gateway-"):
+			var gateways []netip.Addr
+			gateways, err = parseAddresses(strings.ReplaceAll(value, " ", ""))
+			if err == nil && (len(gateways) > 2 || len(gateways) == 2 && gateways[0].Is4() == gateways[1].Is4()) {
+				err = fmt.Errorf("at most one gateway per IP family can be set")
+			}
+		case strings.HasPrefix(key, "reserved-"):
+			// reserved-<namespace>-<service name> holds the address(es) reserved for a service
+			if namespace, name, _ := strings.Cut(strings.TrimPrefix(key, "reserved-"), "-"); len(namespace) == 0 || len(name) == 0 {
+				err = fmt.Errorf("the key must name a service, i.e. reserved-<namespace>-<service name>")
+			} else {
+				_, err = parseAddresses(strings.ReplaceAll(value, " ", ""))
+			}
+		case strings.HasPrefix(key, "alias-"):
+			_, err = resolveNamespaceAlias(cm, strings.TrimPrefix(key, "alias-"))
+		case key == "pool-order":
+			for _, poolKey := range strings.Split(value, ",") {
+				poolKey = strings.TrimSpace(poolKey)
+				if !strings.HasPrefix(poolKey, "cidr-") && !strings.HasPrefix(poolKey, "range-") && !strings.HasPrefix(poolKey, "hosts-") {
+					err = fmt.Errorf("[%s] is not the key of a cidr, range or hosts pool", poolKey)
+					break
+				}
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value [%s] for key [%s]: %v", value, key, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
 func getConfigMap(ctx context.Context, kubeClient kubernetes.Interface, cm, nm string) (*v1.ConfigMap, error) {
 	// Attempt to retrieve the config map
 	return kubeClient.CoreV1().ConfigMaps(nm).Get(ctx, cm, metav1.GetOptions{})
 }
 
+// getCloudConfigMap reads the pool configmap, unless its reads are backed off after repeated failures. A missing
+// configmap is an answer of the API server rather than a failure.
+func (k *kubevipLoadBalancerManager) getCloudConfigMap(ctx context.Context) (*v1.ConfigMap, error) {
+	if k.configMapBackoff == nil {
+		return getConfigMap(ctx, k.kubeClient, k.cloudConfigMap, k.namespace)
+	}
+	if err := k.configMapBackoff.allow(); err != nil {
+		return nil, err
+	}
+	cm, err := getConfigMap(ctx, k.kubeClient, k.cloudConfigMap, k.namespace)
+	if apierrors.IsNotFound(err) {
+		k.configMapBackoff.done(k.cloudConfigMap, k.namespace, nil)
+		return nil, err
+	}
+	return cm, k.configMapBackoff.done(k.cloudConfigMap, k.namespace, err)
+}
+
 func createConfigMap(ctx context.Context, kubeClient kubernetes.Interface, cm, nm string) (*v1.ConfigMap, error) {
 	// Create new configuration map in the correct namespace
 	newConfigMap := v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cm,
 			Namespace: nm,
+			Annotations: map[string]string{
+				AutoGeneratedConfigMapAnnotation: "true",
+			},
 		},
 	}
 	// Return results of configMap create
@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_validateConfigMap(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		wantInvalid []string
+	}{
+		{
+			name: "valid configuration",
+			data: map[string]string{
+				"cidr-global":                "192.168.0.200/29,fe80::10/127",
+				"cidr-dhcp":                  "0.0.0.0/32",
+				"cidr-stepped":               "10.0.0.0/24;step=4",
+				"cidr-window":                "10.0.0.0/24;min=.100;max=.200",
+				"hosts-sparse":               "10.0.0.5,10.0.0.9,fe80::5",
+				"range-development":          "192.168.0.210-192.168.0.219;exclude-endpoints=true",
+				"exclude-cidr-global":        "192.168.0.201,192.168.0.204/31",
+				"drain-cidr-global":          "10.1.0.0/24",
+				"gateway-cidr-global":        "192.168.0.193, fe80::1",
+				"internal-cidr-global":       "10.2.0.0/24",
+				"internal-cidr-stepped":      "10.3.0.0/24;step=4",
+				"internal-cidr-window":       "10.4.0.0/24;min=.100;max=.200",
+				"internal-range-development": "10.5.0.10-10.5.0.20;exclude-endpoints=true",
+				"search-order":               "desc",
+				"pool-order":                 "range-development,cidr-global",
+				"reserved-test-dns":          "192.168.0.50,fe80::50",
+				"exclude-reserved-global":    "192.168.0.201, fe80::11",
+				"alias-team":                 "development",
+			},
+		},
+		{
+			name: "every invalid key is reported",
+			data: map[string]string{
+				"cidr-global":         "192.168.0.200/29",
+				"cidr-finance":        "192.168.0.300/29",
+				"cidr-testing":        "192.168.0.230/29,192.168.0.240",
+				"cidr-stepped":        "10.0.0.0/24;step=0",
+				"cidr-window":         "10.0.0.0/24;min=.200;max=.100",
+				"hosts-sparse":        "10.0.0.5,10.0.0.300",
+				"range-global":        "192.168.0.210-192.168.0.219",
+				"range-development":   "192.168.0.219-192.168.0.210",
+				"exclude-cidr-global": "192.168.0",
+				"drain-cidr-global":   "10.1.0.0/33",
+				"gateway-cidr-global": "192.168.0.193,192.168.0.194",
+				"internal-range-test": "10.2.0.10",
+				"pool-order":          "cidr-global,search-order",
+				"reserved-test-dns":   "192.168.0.300",
+				"reserved-dns":        "192.168.0.50",
+				"exclude-reserved-":   "192.168.0.201",
+				"alias-team":          "development",
+				"alias-development":   "team",
+			},
+			wantInvalid: []string{"alias-development", "alias-team", "cidr-finance", "cidr-stepped", "cidr-testing", "cidr-window", "drain-cidr-global", "exclude-cidr-global", "exclude-reserved-", "gateway-cidr-global", "hosts-sparse", "internal-range-test", "pool-order", "range-development", "reserved-dns", "reserved-test-dns"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfigMap(&v1.ConfigMap{Data: tt.data})
+			if len(tt.wantInvalid) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			agg, ok := err.(utilerrors.Aggregate)
+			if !ok {
+				t.Fatalf("validateConfigMap() error = %v, want an aggregate", err)
+			}
+			var invalid []string
+			for _, e := range agg.Errors() {
+				for key := range tt.data {
+					if strings.Contains(e.Error(), "key ["+key+"]") {
+						invalid = append(invalid, key)
+					}
+				}
+			}
+			assert.Equal(t, tt.wantInvalid, invalid)
+		})
+	}
+}
+
+func Test_validatePoolConfig(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	err := validatePoolConfig(context.Background(), kubeClient, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	assert.ErrorContains(t, err, "unable to retrieve kube-vip ipam config from configMap [kubevip] in namespace [kube-system]")
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: KubeVipClientConfig, Namespace: KubeVipClientConfigNamespace},
+		Data:       map[string]string{"cidr-global": "192.168.0.200/29"},
+	}
+	if _, err := kubeClient.CoreV1().ConfigMaps(cm.Namespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, validatePoolConfig(context.Background(), kubeClient, KubeVipClientConfig, KubeVipClientConfigNamespace))
+}
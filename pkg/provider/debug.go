@@ -0,0 +1,190 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// freeAddressSampleSize is the number of free addresses listed for every pool by the debug endpoint
+const freeAddressSampleSize = 10
+
+// poolStatus is the state of a configured pool returned by the /pools debug endpoint
+type poolStatus struct {
+	// Key is the configmap key of the pool
+	Key string `json:"key"`
+	// Namespace is the namespace of the services using the pool, empty for global and named pools
+	Namespace string `json:"namespace,omitempty"`
+	// Addresses are the ranges of addresses the pool is made of
+	Addresses []string `json:"addresses,omitempty"`
+	// Total is the number of addresses of the pool
+	Total *big.Int `json:"total,omitempty"`
+	// InUse is the number of addresses of the pool that are in use or excluded
+	InUse *big.Int `json:"inUse,omitempty"`
+	// Free is a sample of the free addresses of the pool
+	Free []string `json:"free,omitempty"`
+	// DHCP is true for the special DHCP pool, its addresses are not managed by kube-vip-cloud-provider
+	DHCP bool `json:"dhcp,omitempty"`
+	// Error is the reason the state of the pool couldn't be computed
+	Error string `json:"error,omitempty"`
+}
+
+// servePoolsDebug serves the /pools and /overlaps debug endpoints on the address until the server fails
+func (k *kubevipLoadBalancerManager) servePoolsDebug(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pools", k.poolsHandler)
+	mux.HandleFunc("/overlaps", k.overlapsHandler)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.Infof("serving the pools debug endpoint on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		klog.Errorf("pools debug endpoint stopped: %v", err)
+	}
+}
+
+// poolsHandler returns the state of every pool of the configmap as json
+func (k *kubevipLoadBalancerManager) poolsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pools, err := k.getPoolStatus(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pools); err != nil {
+		klog.Errorf("unable to write the pools debug response: %v", err)
+	}
+}
+
+// getPoolStatus computes the state of every pool of the configmap, the in-use addresses are gathered
+// the same way they are when an address is allocated from the pool
+func (k *kubevipLoadBalancerManager) getPoolStatus(ctx context.Context) ([]poolStatus, error) {
+	controllerCM, err := getConfigMap(ctx, k.kubeClient, k.cloudConfigMap, k.namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(controllerCM.Data))
+	for key := range controllerCM.Data {
+		poolKey := strings.TrimPrefix(key, "internal-")
+		if strings.HasPrefix(poolKey, "cidr-") || strings.HasPrefix(poolKey, "range-") || strings.HasPrefix(poolKey, "hosts-") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pools := make([]poolStatus, 0, len(keys))
+	for _, key := range keys {
+		status := poolStatus{Key: key}
+		var pool *ipPool
+		pool, status.Namespace, err = configMapPool(controllerCM, key)
+		if err != nil {
+			status.Error = err.Error()
+			pools = append(pools, status)
+			continue
+		}
+		if isDHCPPool(pool.addresses) {
+			status.DHCP = true
+			pools = append(pools, status)
+			continue
+		}
+		if err := k.computePoolStatus(ctx, pool, &status); err != nil {
+			status.Error = err.Error()
+		}
+		pools = append(pools, status)
+	}
+	return pools, nil
+}
+
+// configMapPool returns the pool of the cidr, range or hosts key of the configmap, and the namespace of the services
+// using it, empty if it is shared by all namespaces
+func configMapPool(cm *v1.ConfigMap, key string) (*ipPool, string, error) {
+	// Global, named and zone pools are shared by all namespaces, the other pools belong to the namespace of their key,
+	// internal pools included
+	poolKey := strings.TrimPrefix(key, "internal-")
+	scope := poolKey[strings.Index(poolKey, "-")+1:]
+	// Protocol pools are scoped like the namespace or global pool they specialize
+	if protocolScope, ok := strings.CutPrefix(scope, "tcp-"); ok {
+		scope = protocolScope
+	} else if protocolScope, ok := strings.CutPrefix(scope, "udp-"); ok {
+		scope = protocolScope
+	}
+	if scope == "global" || strings.HasPrefix(scope, "pool-") || strings.HasPrefix(scope, "zone-") {
+		pool, err := newIPPool(cm, key, cm.Data[key], true)
+		return pool, "", err
+	}
+	pool, err := newNamespacePool(cm, key, cm.Data[key], scope)
+	return pool, scope, err
+}
+
+// computePoolStatus sets the addresses, the counts and the free address sample of the pool
+func (k *kubevipLoadBalancerManager) computePoolStatus(ctx context.Context, pool *ipPool, status *poolStatus) error {
+	poolSet, err := ipam.BuildPoolSet(pool.addresses)
+	if err != nil {
+		return err
+	}
+	inUseSet, _, err := k.gatherInUseAddresses(ctx, status.Namespace, pool)
+	if err != nil {
+		return err
+	}
+	// The addresses excluded by DNS are taken from the results of the previous allocations, the debug endpoint
+	// never looks them up
+	if k.dnsExclusions != nil {
+		resolvedSet, err := k.dnsExclusions.Cached()
+		if err != nil {
+			return err
+		}
+		builder := &netipx.IPSetBuilder{}
+		builder.AddSet(inUseSet)
+		builder.AddSet(resolvedSet)
+		if inUseSet, err = builder.IPSet(); err != nil {
+			return err
+		}
+	}
+
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(poolSet)
+	builder.Intersect(inUseSet)
+	usedSet, err := builder.IPSet()
+	if err != nil {
+		return err
+	}
+	builder = &netipx.IPSetBuilder{}
+	builder.AddSet(poolSet)
+	builder.RemoveSet(inUseSet)
+	freeSet, err := builder.IPSet()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range poolSet.Ranges() {
+		status.Addresses = append(status.Addresses, r.String())
+	}
+	status.Total = ipam.CountAddresses(poolSet)
+	status.InUse = ipam.CountAddresses(usedSet)
+	status.Free = []string{}
+	for _, r := range freeSet.Ranges() {
+		for addr := r.From(); len(status.Free) < freeAddressSampleSize; addr = addr.Next() {
+			status.Free = append(status.Free, addr.String())
+			if addr == r.To() {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_poolsHandler(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-global":         "10.0.0.0/29",
+		"exclude-cidr-global": "10.0.0.6",
+		"range-test":          "10.0.1.10-10.0.1.12",
+		"cidr-pool-edge":      "10.0.2.0/24;step=0",
+		"cidr-dhcp-test":      "0.0.0.0/32",
+		"search-order":        "desc",
+	},
+		newKubevipService("other", "global", "10.0.0.1"),
+		newKubevipService("test", "test", "10.0.1.10"),
+		// Only the services of the namespace use the addresses of a namespace pool
+		newKubevipService("other", "other", "10.0.1.11"),
+	)
+
+	rec := httptest.NewRecorder()
+	mgr.poolsHandler(rec, httptest.NewRequest(http.MethodGet, "/pools", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var got []poolStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []poolStatus{
+		{
+			Key:       "cidr-dhcp-test",
+			Namespace: "dhcp-test",
+			DHCP:      true,
+		},
+		{
+			Key:       "cidr-global",
+			Addresses: []string{"10.0.0.1-10.0.0.6"},
+			Total:     big.NewInt(6),
+			InUse:     big.NewInt(2),
+			Free:      []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"},
+		},
+		{
+			Key:   "cidr-pool-edge",
+			Error: "invalid step [0] for pool [cidr-pool-edge], must be a positive integer",
+		},
+		{
+			Key:       "range-test",
+			Namespace: "test",
+			Addresses: []string{"10.0.1.10-10.0.1.12"},
+			Total:     big.NewInt(3),
+			InUse:     big.NewInt(1),
+			Free:      []string{"10.0.1.11", "10.0.1.12"},
+		},
+	}, got)
+
+	rec = httptest.NewRecorder()
+	mgr.poolsHandler(rec, httptest.NewRequest(http.MethodPost, "/pools", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func Test_poolsHandlerDNSExclusions(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	resolver := &stubResolver{names: map[string][]string{"10.0.0.1": {"gateway.example.com"}}}
+	mgr.dnsExclusions = NewDNSExclusions(resolver, "", 256)
+	pools := func() []poolStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mgr.poolsHandler(rec, httptest.NewRequest(http.MethodGet, "/pools", nil))
+		var got []poolStatus
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// Nothing is looked up by the debug endpoint
+	assert.Equal(t, big.NewInt(0), pools()[0].InUse)
+	assert.Empty(t, resolver.lookups)
+
+	// The results of the allocations are reused
+	if _, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}}); err != nil {
+		t.Fatal(err)
+	}
+	resolver.lookups = nil
+	got := pools()[0]
+	assert.Equal(t, big.NewInt(2), got.InUse)
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}, got.Free)
+	assert.Empty(t, resolver.lookups)
+}
@@ -0,0 +1,223 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// DefragmentMove is the move of an address of a service planned by DefragmentPool
+type DefragmentMove struct {
+	// ServiceNamespace is the namespace of the service
+	ServiceNamespace string `json:"serviceNamespace"`
+	// ServiceName is the name of the service
+	ServiceName string `json:"serviceName"`
+	// From is the current address of the service
+	From netip.Addr `json:"from"`
+	// To is the address the service is moved to
+	To netip.Addr `json:"to"`
+}
+
+// DefragmentPool plans the moves that pack the addresses of the services using the pool of the configmap key at the
+// lowest free addresses of the pool, so that blocks of contiguous addresses are free again at its end. The services
+// already holding one of the lowest addresses keep it, the others are moved into the gaps, each IP family separately.
+// The addresses of services allocated a block, of services sharing an address and the addresses that are excluded,
+// drained or reserved are never moved. With apply the annotation, and the legacy spec.loadBalancerIP, of every moved
+// service are updated, the moves are only planned otherwise.
+func DefragmentPool(ctx context.Context, kubeClient kubernetes.Interface, cmName, cmNamespace, key string, apply bool) ([]DefragmentMove, error) {
+	k := newLoadBalancer(kubeClient, cmNamespace, cmName, nil)
+	controllerCM, err := getConfigMap(ctx, kubeClient, cmName, cmNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve configMap [%s] in namespace [%s]: %v", cmName, cmNamespace, err)
+	}
+	if _, ok := controllerCM.Data[key]; !ok {
+		return nil, fmt.Errorf("no pool [%s] in configMap [%s]", key, cmName)
+	}
+	pool, namespace, err := configMapPool(controllerCM, key)
+	if err != nil {
+		return nil, err
+	}
+	if isDHCPPool(pool.addresses) {
+		return nil, fmt.Errorf("pool [%s] provides DHCP addresses, which can't be defragmented", key)
+	}
+
+	moves, err := k.planDefragment(ctx, pool, namespace)
+	if err != nil || !apply {
+		return moves, err
+	}
+	for _, move := range moves {
+		if err := k.applyDefragmentMove(ctx, move); err != nil {
+			return moves, err
+		}
+	}
+	return moves, nil
+}
+
+// planDefragment plans the moves of the addresses of the services using the pool
+func (k *kubevipLoadBalancerManager) planDefragment(ctx context.Context, pool *ipPool, namespace string) ([]DefragmentMove, error) {
+	poolSet, err := ipam.BuildPoolSet(pool.addresses)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse pool [%s]: %v", pool.key, err)
+	}
+	inUseSet, owners, err := k.gatherInUseAddresses(ctx, namespace, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	// The addresses held by a single service allocated a single address per family can be moved, everything else
+	// in use stays where it is
+	movable := map[netip.Addr]*v1.Service{}
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(inUseSet)
+	for addr, services := range owners {
+		if !poolSet.Contains(addr) || len(services) != 1 || len(services[0].Annotations[LoadbalancerIPCountAnnotation]) != 0 {
+			continue
+		}
+		movable[addr] = services[0]
+		builder.Remove(addr)
+	}
+	fixedSet, err := builder.IPSet()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4Pool, ipv6Pool, err := splitPoolByIPFamily(pool.addresses)
+	if err != nil {
+		return nil, err
+	}
+	var moves []DefragmentMove
+	for _, familyPool := range []string{ipv4Pool, ipv6Pool} {
+		if len(familyPool) == 0 {
+			continue
+		}
+		familyMoves, err := planFamilyDefragment(ctx, pool, familyPool, fixedSet, movable)
+		if err != nil {
+			return nil, err
+		}
+		moves = append(moves, familyMoves...)
+	}
+	return moves, nil
+}
+
+// planFamilyDefragment plans the moves of the movable addresses of the cidrs, ranges or hosts of a single IP family
+// of the pool. The targets are the lowest addresses the pool would allocate, one per movable address.
+func planFamilyDefragment(ctx context.Context, pool *ipPool, familyPool string, fixedSet *netipx.IPSet,
+	movable map[netip.Addr]*v1.Service) ([]DefragmentMove, error) {
+	familySet, err := ipam.BuildPoolSet(familyPool)
+	if err != nil {
+		return nil, err
+	}
+	var current []netip.Addr
+	for addr := range movable {
+		if familySet.Contains(addr) {
+			current = append(current, addr)
+		}
+	}
+	slices.SortFunc(current, func(a, b netip.Addr) int { return a.Compare(b) })
+
+	opts := allocationOptions{step: pool.step, hostMin: pool.hostMin, hostMax: pool.hostMax, deterministic: true}
+	taken := fixedSet
+	var targets []netip.Addr
+	for range current {
+		vip, err := discoverAddress(ctx, "", familyPool, taken, opts)
+		var outOfIPs *ipam.OutOfIPsError
+		if errors.As(err, &outOfIPs) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddr(vip)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, addr)
+		builder := &netipx.IPSetBuilder{}
+		builder.AddSet(taken)
+		builder.Add(addr)
+		if taken, err = builder.IPSet(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The services already on a target keep their address, the others fill the free targets in order
+	var gaps []netip.Addr
+	for _, target := range targets {
+		if _, ok := movable[target]; !ok {
+			gaps = append(gaps, target)
+		}
+	}
+	var moves []DefragmentMove
+	for _, addr := range current {
+		if len(gaps) == 0 {
+			break
+		}
+		if slices.Contains(targets, addr) {
+			continue
+		}
+		service := movable[addr]
+		moves = append(moves, DefragmentMove{ServiceNamespace: service.Namespace, ServiceName: service.Name, From: addr, To: gaps[0]})
+		gaps = gaps[1:]
+	}
+	return moves, nil
+}
+
+// applyDefragmentMove replaces the address of the service, a service whose address changed in the meantime is
+// left alone
+func (k *kubevipLoadBalancerManager) applyDefragmentMove(ctx context.Context, move DefragmentMove) error {
+	var service *v1.Service
+	err := retry.RetryOnConflict(k.updateRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(move.ServiceNamespace).Get(ctx, move.ServiceName, metav1.GetOptions{})
+		if apierrors.IsNotFound(getErr) {
+			return nil
+		}
+		if getErr != nil {
+			return getErr
+		}
+		addrs := getServiceAddresses(recentService)
+		i := slices.Index(addrs, move.From)
+		if i < 0 {
+			klog.InfoS("Address of the service changed since the defragmentation was planned, leaving it alone",
+				"service", klog.KObj(recentService), "address", move.From)
+			return nil
+		}
+		addrs[i] = move.To
+		ips := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.String())
+		}
+		recentService.Annotations[IPsAnnotation] = strings.Join(ips, ",")
+		if specAddr, err := netip.ParseAddr(recentService.Spec.LoadBalancerIP); err == nil && specAddr.Unmap() == move.From {
+			recentService.Spec.LoadBalancerIP = move.To.String()
+		}
+		updated, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		service = updated
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("unable to move address [%s] of service '%s/%s' to [%s]: %v", move.From, move.ServiceNamespace, move.ServiceName, move.To, err)
+	}
+	if service == nil {
+		return nil
+	}
+	klog.InfoS("Moved the address of the service to defragment its pool", "service", klog.KObj(service), "from", move.From, "to", move.To)
+	if k.allocationLedger {
+		if err := k.releaseAllocation(ctx, service); err != nil {
+			return err
+		}
+		return k.recordAllocation(ctx, service, getServiceAddresses(service))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newFragmentedPool(t *testing.T) *kubevipLoadBalancerManager {
+	block := newKubevipService("test", "block", "10.0.0.9,10.0.0.10")
+	block.Annotations[LoadbalancerIPCountAnnotation] = "2"
+	legacy := newKubevipService("test", "legacy", "10.0.0.7")
+	legacy.Spec.LoadBalancerIP = "10.0.0.7"
+	return newTestLoadBalancer(t, map[string]string{
+		"cidr-global":         "10.0.0.0/28,fd00::/125",
+		"exclude-cidr-global": "10.0.0.2",
+	},
+		newKubevipService("test", "first", "10.0.0.1"),
+		newKubevipService("test", "second", "10.0.0.4"),
+		legacy,
+		block,
+		newKubevipService("other", "last", "10.0.0.12"),
+		newKubevipService("other", "dual-stack", "10.0.0.13,fd00::5"),
+	)
+}
+
+func Test_DefragmentPool(t *testing.T) {
+	mgr := newFragmentedPool(t)
+
+	moves, err := DefragmentPool(context.Background(), mgr.kubeClient, KubeVipClientConfig, KubeVipClientConfigNamespace, "cidr-global", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The services on the lowest addresses stay, the excluded address and the block are skipped
+	assert.Equal(t, []DefragmentMove{
+		{ServiceNamespace: "test", ServiceName: "legacy", From: netip.MustParseAddr("10.0.0.7"), To: netip.MustParseAddr("10.0.0.3")},
+		{ServiceNamespace: "other", ServiceName: "last", From: netip.MustParseAddr("10.0.0.12"), To: netip.MustParseAddr("10.0.0.5")},
+		{ServiceNamespace: "other", ServiceName: "dual-stack", From: netip.MustParseAddr("10.0.0.13"), To: netip.MustParseAddr("10.0.0.6")},
+		{ServiceNamespace: "other", ServiceName: "dual-stack", From: netip.MustParseAddr("fd00::5"), To: netip.MustParseAddr("fd00::")},
+	}, moves)
+
+	// Without apply the services are left alone
+	svc, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "legacy", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.7", svc.Annotations[IPsAnnotation])
+}
+
+func Test_DefragmentPoolApply(t *testing.T) {
+	mgr := newFragmentedPool(t)
+
+	if _, err := DefragmentPool(context.Background(), mgr.kubeClient, KubeVipClientConfig, KubeVipClientConfigNamespace, "cidr-global", true); err != nil {
+		t.Fatal(err)
+	}
+	get := func(namespace, name string) *v1.Service {
+		t.Helper()
+		svc, err := mgr.kubeClient.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+	legacy := get("test", "legacy")
+	assert.Equal(t, "10.0.0.3", legacy.Annotations[IPsAnnotation])
+	assert.Equal(t, "10.0.0.3", legacy.Spec.LoadBalancerIP)
+	assert.Equal(t, "10.0.0.6,fd00::", get("other", "dual-stack").Annotations[IPsAnnotation])
+	assert.Equal(t, "10.0.0.9,10.0.0.10", get("test", "block").Annotations[IPsAnnotation])
+
+	// The packed pool has nothing left to move
+	moves, err := DefragmentPool(context.Background(), mgr.kubeClient, KubeVipClientConfig, KubeVipClientConfigNamespace, "cidr-global", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, moves)
+}
+
+func Test_DefragmentPoolErrors(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-dhcp-test": "0.0.0.0/32"})
+
+	_, err := DefragmentPool(context.Background(), mgr.kubeClient, KubeVipClientConfig, KubeVipClientConfigNamespace, "cidr-global", false)
+	assert.EqualError(t, err, "no pool [cidr-global] in configMap [kubevip]")
+	_, err = DefragmentPool(context.Background(), mgr.kubeClient, KubeVipClientConfig, KubeVipClientConfigNamespace, "cidr-dhcp-test", false)
+	assert.EqualError(t, err, "pool [cidr-dhcp-test] provides DHCP addresses, which can't be defragmented")
+}
@@ -0,0 +1,194 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go4.org/netipx"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+const (
+	// dnsLookupTimeout bounds a single reverse lookup
+	dnsLookupTimeout = 2 * time.Second
+	// dnsExclusionsDeadline bounds all the lookups of an allocation, the addresses found once it passed aren't
+	// looked up
+	dnsExclusionsDeadline = 5 * time.Second
+	// dnsExclusionsCacheTTL is the time the result of a reverse lookup is reused for, so the syncs of the services
+	// don't look up the same addresses again
+	dnsExclusionsCacheTTL = 5 * time.Minute
+	// dnsFailureCacheTTL is the time a failed reverse lookup isn't retried for
+	dnsFailureCacheTTL = 30 * time.Second
+	// dnsBreakerThreshold is the number of consecutive failed lookups after which the lookups stop for
+	// dnsBreakerCooldown, so an unreachable resolver doesn't delay every allocation
+	dnsBreakerThreshold = 3
+	dnsBreakerCooldown  = time.Minute
+)
+
+// errDNSBreakerOpen is returned for the lookups skipped after the resolver kept failing
+var errDNSBreakerOpen = errors.New("reverse lookups stopped after consecutive failures")
+
+// ReverseResolver looks up the names of an address, net.Resolver implements it
+type ReverseResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// dnsLookup is the cached result of the reverse lookup of an address
+type dnsLookup struct {
+	resolved bool
+	failed   bool
+	at       time.Time
+}
+
+// DNSExclusions excludes the addresses of a pool that resolve in DNS, i.e. hosts that were assigned an address of the
+// subnet statically. The address(es) found by the search of the pool are looked up, and the pool is searched again
+// without those that resolve, so the exclusions follow the search order and options of the pool. The lookups are
+// bounded: at most maxLookups addresses are looked up per allocation, within dnsExclusionsDeadline, the results are
+// cached, and the lookups stop for a while after consecutive failures.
+type DNSExclusions struct {
+	resolver ReverseResolver
+	// domain only excludes the addresses whose names end with it, empty excludes every address with a name
+	domain     string
+	maxLookups int
+	clock      clock.PassiveClock
+
+	mu    sync.Mutex
+	cache map[netip.Addr]dnsLookup
+	// failures is the number of consecutive failed lookups, the lookups are skipped until breakerUntil once it
+	// reached dnsBreakerThreshold
+	failures     int
+	breakerUntil time.Time
+}
+
+// NewDNSExclusions returns a DNSExclusions looking up at most maxLookups addresses per allocation with the resolver
+func NewDNSExclusions(resolver ReverseResolver, domain string, maxLookups int) *DNSExclusions {
+	return &DNSExclusions{
+		resolver:   resolver,
+		domain:     strings.TrimSuffix(domain, "."),
+		maxLookups: maxLookups,
+		clock:      clock.RealClock{},
+		cache:      map[netip.Addr]dnsLookup{},
+	}
+}
+
+// Search returns the address(es) found by search that don't resolve in DNS. The pool is searched again, with the
+// addresses that resolve added to the in-use addresses, until none of the addresses found resolves. Once the lookups
+// are exhausted the addresses found are returned without being looked up, an address that can't be looked up isn't
+// excluded either.
+func (d *DNSExclusions) Search(ctx context.Context, pool string, inUseSet *netipx.IPSet, search func(*netipx.IPSet) (string, error)) (string, error) {
+	lookupCtx, cancel := context.WithTimeout(ctx, dnsExclusionsDeadline)
+	defer cancel()
+	lookups, failed := 0, 0
+	defer func() {
+		if failed != 0 {
+			klog.InfoS("Unable to look up addresses in DNS, they aren't excluded", "pool", pool, "failed", failed)
+		}
+	}()
+	for {
+		addresses, err := search(inUseSet)
+		if err != nil {
+			return "", err
+		}
+		addrs, err := parseAddresses(addresses)
+		if err != nil {
+			return "", err
+		}
+		var resolved []netip.Addr
+		for _, addr := range addrs {
+			if lookups == d.maxLookups {
+				klog.V(2).InfoS("Reached the maximum of reverse lookups, the address isn't looked up", "pool", pool, "address", addr, "maxLookups", d.maxLookups)
+				return addresses, nil
+			}
+			lookups++
+			ok, err := d.lookup(lookupCtx, addr)
+			if err != nil {
+				failed++
+				continue
+			}
+			if ok {
+				resolved = append(resolved, addr)
+			}
+		}
+		if len(resolved) == 0 {
+			return addresses, nil
+		}
+		klog.V(2).InfoS("Addresses resolve in DNS, searching the pool again", "pool", pool, "addresses", resolved)
+		builder := &netipx.IPSetBuilder{}
+		builder.AddSet(inUseSet)
+		for _, addr := range resolved {
+			builder.Add(addr)
+		}
+		if inUseSet, err = builder.IPSet(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Cached returns the addresses whose cached lookup found a name in the domain, no address is looked up
+func (d *DNSExclusions) Cached() (*netipx.IPSet, error) {
+	now := d.clock.Now()
+	builder := &netipx.IPSetBuilder{}
+	d.mu.Lock()
+	for addr, cached := range d.cache {
+		if cached.resolved && now.Sub(cached.at) < dnsExclusionsCacheTTL {
+			builder.Add(addr)
+		}
+	}
+	d.mu.Unlock()
+	return builder.IPSet()
+}
+
+// lookup returns true if the address has a name in the domain. The result is cached, a failure for a shorter time.
+func (d *DNSExclusions) lookup(ctx context.Context, addr netip.Addr) (bool, error) {
+	now := d.clock.Now()
+	d.mu.Lock()
+	cached, ok := d.cache[addr]
+	breakerOpen := now.Before(d.breakerUntil)
+	d.mu.Unlock()
+	switch {
+	case ok && cached.failed && now.Sub(cached.at) < dnsFailureCacheTTL:
+		return false, fmt.Errorf("lookup of %s failed recently", addr)
+	case ok && !cached.failed && now.Sub(cached.at) < dnsExclusionsCacheTTL:
+		return cached.resolved, nil
+	case breakerOpen:
+		return false, errDNSBreakerOpen
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+	names, err := d.resolver.LookupAddr(lookupCtx, addr.String())
+	var dnsErr *net.DNSError
+	if err != nil && (!errors.As(err, &dnsErr) || !dnsErr.IsNotFound) {
+		d.mu.Lock()
+		d.cache[addr] = dnsLookup{failed: true, at: now}
+		d.failures++
+		if d.failures == dnsBreakerThreshold {
+			klog.ErrorS(err, "Reverse lookups keep failing, stopping them for a while", "failures", d.failures, "cooldown", dnsBreakerCooldown)
+		}
+		if d.failures >= dnsBreakerThreshold {
+			d.breakerUntil = now.Add(dnsBreakerCooldown)
+		}
+		d.mu.Unlock()
+		return false, err
+	}
+	resolved := false
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if len(d.domain) == 0 || name == d.domain || strings.HasSuffix(name, "."+d.domain) {
+			resolved = true
+			break
+		}
+	}
+	d.mu.Lock()
+	d.cache[addr] = dnsLookup{resolved: resolved, at: now}
+	d.failures = 0
+	d.mu.Unlock()
+	return resolved, nil
+}
@@ -0,0 +1,182 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// stubResolver resolves the addresses of its names, every lookup is recorded
+type stubResolver struct {
+	names   map[string][]string
+	failing map[string]bool
+	lookups []string
+}
+
+func (r *stubResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	r.lookups = append(r.lookups, addr)
+	if r.failing[addr] {
+		return nil, errors.New("server misbehaving")
+	}
+	if names, ok := r.names[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func Test_syncLoadBalancerDNSExclusions(t *testing.T) {
+	tests := []struct {
+		name        string
+		pool        string
+		config      map[string]string
+		domain      string
+		maxLookups  int
+		want        string
+		wantLookups []string
+	}{
+		{
+			name:        "resolved address is excluded",
+			pool:        "10.0.0.0/29",
+			maxLookups:  256,
+			want:        "10.0.0.3",
+			wantLookups: []string{"10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:        "address resolving outside of the domain isn't excluded",
+			pool:        "10.0.0.0/29",
+			domain:      "infra.example.com",
+			maxLookups:  256,
+			want:        "10.0.0.2",
+			wantLookups: []string{"10.0.0.2"},
+		},
+		{
+			name:        "lookups are bounded",
+			pool:        "10.0.0.0/29",
+			maxLookups:  1,
+			want:        "10.0.0.3",
+			wantLookups: []string{"10.0.0.2"},
+		},
+		{
+			name:        "addresses are looked up in the search order",
+			pool:        "10.0.0.0/24",
+			config:      map[string]string{"search-order": "desc"},
+			maxLookups:  256,
+			want:        "10.0.0.253",
+			wantLookups: []string{"10.0.0.254", "10.0.0.253"},
+		},
+		{
+			name:        "addresses are looked up in the steps of the pool",
+			pool:        "10.0.0.0/29;step=2",
+			maxLookups:  256,
+			want:        "10.0.0.4",
+			wantLookups: []string{"10.0.0.2", "10.0.0.4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := map[string]string{"cidr-global": tt.pool}
+			for key, value := range tt.config {
+				config[key] = value
+			}
+			mgr := newTestLoadBalancer(t, config, newKubevipService("test", "existing", "10.0.0.1"))
+			resolver := &stubResolver{names: map[string][]string{
+				"10.0.0.2":   {"printer.office.example.com."},
+				"10.0.0.254": {"router.office.example.com."},
+			}}
+			mgr.dnsExclusions = NewDNSExclusions(resolver, tt.domain, tt.maxLookups)
+
+			got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+			// Only the addresses found by the search are looked up
+			assert.Equal(t, tt.wantLookups, resolver.lookups)
+		})
+	}
+}
+
+func Test_DNSExclusionsCache(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	resolver := &stubResolver{
+		names:   map[string][]string{"10.0.0.1": {"gateway.infra.example.com"}},
+		failing: map[string]bool{"10.0.0.2": true},
+	}
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	mgr.dnsExclusions = NewDNSExclusions(resolver, "infra.example.com.", 256)
+	mgr.dnsExclusions.clock = fakeClock
+
+	// An address that can't be looked up isn't excluded
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", got)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, resolver.lookups)
+
+	// The result of the excluded address is reused
+	resolver.lookups = nil
+	got, err = syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.3", got)
+	assert.Equal(t, []string{"10.0.0.3"}, resolver.lookups)
+
+	// Once the cached result expired the address is looked up again
+	resolver.lookups = nil
+	fakeClock.Step(dnsExclusionsCacheTTL)
+	got, err = syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "third"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.4", got)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.4"}, resolver.lookups)
+}
+
+func Test_DNSExclusionsFailingResolver(t *testing.T) {
+	resolver := &stubResolver{failing: map[string]bool{}}
+	for i := 1; i < 10; i++ {
+		resolver.failing[fmt.Sprintf("10.0.0.%d", i)] = true
+	}
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	d := NewDNSExclusions(resolver, "", 256)
+	d.clock = fakeClock
+	var addr string
+	search := func(*netipx.IPSet) (string, error) { return addr, nil }
+	searchAddress := func(a string) {
+		t.Helper()
+		addr = a
+		got, err := d.Search(context.Background(), "cidr-global", &netipx.IPSet{}, search)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, a, got)
+	}
+
+	// A failed lookup isn't retried for a while
+	searchAddress("10.0.0.1")
+	searchAddress("10.0.0.1")
+	assert.Equal(t, []string{"10.0.0.1"}, resolver.lookups)
+	fakeClock.Step(dnsFailureCacheTTL)
+	searchAddress("10.0.0.1")
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.1"}, resolver.lookups)
+
+	// The lookups stop after consecutive failures, until the cooldown elapsed
+	resolver.lookups = nil
+	searchAddress("10.0.0.2")
+	searchAddress("10.0.0.3")
+	assert.Equal(t, []string{"10.0.0.2"}, resolver.lookups)
+	fakeClock.Step(dnsBreakerCooldown)
+	searchAddress("10.0.0.3")
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3"}, resolver.lookups)
+}
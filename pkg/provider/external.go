@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go4.org/netipx"
+)
+
+// externalReservationsTimeout bounds a query of the external reservations endpoint
+const externalReservationsTimeout = 10 * time.Second
+
+// ExternalReservations returns the addresses reserved by another allocator sharing the subnets of the pools, they
+// are treated as in use when an address is allocated from the pool
+type ExternalReservations interface {
+	// Reserved returns the addresses reserved in the pool, the namespace is empty for global and named pools
+	Reserved(ctx context.Context, pool, namespace string) (*netipx.IPSet, error)
+}
+
+// ReservationsResponse is the json body returned by the endpoint of an HTTPReservations
+// Example: {"addresses": ["10.0.0.5", "10.0.1.0/28", "fd00::5"]}
+type ReservationsResponse struct {
+	// Addresses are the reserved addresses and cidrs, cidrs are reserved as a whole
+	Addresses []string `json:"addresses"`
+}
+
+// HTTPReservations queries the reserved addresses of a pool with a GET request to an endpoint, passing the key of the
+// pool and the namespace as the pool and namespace query parameters
+type HTTPReservations struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewHTTPReservations returns an HTTPReservations querying the endpoint
+func NewHTTPReservations(endpoint string) *HTTPReservations {
+	return &HTTPReservations{endpoint: endpoint, client: &http.Client{Timeout: externalReservationsTimeout}}
+}
+
+// Reserved returns the addresses the endpoint reserves in the pool
+func (r *HTTPReservations) Reserved(ctx context.Context, pool, namespace string) (*netipx.IPSet, error) {
+	u, err := url.Parse(r.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external reservations endpoint [%s]: %v", r.endpoint, err)
+	}
+	query := u.Query()
+	query.Set("pool", pool)
+	query.Set("namespace", namespace)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query the external reservations: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to query the external reservations: unexpected status [%s]", resp.Status)
+	}
+
+	var body ReservationsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid external reservations: %v", err)
+	}
+	if len(body.Addresses) == 0 {
+		return (&netipx.IPSetBuilder{}).IPSet()
+	}
+	set, err := ipam.BuildAddressSet(strings.Join(body.Addresses, ","))
+	if err != nil {
+		return nil, fmt.Errorf("invalid external reservations: %v", err)
+	}
+	return set, nil
+}
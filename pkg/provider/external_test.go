@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_syncLoadBalancerExternalReservations(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"addresses": ["10.0.0.1", "10.0.0.2/31"]}`))
+	}))
+	defer server.Close()
+
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	mgr.externalReservations = NewHTTPReservations(server.URL)
+
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.4", got)
+	assert.Equal(t, []string{"namespace=&pool=cidr-global"}, queries)
+}
+
+func Test_HTTPReservations(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "addresses and cidrs",
+			status: http.StatusOK,
+			body:   `{"addresses": ["10.0.0.5", "10.0.1.0/30", "fd00::5"]}`,
+			want:   []string{"10.0.0.5", "10.0.1.0-10.0.1.3", "fd00::5"},
+		},
+		{
+			name:   "no addresses",
+			status: http.StatusOK,
+			body:   `{}`,
+		},
+		{
+			name:    "invalid address",
+			status:  http.StatusOK,
+			body:    `{"addresses": ["10.0.0"]}`,
+			wantErr: "invalid external reservations: ParseAddr(\"10.0.0\"): IPv4 address too short",
+		},
+		{
+			name:    "error status",
+			status:  http.StatusServiceUnavailable,
+			wantErr: "unable to query the external reservations: unexpected status [503 Service Unavailable]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "test", r.URL.Query().Get("namespace"))
+				assert.Equal(t, "range-test", r.URL.Query().Get("pool"))
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			set, err := NewHTTPReservations(server.URL).Reserved(context.Background(), "range-test", "test")
+			if len(tt.wantErr) != 0 {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range set.Ranges() {
+				if r.From() == r.To() {
+					got = append(got, r.From().String())
+				} else {
+					got = append(got, r.String())
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
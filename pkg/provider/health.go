@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// serveHealthz serves the /healthz endpoint on the address until the server fails
+func (k *kubevipLoadBalancerManager) serveHealthz(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", k.healthzHandler)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.Infof("serving the health endpoint on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		klog.Errorf("health endpoint stopped: %v", err)
+	}
+}
+
+// healthzHandler returns 200 if the configmap can be read and its pools are valid. A failing
+// check, i.e. once the RBAC rules of the controller no longer allow it to read the configmap, returns 503.
+func (k *kubevipLoadBalancerManager) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := k.checkConfigMap(r.Context()); err != nil {
+		klog.Errorf("health check failed: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+// checkConfigMap reads the configmap and validates its pools. The configmap must hold at least one pool, unless the
+// pools are read from the IPPool custom resources, where the configmap can be left without pools
+func (k *kubevipLoadBalancerManager) checkConfigMap(ctx context.Context) error {
+	controllerCM, err := getConfigMap(ctx, k.kubeClient, k.cloudConfigMap, k.namespace)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve configMap [%s] in namespace [%s]: %v", k.cloudConfigMap, k.namespace, err)
+	}
+	if err := validateConfigMap(controllerCM); err != nil {
+		return err
+	}
+	if k.dynamicClient != nil {
+		return nil
+	}
+	for key := range controllerCM.Data {
+		poolKey := strings.TrimPrefix(key, "internal-")
+		if strings.HasPrefix(poolKey, "cidr-") || strings.HasPrefix(poolKey, "range-") || strings.HasPrefix(poolKey, "hosts-") {
+			return nil
+		}
+	}
+	return fmt.Errorf("configMap [%s] in namespace [%s] has no pools", k.cloudConfigMap, k.namespace)
+}
@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_healthzHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		mgr      func(t *testing.T) *kubevipLoadBalancerManager
+		wantCode int
+		wantBody string
+	}{
+		{
+			name: "healthy",
+			mgr: func(t *testing.T) *kubevipLoadBalancerManager {
+				return newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/24"})
+			},
+			wantCode: http.StatusOK,
+			wantBody: "ok",
+		},
+		{
+			name: "missing configmap",
+			mgr: func(*testing.T) *kubevipLoadBalancerManager {
+				return newLoadBalancer(fake.NewSimpleClientset(), KubeVipClientConfigNamespace, KubeVipClientConfig, record.NewFakeRecorder(100))
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "unable to retrieve configMap [kubevip] in namespace [kube-system]",
+		},
+		{
+			name: "invalid pool",
+			mgr: func(t *testing.T) *kubevipLoadBalancerManager {
+				return newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/33"})
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "cidr-global",
+		},
+		{
+			name: "no pools",
+			mgr: func(t *testing.T) *kubevipLoadBalancerManager {
+				return newTestLoadBalancer(t, map[string]string{"search-order": "desc"})
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: "configMap [kubevip] in namespace [kube-system] has no pools",
+		},
+		{
+			name: "no pools with IPPools",
+			mgr: func(t *testing.T) *kubevipLoadBalancerManager {
+				mgr := newTestLoadBalancer(t, map[string]string{"search-order": "desc"})
+				mgr.dynamicClient = fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(),
+					newTestIPPool(KubeVipClientConfigNamespace, DefaultIPPoolName, map[string]interface{}{"cidr": "10.0.0.0/24"}))
+				return mgr
+			},
+			wantCode: http.StatusOK,
+			wantBody: "ok",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.mgr(t).healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			assert.Equal(t, tt.wantCode, rec.Code)
+			assert.Contains(t, rec.Body.String(), tt.wantBody)
+		})
+	}
+}
+
+func Test_healthzServedByStandby(t *testing.T) {
+	// Pick a free port for the endpoint
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	bindAddress := HealthzBindAddress
+	HealthzBindAddress = addr
+	t.Cleanup(func() { HealthzBindAddress = bindAddress })
+
+	// Initialize is never called on a standby replica
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/24"})
+	p := &KubeVipCloudProvider{lb: mgr, kubeClient: mgr.kubeClient, namespace: mgr.namespace, configMapName: mgr.cloudConfigMap}
+	p.serveEndpoints()
+
+	healthy := func(context.Context) (bool, error) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/healthz", addr))
+		if err != nil {
+			return false, nil
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusOK, nil
+	}
+	assert.NoError(t, wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, healthy))
+}
@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// IPPoolResource is the resource of the IPPool custom resource the pools are read from with IPPoolCRD
+var IPPoolResource = schema.GroupVersionResource{Group: "kube-vip.io", Version: "v1alpha1", Resource: "ippools"}
+
+// DefaultIPPoolName is the name of the IPPool of the services that don't request a named pool
+const DefaultIPPoolName = "default"
+
+// discoverIPPool returns the IPPool the service takes its address(es) from, nil if there is none. The IPPool named
+// by the LoadbalancerPoolAnnotation of the service, or the default IPPool, is looked up in the namespace of the
+// service first, where it is used by the services of that namespace only. It is looked up in the namespace of the
+// pool configmap next, where it is shared by the services of all namespaces like a global pool.
+func (k *kubevipLoadBalancerManager) discoverIPPool(ctx context.Context, service *v1.Service) (*ipPool, error) {
+	name := service.Annotations[LoadbalancerPoolAnnotation]
+	if len(name) == 0 {
+		name = DefaultIPPoolName
+	}
+	for _, namespace := range []string{service.Namespace, k.namespace} {
+		obj, err := k.dynamicClient.Resource(IPPoolResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get IPPool [%s/%s]: %v", namespace, name, err)
+		}
+		pool, err := newIPPoolFromResource(obj, namespace != service.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		klog.InfoS("Taking address from IPPool", "service", klog.KObj(service), "ipPool", klog.KObj(obj))
+		return pool, nil
+	}
+	return nil, nil
+}
+
+// newIPPoolFromResource returns the pool of the IPPool, which sets either spec.cidr or spec.range
+func newIPPoolFromResource(obj *unstructured.Unstructured, global bool) (*ipPool, error) {
+	cidr, _, err := unstructured.NestedString(obj.Object, "spec", "cidr")
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec.cidr of IPPool [%s/%s]: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	ipRange, _, err := unstructured.NestedString(obj.Object, "spec", "range")
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec.range of IPPool [%s/%s]: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	searchOrder, _, err := unstructured.NestedString(obj.Object, "spec", "searchOrder")
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec.searchOrder of IPPool [%s/%s]: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	addresses := cidr
+	switch {
+	case len(cidr) != 0 && len(ipRange) != 0, len(cidr) == 0 && len(ipRange) == 0:
+		return nil, fmt.Errorf("IPPool [%s/%s] must set exactly one of spec.cidr and spec.range", obj.GetNamespace(), obj.GetName())
+	case len(cidr) != 0:
+		_, _, err = ipam.SplitCIDRsByIPFamily(cidr)
+	default:
+		addresses = ipRange
+		_, _, err = ipam.SplitRangesByIPFamily(ipRange)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid addresses [%s] of IPPool [%s/%s]: %v", addresses, obj.GetNamespace(), obj.GetName(), err)
+	}
+	if searchOrder != "" && searchOrder != "asc" && searchOrder != "desc" {
+		return nil, fmt.Errorf("invalid spec.searchOrder [%s] of IPPool [%s/%s], must be one of asc or desc", searchOrder, obj.GetNamespace(), obj.GetName())
+	}
+
+	return &ipPool{
+		addresses:   addresses,
+		key:         fmt.Sprintf("ippool-%s-%s", obj.GetNamespace(), obj.GetName()),
+		global:      global,
+		step:        1,
+		searchOrder: searchOrder,
+	}, nil
+}
@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+)
+
+func newTestIPPool(namespace, name string, spec map[string]interface{}) runtime.Object {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kube-vip.io/v1alpha1",
+		"kind":       "IPPool",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		"spec":       spec,
+	}}
+}
+
+func Test_syncLoadBalancerIPPool(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipPools  []runtime.Object
+		services []*v1.Service
+		service  *v1.Service
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "the default IPPool of the namespace takes precedence over the configmap",
+			ipPools: []runtime.Object{
+				newTestIPPool("test", "default", map[string]interface{}{"cidr": "10.1.0.0/29"}),
+				newTestIPPool(KubeVipClientConfigNamespace, "default", map[string]interface{}{"cidr": "10.2.0.0/29"}),
+			},
+			// Only the services of the namespace use the addresses of its IPPool
+			services: []*v1.Service{newKubevipService("other", "other", "10.1.0.1")},
+			service:  &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}},
+			want:     "10.1.0.1",
+		},
+		{
+			name: "the default IPPool of the configmap namespace is shared by all namespaces",
+			ipPools: []runtime.Object{
+				newTestIPPool(KubeVipClientConfigNamespace, "default", map[string]interface{}{"range": "10.2.0.10-10.2.0.12", "searchOrder": "desc"}),
+			},
+			services: []*v1.Service{newKubevipService("other", "other", "10.2.0.12")},
+			service:  &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}},
+			want:     "10.2.0.11",
+		},
+		{
+			name: "the named pool of the service is an IPPool",
+			ipPools: []runtime.Object{
+				newTestIPPool("test", "default", map[string]interface{}{"cidr": "10.1.0.0/29"}),
+				newTestIPPool(KubeVipClientConfigNamespace, "edge", map[string]interface{}{"cidr": "10.3.0.0/29"}),
+			},
+			service: &v1.Service{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        "svc",
+				Annotations: map[string]string{LoadbalancerPoolAnnotation: "edge"},
+			}},
+			want: "10.3.0.1",
+		},
+		{
+			name:    "services without an IPPool use the configmap",
+			ipPools: []runtime.Object{newTestIPPool("other", "default", map[string]interface{}{"cidr": "10.1.0.0/29"})},
+			service: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name: "an IPPool must set either a cidr or a range",
+			ipPools: []runtime.Object{
+				newTestIPPool("test", "default", map[string]interface{}{"cidr": "10.1.0.0/29", "range": "10.1.0.10-10.1.0.12"}),
+			},
+			service: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}},
+			wantErr: "IPPool [test/default] must set exactly one of spec.cidr and spec.range",
+		},
+		{
+			name:    "invalid addresses of an IPPool",
+			ipPools: []runtime.Object{newTestIPPool("test", "default", map[string]interface{}{"cidr": "10.1.0.0"})},
+			service: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}},
+			wantErr: "invalid addresses [10.1.0.0] of IPPool [test/default]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, tt.services...)
+			mgr.dynamicClient = fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), tt.ipPools...)
+			got, err := syncNewService(t, mgr, tt.service)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package provider
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// IPv6ScopeULA selects the unique local IPv6 addresses of a pool, fc00::/7
+	IPv6ScopeULA = "ula"
+	// IPv6ScopeGUA selects the global unicast IPv6 addresses of a pool, 2000::/3
+	IPv6ScopeGUA = "gua"
+)
+
+var (
+	ulaPrefix = netip.MustParsePrefix("fc00::/7")
+	guaPrefix = netip.MustParsePrefix("2000::/3")
+)
+
+// getIPv6Scope returns the scope of the IPv6ScopeAnnotation of the service, ula or gua, empty if it isn't set
+func getIPv6Scope(service *v1.Service) (string, error) {
+	value, ok := service.Annotations[IPv6ScopeAnnotation]
+	if !ok || len(value) == 0 {
+		return "", nil
+	}
+	scope := strings.ToLower(value)
+	if scope != IPv6ScopeULA && scope != IPv6ScopeGUA {
+		return "", fmt.Errorf("invalid IPv6 scope [%s] in annotation '%s', must be one of %s or %s", value, IPv6ScopeAnnotation, IPv6ScopeULA, IPv6ScopeGUA)
+	}
+	return scope, nil
+}
+
+// scopeIPv6Pool returns the cidrs, ranges or hosts of the IPv6 pool whose addresses are all in the scope, an
+// error if there is none
+func scopeIPv6Pool(ipv6Pool, scope string) (string, error) {
+	prefix := ulaPrefix
+	if scope == IPv6ScopeGUA {
+		prefix = guaPrefix
+	}
+	var scoped []string
+	for _, subPool := range strings.Split(ipv6Pool, ",") {
+		r, ok := subPoolRange(subPool)
+		if ok && prefix.Contains(r.From()) && prefix.Contains(r.To()) {
+			scoped = append(scoped, subPool)
+		}
+	}
+	if len(scoped) == 0 {
+		return "", fmt.Errorf("service requires IPv6 scope [%s], but the pool has no %s addresses configured", scope, prefix)
+	}
+	return strings.Join(scoped, ","), nil
+}
+
+// subPoolRange returns the addresses of a single cidr, range or host of a pool
+func subPoolRange(subPool string) (netipx.IPRange, bool) {
+	switch {
+	case strings.Contains(subPool, "/"):
+		prefix, err := netip.ParsePrefix(subPool)
+		if err != nil {
+			return netipx.IPRange{}, false
+		}
+		return netipx.RangeOfPrefix(prefix.Masked()), true
+	case strings.Contains(subPool, "-"):
+		r, err := netipx.ParseIPRange(subPool)
+		return r, err == nil
+	default:
+		addr, err := netip.ParseAddr(subPool)
+		return netipx.IPRangeFrom(addr, addr), err == nil
+	}
+}
@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// AllocationLedgerConfigMap is the name of the configmap, in the namespace of the pool configmap, that records
+// the UID of the service every address is allocated to
+const AllocationLedgerConfigMap = "kube-vip-allocations"
+
+// ledgerKey returns the configmap key of the address, configmap keys can't contain the colons of IPv6 addresses
+func ledgerKey(addr netip.Addr) string {
+	return strings.ReplaceAll(addr.String(), ":", "_")
+}
+
+// parseLedgerKey returns the address of the configmap key
+func parseLedgerKey(key string) (netip.Addr, error) {
+	return netip.ParseAddr(strings.ReplaceAll(key, "_", ":"))
+}
+
+// getLedgerAddresses returns the addresses recorded in the allocation ledger
+func (k *kubevipLoadBalancerManager) getLedgerAddresses(ctx context.Context) ([]netip.Addr, error) {
+	cm, err := getConfigMap(ctx, k.kubeClient, AllocationLedgerConfigMap, k.namespace)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.Addr, 0, len(cm.Data))
+	for key := range cm.Data {
+		addr, err := parseLedgerKey(key)
+		if err != nil {
+			klog.InfoS("Ignoring invalid key of the allocation ledger", "configMap", klog.KObj(cm), "key", key)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// recordAllocation records the addresses allocated to the service in the allocation ledger
+func (k *kubevipLoadBalancerManager) recordAllocation(ctx context.Context, service *v1.Service, addresses []netip.Addr) error {
+	return k.updateLedger(ctx, func(data map[string]string) {
+		for _, addr := range addresses {
+			data[ledgerKey(addr)] = string(service.UID)
+		}
+	})
+}
+
+// releaseAllocation removes the addresses recorded for the service from the allocation ledger
+func (k *kubevipLoadBalancerManager) releaseAllocation(ctx context.Context, service *v1.Service) error {
+	return k.updateLedger(ctx, func(data map[string]string) {
+		for key, uid := range data {
+			if uid == string(service.UID) {
+				delete(data, key)
+			}
+		}
+	})
+}
+
+// updateLedger applies the update to the data of the allocation ledger, the configmap is created if it doesn't exist
+func (k *kubevipLoadBalancerManager) updateLedger(ctx context.Context, update func(data map[string]string)) error {
+	return k.updateConfigMapData(ctx, AllocationLedgerConfigMap, update)
+}
+
+// updateConfigMapData applies the update to the data of the configmap of the namespace of the pool configmap, the
+// configmap is created if it doesn't exist
+func (k *kubevipLoadBalancerManager) updateConfigMapData(ctx context.Context, name string, update func(data map[string]string)) error {
+	return retry.RetryOnConflict(k.updateRetry, func() error {
+		cm, err := getConfigMap(ctx, k.kubeClient, name, k.namespace)
+		if apierrors.IsNotFound(err) {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: k.namespace},
+				Data:       map[string]string{},
+			}
+			update(cm.Data)
+			_, err = k.kubeClient.CoreV1().ConfigMaps(k.namespace).Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Created concurrently, retry the update
+				return apierrors.NewConflict(v1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		update(cm.Data)
+		_, err = k.kubeClient.CoreV1().ConfigMaps(k.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// reclaimLedger removes the entries of the allocation ledger whose service no longer exists, i.e. when the
+// namespace of the service was deleted while the controller wasn't running. The ledger is read before the
+// services are listed, an address recorded in the meantime belongs to a service that is listed.
+func (k *kubevipLoadBalancerManager) reclaimLedger(ctx context.Context) error {
+	cm, err := getConfigMap(ctx, k.kubeClient, AllocationLedgerConfigMap, k.namespace)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read the allocation ledger: %v", err)
+	}
+	svcs, err := k.kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list services: %v", err)
+	}
+	uids := make(map[types.UID]bool, len(svcs.Items))
+	for x := range svcs.Items {
+		uids[svcs.Items[x].UID] = true
+	}
+
+	stale := map[string]string{}
+	for key, uid := range cm.Data {
+		if !uids[types.UID(uid)] {
+			stale[key] = uid
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	reclaimed := 0
+	err = k.updateLedger(ctx, func(data map[string]string) {
+		reclaimed = 0
+		for key, uid := range stale {
+			// The address might have been recorded again for a new service
+			if data[key] == uid {
+				delete(data, key)
+				reclaimed++
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	klog.InfoS("Reclaimed addresses of deleted services from the allocation ledger", "count", reclaimed)
+	ledgerReclaimedAddresses.Add(float64(reclaimed))
+	return nil
+}
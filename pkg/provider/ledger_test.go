@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/utils/ptr"
+)
+
+func getLedger(t *testing.T, mgr *kubevipLoadBalancerManager) map[string]string {
+	t.Helper()
+	cm, err := mgr.kubeClient.CoreV1().ConfigMaps(mgr.namespace).Get(context.Background(), AllocationLedgerConfigMap, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm.Data
+}
+
+func Test_allocationLedger(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29,fe80::10/127"})
+	mgr.allocationLedger = true
+
+	newService := func(name string, uid types.UID) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name, UID: uid},
+			Spec: v1.ServiceSpec{
+				IPFamilyPolicy: ptr.To(v1.IPFamilyPolicyRequireDualStack),
+				IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			},
+		}
+	}
+
+	// The allocation is written to the ledger
+	first := newService("first", "uid-first")
+	got, err := syncNewService(t, mgr, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.1,fe80::10", got)
+	assert.Equal(t, map[string]string{"10.0.0.1": "uid-first", "fe80__10": "uid-first"}, getLedger(t, mgr))
+
+	// The annotation of the first service is stripped, the ledger keeps its addresses in use
+	svc, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), first.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(svc.Annotations, LoadbalancerIPsAnnotations)
+	if _, err := mgr.kubeClient.CoreV1().Services("test").Update(context.Background(), svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = syncNewService(t, mgr, newService("second", "uid-second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2,fe80::11", got)
+
+	// Deleting the first service clears its addresses from the ledger
+	if err := mgr.deleteLoadBalancer(context.Background(), svc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"10.0.0.2": "uid-second", "fe80__11": "uid-second"}, getLedger(t, mgr))
+}
+
+func Test_ledgerKey(t *testing.T) {
+	for _, address := range []string{"10.0.0.1", "fe80::10", "2001:db8::1:0:0:1"} {
+		addr, err := parseLedgerKey(ledgerKey(netip.MustParseAddr(address)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, address, addr.String())
+	}
+}
+
+func Test_reclaimLedger(t *testing.T) {
+	registerMetrics()
+	ledgerReclaimedAddresses.Reset()
+
+	existing := newKubevipService("test", "existing", "10.0.0.1")
+	existing.UID = "uid-existing"
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, existing)
+	mgr.allocationLedger = true
+
+	// Nothing to reclaim without a ledger
+	if err := mgr.reclaimLedger(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The service of the second address was deleted together with its namespace
+	if err := mgr.updateLedger(context.Background(), func(data map[string]string) {
+		data["10.0.0.1"] = "uid-existing"
+		data["10.0.0.2"] = "uid-deleted"
+		data["fe80__10"] = "uid-deleted"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.reclaimLedger(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"10.0.0.1": "uid-existing"}, getLedger(t, mgr))
+	reclaimed, err := testutil.GetCounterMetricValue(ledgerReclaimedAddresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, float64(2), reclaimed)
+
+	// The reclaimed address can be allocated again
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc", UID: "uid-svc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", got)
+}
@@ -2,19 +2,35 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"go4.org/netipx"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/cloud-provider/api"
 
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 )
 
 const (
@@ -22,12 +38,94 @@ const (
 	// use plural for dual stack support in the future
 	// Example: kube-vip.io/loadbalancerIPs: 10.1.2.3,fd00::100
 	LoadbalancerIPsAnnotations = "kube-vip.io/loadbalancerIPs"
+	// IPFamilyOrderAnnotation is for overriding the order in which the IP families of a service are allocated
+	// Example: kube-vip.io/loadbalancerIPFamilyOrder: ipv6,ipv4
+	IPFamilyOrderAnnotation = "kube-vip.io/loadbalancerIPFamilyOrder"
+	// SearchOrderAnnotation is for overriding the search order of the configmap for a single service
+	// Example: kube-vip.io/loadbalancerSearchOrder: desc
+	SearchOrderAnnotation = "kube-vip.io/loadbalancerSearchOrder"
+	// FromEndAnnotation is for allocating the address(es) of a single service from the end of its pool
+	// Example: kube-vip.io/loadbalancerFromEnd: "true"
+	FromEndAnnotation = "kube-vip.io/loadbalancerFromEnd"
+	// SkipManagementAnnotation is for services whose addresses and labels are managed out of band
+	// Example: kube-vip.io/skipManagement: "true"
+	SkipManagementAnnotation = "kube-vip.io/skipManagement"
+	// LoadbalancerPoolAnnotation is for taking the address(es) of a service from a named pool
+	// Example: kube-vip.io/loadbalancerPool: edge, with the pool configured as cidr-pool-edge or range-pool-edge
+	LoadbalancerPoolAnnotation = "kube-vip.io/loadbalancerPool"
+	// LoadbalancerPoolCIDRAnnotation is for taking the address(es) of a service from an ad-hoc pool, bypassing the
+	// pools of the configmap
+	// Example: kube-vip.io/loadbalancerPoolCIDR: 10.5.0.0/24
+	LoadbalancerPoolCIDRAnnotation = "kube-vip.io/loadbalancerPoolCIDR"
+	// LoadbalancerCIDRAnnotation is for taking the address of a service from one of the cidrs of its pool
+	// Example: kube-vip.io/loadbalancerCIDR: 203.0.113.0/28
+	LoadbalancerCIDRAnnotation = "kube-vip.io/loadbalancerCIDR"
+	// LoadbalancerIPCountAnnotation is for allocating a block of contiguous addresses to a single stack service
+	// Example: kube-vip.io/loadbalancerIPCount: "4"
+	LoadbalancerIPCountAnnotation = "kube-vip.io/loadbalancerIPCount"
+	// ReallocateAnnotation is for moving a service off its current address(es), the annotation is removed once
+	// the service has been allocated new address(es)
+	// Example: kube-vip.io/reallocate: "true"
+	ReallocateAnnotation = "kube-vip.io/reallocate"
+	// AllocationSourceAnnotation records where the address(es) of the service were allocated from, for auditing
+	// Example: kube-vip.io/allocationSource: pool:cidr-dev
+	AllocationSourceAnnotation = "kube-vip.io/allocationSource"
+	// PreferredIPAnnotation is for allocating an address to a service if it is free, unlike the IPsAnnotation
+	// the service is allocated another address of its pool otherwise
+	// Example: kube-vip.io/preferredIP: 10.0.0.77
+	PreferredIPAnnotation = "kube-vip.io/preferredIP"
+	// InternalAnnotation is for taking the address(es) of an internal load balancer from the internal pools,
+	// internal-cidr-<namespace>, internal-range-<namespace> or internal-hosts-<namespace> and their global variants
+	// Example: service.beta.kubernetes.io/kube-vip-internal: "true"
+	InternalAnnotation = "service.beta.kubernetes.io/kube-vip-internal"
+	// ManualAssignmentRequiredAnnotation is for services that are never allocated an address from a pool, they stay
+	// pending until an address is set with the IPsAnnotation or spec.loadBalancerIP
+	// Example: kube-vip.io/manualAssignmentRequired: "true"
+	ManualAssignmentRequiredAnnotation = "kube-vip.io/manualAssignmentRequired"
+	// IPv6ScopeAnnotation is for allocating the IPv6 address of a service from the unique local (ula) or the global
+	// unicast (gua) addresses of its pool
+	// Example: kube-vip.io/ipv6Scope: ula
+	IPv6ScopeAnnotation = "kube-vip.io/ipv6Scope"
+	// LoadbalancerGatewayAnnotation records the gateway(s) of the pool the address(es) of the service were allocated
+	// from, one per IP family of the addresses, for the tooling advertising them
+	// Example: kube-vip.io/loadbalancerGateway: 10.0.0.1
+	LoadbalancerGatewayAnnotation = "kube-vip.io/loadbalancerGateway"
 	// ImplementationLabelKey is the label key showing the service is implemented by kube-vip
 	ImplementationLabelKey = "implementation"
 	// ImplementationLabelValue is the label value showing the service is implemented by kube-vip
 	ImplementationLabelValue = "kube-vip"
 	// LegacyIpamAddressLabelKey is the legacy label key showing the service is implemented by kube-vip
 	LegacyIpamAddressLabelKey = "ipam-address"
+
+	// IPAllocatedReason is the event reason used when address(es) are allocated to a service
+	IPAllocatedReason = "IPAllocated"
+	// IPAllocationFailedReason is the event reason used when no address could be allocated to a service
+	IPAllocationFailedReason = "IPAllocationFailed"
+	// IPReleasedReason is the event reason used when the address(es) of a deleted service are released
+	IPReleasedReason = "IPReleased"
+	// DuplicateIPReason is the event reason used when an address is assigned to more than one service
+	DuplicateIPReason = "DuplicateIP"
+	// ReservedIPConflictReason is the event reason used when the address reserved for a service is held by another service
+	ReservedIPConflictReason = "ReservedIPConflict"
+	// IPOutOfPoolReason is the event reason used when the address of a service is no longer part of its pool
+	IPOutOfPoolReason = "IPOutOfPool"
+	// NoReadyNodesReason is the event reason used when the allocation is deferred as no node can host the address
+	NoReadyNodesReason = "NoReadyNodes"
+	// LoadBalancerIPConflictReason is the event reason used when spec.loadBalancerIP isn't one of the address(es) of the annotation
+	LoadBalancerIPConflictReason = "LoadBalancerIPConflict"
+	// PreferredIPIgnoredReason is the event reason used when the preferred address of a service can't be allocated
+	PreferredIPIgnoredReason = "PreferredIPIgnored"
+	// ManualAssignmentRequiredReason is the event reason used when a service waits for an address to be set manually
+	ManualAssignmentRequiredReason = "ManualAssignmentRequired"
+
+	// LoadBalancerIPConflictAnnotation keeps the address(es) of the annotation when spec.loadBalancerIP disagrees
+	LoadBalancerIPConflictAnnotation = "annotation"
+	// LoadBalancerIPConflictSpec writes spec.loadBalancerIP to the annotation when they disagree
+	LoadBalancerIPConflictSpec = "spec"
+
+	// maxAllocationVerifyAttempts is the number of times a service is allocated again when its address(es) were
+	// assigned to another service concurrently
+	maxAllocationVerifyAttempts = 3
 )
 
 // kubevipLoadBalancerManager -
@@ -35,23 +133,124 @@ type kubevipLoadBalancerManager struct {
 	kubeClient     kubernetes.Interface
 	namespace      string
 	cloudConfigMap string
+	recorder       record.EventRecorder
+
+	// updateRetry is the backoff used when updating a service conflicts with another update
+	updateRetry wait.Backoff
+	// loadBalancerClass is the spec.loadBalancerClass of the services managed by kube-vip, services with
+	// another class are provisioned by a different implementation, services without a class are managed
+	loadBalancerClass string
+	// autoCreateConfigMap creates an empty configmap if the configured one doesn't exist
+	autoCreateConfigMap bool
+	// refuseDuplicateIPs stops allocating from a pool while an address of the pool is assigned to more than one service
+	refuseDuplicateIPs bool
+	// allocationLedger records the allocated addresses in the AllocationLedgerConfigMap, and treats them as in use
+	allocationLedger bool
+	// writeLegacyLoadBalancerIP sets spec.loadBalancerIP of the service to its first allocated address
+	writeLegacyLoadBalancerIP bool
+	// outOfIPsRetry is the delay before a service whose pool is out of addresses is retried, 0 uses the controller backoff
+	outOfIPsRetry time.Duration
+	// reallocateOutOfPool reallocates the address(es) of a service that are no longer part of its pool
+	reallocateOutOfPool bool
+	// writeIPFamilies sets spec.ipFamilies of a single stack service without families to the family allocated to it
+	writeIPFamilies bool
+	// deterministic always allocates the numerically lowest free address of a pool, regardless of the search order
+	deterministic bool
+	// verifyAllocation checks that the allocated address(es) are still free right before the service is updated
+	verifyAllocation bool
+	// populateIngress returns the address(es) of the service as the ingress of its load balancer status
+	populateIngress bool
+	// zonePools allocates the address(es) of a service from the pool of the topology zone of its nodes
+	zonePools bool
+	// requireReadyNodes defers the allocation of a service until one of its nodes is ready and schedulable
+	requireReadyNodes bool
+	// loadBalancerIPConflictWinner is the address kept when spec.loadBalancerIP isn't one of the address(es) of the annotation
+	loadBalancerIPConflictWinner string
+	// reportedIPConflicts are the conflicts between spec.loadBalancerIP and the annotation already reported, by service
+	reportedIPConflictsMu sync.Mutex
+	reportedIPConflicts   map[types.NamespacedName]string
+	// externalReservations returns the addresses reserved by another allocator, nil if there is none
+	externalReservations ExternalReservations
+	// namespacePoolOverflow allocates from the global pool once the pool of the namespace is out of addresses
+	namespacePoolOverflow bool
+	// addressAffinity allocates the previous address of a service that is created again if it is free
+	addressAffinity bool
+	// dynamicClient reads the IPPool custom resources, nil if the pools are only read from the configmap
+	dynamicClient dynamic.Interface
+	// alignDualStackOffsets allocates the second address of a dual-stack service at the host offset of the first
+	alignDualStackOffsets bool
+	// releasedAddresses withholds the addresses of deleted services for the grace period, nil frees them immediately
+	releasedAddresses *releasedAddresses
+	// tracer starts the allocation spans, they are no-ops unless a tracer provider is configured
+	tracer trace.Tracer
+	// managedNamespaces are the only namespaces whose services are managed, empty manages all namespaces
+	managedNamespaces []string
+	// excludedNamespaces are the namespaces whose services are never managed
+	excludedNamespaces []string
+	// defaultIPFamilyPolicy is the IP family policy of the services without spec.ipFamilyPolicy, nil leaves it unset
+	defaultIPFamilyPolicy *v1.IPFamilyPolicy
+	// configMapBackoff backs off the reads of the configmap after repeated failures, nil always reads it
+	configMapBackoff *configMapBackoff
+	// dnsExclusions excludes the addresses found in a pool that resolve in DNS, nil if they aren't looked up
+	dnsExclusions *DNSExclusions
 }
 
-func newLoadBalancer(kubeClient kubernetes.Interface, ns, cm string) cloudprovider.LoadBalancer {
+var _ cloudprovider.LoadBalancer = &kubevipLoadBalancerManager{}
+
+func newLoadBalancer(kubeClient kubernetes.Interface, ns, cm string, recorder record.EventRecorder) *kubevipLoadBalancerManager {
 	k := &kubevipLoadBalancerManager{
 		kubeClient:     kubeClient,
 		namespace:      ns,
 		cloudConfigMap: cm,
+		recorder:       recorder,
+
+		loadBalancerClass:            LoadbalancerClass,
+		updateRetry:                  ServiceUpdateRetry,
+		autoCreateConfigMap:          AutoCreateConfigMap,
+		refuseDuplicateIPs:           RefuseDuplicateIPs,
+		allocationLedger:             EnableAllocationLedger,
+		outOfIPsRetry:                OutOfIPsRetryInterval,
+		writeLegacyLoadBalancerIP:    WriteLegacyLoadBalancerIP,
+		reallocateOutOfPool:          ReallocateOutOfPool,
+		writeIPFamilies:              WriteIPFamilies,
+		deterministic:                Deterministic,
+		verifyAllocation:             VerifyAllocation,
+		populateIngress:              PopulateIngressStatus,
+		zonePools:                    ZonePools,
+		requireReadyNodes:            RequireReadyNodes,
+		loadBalancerIPConflictWinner: LoadBalancerIPConflictWinner,
+		namespacePoolOverflow:        NamespacePoolOverflowToGlobal,
+		addressAffinity:              AddressAffinity,
+		alignDualStackOffsets:        AlignDualStackOffsets,
+		tracer:                       otel.Tracer(tracerName),
+		managedNamespaces:            ManagedNamespaces,
+		excludedNamespaces:           ExcludedNamespaces,
+	}
+	if ConfigMapFailureThreshold > 0 {
+		k.configMapBackoff = newConfigMapBackoff(clock.RealClock{}, ConfigMapFailureThreshold, ConfigMapMaxBackoff)
+	}
+	if ReleaseGracePeriod > 0 {
+		k.releasedAddresses = newReleasedAddresses(clock.RealClock{}, ReleaseGracePeriod)
+	}
+	if len(DefaultIPFamilyPolicy) != 0 {
+		policy := v1.IPFamilyPolicy(DefaultIPFamilyPolicy)
+		k.defaultIPFamilyPolicy = &policy
+	}
+	if EnableDNSExclusions {
+		k.dnsExclusions = NewDNSExclusions(net.DefaultResolver, DNSExclusionDomain, DNSExclusionMaxLookups)
+	}
+	if len(ExternalReservationsEndpoint) != 0 {
+		k.externalReservations = NewHTTPReservations(ExternalReservationsEndpoint)
 	}
 	return k
 }
 
-func (k *kubevipLoadBalancerManager) EnsureLoadBalancer(ctx context.Context, _ string, service *v1.Service, _ []*v1.Node) (lbs *v1.LoadBalancerStatus, err error) {
-	return syncLoadBalancer(ctx, k.kubeClient, service, k.cloudConfigMap, k.namespace)
+func (k *kubevipLoadBalancerManager) EnsureLoadBalancer(ctx context.Context, _ string, service *v1.Service, nodes []*v1.Node) (lbs *v1.LoadBalancerStatus, err error) {
+	return k.syncLoadBalancer(ctx, service, nodes)
 }
 
-func (k *kubevipLoadBalancerManager) UpdateLoadBalancer(ctx context.Context, _ string, service *v1.Service, _ []*v1.Node) (err error) {
-	_, err = syncLoadBalancer(ctx, k.kubeClient, service, k.cloudConfigMap, k.namespace)
+func (k *kubevipLoadBalancerManager) UpdateLoadBalancer(ctx context.Context, _ string, service *v1.Service, nodes []*v1.Node) (err error) {
+	_, err = k.syncLoadBalancer(ctx, service, nodes)
 	return err
 }
 
@@ -60,7 +259,7 @@ func (k *kubevipLoadBalancerManager) EnsureLoadBalancerDeleted(ctx context.Conte
 }
 
 func (k *kubevipLoadBalancerManager) GetLoadBalancer(_ context.Context, _ string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
-	if service.Labels[ImplementationLabelKey] == ImplementationLabelValue {
+	if service.Labels[ImplementationLabel] == ImplementationValue {
 		return &service.Status.LoadBalancer, true, nil
 	}
 	return nil, false, nil
@@ -76,333 +275,2068 @@ func getDefaultLoadBalancerName(service *v1.Service) string {
 	return cloudprovider.DefaultLoadBalancerName(service)
 }
 
-func (k *kubevipLoadBalancerManager) deleteLoadBalancer(_ context.Context, service *v1.Service) error {
-	klog.Infof("deleting service '%s' (%s)", service.Name, service.UID)
+func (k *kubevipLoadBalancerManager) deleteLoadBalancer(ctx context.Context, service *v1.Service) error {
+	klog.InfoS("Deleting service", "service", klog.KObj(service), "uid", service.UID)
+	k.setReportedIPConflict(types.NamespacedName{Namespace: service.Namespace, Name: service.Name}, "")
+
+	// The ledger is cleared even if the label was removed, the addresses are recorded by the UID of the service
+	if k.allocationLedger {
+		if err := k.releaseAllocation(ctx, service); err != nil {
+			return fmt.Errorf("unable to release the addresses of service '%s/%s' from the allocation ledger: %v", service.Namespace, service.Name, err)
+		}
+	}
+
+	// Only release addresses of services that were implemented by kube-vip, the addresses of a service managed out of
+	// band are left to its owner
+	if service.Labels[ImplementationLabel] != ImplementationValue || service.Annotations[SkipManagementAnnotation] == "true" {
+		klog.InfoS("Service is not implemented by kube-vip, nothing to release", "service", klog.KObj(service))
+		return nil
+	}
+
+	addresses := service.Annotations[IPsAnnotation]
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	// In-use addresses are gathered from the annotations of the existing services. A service that is no longer
+	// a load balancer still exists, its annotation and label are removed so the address(es) are free again.
+	if err := k.clearServiceAddresses(ctx, service); err != nil {
+		return fmt.Errorf("unable to clear the address(es) of service '%s/%s': %v", service.Namespace, service.Name, err)
+	}
+	klog.InfoS("Releasing address(es) of service", "service", klog.KObj(service), "address", addresses)
+	if k.releasedAddresses != nil {
+		k.releasedAddresses.release(getServiceAddresses(service))
+	}
+	k.recordEventf(service, v1.EventTypeNormal, IPReleasedReason, "Released address(es) [%s]", addresses)
 
 	return nil
 }
 
+// clearServiceAddresses removes the IPsAnnotation, the AllocationSourceAnnotation, the LoadbalancerGatewayAnnotation
+// and the implementation label from the service, a service that was deleted in the meantime is left alone
+func (k *kubevipLoadBalancerManager) clearServiceAddresses(ctx context.Context, service *v1.Service) error {
+	return retry.RetryOnConflict(k.updateRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(getErr) {
+			return nil
+		}
+		if getErr != nil {
+			return getErr
+		}
+		_, labeled := recentService.Labels[ImplementationLabel]
+		_, annotated := recentService.Annotations[IPsAnnotation]
+		if !labeled && !annotated {
+			return nil
+		}
+		delete(recentService.Annotations, IPsAnnotation)
+		delete(recentService.Annotations, AllocationSourceAnnotation)
+		delete(recentService.Annotations, LoadbalancerGatewayAnnotation)
+		delete(recentService.Labels, ImplementationLabel)
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+}
+
 // syncLoadBalancer
 // 1. Is this loadBalancer already created, and does it have an address? return status
 // 2. Is this a new loadBalancer (with no IP address)
 // 2a. Get all existing kube-vip services
 // 2b. Get the network configuration for this service (namespace) / (CIDR/Range)
 // 2c. Between the two find a free address
+// The nodes are the ones the service controller passes to the load balancer, nil if the service is synced
+// without them
 
-func syncLoadBalancer(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, cmName, cmNamespace string) (*v1.LoadBalancerStatus, error) {
+func (k *kubevipLoadBalancerManager) syncLoadBalancer(ctx context.Context, service *v1.Service, nodes []*v1.Node) (_ *v1.LoadBalancerStatus, err error) {
 	// This function reconciles the load balancer state
-	klog.Infof("syncing service '%s' (%s)", service.Name, service.UID)
+	klog.InfoS("Syncing service", "service", klog.KObj(service), "uid", service.UID)
+
+	ctx, span := k.tracer.Start(ctx, "syncLoadBalancer", trace.WithAttributes(
+		namespaceAttribute.String(service.Namespace), serviceAttribute.String(service.Name)))
+	start := time.Now()
+	result := syncResultAllocated
+	defer func() {
+		if err != nil {
+			result = syncResultError
+		}
+		observeSyncDuration(result, start)
+		endSpan(span, result, err)
+	}()
+
+	// The service is managed out of band, leave its labels and annotations alone. As the service won't
+	// carry the implementation label its addresses are not gathered as in-use by the label selector
+	// below, they have to be excluded from the pool to make sure they are never allocated again.
+	if service.Annotations[SkipManagementAnnotation] == "true" {
+		klog.InfoS("Skipping service managed out of band", "service", klog.KObj(service), "annotation", SkipManagementAnnotation)
+		result = syncResultSkipped
+		return &service.Status.LoadBalancer, nil
+	}
+
+	// The service is provisioned by another load balancer implementation
+	if class := service.Spec.LoadBalancerClass; class != nil && len(*class) != 0 && *class != k.loadBalancerClass {
+		klog.InfoS("Skipping service of another loadBalancerClass", "service", klog.KObj(service), "loadBalancerClass", *class)
+		result = syncResultSkipped
+		return &service.Status.LoadBalancer, nil
+	}
+
+	// The namespace of the service isn't managed, the service is never labeled
+	if !k.namespaceManaged(service.Namespace) {
+		klog.InfoS("Skipping service of an unmanaged namespace", "service", klog.KObj(service))
+		result = syncResultSkipped
+		return &service.Status.LoadBalancer, nil
+	}
+
+	// The address(es) of the service are only ever set manually, it is never moved to another address either
+	manual := service.Annotations[ManualAssignmentRequiredAnnotation] == "true"
+
+	// The service is moved off its current address(es), which are kept in use until the new address(es) are allocated
+	reallocate := service.Annotations[ReallocateAnnotation] == "true" && !manual
+	var previousIPs string
+	if reallocate {
+		previousIPs = service.Annotations[IPsAnnotation]
+		if len(previousIPs) == 0 {
+			previousIPs = service.Spec.LoadBalancerIP
+		}
+		klog.InfoS("Reallocating the address(es) of the service", "service", klog.KObj(service), "annotation", ReallocateAnnotation, "address", previousIPs)
+	}
+
+	// The pool was reconfigured since the address(es) were allocated, the service is moved back into its pool
+	if !reallocate && !manual && k.reallocateOutOfPool {
+		current := service.Annotations[IPsAnnotation]
+		if len(current) == 0 {
+			current = service.Spec.LoadBalancerIP
+		}
+		if len(current) != 0 {
+			outside, err := k.outOfPoolAddresses(ctx, service, current, nodes)
+			if err != nil {
+				klog.ErrorS(err, "Unable to check that the address(es) of the service are part of its pool", "service", klog.KObj(service), "address", current)
+			} else if len(outside) != 0 {
+				klog.InfoS("Reallocating the address(es) of the service that are no longer part of its pool", "service", klog.KObj(service), "address", current, "outside", outside)
+				k.recordEventf(service, v1.EventTypeNormal, IPOutOfPoolReason, "Address(es) %v are no longer part of the pool, reallocating", outside)
+				reallocate = true
+				previousIPs = current
+			}
+		}
+	}
+
+	// spec.loadBalancerIP and the annotation disagree, only the winner is kept
+	conflict := !reallocate && k.loadBalancerIPConflict(service)
 
 	// The loadBalancer address has already been populated
-	if service.Spec.LoadBalancerIP != "" {
-		if v, ok := service.Annotations[LoadbalancerIPsAnnotations]; !ok || len(v) == 0 {
-			klog.Warningf("service.Spec.LoadBalancerIP is defined but annotations '%s' is not, assume it's a legacy service, updates its annotations", LoadbalancerIPsAnnotations)
+	if service.Spec.LoadBalancerIP != "" && !reallocate && (!conflict || k.loadBalancerIPConflictWinner == LoadBalancerIPConflictSpec) {
+		result = syncResultExisting
+		if v, ok := service.Annotations[IPsAnnotation]; !ok || len(v) == 0 || conflict {
+			klog.InfoS("service.Spec.LoadBalancerIP is defined but the annotation is not or disagrees, assume it's a legacy service, updating its annotations",
+				"service", klog.KObj(service), "annotation", IPsAnnotation, "address", service.Spec.LoadBalancerIP)
 			// assume it's legacy service, need to update the annotation.
-			err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-				recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+			err := retry.RetryOnConflict(k.updateRetry, func() error {
+				recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
 				if getErr != nil {
 					return getErr
 				}
+				_, hasLegacyLabel := recentService.Labels[LegacyIpamAddressLabelKey]
+				if recentService.Annotations[IPsAnnotation] == service.Spec.LoadBalancerIP && !hasLegacyLabel {
+					// Updated since the service was queued, skip the write
+					return nil
+				}
 				if recentService.Annotations == nil {
 					recentService.Annotations = make(map[string]string)
 				}
-				recentService.Annotations[LoadbalancerIPsAnnotations] = service.Spec.LoadBalancerIP
+				recentService.Annotations[IPsAnnotation] = service.Spec.LoadBalancerIP
 				// remove ipam-address label
 				delete(recentService.Labels, LegacyIpamAddressLabelKey)
 
 				// Update the actual service with the annotations
-				_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+				_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
 				return updateErr
 			})
 			if err != nil {
 				return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, err)
 			}
 		}
-		return &service.Status.LoadBalancer, nil
+		return k.loadBalancerStatus(service, service.Spec.LoadBalancerIP), nil
 	}
 
-	if v, ok := service.Annotations[LoadbalancerIPsAnnotations]; ok && len(v) != 0 {
-		klog.Infof("service '%s/%s' annotations '%s' is defined but service.Spec.LoadBalancerIP is not. Assume it's not legacy service", service.Namespace, service.Name, LoadbalancerIPsAnnotations)
+	if v, ok := service.Annotations[IPsAnnotation]; ok && len(v) != 0 && !reallocate {
+		klog.InfoS("Annotation is defined but service.Spec.LoadBalancerIP is not, assume it's not a legacy service",
+			"service", klog.KObj(service), "annotation", IPsAnnotation, "address", v)
+		// Every address of a pre-defined annotation must be valid, an invalid one would be skipped as in-use
+		if _, err := parseAddresses(v); err != nil {
+			k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Invalid address(es) [%s] in annotation %s: %v", v, IPsAnnotation, err)
+			return nil, fmt.Errorf("invalid value [%s] for annotation '%s' of service '%s/%s': %v", v, IPsAnnotation, service.Namespace, service.Name, err)
+		}
+		result = syncResultExisting
 		// Set Label for service lookups
-		if service.Labels == nil || service.Labels[ImplementationLabelKey] != ImplementationLabelValue {
-			klog.Infof("service '%s/%s' created with pre-defined ip '%s'", service.Namespace, service.Name, v)
-			err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-				recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if service.Labels == nil || service.Labels[ImplementationLabel] != ImplementationValue {
+			klog.InfoS("Service created with pre-defined address", "service", klog.KObj(service), "address", v)
+			err := retry.RetryOnConflict(k.updateRetry, func() error {
+				recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
 				if getErr != nil {
 					return getErr
 				}
+				if recentService.Labels[ImplementationLabel] == ImplementationValue {
+					// Labeled since the service was queued, skip the write
+					return nil
+				}
 				if recentService.Labels == nil {
 					// Just because ..
 					recentService.Labels = make(map[string]string)
 				}
-				recentService.Labels[ImplementationLabelKey] = ImplementationLabelValue
+				recentService.Labels[ImplementationLabel] = ImplementationValue
 				// Update the actual service with the annotations
-				_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+				_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
 				return updateErr
 			})
 			if err != nil {
 				return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, err)
 			}
 		}
-		return &service.Status.LoadBalancer, nil
-	}
-
-	// Get the clound controller configuration map
-	controllerCM, err := getConfigMap(ctx, kubeClient, cmName, cmNamespace)
-	if err != nil {
-		klog.Errorf("Unable to retrieve kube-vip ipam config from configMap [%s] in %s", cmName, cmNamespace)
-		// TODO - determine best course of action, create one if it doesn't exist
-		controllerCM, err = createConfigMap(ctx, kubeClient, cmName, cmNamespace)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	// Get ip pool from configmap and determine if it is namespace specific or global
-	pool, global, err := discoverPool(controllerCM, service.Namespace, cmName)
-	if err != nil {
-		return nil, err
+		return k.loadBalancerStatus(service, v), nil
 	}
 
-	// Get all services in this namespace or globally, that have the correct label
-	var svcs *v1.ServiceList
-	if global {
-		svcs, err = kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
-		if err != nil {
-			return &service.Status.LoadBalancer, err
-		}
-	} else {
-		svcs, err = kubeClient.CoreV1().Services(service.Namespace).List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
-		if err != nil {
-			return &service.Status.LoadBalancer, err
-		}
+	// The service stays pending until an operator sets its address(es), the event is recorded on every sync so
+	// the service keeps showing up as waiting
+	if manual {
+		klog.InfoS("Waiting for the address of the service to be set manually", "service", klog.KObj(service), "annotation", ManualAssignmentRequiredAnnotation)
+		k.recordEventf(service, v1.EventTypeNormal, ManualAssignmentRequiredReason, "Waiting for an address to be set with the %s annotation", IPsAnnotation)
+		result = syncResultSkipped
+		return &service.Status.LoadBalancer, nil
 	}
 
-	builder := &netipx.IPSetBuilder{}
-	for x := range svcs.Items {
-		if ip, ok := svcs.Items[x].Annotations[LoadbalancerIPsAnnotations]; ok {
-			addr, err := netip.ParseAddr(ip)
-			if err != nil {
-				return nil, err
-			}
-			builder.Add(addr)
-		}
-	}
-	inUseSet, err := builder.IPSet()
-	if err != nil {
-		return nil, err
+	// Without a node to host the address(es) the service would look ready while nothing advertises them
+	if k.requireReadyNodes && !hasReadyNode(nodes) {
+		k.recordEventf(service, v1.EventTypeWarning, NoReadyNodesReason, "No ready node can host the load balancer, deferring the allocation")
+		return nil, fmt.Errorf("no ready node can host the load balancer of service '%s/%s', deferring the allocation", service.Namespace, service.Name)
 	}
 
-	descOrder := getSearchOrder(controllerCM)
-
-	// If the LoadBalancer address is empty, then do a local IPAM lookup
-	loadBalancerIPs, err := discoverVIPs(service.Namespace, pool, inUseSet, descOrder, service.Spec.IPFamilyPolicy, service.Spec.IPFamilies)
+	loadBalancerIPs, pool, err := k.allocateAddresses(ctx, service, nodes)
 	if err != nil {
+		// The pool might have free addresses again once a service is deleted, retry the service
+		// after a fixed delay instead of the growing backoff of the controller
+		var outOfIPs *ipam.OutOfIPsError
+		if errors.As(err, &outOfIPs) && k.outOfIPsRetry > 0 {
+			return nil, newRetryableError(err, k.outOfIPsRetry)
+		}
 		return nil, err
 	}
 
 	// Update the services with this new address
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		recentService, getErr := kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	retryErr := retry.RetryOnConflict(k.updateRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
 		if getErr != nil {
 			return getErr
 		}
 
-		klog.Infof("Updating service [%s], with load balancer IPAM address(es) [%s]", service.Name, loadBalancerIPs)
+		// Another replica or a concurrent sync could have assigned the address(es) since the in-use addresses were
+		// gathered, allocate again from the current state until the address(es) are still free
+		for attempt := 0; k.verifyAllocation; attempt++ {
+			taken, err := k.addressesTaken(ctx, service, pool, loadBalancerIPs)
+			if err != nil {
+				return err
+			}
+			if len(taken) == 0 {
+				break
+			}
+			if attempt == maxAllocationVerifyAttempts {
+				return fmt.Errorf("address(es) %v were still assigned to another service after %d allocation attempts", taken, attempt+1)
+			}
+			klog.InfoS("Address(es) were assigned to another service concurrently, allocating again", "service", klog.KObj(service), "pool", pool.key, "taken", taken)
+			if loadBalancerIPs, pool, err = k.allocateAddresses(ctx, service, nodes); err != nil {
+				return err
+			}
+		}
+
+		klog.InfoS("Updating service with load balancer IPAM address(es)", "service", klog.KObj(service), "pool", pool.key, "address", loadBalancerIPs)
 
 		if recentService.Labels == nil {
 			// Just because ..
 			recentService.Labels = make(map[string]string)
 		}
 		// Set Label for service lookups
-		recentService.Labels[ImplementationLabelKey] = ImplementationLabelValue
+		recentService.Labels[ImplementationLabel] = ImplementationValue
 
 		if recentService.Annotations == nil {
 			recentService.Annotations = make(map[string]string)
 		}
 		// use annotation instead of label to support ipv6
-		recentService.Annotations[LoadbalancerIPsAnnotations] = loadBalancerIPs
+		recentService.Annotations[IPsAnnotation] = loadBalancerIPs
+		recentService.Annotations[AllocationSourceAnnotation] = fmt.Sprintf("pool:%s", pool.key)
+		if gateway := pool.gatewayOf(loadBalancerIPs); len(gateway) != 0 {
+			recentService.Annotations[LoadbalancerGatewayAnnotation] = gateway
+		} else {
+			delete(recentService.Annotations, LoadbalancerGatewayAnnotation)
+		}
+
+		delete(recentService.Annotations, ReallocateAnnotation)
+
+		// A single stack service without IP families is given the family of the address(es) allocated to it
+		policy := k.ipFamilyPolicy(recentService)
+		if k.writeIPFamilies && len(recentService.Spec.IPFamilies) == 0 && !isDHCPPool(pool.addresses) &&
+			(policy == nil || *policy == v1.IPFamilyPolicySingleStack) {
+			if addr, err := netip.ParseAddr(strings.Split(loadBalancerIPs, ",")[0]); err == nil {
+				family := v1.IPv4Protocol
+				if addr.Is6() {
+					family = v1.IPv6Protocol
+				}
+				recentService.Spec.IPFamilies = []v1.IPFamily{family}
+			}
+		}
 
 		// this line will be removed once kube-vip can recognize annotations
 		// Set IPAM address to Load Balancer Service
-		recentService.Spec.LoadBalancerIP = strings.Split(loadBalancerIPs, ",")[0]
+		if k.writeLegacyLoadBalancerIP {
+			recentService.Spec.LoadBalancerIP = strings.Split(loadBalancerIPs, ",")[0]
+		} else if reallocate {
+			// The previous address is no longer the address of the service
+			recentService.Spec.LoadBalancerIP = ""
+		}
 
 		// Update the actual service with the address and the labels
-		_, updateErr := kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
 		return updateErr
 	})
 	if retryErr != nil {
 		return nil, fmt.Errorf("error updating Service Spec [%s] : %v", service.Name, retryErr)
 	}
 
-	return &service.Status.LoadBalancer, nil
+	if k.allocationLedger && reallocate {
+		// The previous address(es) of the service are released
+		if err := k.releaseAllocation(ctx, service); err != nil {
+			klog.ErrorS(err, "Unable to release the previous allocation in the ledger", "service", klog.KObj(service), "address", previousIPs)
+		}
+	}
+	if k.allocationLedger && !isDHCPPool(pool.addresses) {
+		// The service already holds the address(es), a failure only loses the protection of the ledger
+		addrs, err := parseAddresses(loadBalancerIPs)
+		if err == nil {
+			err = k.recordAllocation(ctx, service, addrs)
+		}
+		if err != nil {
+			klog.ErrorS(err, "Unable to record the allocation in the ledger", "service", klog.KObj(service), "address", loadBalancerIPs)
+		}
+	}
+	if k.addressAffinity && !isDHCPPool(pool.addresses) {
+		// A failure only loses the previous address if the service is created again
+		if err := k.recordAffinity(ctx, service, loadBalancerIPs); err != nil {
+			klog.ErrorS(err, "Unable to record the address of the service for affinity", "service", klog.KObj(service), "address", loadBalancerIPs)
+		}
+	}
+
+	if reallocate {
+		k.recordEventf(service, v1.EventTypeNormal, IPAllocatedReason, "Reallocated address(es) [%s] from pool [%s], replacing [%s]", loadBalancerIPs, pool.key, previousIPs)
+	} else {
+		k.recordEventf(service, v1.EventTypeNormal, IPAllocatedReason, "Allocated address(es) [%s] from pool [%s]", loadBalancerIPs, pool.key)
+	}
+
+	return k.loadBalancerStatus(service, loadBalancerIPs), nil
 }
 
-func discoverPool(cm *v1.ConfigMap, namespace, configMapName string) (pool string, global bool, err error) {
-	var cidr, ipRange string
-	var ok bool
+// namespaceManaged returns true if the services of the namespace are managed, the namespace must be one of the
+// managedNamespaces, if set, and none of the excludedNamespaces
+func (k *kubevipLoadBalancerManager) namespaceManaged(namespace string) bool {
+	if len(k.managedNamespaces) != 0 && !slices.Contains(k.managedNamespaces, namespace) {
+		return false
+	}
+	return !slices.Contains(k.excludedNamespaces, namespace)
+}
 
-	// Find Cidr
-	cidrKey := fmt.Sprintf("cidr-%s", namespace)
-	// Lookup current namespace
-	if cidr, ok = cm.Data[cidrKey]; !ok {
-		klog.Info(fmt.Errorf("no cidr config for namespace [%s] exists in key [%s] configmap [%s]", namespace, cidrKey, configMapName))
-		// Lookup global cidr configmap data
-		if cidr, ok = cm.Data["cidr-global"]; !ok {
-			klog.Info(fmt.Errorf("no global cidr config exists [cidr-global]"))
-		} else {
-			klog.Infof("Taking address from [cidr-global] pool")
-			return cidr, true, nil
-		}
-	} else {
-		klog.Infof("Taking address from [%s] pool", cidrKey)
-		return cidr, false, nil
+// ipFamilyPolicy returns the IP family policy the address(es) of the service are allocated with, spec.ipFamilyPolicy
+// if set and the defaultIPFamilyPolicy otherwise
+func (k *kubevipLoadBalancerManager) ipFamilyPolicy(service *v1.Service) *v1.IPFamilyPolicy {
+	if service.Spec.IPFamilyPolicy != nil {
+		return service.Spec.IPFamilyPolicy
 	}
+	return k.defaultIPFamilyPolicy
+}
 
-	// Find Range
-	rangeKey := fmt.Sprintf("range-%s", namespace)
-	// Lookup current namespace
-	if ipRange, ok = cm.Data[rangeKey]; !ok {
-		klog.Info(fmt.Errorf("no range config for namespace [%s] exists in key [%s] configmap [%s]", namespace, rangeKey, configMapName))
-		// Lookup global range configmap data
-		if ipRange, ok = cm.Data["range-global"]; !ok {
-			klog.Info(fmt.Errorf("no global range config exists [range-global]"))
-		} else {
-			klog.Infof("Taking address from [range-global] pool")
-			return ipRange, true, nil
+// withDefaultIPFamilyPolicy returns the service, or a copy of it with the defaultIPFamilyPolicy if it has no
+// spec.ipFamilyPolicy. The policy of the copy is never written back to the service.
+func (k *kubevipLoadBalancerManager) withDefaultIPFamilyPolicy(service *v1.Service) *v1.Service {
+	if service.Spec.IPFamilyPolicy != nil || k.defaultIPFamilyPolicy == nil {
+		return service
+	}
+	defaulted := service.DeepCopy()
+	defaulted.Spec.IPFamilyPolicy = k.defaultIPFamilyPolicy
+	return defaulted
+}
+
+// loadBalancerIPConflict returns true if spec.loadBalancerIP and the IPsAnnotation of the service disagree, i.e.
+// spec.loadBalancerIP isn't one of the address(es) of the annotation. With writeLegacyLoadBalancerIP the spec holds the
+// first address of a dual-stack service, which is no conflict. The conflict is seen again on every sync until it is
+// resolved, a warning is only logged and recorded when it is first seen.
+func (k *kubevipLoadBalancerManager) loadBalancerIPConflict(service *v1.Service) bool {
+	key := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+	spec := service.Spec.LoadBalancerIP
+	annotation := service.Annotations[IPsAnnotation]
+	if len(spec) == 0 || len(annotation) == 0 {
+		k.setReportedIPConflict(key, "")
+		return false
+	}
+	specAddr, err := netip.ParseAddr(spec)
+	if err == nil {
+		for _, addr := range getServiceAddresses(service) {
+			if addr == specAddr.Unmap() {
+				k.setReportedIPConflict(key, "")
+				return false
+			}
 		}
-	} else {
-		klog.Infof("Taking address from [%s] pool", rangeKey)
-		return ipRange, false, nil
 	}
+	if !k.setReportedIPConflict(key, spec+"/"+annotation) {
+		klog.V(4).InfoS("spec.loadBalancerIP still isn't one of the address(es) of the annotation", "service", klog.KObj(service),
+			"loadBalancerIP", spec, "annotation", IPsAnnotation, "address", annotation, "keeping", k.loadBalancerIPConflictWinner)
+		return true
+	}
+	klog.InfoS("spec.loadBalancerIP isn't one of the address(es) of the annotation", "service", klog.KObj(service),
+		"loadBalancerIP", spec, "annotation", IPsAnnotation, "address", annotation, "keeping", k.loadBalancerIPConflictWinner)
+	k.recordEventf(service, v1.EventTypeWarning, LoadBalancerIPConflictReason, "spec.loadBalancerIP [%s] isn't one of the address(es) [%s] of the annotation, keeping the %s",
+		spec, annotation, k.loadBalancerIPConflictWinner)
+	return true
+}
 
-	return "", false, fmt.Errorf("no address pools could be found")
+// setReportedIPConflict records the conflict of the service, empty once it is resolved, and returns true if it
+// wasn't reported yet
+func (k *kubevipLoadBalancerManager) setReportedIPConflict(key types.NamespacedName, conflict string) bool {
+	k.reportedIPConflictsMu.Lock()
+	defer k.reportedIPConflictsMu.Unlock()
+	if len(conflict) == 0 {
+		delete(k.reportedIPConflicts, key)
+		return false
+	}
+	if k.reportedIPConflicts[key] == conflict {
+		return false
+	}
+	if k.reportedIPConflicts == nil {
+		k.reportedIPConflicts = map[types.NamespacedName]string{}
+	}
+	k.reportedIPConflicts[key] = conflict
+	return true
 }
 
-func discoverVIPs(
-	namespace, pool string, inUseIPSet *netipx.IPSet, descOrder bool,
-	ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily,
-) (vips string, err error) {
-	var ipv4Pool, ipv6Pool string
+// loadBalancerStatus returns the load balancer status of the service. If populateIngress is set, the status lists an
+// ingress entry for each of the addresses, the pool they were allocated from is recorded by the
+// AllocationSourceAnnotation. Otherwise, or for the DHCP address only kube-vip knows, the status is left to kube-vip.
+func (k *kubevipLoadBalancerManager) loadBalancerStatus(service *v1.Service, addresses string) *v1.LoadBalancerStatus {
+	if !k.populateIngress {
+		return &service.Status.LoadBalancer
+	}
+	addrs, err := parseAddresses(addresses)
+	if err != nil || len(addrs) == 0 {
+		return &service.Status.LoadBalancer
+	}
+	status := &v1.LoadBalancerStatus{}
+	for _, addr := range addrs {
+		if addr.IsUnspecified() {
+			return &service.Status.LoadBalancer
+		}
+		status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{IP: addr.String()})
+	}
+	return status
+}
 
-	// Check if DHCP is required
-	if pool == "0.0.0.0/32" {
-		return "0.0.0.0", nil
-		// Check if ip pool contains a cidr, if not assume it is a range
-	} else if len(pool) == 0 {
-		return "", fmt.Errorf("could not discover address: pool is not specified")
-	} else if strings.Contains(pool, "/") {
-		ipv4Pool, ipv6Pool, err = ipam.SplitCIDRsByIPFamily(pool)
-	} else {
-		ipv4Pool, ipv6Pool, err = ipam.SplitRangesByIPFamily(pool)
+// PlanLoadBalancer returns the address(es) the service would be allocated by syncLoadBalancer without
+// updating the service, so that tooling can preview allocations. Addresses in use by the existing
+// kube-vip services are skipped, but planned addresses are not reserved: planning several services
+// reports the same free address until one of them has actually been allocated.
+func PlanLoadBalancer(ctx context.Context, kubeClient kubernetes.Interface, service *v1.Service, cmName, cmNamespace string) (string, error) {
+	if service.Annotations[SkipManagementAnnotation] == "true" {
+		return "", nil
 	}
-	if err != nil {
-		return "", err
+	// The address(es) of the service are already populated and are kept as is
+	if v := service.Annotations[IPsAnnotation]; len(v) != 0 {
+		return v, nil
+	}
+	if service.Spec.LoadBalancerIP != "" {
+		return service.Spec.LoadBalancerIP, nil
 	}
 
-	vipBuilder := strings.Builder{}
+	k := newLoadBalancer(kubeClient, cmNamespace, cmName, nil)
+	// A plan never creates the configmap
+	k.autoCreateConfigMap = false
+	loadBalancerIPs, _, err := k.allocateAddresses(ctx, service, nil)
+	return loadBalancerIPs, err
+}
 
-	// Handle single stack case
-	if ipFamilyPolicy == nil || *ipFamilyPolicy == v1.IPFamilyPolicySingleStack {
-		ipPool := ipv4Pool
-		if len(ipFamilies) == 0 {
-			if len(ipv4Pool) == 0 {
-				ipPool = ipv6Pool
+// AllocatedIP is an address allocated to a service implemented by kube-vip
+type AllocatedIP struct {
+	// Address is the allocated address
+	Address netip.Addr
+	// Family is the IP family of the address
+	Family v1.IPFamily
+	// ServiceName is the name of the service the address is allocated to
+	ServiceName string
+	// ServiceNamespace is the namespace of the service the address is allocated to
+	ServiceNamespace string
+}
+
+// ListAllocatedIPs returns the addresses allocated to the services implemented by kube-vip in the namespace,
+// or in all namespaces if global is true, the same way they are gathered as in-use when allocating addresses
+func ListAllocatedIPs(ctx context.Context, kubeClient kubernetes.Interface, namespace string, global bool) ([]AllocatedIP, error) {
+	svcs, err := listKubevipServices(ctx, kubeClient, namespace, global)
+	if err != nil {
+		return nil, err
+	}
+
+	var allocated []AllocatedIP
+	for x := range svcs.Items {
+		addrs := getServiceAddresses(&svcs.Items[x])
+		for _, addr := range addrs {
+			family := v1.IPv4Protocol
+			if addr.Is6() {
+				family = v1.IPv6Protocol
 			}
-		} else if ipFamilies[0] == v1.IPv6Protocol {
-			ipPool = ipv6Pool
+			allocated = append(allocated, AllocatedIP{
+				Address:          addr,
+				Family:           family,
+				ServiceName:      svcs.Items[x].Name,
+				ServiceNamespace: svcs.Items[x].Namespace,
+			})
 		}
-		if len(ipPool) == 0 {
-			return "", fmt.Errorf("could not find suitable pool for the IP family of the service")
+	}
+	return allocated, nil
+}
+
+// listKubevipServices returns the services implemented by kube-vip in the namespace, or in all namespaces if global is true
+func listKubevipServices(ctx context.Context, kubeClient kubernetes.Interface, namespace string, global bool) (*v1.ServiceList, error) {
+	if global {
+		namespace = ""
+	}
+	return kubeClient.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{LabelSelector: getKubevipImplementationLabel()})
+}
+
+// getServiceAddresses parses the comma separated addresses of the IPsAnnotation of the service.
+// Malformed addresses, i.e. from a manual edit, are logged and skipped, so that a single service can't block
+// the allocation of addresses for every other service sharing its pool.
+func getServiceAddresses(service *v1.Service) []netip.Addr {
+	ips := service.Annotations[IPsAnnotation]
+	if len(ips) == 0 {
+		return nil
+	}
+	var addrs []netip.Addr
+	for _, ip := range splitAddresses(ips) {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			klog.ErrorS(err, "Ignoring invalid address in annotation", "service", klog.KObj(service), "annotation", IPsAnnotation, "address", ip)
+			continue
 		}
-		return discoverAddress(namespace, ipPool, inUseIPSet, descOrder)
+		// An IPv4-mapped IPv6 address is in use as the IPv4 address
+		addrs = append(addrs, addr.Unmap())
 	}
+	return addrs
+}
 
-	// Handle dual stack case
-	if *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack {
-		// With RequireDualStack, we want to make sure both pools with both IP
-		// families exist
-		if len(ipv4Pool) == 0 || len(ipv6Pool) == 0 {
-			return "", fmt.Errorf("service requires dual-stack, but the configuration does not have both IPv4 and IPv6 pools listed for the namespace")
+// splitAddresses splits a comma separated list of addresses, i.e. "10.0.0.1, 10.0.1.1, fd00::1" set by hand for a
+// multi-homed service, into its addresses without the surrounding spaces and the empty entries
+func splitAddresses(ips string) []string {
+	var split []string
+	for _, ip := range strings.Split(ips, ",") {
+		if ip = strings.TrimSpace(ip); len(ip) != 0 {
+			split = append(split, ip)
 		}
 	}
+	return split
+}
 
-	primaryPool := ipv4Pool
-	secondaryPool := ipv6Pool
-	if len(ipFamilies) > 0 && ipFamilies[0] == v1.IPv6Protocol {
-		primaryPool = ipv6Pool
-		secondaryPool = ipv4Pool
+// ValidateRequestedIPs checks that the addresses of an IPsAnnotation value are valid and part of
+// the pool, so that i.e. a validating webhook rejects the same addresses the controller would not allocate.
+// The pool is the comma separated list of cidrs or ranges of a pool of the configmap.
+func ValidateRequestedIPs(annotationValue string, pool string) error {
+	addrs, err := parseAddresses(annotationValue)
+	if err != nil {
+		return fmt.Errorf("invalid value [%s] for annotation '%s': %v", annotationValue, IPsAnnotation, err)
 	}
-	// Provide VIPs from both IP families if possible (guaranteed if RequireDualStack)
-	var primaryPoolErr, secondaryPoolErr error
-	if len(primaryPool) > 0 {
-		primaryVip, err := discoverAddress(namespace, primaryPool, inUseIPSet, descOrder)
-		if err == nil {
-			_, _ = vipBuilder.WriteString(primaryVip)
-		} else if _, outOfIPs := err.(*ipam.OutOfIPsError); outOfIPs {
-			primaryPoolErr = err
-		} else {
-			return "", err
+	if len(addrs) == 0 {
+		return fmt.Errorf("annotation '%s' has no addresses", IPsAnnotation)
+	}
+	// The options of the pool, like the step, only restrict the addresses the controller allocates itself
+	pool, _, _ = strings.Cut(pool, ";")
+	if isDHCPPool(pool) {
+		if annotationValue != "0.0.0.0" {
+			return fmt.Errorf("address(es) [%s] are not part of the DHCP pool [%s], only 0.0.0.0 is", annotationValue, pool)
 		}
+		return nil
 	}
-	if len(secondaryPool) > 0 {
-		secondaryVip, err := discoverAddress(namespace, secondaryPool, inUseIPSet, descOrder)
-		if err == nil {
-			if vipBuilder.Len() > 0 {
-				vipBuilder.WriteByte(',')
-			}
-			_, _ = vipBuilder.WriteString(secondaryVip)
-		} else if _, outOfIPs := err.(*ipam.OutOfIPsError); outOfIPs {
-			secondaryPoolErr = err
-		} else {
-			return "", err
+
+	poolIPSet, err := ipam.BuildPoolSet(pool)
+	if err != nil {
+		return fmt.Errorf("invalid pool [%s]: %v", pool, err)
+	}
+	for _, addr := range addrs {
+		if !poolIPSet.Contains(addr) {
+			return fmt.Errorf("address [%s] is not part of the pool [%s]", addr, pool)
 		}
 	}
-	if *ipFamilyPolicy == v1.IPFamilyPolicyPreferDualStack {
-		if primaryPoolErr != nil && secondaryPoolErr != nil {
-			return "", fmt.Errorf("could not allocate any IP address for PreferDualStack service: %s", renderErrors(primaryPoolErr, secondaryPoolErr))
+	return nil
+}
+
+// parseAddresses parses a comma separated list of addresses, as used in the IPsAnnotation. The spaces around
+// the addresses and empty entries are ignored. IPv4-mapped IPv6 addresses are returned as IPv4 addresses.
+func parseAddresses(ips string) ([]netip.Addr, error) {
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	var addrs []netip.Addr
+	for _, ip := range splitAddresses(ips) {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, err
 		}
-		singleError := primaryPoolErr
-		if secondaryPoolErr != nil {
-			singleError = secondaryPoolErr
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
+
+// allocateAddresses finds free address(es) for the service in its pool without updating the service, the nodes
+// select the zone pool if zonePools is set
+func (k *kubevipLoadBalancerManager) allocateAddresses(ctx context.Context, service *v1.Service, nodes []*v1.Node) (string, *ipPool, error) {
+	// The service defines its own pool
+	if _, ok := service.Annotations[LoadbalancerPoolCIDRAnnotation]; ok {
+		return k.allocateFromServicePool(ctx, service)
+	}
+
+	// Get the clound controller configuration map
+	controllerCM, err := k.getCloudConfigMap(ctx)
+	if err != nil {
+		// The failures of backed off reads were already logged
+		var backoffErr *configMapBackoffError
+		if !errors.As(err, &backoffErr) {
+			klog.ErrorS(err, "Unable to retrieve kube-vip ipam config", "service", klog.KObj(service), "configMap", klog.KRef(k.namespace, k.cloudConfigMap))
 		}
-		if singleError != nil {
-			klog.Warningf("PreferDualStack service will be single-stack because of error: %s", singleError)
+		// An empty configmap has no pools either, so only create it when asked to, otherwise a wrong
+		// name or namespace would be hidden behind a "no address pools could be found" error
+		if !apierrors.IsNotFound(err) || !k.autoCreateConfigMap {
+			recordAllocationFailure(allocationFailureNoPool)
+			err = fmt.Errorf("unable to retrieve kube-vip ipam config from configMap [%s] in namespace [%s]: %v", k.cloudConfigMap, k.namespace, err)
+			k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to find an address pool: %v", err)
+			return "", nil, err
 		}
-	} else if *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack {
-		if primaryPoolErr != nil || secondaryPoolErr != nil {
-			return "", fmt.Errorf("could not allocate required IP addresses for RequireDualStack service: %s", renderErrors(primaryPoolErr, secondaryPoolErr))
+		controllerCM, err = createConfigMap(ctx, k.kubeClient, k.cloudConfigMap, k.namespace)
+		if err != nil {
+			return "", nil, err
 		}
 	}
 
-	return vipBuilder.String(), nil
-}
+	// Address(es) reserved for the service are assigned directly, unless another service holds them
+	reserved, ok, err := k.reservedAddresses(ctx, service, controllerCM)
+	if err != nil {
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to assign reserved address: %v", err)
+		return "", nil, err
+	}
+	if ok {
+		return reserved, &ipPool{addresses: reserved, key: reservedKey(service), global: true}, nil
+	}
 
-func discoverAddress(namespace, pool string, inUseIPSet *netipx.IPSet, descOrder bool) (vip string, err error) {
-	// Check if DHCP is required
-	if pool == "0.0.0.0/32" {
-		vip = "0.0.0.0"
-		// Check if ip pool contains a cidr, if not assume it is a range
-	} else if strings.Contains(pool, "/") {
-		vip, err = ipam.FindAvailableHostFromCidr(namespace, pool, inUseIPSet, descOrder)
-		if err != nil {
-			return "", err
+	// Get ip pool(s) from configmap and determine if they are namespace specific or global
+	poolCtx, span := k.tracer.Start(ctx, "discoverPool", trace.WithAttributes(namespaceAttribute.String(service.Namespace)))
+	pools, err := k.servicePools(poolCtx, controllerCM, service, nodes)
+	span.SetAttributes(poolAttribute.String(poolKeys(pools)))
+	endSpan(span, "", err)
+	if err != nil {
+		recordAllocationFailure(allocationFailureNoPool)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to find an address pool: %v", err)
+		return "", nil, err
+	}
+
+	// The pools are tried in order, the next pool is only used once the previous one is out of addresses
+	for i, pool := range pools {
+		loadBalancerIPs, err := k.allocateFromPool(ctx, service, controllerCM, pool)
+		if err == nil {
+			return loadBalancerIPs, pool, nil
 		}
-	} else {
-		vip, err = ipam.FindAvailableHostFromRange(namespace, pool, inUseIPSet, descOrder)
-		if err != nil {
-			return "", err
+		var outOfIPs *ipam.OutOfIPsError
+		if !errors.As(err, &outOfIPs) {
+			return "", nil, err
 		}
+		if i < len(pools)-1 {
+			klog.InfoS("Pool is out of addresses, trying the next pool", "service", klog.KObj(service), "pool", pool.key, "next", pools[i+1].key)
+			continue
+		}
+		recordAllocationFailure(allocationFailureOutOfIPs)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		return "", nil, err
 	}
-
-	return vip, err
+	return "", nil, NewNoPoolError(service.Namespace, k.cloudConfigMap)
+}
+
+// gatherInUseAddresses returns the addresses of the pool that can't be allocated to a service of the
+// namespace: the addresses of the kube-vip services sharing the pool, the addresses recorded in the
+// allocation ledger or reserved by an external allocator, and the addresses excluded from the pool.
+// The services each address is assigned to are returned as well.
+func (k *kubevipLoadBalancerManager) gatherInUseAddresses(ctx context.Context, namespace string, pool *ipPool) (*netipx.IPSet, map[netip.Addr][]*v1.Service, error) {
+	// Get all services in this namespace or globally, that have the correct label. The services of
+	// all namespaces sharing the pool through aliases are listed and filtered by namespace.
+	svcs, err := listKubevipServices(ctx, k.kubeClient, namespace, pool.global || len(pool.namespaces) != 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !pool.global && len(pool.namespaces) != 0 {
+		svcs.Items = slices.DeleteFunc(svcs.Items, func(svc v1.Service) bool {
+			return !slices.Contains(pool.namespaces, svc.Namespace)
+		})
+	}
+	// Only the services of the managed namespaces hold addresses of the pools
+	svcs.Items = slices.DeleteFunc(svcs.Items, func(svc v1.Service) bool {
+		return !k.namespaceManaged(svc.Namespace)
+	})
+
+	builder := &netipx.IPSetBuilder{}
+	// owners keeps track of the services each address is assigned to, the parsed address is used
+	// as key so that different notations of the same address are detected as duplicates
+	owners := map[netip.Addr][]*v1.Service{}
+	for x := range svcs.Items {
+		addrs := getServiceAddresses(&svcs.Items[x])
+		for _, addr := range addrs {
+			builder.Add(addr)
+			owners[addr] = append(owners[addr], &svcs.Items[x])
+		}
+	}
+	// Addresses recorded in the ledger stay in use, even if the annotation of their service was removed
+	if k.allocationLedger {
+		ledgerAddrs, err := k.getLedgerAddresses(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read the allocation ledger: %v", err)
+		}
+		for _, addr := range ledgerAddrs {
+			builder.Add(addr)
+		}
+	}
+	// Addresses of deleted services are withheld for the grace period
+	if k.releasedAddresses != nil {
+		for _, addr := range k.releasedAddresses.withheld() {
+			builder.Add(addr)
+		}
+	}
+	// Addresses excluded from the pool are treated as if they were in use
+	if len(pool.excluded) != 0 {
+		excludedSet, err := ipam.BuildAddressSet(pool.excluded)
+		if err != nil {
+			recordAllocationFailure(allocationFailureInvalidConfig)
+			return nil, nil, fmt.Errorf("unable to parse excluded addresses of pool [%s]: %v", pool.key, err)
+		}
+		builder.AddSet(excludedSet)
+	}
+	// The addresses of the drain pool are only kept by the services holding them
+	if len(pool.drain) != 0 {
+		drainSet, err := ipam.BuildPoolSet(pool.drain)
+		if err != nil {
+			recordAllocationFailure(allocationFailureInvalidConfig)
+			return nil, nil, fmt.Errorf("unable to parse the drain pool of pool [%s]: %v", pool.key, err)
+		}
+		builder.AddSet(drainSet)
+	}
+	// Addresses reserved by another allocator sharing the subnet are never allocated
+	if k.externalReservations != nil && !isDHCPPool(pool.addresses) {
+		poolNamespace := namespace
+		if pool.global {
+			poolNamespace = ""
+		}
+		reservedSet, err := k.externalReservations.Reserved(ctx, pool.key, poolNamespace)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to get the external reservations of pool [%s]: %v", pool.key, err)
+		}
+		builder.AddSet(reservedSet)
+	}
+	if pool.excludeEndpoints {
+		endpointsSet, err := ipam.BuildRangeEndpointsSet(pool.addresses)
+		if err != nil {
+			recordAllocationFailure(allocationFailureInvalidConfig)
+			return nil, nil, fmt.Errorf("unable to parse the ranges of pool [%s]: %v", pool.key, err)
+		}
+		builder.AddSet(endpointsSet)
+	}
+	inUseSet, err := builder.IPSet()
+	if err != nil {
+		return nil, nil, err
+	}
+	return inUseSet, owners, nil
+}
+
+// allocateFromPool finds free address(es) for the service in the pool. Failures are recorded, except
+// an OutOfIPsError, also when aggregated for a dual-stack service, as the caller might still find
+// addresses in the next pool
+func (k *kubevipLoadBalancerManager) allocateFromPool(ctx context.Context, service *v1.Service, controllerCM *v1.ConfigMap, pool *ipPool) (string, error) {
+	service = k.withDefaultIPFamilyPolicy(service)
+	// A RequireDualStack service is refused before anything is gathered if the pool can't provide both families
+	if err := ValidateDualStackPool(pool.key, pool.addresses, service.Spec.IPFamilyPolicy); err != nil {
+		recordAllocationFailure(allocationFailureInvalidConfig)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		return "", err
+	}
+	inUseSet, owners, err := k.gatherInUseAddresses(ctx, service.Namespace, pool)
+	if err != nil {
+		return "", err
+	}
+	// The previous address(es) of a reallocated service are not allocated to it again, even if the
+	// service isn't labeled or only has the legacy spec.loadBalancerIP
+	if service.Annotations[ReallocateAnnotation] == "true" {
+		builder := &netipx.IPSetBuilder{}
+		builder.AddSet(inUseSet)
+		for _, addr := range getServiceAddresses(service) {
+			builder.Add(addr)
+		}
+		if addr, err := netip.ParseAddr(service.Spec.LoadBalancerIP); err == nil {
+			builder.Add(addr)
+		}
+		if inUseSet, err = builder.IPSet(); err != nil {
+			return "", err
+		}
+	}
+	if k.reportDuplicateAddresses(owners) && k.refuseDuplicateIPs {
+		recordAllocationFailure(allocationFailureDuplicateIPs)
+		err = fmt.Errorf("addresses of pool [%s] are assigned to more than one service, refusing to allocate until resolved", pool.key)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		return "", err
+	}
+
+	updatePoolMetrics(pool, service.Namespace, inUseSet)
+
+	opts := allocationOptions{
+		descOrder:       getSearchOrder(controllerCM, service, pool.searchOrder),
+		familyDescOrder: getFamilySearchOrders(controllerCM, service, pool.searchOrder),
+		step:            pool.step,
+		hostMin:         pool.hostMin,
+		hostMax:         pool.hostMax,
+		deterministic:   k.deterministic,
+		alignOffsets:    k.alignDualStackOffsets,
+	}
+
+	ipFamilies, err := getIPFamilyOrder(service, pool.addresses)
+	if err != nil {
+		recordAllocationFailure(allocationFailureInvalidConfig)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		return "", err
+	}
+
+	opts.cidr, err = getCIDRHint(service, pool.addresses)
+	if err != nil {
+		recordAllocationFailure(allocationFailureInvalidConfig)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		return "", err
+	}
+
+	opts.ipv6Scope, err = getIPv6Scope(service)
+	if err != nil {
+		recordAllocationFailure(allocationFailureInvalidConfig)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		return "", err
+	}
+
+	ipFamilyPolicy, err := applyMaxVIPsPerService(controllerCM, service)
+	if err != nil {
+		recordAllocationFailure(allocationFailureInvalidConfig)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		return "", err
+	}
+
+	opts.count, err = getIPCount(controllerCM, service, ipFamilyPolicy)
+	if err != nil {
+		recordAllocationFailure(allocationFailureInvalidConfig)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		return "", err
+	}
+
+	search := func(inUse *netipx.IPSet) (string, error) {
+		// The preferred address is taken if it is free, the pool is searched otherwise
+		if preferred, ok := k.preferredAddress(service, pool, inUse, ipFamilyPolicy, ipFamilies, opts.count); ok {
+			klog.InfoS("Allocating the preferred address", "service", klog.KObj(service), "address", preferred, "pool", pool.key)
+			return preferred, nil
+		}
+		// A service created again after it was deleted takes its previous address back if it is free
+		if previous, ok := k.affinityAddress(ctx, service, pool, inUse, ipFamilyPolicy, ipFamilies, opts.count); ok {
+			klog.InfoS("Allocating the previous address of the service", "service", klog.KObj(service), "address", previous, "pool", pool.key)
+			return previous, nil
+		}
+
+		// If the LoadBalancer address is empty, then do a local IPAM lookup
+		start := time.Now()
+		vipsCtx, span := k.tracer.Start(ctx, "discoverVIPs", trace.WithAttributes(namespaceAttribute.String(service.Namespace),
+			poolAttribute.String(pool.key), familyAttribute.String(familyNames(ipFamilies))))
+		loadBalancerIPs, err := discoverVIPs(vipsCtx, service.Namespace, pool.addresses, inUse, opts, ipFamilyPolicy, ipFamilies)
+		span.SetAttributes(addressesAttribute.String(loadBalancerIPs))
+		endSpan(span, "", err)
+		observeDiscoverDuration(err, start)
+		return loadBalancerIPs, err
+	}
+
+	var loadBalancerIPs string
+	if k.dnsExclusions != nil && !isDHCPPool(pool.addresses) {
+		// The address(es) found that resolve in DNS are assigned to hosts outside of the cluster, the pool is
+		// searched again without them
+		loadBalancerIPs, err = k.dnsExclusions.Search(ctx, pool.key, inUseSet, search)
+	} else {
+		loadBalancerIPs, err = search(inUseSet)
+	}
+	if err != nil {
+		// A search stopped by the cancelled context (i.e. on shutdown) isn't a failure of the pool
+		var outOfIPs *ipam.OutOfIPsError
+		if !errors.As(err, &outOfIPs) && ctx.Err() == nil {
+			recordAllocationFailure(allocationFailureReason(err))
+			k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		}
+		return "", err
+	}
+	return loadBalancerIPs, nil
+}
+
+// addressesTaken returns the addresses that are assigned to a service other than the given one, according to the
+// current state of the services sharing the pool
+func (k *kubevipLoadBalancerManager) addressesTaken(ctx context.Context, service *v1.Service, pool *ipPool, addresses string) ([]netip.Addr, error) {
+	// Every service takes the same DHCP address
+	if isDHCPPool(pool.addresses) {
+		return nil, nil
+	}
+	addrs, err := parseAddresses(addresses)
+	if err != nil {
+		return nil, err
+	}
+	_, owners, err := k.gatherInUseAddresses(ctx, service.Namespace, pool)
+	if err != nil {
+		return nil, err
+	}
+	var taken []netip.Addr
+	for _, addr := range addrs {
+		for _, owner := range owners[addr] {
+			if owner.Namespace != service.Namespace || owner.Name != service.Name {
+				taken = append(taken, addr)
+				break
+			}
+		}
+	}
+	return taken, nil
+}
+
+// recordEventf emits an event on the service if the manager has a recorder configured
+func (k *kubevipLoadBalancerManager) recordEventf(service *v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if k.recorder == nil {
+		return
+	}
+	k.recorder.Eventf(service, eventType, reason, messageFmt, args...)
+}
+
+// reportDuplicateAddresses emits a warning event on every service that shares an address with
+// another service, it returns true if any duplicates were found
+func (k *kubevipLoadBalancerManager) reportDuplicateAddresses(owners map[netip.Addr][]*v1.Service) bool {
+	var duplicates []netip.Addr
+	for addr, svcs := range owners {
+		if len(svcs) > 1 {
+			duplicates = append(duplicates, addr)
+		}
+	}
+	slices.SortFunc(duplicates, func(a, b netip.Addr) int { return a.Compare(b) })
+
+	for _, addr := range duplicates {
+		names := make([]string, 0, len(owners[addr]))
+		for _, svc := range owners[addr] {
+			names = append(names, fmt.Sprintf("%s/%s", svc.Namespace, svc.Name))
+		}
+		klog.InfoS("Address is assigned to more than one service", "address", addr, "services", names)
+		for _, svc := range owners[addr] {
+			k.recordEventf(svc, v1.EventTypeWarning, DuplicateIPReason, "Address [%s] is assigned to more than one service [%s]", addr, strings.Join(names, ","))
+		}
+	}
+	return len(duplicates) != 0
+}
+
+// NoPoolError stores the informations that are required to return a no pool error, it is returned when
+// the configmap exists but has no pool the services of the namespace can take their address(es) from
+type NoPoolError struct {
+	// Namespace is the namespace of the service that no pool was found for
+	Namespace string
+	// ConfigMap is the name of the configmap the pools were looked up in
+	ConfigMap string
+}
+
+// NewNoPoolError returns a NoPoolError for the namespace and configmap
+func NewNoPoolError(namespace, configMap string) *NoPoolError {
+	return &NoPoolError{Namespace: namespace, ConfigMap: configMap}
+}
+
+func (e *NoPoolError) Error() string {
+	return fmt.Sprintf("no address pools could be found for namespace [%s] in configMap [%s]", e.Namespace, e.ConfigMap)
+}
+
+// DualStackUnsupportedError is returned when a RequireDualStack service is allocated from a pool that doesn't
+// have addresses of both IP families
+type DualStackUnsupportedError struct {
+	pool    string
+	missing v1.IPFamily
+}
+
+// NewDualStackUnsupportedError returns a DualStackUnsupportedError for the pool and the IP family it is missing
+func NewDualStackUnsupportedError(pool string, missing v1.IPFamily) *DualStackUnsupportedError {
+	return &DualStackUnsupportedError{pool: pool, missing: missing}
+}
+
+func (e *DualStackUnsupportedError) Error() string {
+	return fmt.Sprintf("service requires dual-stack, but pool [%s] has no %s addresses configured", e.pool, e.missing)
+}
+
+// retryableError wraps an error after which the service is synced again once the delay has passed.
+// errors.As finds the wrapped error, and an api.RetryError that the service controller of the
+// cloud-provider requeues the service with after the delay, instead of the exponential backoff.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func newRetryableError(err error, retryAfter time.Duration) *retryableError {
+	return &retryableError{err: err, retryAfter: retryAfter}
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// RetryAfter returns the delay before the service is synced again
+func (e *retryableError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// As sets target to an api.RetryError with the same message and delay
+func (e *retryableError) As(target interface{}) bool {
+	if re, ok := target.(**api.RetryError); ok {
+		*re = api.NewRetryError(e.err.Error(), e.retryAfter)
+		return true
+	}
+	return false
+}
+
+// ipPool is the address pool a service takes its address(es) from
+type ipPool struct {
+	// addresses is the comma separated list of cidrs, ranges or hosts of the pool
+	addresses string
+	// key is the configmap key the pool was read from
+	key string
+	// global is true if the pool is shared by the services of all namespaces
+	global bool
+	// excluded is the comma separated list of addresses and cidrs that are never allocated from the pool, the
+	// exclusions of the pool followed by its reserved addresses
+	excluded string
+	// drain is the previous pool the services are migrated from, its addresses stay with the services holding them
+	// but are never allocated
+	drain string
+	// step only allows addresses at a multiple of step from the network address of each cidr to be allocated
+	step int
+	// excludeEndpoints never allocates the first and last address of each range
+	excludeEndpoints bool
+	// hostMin and hostMax restrict the addresses allocated from each cidr to a window
+	hostMin, hostMax string
+	// namespaces are the namespaces whose services share a namespace pool through aliases, empty if the
+	// pool is only used by the services of its own namespace
+	namespaces []string
+	// searchOrder is the search order of an IPPool, asc or desc, empty uses the search order of the configmap
+	searchOrder string
+	// gateway is the comma separated list of the gateways of the pool, at most one per IP family
+	gateway string
+}
+
+func newIPPool(cm *v1.ConfigMap, key, value string, global bool) (*ipPool, error) {
+	addresses, options, err := parsePoolOptions(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return &ipPool{
+		addresses:        addresses,
+		key:              key,
+		global:           global,
+		excluded:         poolExclusions(cm, key),
+		drain:            cm.Data[fmt.Sprintf("drain-%s", key)],
+		step:             options.step,
+		excludeEndpoints: options.excludeEndpoints,
+		hostMin:          options.hostMin,
+		hostMax:          options.hostMax,
+		gateway:          strings.ReplaceAll(cm.Data[fmt.Sprintf("gateway-%s", key)], " ", ""),
+	}, nil
+}
+
+// gatewayOf returns the gateways of the pool of the IP families of the address(es), in the order of the addresses
+func (p *ipPool) gatewayOf(loadBalancerIPs string) string {
+	if len(p.gateway) == 0 || isDHCPPool(p.addresses) {
+		return ""
+	}
+	gateways, err := parseAddresses(p.gateway)
+	if err != nil {
+		klog.ErrorS(err, "Invalid gateway of pool", "pool", p.key, "gateway", p.gateway)
+		return ""
+	}
+	addrs, err := parseAddresses(loadBalancerIPs)
+	if err != nil {
+		return ""
+	}
+	var matching []string
+	for _, addr := range addrs {
+		for _, gateway := range gateways {
+			if gateway.Is4() == addr.Is4() && !slices.Contains(matching, gateway.String()) {
+				matching = append(matching, gateway.String())
+				break
+			}
+		}
+	}
+	return strings.Join(matching, ",")
+}
+
+// poolExclusions returns the addresses and cidrs of the exclude-<pool key> key of the pool, followed by the addresses
+// of its exclude-reserved-<pool> key, i.e. exclude-reserved-prod for cidr-prod
+func poolExclusions(cm *v1.ConfigMap, key string) string {
+	var exclusions []string
+	for _, value := range []string{cm.Data[fmt.Sprintf("exclude-%s", key)], cm.Data[poolReservedKey(key)]} {
+		if value = strings.ReplaceAll(value, " ", ""); len(value) != 0 {
+			exclusions = append(exclusions, value)
+		}
+	}
+	return strings.Join(exclusions, ",")
+}
+
+// poolReservedKey returns the key of the addresses reserved in the pool, the pool key without the internal- prefix and
+// its kind, i.e. exclude-reserved-prod for cidr-prod and exclude-reserved-pool-edge for range-pool-edge. Its prefix
+// differs from the reserved-<namespace>-<service name> keys of the services, whose namespaces can contain dashes.
+func poolReservedKey(key string) string {
+	poolKey := strings.TrimPrefix(key, "internal-")
+	return "exclude-reserved-" + poolKey[strings.Index(poolKey, "-")+1:]
+}
+
+// newNamespacePool returns the pool of the namespace, shared with the namespaces aliased to it
+func newNamespacePool(cm *v1.ConfigMap, key, value, namespace string) (*ipPool, error) {
+	pool, err := newIPPool(cm, key, value, false)
+	if err != nil {
+		return nil, err
+	}
+	if aliases := aliasedNamespaces(cm, namespace); len(aliases) != 0 {
+		pool.namespaces = append([]string{namespace}, aliases...)
+	}
+	return pool, nil
+}
+
+// resolveNamespaceAlias returns the namespace whose pools the services of the namespace take their addresses
+// from, following the alias-<namespace> keys of the configmap. A namespace without alias uses its own pools.
+func resolveNamespaceAlias(cm *v1.ConfigMap, namespace string) (string, error) {
+	chain := []string{namespace}
+	for {
+		target, ok := cm.Data["alias-"+chain[len(chain)-1]]
+		if !ok {
+			return chain[len(chain)-1], nil
+		}
+		target = strings.TrimSpace(target)
+		if len(target) == 0 {
+			return "", fmt.Errorf("alias of namespace [%s] is empty", chain[len(chain)-1])
+		}
+		if slices.Contains(chain, target) {
+			return "", fmt.Errorf("alias cycle [%s]", strings.Join(append(chain, target), " -> "))
+		}
+		chain = append(chain, target)
+	}
+}
+
+// aliasedNamespaces returns the namespaces that are aliased to the namespace, sorted by name
+func aliasedNamespaces(cm *v1.ConfigMap, namespace string) []string {
+	var aliases []string
+	for key := range cm.Data {
+		alias, ok := strings.CutPrefix(key, "alias-")
+		if !ok || alias == namespace {
+			continue
+		}
+		if target, err := resolveNamespaceAlias(cm, alias); err == nil && target == namespace {
+			aliases = append(aliases, alias)
+		}
+	}
+	slices.Sort(aliases)
+	return aliases
+}
+
+// poolOptions are the options that can be appended to the addresses of a pool
+type poolOptions struct {
+	// step of cidr pools, defaults to 1
+	step int
+	// excludeEndpoints of range pools, defaults to false
+	excludeEndpoints bool
+	// hostMin and hostMax restrict the addresses of cidr pools to a window, as .N offsets or addresses
+	hostMin, hostMax string
+}
+
+// parsePoolOptions splits the ;<option>=<value> suffixes off the addresses of a pool, i.e.
+// 10.0.0.0/24;step=4, 10.0.0.0/24;min=.100;max=.200 or 10.0.0.1-10.0.0.10;exclude-endpoints=true. The options
+// of the internal pools are the options of their cidr or range pool.
+func parsePoolOptions(key, value string) (addresses string, options poolOptions, err error) {
+	poolKey := strings.TrimPrefix(key, "internal-")
+	parts := strings.Split(value, ";")
+	addresses, options.step = parts[0], 1
+	for _, option := range parts[1:] {
+		name, optionValue, _ := strings.Cut(option, "=")
+		switch name {
+		case "step":
+			if !strings.HasPrefix(poolKey, "cidr-") {
+				return "", poolOptions{}, fmt.Errorf("invalid option [%s] for pool [%s], step is only supported by cidr pools", option, key)
+			}
+			options.step, err = strconv.Atoi(optionValue)
+			if err != nil || options.step < 1 {
+				return "", poolOptions{}, fmt.Errorf("invalid step [%s] for pool [%s], must be a positive integer", optionValue, key)
+			}
+		case "exclude-endpoints":
+			if !strings.HasPrefix(poolKey, "range-") {
+				return "", poolOptions{}, fmt.Errorf("invalid option [%s] for pool [%s], exclude-endpoints is only supported by range pools", option, key)
+			}
+			options.excludeEndpoints, err = strconv.ParseBool(optionValue)
+			if err != nil {
+				return "", poolOptions{}, fmt.Errorf("invalid exclude-endpoints [%s] for pool [%s], must be true or false", optionValue, key)
+			}
+		case "min", "max":
+			if !strings.HasPrefix(poolKey, "cidr-") {
+				return "", poolOptions{}, fmt.Errorf("invalid option [%s] for pool [%s], %s is only supported by cidr pools", option, key, name)
+			}
+			if len(optionValue) == 0 {
+				return "", poolOptions{}, fmt.Errorf("invalid %s [%s] for pool [%s], must be an offset like .100 or an address", name, optionValue, key)
+			}
+			if name == "min" {
+				options.hostMin = optionValue
+			} else {
+				options.hostMax = optionValue
+			}
+		default:
+			return "", poolOptions{}, fmt.Errorf("unknown option [%s] for pool [%s]", option, key)
+		}
+	}
+	if len(options.hostMin) != 0 || len(options.hostMax) != 0 {
+		if options.step > 1 {
+			return "", poolOptions{}, fmt.Errorf("invalid options for pool [%s], min and max can't be combined with step", key)
+		}
+		for _, cidr := range strings.Split(addresses, ",") {
+			if _, _, err := ipam.CidrHostWindow(strings.TrimSpace(cidr), options.hostMin, options.hostMax); err != nil {
+				return "", poolOptions{}, fmt.Errorf("invalid min or max for pool [%s]: %v", key, err)
+			}
+		}
+	}
+	return addresses, options, nil
+}
+
+// servicePools returns the pools the service takes its address(es) from, in the order they are tried. With the
+// IPPool custom resources enabled, the IPPool found by discoverIPPool takes precedence over the pools of the
+// configmap, internal load balancers excepted. With namespacePoolOverflow the cidr, range or hosts pool of the namespace found by discoverPool is followed by the
+// global pool, looked up in the order cidr-global, range-global, hosts-global, so the global pool is only used
+// once the namespace pool is out of addresses. Internal and protocol pools don't overflow.
+func (k *kubevipLoadBalancerManager) servicePools(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, nodes []*v1.Node) ([]*ipPool, error) {
+	if k.dynamicClient != nil && service.Annotations[InternalAnnotation] != "true" {
+		pool, err := k.discoverIPPool(ctx, service)
+		if err != nil {
+			return nil, err
+		}
+		if pool != nil {
+			return []*ipPool{pool}, nil
+		}
+	}
+	pools, err := discoverServicePools(cm, service, k.serviceZone(nodes), k.cloudConfigMap)
+	if err != nil || !k.namespacePoolOverflow || len(pools) != 1 || pools[0].global {
+		return pools, err
+	}
+	poolNamespace, err := resolveNamespaceAlias(cm, service.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	switch pools[0].key {
+	case "cidr-" + poolNamespace, "range-" + poolNamespace, "hosts-" + poolNamespace:
+	default:
+		return pools, nil
+	}
+	for _, key := range []string{"cidr-global", "range-global", "hosts-global"} {
+		if addresses, ok := cm.Data[key]; ok {
+			pool, err := newIPPool(cm, key, addresses, true)
+			if err != nil {
+				return nil, err
+			}
+			return append(pools, pool), nil
+		}
+	}
+	return pools, nil
+}
+
+// discoverServicePools returns the pools the service takes its address(es) from, the internal pools for an internal
+// load balancer, the pool of the zone or of the protocol of the ports unless the service requests a named pool, and
+// the pools found by discoverPools otherwise
+func discoverServicePools(cm *v1.ConfigMap, service *v1.Service, zone, configMapName string) ([]*ipPool, error) {
+	if service.Annotations[InternalAnnotation] == "true" {
+		pool, err := discoverInternalPool(cm, service.Namespace, configMapName)
+		if err != nil {
+			return nil, err
+		}
+		return []*ipPool{pool}, nil
+	}
+	poolName := service.Annotations[LoadbalancerPoolAnnotation]
+	if len(zone) != 0 && len(poolName) == 0 {
+		// Zone pools are shared by the services of all namespaces, like named pools
+		for _, prefix := range []string{"cidr", "range", "hosts"} {
+			poolKey := fmt.Sprintf("%s-zone-%s", prefix, zone)
+			if addresses, ok := cm.Data[poolKey]; ok {
+				klog.InfoS("Taking address from the pool of the zone", "service", klog.KObj(service), "zone", zone, "pool", poolKey)
+				pool, err := newIPPool(cm, poolKey, addresses, true)
+				if err != nil {
+					return nil, err
+				}
+				return []*ipPool{pool}, nil
+			}
+		}
+		klog.InfoS("No pool for the zone exists", "service", klog.KObj(service), "zone", zone,
+			"keys", []string{"cidr-zone-" + zone, "range-zone-" + zone, "hosts-zone-" + zone}, "configMap", configMapName)
+	}
+	if protocol := serviceProtocol(service); len(protocol) != 0 && len(poolName) == 0 {
+		pool, err := discoverProtocolPool(cm, service.Namespace, protocol)
+		if err != nil {
+			return nil, err
+		}
+		if pool != nil {
+			return []*ipPool{pool}, nil
+		}
+	}
+	return discoverPools(cm, service.Namespace, poolName, configMapName)
+}
+
+// serviceProtocol returns tcp or udp if all the ports of the service use that protocol, and an empty string for
+// services mixing protocols, using SCTP or without ports
+func serviceProtocol(service *v1.Service) string {
+	var protocol v1.Protocol
+	for _, port := range service.Spec.Ports {
+		portProtocol := port.Protocol
+		if len(portProtocol) == 0 {
+			portProtocol = v1.ProtocolTCP
+		}
+		if len(protocol) != 0 && portProtocol != protocol {
+			return ""
+		}
+		protocol = portProtocol
+	}
+	switch protocol {
+	case v1.ProtocolTCP:
+		return "tcp"
+	case v1.ProtocolUDP:
+		return "udp"
+	}
+	return ""
+}
+
+// discoverProtocolPool returns the pool of the protocol for the services of the namespace, looked up in the order
+// cidr-<protocol>-<namespace>, cidr-<protocol>-global, then the range and hosts pools. It returns nil if there is
+// none, the services then take their address(es) from the generic pools.
+func discoverProtocolPool(cm *v1.ConfigMap, namespace, protocol string) (*ipPool, error) {
+	poolNamespace, err := resolveNamespaceAlias(cm, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range []string{"cidr", "range", "hosts"} {
+		key := fmt.Sprintf("%s-%s-%s", prefix, protocol, poolNamespace)
+		if addresses, ok := cm.Data[key]; ok {
+			klog.InfoS("Taking address from the pool of the protocol", "namespace", namespace, "protocol", protocol, "pool", key)
+			return newNamespacePool(cm, key, addresses, poolNamespace)
+		}
+		key = fmt.Sprintf("%s-%s-global", prefix, protocol)
+		if addresses, ok := cm.Data[key]; ok {
+			klog.InfoS("Taking address from the pool of the protocol", "namespace", namespace, "protocol", protocol, "pool", key)
+			return newIPPool(cm, key, addresses, true)
+		}
+	}
+	return nil, nil
+}
+
+// serviceZone returns the topology zone most of the nodes are in, the first zone by name if several zones have the
+// same number of nodes. It is empty if zonePools isn't set or none of the nodes has a zone.
+func (k *kubevipLoadBalancerManager) serviceZone(nodes []*v1.Node) string {
+	if !k.zonePools {
+		return ""
+	}
+	counts := map[string]int{}
+	for _, node := range nodes {
+		if zone := node.Labels[v1.LabelTopologyZone]; len(zone) != 0 {
+			counts[zone]++
+		}
+	}
+	var zone string
+	for z, count := range counts {
+		if count > counts[zone] || (count == counts[zone] && z < zone) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+// discoverPools returns the pools the services of the namespace take their address(es) from, in the order
+// they are tried. The pool-order key of the configmap lists the keys of the pools in that order, the keys
+// that don't apply to the namespace are skipped. Without a pool-order, or if the service requests a named
+// pool, the single pool found by discoverPool is used.
+func discoverPools(cm *v1.ConfigMap, namespace, poolName, configMapName string) ([]*ipPool, error) {
+	order, ok := cm.Data["pool-order"]
+	if !ok || len(poolName) != 0 {
+		pool, err := discoverPool(cm, namespace, poolName, configMapName)
+		if err != nil {
+			return nil, err
+		}
+		return []*ipPool{pool}, nil
+	}
+
+	poolNamespace, err := resolveNamespaceAlias(cm, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var pools []*ipPool
+	for _, key := range strings.Split(order, ",") {
+		key = strings.TrimSpace(key)
+		var global bool
+		switch key {
+		case "cidr-global", "range-global", "hosts-global":
+			global = true
+		case "cidr-" + poolNamespace, "range-" + poolNamespace, "hosts-" + poolNamespace:
+			global = false
+		default:
+			if !strings.HasPrefix(key, "cidr-pool-") && !strings.HasPrefix(key, "range-pool-") && !strings.HasPrefix(key, "hosts-pool-") {
+				continue
+			}
+			global = true
+		}
+		value, ok := cm.Data[key]
+		if !ok {
+			klog.InfoS("Pool listed in pool-order doesn't exist", "namespace", namespace, "key", key, "configMap", configMapName)
+			continue
+		}
+		var pool *ipPool
+		if global {
+			pool, err = newIPPool(cm, key, value, true)
+		} else {
+			pool, err = newNamespacePool(cm, key, value, poolNamespace)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	if len(pools) == 0 {
+		klog.InfoS("No pool listed in pool-order applies to the namespace", "namespace", namespace, "poolOrder", order)
+		pool, err := discoverPool(cm, namespace, poolName, configMapName)
+		if err != nil {
+			return nil, err
+		}
+		return []*ipPool{pool}, nil
+	}
+	return pools, nil
+}
+
+// discoverPool returns the pool the services of the namespace take their address(es) from. The lookup
+// precedence is: the named pool (cidr-pool-<name>, range-pool-<name>, hosts-pool-<name>) if a pool name
+// is given, then cidr-<namespace>, cidr-global, range-<namespace>, range-global, hosts-<namespace> and
+// finally hosts-global. Named pools are shared by the services of all namespaces, so they are treated
+// like global pools.
+func discoverPool(cm *v1.ConfigMap, namespace, poolName, configMapName string) (*ipPool, error) {
+	var cidr, ipRange string
+	var ok bool
+
+	// Find named pool
+	if len(poolName) != 0 {
+		for _, prefix := range []string{"cidr", "range", "hosts"} {
+			poolKey := fmt.Sprintf("%s-pool-%s", prefix, poolName)
+			if addresses, ok := cm.Data[poolKey]; ok {
+				klog.InfoS("Taking address from pool", "namespace", namespace, "pool", poolKey)
+				return newIPPool(cm, poolKey, addresses, true)
+			}
+		}
+		klog.InfoS("No config for named pool exists", "namespace", namespace, "pool", poolName,
+			"keys", []string{"cidr-pool-" + poolName, "range-pool-" + poolName, "hosts-pool-" + poolName}, "configMap", configMapName)
+	}
+
+	// The namespace can take its address(es) from the pools of another namespace
+	poolNamespace, err := resolveNamespaceAlias(cm, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if poolNamespace != namespace {
+		_, hasCidr := cm.Data["cidr-"+poolNamespace]
+		_, hasRange := cm.Data["range-"+poolNamespace]
+		_, hasHosts := cm.Data["hosts-"+poolNamespace]
+		if !hasCidr && !hasRange && !hasHosts {
+			return nil, fmt.Errorf("namespace [%s] is aliased to namespace [%s], which has no cidr, range or hosts pool", namespace, poolNamespace)
+		}
+		klog.InfoS("Taking address from the pools of the aliased namespace", "namespace", namespace, "alias", poolNamespace)
+	}
+
+	// Find Cidr
+	cidrKey := fmt.Sprintf("cidr-%s", poolNamespace)
+	// Lookup current namespace
+	if cidr, ok = cm.Data[cidrKey]; !ok {
+		klog.InfoS("No cidr config for namespace exists", "namespace", namespace, "key", cidrKey, "configMap", configMapName)
+		// Lookup global cidr configmap data
+		if cidr, ok = cm.Data["cidr-global"]; !ok {
+			klog.InfoS("No global cidr config exists", "namespace", namespace, "key", "cidr-global")
+		} else {
+			klog.InfoS("Taking address from pool", "namespace", namespace, "pool", "cidr-global")
+			return newIPPool(cm, "cidr-global", cidr, true)
+		}
+	} else {
+		klog.InfoS("Taking address from pool", "namespace", namespace, "pool", cidrKey)
+		return newNamespacePool(cm, cidrKey, cidr, poolNamespace)
+	}
+
+	// Find Range
+	rangeKey := fmt.Sprintf("range-%s", poolNamespace)
+	// Lookup current namespace
+	if ipRange, ok = cm.Data[rangeKey]; !ok {
+		klog.InfoS("No range config for namespace exists", "namespace", namespace, "key", rangeKey, "configMap", configMapName)
+		// Lookup global range configmap data
+		if ipRange, ok = cm.Data["range-global"]; !ok {
+			klog.InfoS("No global range config exists", "namespace", namespace, "key", "range-global")
+		} else {
+			klog.InfoS("Taking address from pool", "namespace", namespace, "pool", "range-global")
+			return newIPPool(cm, "range-global", ipRange, true)
+		}
+	} else {
+		klog.InfoS("Taking address from pool", "namespace", namespace, "pool", rangeKey)
+		return newNamespacePool(cm, rangeKey, ipRange, poolNamespace)
+	}
+
+	// Find Hosts
+	hostsKey := fmt.Sprintf("hosts-%s", poolNamespace)
+	// Lookup current namespace
+	if hosts, ok := cm.Data[hostsKey]; !ok {
+		klog.InfoS("No hosts config for namespace exists", "namespace", namespace, "key", hostsKey, "configMap", configMapName)
+		// Lookup global hosts configmap data
+		if hosts, ok = cm.Data["hosts-global"]; !ok {
+			klog.InfoS("No global hosts config exists", "namespace", namespace, "key", "hosts-global")
+		} else {
+			klog.InfoS("Taking address from pool", "namespace", namespace, "pool", "hosts-global")
+			return newIPPool(cm, "hosts-global", hosts, true)
+		}
+	} else {
+		klog.InfoS("Taking address from pool", "namespace", namespace, "pool", hostsKey)
+		return newNamespacePool(cm, hostsKey, hosts, poolNamespace)
+	}
+
+	return nil, NewNoPoolError(namespace, configMapName)
+}
+
+// discoverInternalPool returns the pool the internal load balancers of the namespace take their address(es) from.
+// The lookup precedence is the one of discoverPool with the keys prefixed by internal-, named pools and the
+// pool-order don't apply. An internal load balancer never falls back to the other pools, so it isn't exposed
+// on an external address.
+func discoverInternalPool(cm *v1.ConfigMap, namespace, configMapName string) (*ipPool, error) {
+	poolNamespace, err := resolveNamespaceAlias(cm, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range []string{"cidr", "range", "hosts"} {
+		key := fmt.Sprintf("internal-%s-%s", prefix, poolNamespace)
+		if addresses, ok := cm.Data[key]; ok {
+			klog.InfoS("Taking address from internal pool", "namespace", namespace, "pool", key)
+			return newNamespacePool(cm, key, addresses, poolNamespace)
+		}
+		key = fmt.Sprintf("internal-%s-global", prefix)
+		if addresses, ok := cm.Data[key]; ok {
+			klog.InfoS("Taking address from internal pool", "namespace", namespace, "pool", key)
+			return newIPPool(cm, key, addresses, true)
+		}
+	}
+	return nil, fmt.Errorf("no internal address pools could be found for namespace [%s] in configMap [%s]", namespace, configMapName)
+}
+
+// allocationOptions control how a free address is searched for in a pool
+type allocationOptions struct {
+	// descOrder searches the pool from the last address to the first
+	descOrder bool
+	// familyDescOrder overrides descOrder for the addresses of an IP family, if set
+	familyDescOrder map[v1.IPFamily]bool
+	// step only allows addresses at a multiple of step from the network address of each cidr, 0 or 1 allows all
+	step int
+	// cidr restricts the search of its IP family to this cidr of the pool, if set
+	cidr netip.Prefix
+	// count allocates a block of contiguous addresses, 0 or 1 allocates a single address
+	count int
+	// hostMin and hostMax restrict the search of each cidr to a window, if set
+	hostMin, hostMax string
+	// deterministic searches the cidrs, ranges and hosts of the pool from the numerically lowest address, large
+	// IPv6 cidrs included
+	deterministic bool
+	// ipv6Scope restricts the search of the IPv6 addresses to the ula or gua addresses of the pool, if set
+	ipv6Scope string
+	// alignOffsets searches the second address of a dual-stack service at the host offset of the first address first
+	alignOffsets bool
+}
+
+// forFamily returns the options the addresses of the IP family are searched with
+func (opts allocationOptions) forFamily(family v1.IPFamily) allocationOptions {
+	if descOrder, ok := opts.familyDescOrder[family]; ok {
+		opts.descOrder = descOrder
+	}
+	return opts
+}
+
+func discoverVIPs(
+	ctx context.Context, namespace, pool string, inUseIPSet *netipx.IPSet, opts allocationOptions,
+	ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily,
+) (vips string, err error) {
+	// Check if DHCP is required, the DHCP address can't be combined with an address of another family
+	if isDHCPPool(pool) {
+		// The DHCP address is IPv4, it can't serve a service that requires an IPv6 address
+		if ipFamilyPolicy != nil && *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack {
+			return "", fmt.Errorf("pool [%s] provides DHCP addresses, which are IPv4 only, but the service requires dual-stack", pool)
+		}
+		if (ipFamilyPolicy == nil || *ipFamilyPolicy == v1.IPFamilyPolicySingleStack) && len(ipFamilies) != 0 && ipFamilies[0] == v1.IPv6Protocol {
+			return "", fmt.Errorf("pool [%s] provides DHCP addresses, which are IPv4 only, but the service requires IP family [%s]", pool, v1.IPv6Protocol)
+		}
+		if pool != "0.0.0.0/32" || (ipFamilyPolicy != nil && *ipFamilyPolicy != v1.IPFamilyPolicySingleStack) {
+			klog.InfoS("Pool contains the DHCP cidr, allocating a single DHCP address regardless of the IP family policy",
+				"namespace", namespace, "pool", pool, "ipFamilyPolicy", ipFamilyPolicy)
+		}
+		return "0.0.0.0", nil
+	}
+
+	ipv4Pool, ipv6Pool, err := splitPoolByIPFamily(pool)
+	if err != nil {
+		return "", err
+	}
+
+	vipBuilder := strings.Builder{}
+
+	// Handle single stack case
+	if ipFamilyPolicy == nil || *ipFamilyPolicy == v1.IPFamilyPolicySingleStack {
+		ipPool, family, err := selectSingleStackPool(namespace, ipv4Pool, ipv6Pool, ipFamilies)
+		if err != nil {
+			return "", err
+		}
+		if len(opts.ipv6Scope) != 0 && family == v1.IPv6Protocol {
+			if ipPool, err = scopeIPv6Pool(ipv6Pool, opts.ipv6Scope); err != nil {
+				return "", err
+			}
+		}
+		vip, err := discoverAddress(ctx, namespace, ipPool, inUseIPSet, opts.forFamily(family))
+		if err != nil {
+			return "", err
+		}
+		logDiscoveredAddress(namespace, vip)
+		return vip, nil
+	}
+
+	// Handle dual stack case
+	if *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack {
+		// With RequireDualStack, we want to make sure both pools with both IP
+		// families exist
+		if err := ValidateDualStackPool(pool, pool, ipFamilyPolicy); err != nil {
+			return "", err
+		}
+	}
+	// Without an IPv6 address of the scope a PreferDualStack service is single stack
+	if len(opts.ipv6Scope) != 0 && len(ipv6Pool) != 0 {
+		scoped, err := scopeIPv6Pool(ipv6Pool, opts.ipv6Scope)
+		if err != nil {
+			if *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack || len(ipv4Pool) == 0 {
+				return "", err
+			}
+			klog.InfoS("PreferDualStack service will be single-stack", "namespace", namespace, "err", err)
+		}
+		ipv6Pool = scoped
+	}
+
+	primaryPool, primaryFamily := ipv4Pool, v1.IPv4Protocol
+	secondaryPool, secondaryFamily := ipv6Pool, v1.IPv6Protocol
+	if len(ipFamilies) > 0 && ipFamilies[0] == v1.IPv6Protocol {
+		primaryPool, primaryFamily = ipv6Pool, v1.IPv6Protocol
+		secondaryPool, secondaryFamily = ipv4Pool, v1.IPv4Protocol
+	}
+	// Provide VIPs from both IP families if possible (guaranteed if RequireDualStack)
+	var primaryVip, secondaryVip string
+	var primaryPoolErr, secondaryPoolErr error
+	if len(primaryPool) > 0 {
+		primaryVip, err = discoverAddress(ctx, namespace, primaryPool, inUseIPSet, opts.forFamily(primaryFamily))
+		if err == nil {
+			logDiscoveredAddress(namespace, primaryVip)
+			_, _ = vipBuilder.WriteString(primaryVip)
+		} else if _, outOfIPs := err.(*ipam.OutOfIPsError); outOfIPs {
+			primaryPoolErr = err
+		} else {
+			return "", err
+		}
+	}
+	if len(secondaryPool) > 0 {
+		if aligned, ok := alignSecondaryAddress(namespace, primaryPool, primaryVip, secondaryPool, inUseIPSet, opts); ok {
+			secondaryVip, err = aligned, nil
+		} else {
+			secondaryVip, err = discoverAddress(ctx, namespace, secondaryPool, inUseIPSet, opts.forFamily(secondaryFamily))
+		}
+		if err == nil {
+			logDiscoveredAddress(namespace, secondaryVip)
+			if vipBuilder.Len() > 0 {
+				vipBuilder.WriteByte(',')
+			}
+			_, _ = vipBuilder.WriteString(secondaryVip)
+		} else if _, outOfIPs := err.(*ipam.OutOfIPsError); outOfIPs {
+			secondaryPoolErr = err
+		} else {
+			return "", err
+		}
+	}
+	if *ipFamilyPolicy == v1.IPFamilyPolicyPreferDualStack {
+		if primaryPoolErr != nil && secondaryPoolErr != nil {
+			return "", newMultiError("could not allocate any IP address for PreferDualStack service: "+renderErrors(primaryPoolErr, secondaryPoolErr),
+				primaryPoolErr, secondaryPoolErr)
+		}
+		singleError := primaryPoolErr
+		if secondaryPoolErr != nil {
+			singleError = secondaryPoolErr
+		}
+		if singleError != nil {
+			klog.InfoS("PreferDualStack service will be single-stack", "namespace", namespace, "err", singleError)
+		}
+	} else if *ipFamilyPolicy == v1.IPFamilyPolicyRequireDualStack {
+		if primaryPoolErr != nil || secondaryPoolErr != nil {
+			// Name the family that could be allocated and the pool that is exhausted, so it's clear which pool to expand
+			return "", newMultiError("could not allocate required IP addresses for RequireDualStack service: "+
+				renderFamilyResult(primaryFamily, primaryVip, primaryPoolErr)+renderFamilyResult(secondaryFamily, secondaryVip, secondaryPoolErr),
+				primaryPoolErr, secondaryPoolErr)
+		}
+	}
+
+	return vipBuilder.String(), nil
+}
+
+// alignSecondaryAddress returns the free address of the secondary pool at the host offset of the primary address in
+// the primary pool, with opts.alignOffsets. Offsets are numeric, 10.0.0.50 of 10.0.0.0/24 is aligned with fd00::32 of
+// fd00::/120. Host lists, stepped pools and pools restricted to a window aren't aligned.
+func alignSecondaryAddress(namespace, primaryPool, primaryVip, secondaryPool string, inUseIPSet *netipx.IPSet, opts allocationOptions) (string, bool) {
+	if !opts.alignOffsets || len(primaryVip) == 0 || opts.step > 1 || len(opts.hostMin) != 0 || len(opts.hostMax) != 0 {
+		return "", false
+	}
+	addr, err := netip.ParseAddr(primaryVip)
+	if err != nil {
+		return "", false
+	}
+	offset, ok := ipam.HostOffset(primaryPool, addr)
+	if !ok {
+		return "", false
+	}
+	subPools := []string{}
+	for _, subPool := range strings.Split(secondaryPool, ",") {
+		if matchesCIDRHint(subPool, opts.cidr) {
+			subPools = append(subPools, subPool)
+		}
+	}
+	aligned, ok := ipam.FindHostAtOffset(strings.Join(subPools, ","), offset, inUseIPSet)
+	if !ok {
+		klog.InfoS("Address at the host offset of the primary address isn't free, falling back to the next free address",
+			"namespace", namespace, "address", primaryVip, "offset", offset)
+		return "", false
+	}
+	return aligned.String(), true
+}
+
+// selectSingleStackPool returns the pool and the IP family a single stack service is allocated from. Without
+// IP families the family that has a pool is used, preferring IPv4, otherwise the first family of the
+// service must have a pool.
+func selectSingleStackPool(namespace, ipv4Pool, ipv6Pool string, ipFamilies []v1.IPFamily) (string, v1.IPFamily, error) {
+	if len(ipFamilies) == 0 {
+		if len(ipv4Pool) != 0 {
+			return ipv4Pool, v1.IPv4Protocol, nil
+		}
+		klog.InfoS("Single stack service has no IP family and the pool has no IPv4 addresses, using IPv6", "namespace", namespace, "family", v1.IPv6Protocol)
+		return ipv6Pool, v1.IPv6Protocol, nil
+	}
+
+	family := ipFamilies[0]
+	ipPool := ipv4Pool
+	if family == v1.IPv6Protocol {
+		ipPool = ipv6Pool
+	}
+	if len(ipPool) == 0 {
+		return "", family, fmt.Errorf("service requires IP family [%s], but the pool has no %s addresses configured", family, family)
+	}
+	return ipPool, family, nil
+}
+
+// isDHCPPool returns true if any of the comma separated cidrs of the pool is the special DHCP cidr
+func isDHCPPool(pool string) bool {
+	return slices.Contains(strings.Split(pool, ","), "0.0.0.0/32")
+}
+
+// logDiscoveredAddress logs the address found in the pool together with its IP family
+func logDiscoveredAddress(namespace, vip string) {
+	family := v1.IPv4Protocol
+	if addr, err := netip.ParseAddr(vip); err == nil && addr.Is6() {
+		family = v1.IPv6Protocol
+	}
+	klog.InfoS("Discovered address", "namespace", namespace, "address", vip, "family", family)
+}
+
+// splitPoolByIPFamily splits the cidrs, ranges or hosts of the pool into the ipv4 and ipv6 pools
+func splitPoolByIPFamily(pool string) (ipv4Pool, ipv6Pool string, err error) {
+	if len(pool) == 0 {
+		return "", "", fmt.Errorf("could not discover address: pool is not specified")
+	}
+	// Check if ip pool contains a cidr, if not assume it is a range unless it only lists addresses
+	if strings.Contains(pool, "/") {
+		return ipam.SplitCIDRsByIPFamily(pool)
+	}
+	if ipam.IsHostList(pool) {
+		return ipam.SplitHostsByIPFamily(pool)
+	}
+	return ipam.SplitRangesByIPFamily(pool)
+}
+
+// ValidateDualStackPool returns a DualStackUnsupportedError if the policy is RequireDualStack and the cidrs, ranges
+// or hosts of the pool don't have addresses of both IP families. The DHCP pool is accepted here, discoverVIPs
+// refuses its IPv4 only address to services that require an IPv6 address. It only depends on the pool, so that admission webhooks can refuse
+// the service before it is synced.
+func ValidateDualStackPool(name, pool string, ipFamilyPolicy *v1.IPFamilyPolicy) error {
+	if ipFamilyPolicy == nil || *ipFamilyPolicy != v1.IPFamilyPolicyRequireDualStack || isDHCPPool(pool) {
+		return nil
+	}
+	ipv4Pool, ipv6Pool, err := splitPoolByIPFamily(pool)
+	if err != nil {
+		return err
+	}
+	if len(ipv4Pool) == 0 {
+		return NewDualStackUnsupportedError(name, v1.IPv4Protocol)
+	}
+	if len(ipv6Pool) == 0 {
+		return NewDualStackUnsupportedError(name, v1.IPv6Protocol)
+	}
+	return nil
+}
+
+// getIPFamilyOrder returns the IP families that should be used to allocate the addresses of the service.
+// The families listed in the IPFamilyOrderAnnotation take precedence over service.Spec.IPFamilies, every
+// family listed in the annotation must have a pool configured.
+func getIPFamilyOrder(service *v1.Service, pool string) ([]v1.IPFamily, error) {
+	value, ok := service.Annotations[IPFamilyOrderAnnotation]
+	if !ok || len(value) == 0 {
+		return service.Spec.IPFamilies, nil
+	}
+
+	var families []v1.IPFamily
+	for _, f := range strings.Split(value, ",") {
+		var family v1.IPFamily
+		switch strings.ToLower(strings.TrimSpace(f)) {
+		case "ipv4":
+			family = v1.IPv4Protocol
+		case "ipv6":
+			family = v1.IPv6Protocol
+		default:
+			return nil, fmt.Errorf("invalid IP family [%s] in annotation '%s', must be one of ipv4 or ipv6", f, IPFamilyOrderAnnotation)
+		}
+		for _, existing := range families {
+			if existing == family {
+				return nil, fmt.Errorf("IP family [%s] is listed more than once in annotation '%s'", f, IPFamilyOrderAnnotation)
+			}
+		}
+		families = append(families, family)
+	}
+
+	// A single stack service only gets one address, so only an annotation naming exactly one family makes sense
+	policy := service.Spec.IPFamilyPolicy
+	if (policy == nil || *policy == v1.IPFamilyPolicySingleStack) && len(families) != 1 {
+		klog.InfoS("Service is single stack, ignoring the annotation listing several IP families", "service", klog.KObj(service),
+			"annotation", IPFamilyOrderAnnotation, "families", len(families))
+		return service.Spec.IPFamilies, nil
+	}
+
+	if isDHCPPool(pool) {
+		return families, nil
+	}
+	ipv4Pool, ipv6Pool, err := splitPoolByIPFamily(pool)
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range families {
+		if (family == v1.IPv4Protocol && len(ipv4Pool) == 0) || (family == v1.IPv6Protocol && len(ipv6Pool) == 0) {
+			return nil, fmt.Errorf("IP family [%s] requested by annotation '%s' has no pool configured", family, IPFamilyOrderAnnotation)
+		}
+	}
+	return families, nil
+}
+
+func discoverAddress(ctx context.Context, namespace, pool string, inUseIPSet *netipx.IPSet, opts allocationOptions) (vip string, err error) {
+	// Check if DHCP is required
+	if pool == "0.0.0.0/32" {
+		return "0.0.0.0", nil
+	}
+
+	// The search order doesn't apply to a deterministic search
+	if opts.deterministic {
+		opts.descOrder = false
+	}
+
+	// The addresses of a host list are searched in the order they are listed, not as a logical pool
+	if ipam.IsHostList(pool) {
+		if opts.count > 1 {
+			return "", fmt.Errorf("a block of addresses can't be allocated from the host list [%s]", pool)
+		}
+		if opts.deterministic {
+			hosts := strings.Split(pool, ",")
+			sortByFirstAddress(hosts)
+			// The error names the pool as configured
+			vip, err = ipam.FindAvailableHostFromList(ctx, namespace, strings.Join(hosts, ","), inUseIPSet, false)
+			if _, outOfIPs := err.(*ipam.OutOfIPsError); outOfIPs {
+				return "", ipam.NewOutOfIPsError(namespace, pool, false)
+			}
+			return vip, err
+		}
+		return ipam.FindAvailableHostFromList(ctx, namespace, pool, inUseIPSet, opts.descOrder)
+	}
+
+	// Check if ip pool contains a cidr, if not assume it is a range
+	isCidr := strings.Contains(pool, "/")
+
+	// Search the comma separated pools in the order they are configured, and only
+	// give up once every one of them is exhausted. The pools form a single logical
+	// pool, the descending order searches it from the end of the last pool.
+	subPools := strings.Split(pool, ",")
+	if opts.deterministic {
+		sortByFirstAddress(subPools)
+	} else if opts.descOrder {
+		slices.Reverse(subPools)
+	}
+	for _, subPool := range subPools {
+		if !matchesCIDRHint(subPool, opts.cidr) {
+			continue
+		}
+		var window netipx.IPRange
+		var windowed bool
+		if isCidr && (len(opts.hostMin) != 0 || len(opts.hostMax) != 0) {
+			window, windowed, err = ipam.CidrHostWindow(subPool, opts.hostMin, opts.hostMax)
+			if err != nil {
+				return "", err
+			}
+		}
+		switch {
+		case opts.count > 1 && opts.step > 1:
+			return "", fmt.Errorf("a block of addresses can't be allocated from the stepped pool [%s]", pool)
+		case opts.count > 1 && windowed:
+			return "", fmt.Errorf("a block of addresses can't be allocated from the pool [%s] restricted by min and max", pool)
+		case opts.count > 1:
+			var block []netip.Addr
+			block, err = ipam.FindAvailableBlock(ctx, namespace, subPool, opts.count, inUseIPSet, opts.descOrder)
+			if err == nil {
+				vips := make([]string, 0, len(block))
+				for _, addr := range block {
+					vips = append(vips, addr.String())
+				}
+				vip = strings.Join(vips, ",")
+			}
+		case windowed:
+			vip, err = ipam.FindAvailableHostInWindow(ctx, namespace, subPool, window, inUseIPSet, opts.descOrder)
+		case isCidr && opts.step > 1:
+			vip, err = ipam.FindAvailableSteppedHostFromCidr(ctx, namespace, subPool, opts.step, inUseIPSet, opts.descOrder)
+		case isCidr && ipam.IsLargeIPv6Cidr(subPool) && !opts.deterministic:
+			// Large IPv6 cidrs are probed randomly, so the search order doesn't apply to them
+			vip, err = ipam.FindRandomHostFromCidr(ctx, namespace, subPool, inUseIPSet)
+		case isCidr:
+			vip, err = ipam.FindAvailableHostFromCidr(ctx, namespace, subPool, inUseIPSet, opts.descOrder)
+		default:
+			vip, err = ipam.FindAvailableHostFromRange(ctx, namespace, subPool, inUseIPSet, opts.descOrder)
+		}
+		if err == nil {
+			return vip, nil
+		}
+		var noBlock *ipam.NoContiguousBlockError
+		if _, outOfIPs := err.(*ipam.OutOfIPsError); !outOfIPs && !errors.As(err, &noBlock) {
+			return "", err
+		}
+	}
+
+	if opts.count > 1 {
+		return "", ipam.NewNoContiguousBlockError(namespace, pool, opts.count)
+	}
+	return "", ipam.NewOutOfIPsError(namespace, pool, isCidr)
+}
+
+// sortByFirstAddress sorts the cidrs, ranges or hosts of a pool by their first address, entries that can't be
+// parsed are sorted first and fail the search
+func sortByFirstAddress(entries []string) {
+	first := func(entry string) netip.Addr {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			return prefix.Masked().Addr()
+		}
+		start, _, _ := strings.Cut(entry, "-")
+		addr, _ := netip.ParseAddr(start)
+		return addr
+	}
+	slices.SortStableFunc(entries, func(a, b string) int {
+		return first(a).Compare(first(b))
+	})
+}
+
+// getCIDRHint returns the cidr of the LoadbalancerCIDRAnnotation of the service, which must be one of the cidrs of the pool
+func getCIDRHint(service *v1.Service, pool string) (netip.Prefix, error) {
+	value, ok := service.Annotations[LoadbalancerCIDRAnnotation]
+	if !ok || len(value) == 0 {
+		return netip.Prefix{}, nil
+	}
+	hint, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr [%s] in annotation '%s': %v", value, LoadbalancerCIDRAnnotation, err)
+	}
+	if strings.Contains(pool, "/") {
+		for _, subPool := range strings.Split(pool, ",") {
+			if prefix, err := netip.ParsePrefix(subPool); err == nil && prefix.Masked() == hint.Masked() {
+				return hint, nil
+			}
+		}
+	}
+	return netip.Prefix{}, fmt.Errorf("cidr [%s] in annotation '%s' is not one of the cidrs of the pool [%s]", value, LoadbalancerCIDRAnnotation, pool)
+}
+
+// matchesCIDRHint returns true if the cidr of the pool can be searched for the cidr hint. Only the
+// hinted cidr is searched in the pool of its IP family, the pool of the other IP family isn't restricted.
+func matchesCIDRHint(subPool string, hint netip.Prefix) bool {
+	if !hint.IsValid() {
+		return true
+	}
+	prefix, err := netip.ParsePrefix(subPool)
+	if err != nil || prefix.Addr().Is4() != hint.Addr().Is4() {
+		return true
+	}
+	return prefix.Masked() == hint.Masked()
 }
 
 func getKubevipImplementationLabel() string {
-	return fmt.Sprintf("%s=%s", ImplementationLabelKey, ImplementationLabelValue)
+	return fmt.Sprintf("%s=%s", ImplementationLabel, ImplementationValue)
+}
+
+// validateServiceKeys checks that the configured annotation and label of the services are valid keys and values
+func validateServiceKeys() error {
+	for _, key := range []string{IPsAnnotation, ImplementationLabel} {
+		if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+			return fmt.Errorf("invalid service annotation or label key [%s]: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	if len(ImplementationValue) == 0 {
+		return errors.New("the implementation label value must not be empty")
+	}
+	if errs := validation.IsValidLabelValue(ImplementationValue); len(errs) != 0 {
+		return fmt.Errorf("invalid implementation label value [%s]: %s", ImplementationValue, strings.Join(errs, ", "))
+	}
+	return nil
 }
 
-func getSearchOrder(cm *v1.ConfigMap) (descOrder bool) {
+// getSearchOrder returns true if addresses should be searched in descending order, a FromEndAnnotation set to true
+// always searches from the end, otherwise the SearchOrderAnnotation of the service takes precedence over the
+// search order of the pool, set by an IPPool, and the search-order of the configmap
+func getSearchOrder(cm *v1.ConfigMap, service *v1.Service, poolSearchOrder string) (descOrder bool) {
+	if value, ok := service.Annotations[FromEndAnnotation]; ok {
+		fromEnd, err := strconv.ParseBool(value)
+		if err != nil {
+			klog.InfoS("Ignoring invalid value of annotation, must be true or false", "service", klog.KObj(service), "annotation", FromEndAnnotation, "value", value)
+		} else if fromEnd {
+			return true
+		}
+	}
+	if searchOrder, ok := service.Annotations[SearchOrderAnnotation]; ok {
+		switch searchOrder {
+		case "asc":
+			return false
+		case "desc":
+			return true
+		default:
+			klog.InfoS("Invalid value of annotation, must be one of asc or desc, using the configmap search order", "service", klog.KObj(service),
+				"annotation", SearchOrderAnnotation, "value", searchOrder)
+		}
+	}
+	if len(poolSearchOrder) != 0 {
+		return poolSearchOrder == "desc"
+	}
 	if searchOrder, ok := cm.Data["search-order"]; ok {
 		if searchOrder == "desc" {
 			return true
@@ -411,6 +2345,120 @@ func getSearchOrder(cm *v1.ConfigMap) (descOrder bool) {
 	return false
 }
 
+// familySearchOrderKeys are the configmap keys overriding the search-order for the addresses of an IP family
+var familySearchOrderKeys = map[v1.IPFamily]string{
+	v1.IPv4Protocol: "search-order-ipv4",
+	v1.IPv6Protocol: "search-order-ipv6",
+}
+
+// getFamilySearchOrders returns the search order of the IP families whose search-order-ipv4 or search-order-ipv6 is set
+// in the configmap. The key only replaces the search-order of the configmap, the annotations of the service and the
+// search order of the pool still take precedence.
+func getFamilySearchOrders(cm *v1.ConfigMap, service *v1.Service, poolSearchOrder string) map[v1.IPFamily]bool {
+	var descOrders map[v1.IPFamily]bool
+	for family, key := range familySearchOrderKeys {
+		searchOrder, ok := cm.Data[key]
+		if !ok {
+			continue
+		}
+		if descOrders == nil {
+			descOrders = map[v1.IPFamily]bool{}
+		}
+		descOrders[family] = getSearchOrder(&v1.ConfigMap{Data: map[string]string{"search-order": searchOrder}}, service, poolSearchOrder)
+	}
+	return descOrders
+}
+
+// getIPCount returns the number of contiguous addresses of the LoadbalancerIPCountAnnotation of the service,
+// which can't exceed the max-vips-per-service of the configmap. Blocks are only allocated to single stack services.
+func getIPCount(cm *v1.ConfigMap, service *v1.Service, ipFamilyPolicy *v1.IPFamilyPolicy) (int, error) {
+	value, ok := service.Annotations[LoadbalancerIPCountAnnotation]
+	if !ok || len(value) == 0 {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid value [%s] for annotation '%s', must be a positive integer", value, LoadbalancerIPCountAnnotation)
+	}
+	if count == 1 {
+		return count, nil
+	}
+	if ipFamilyPolicy != nil && *ipFamilyPolicy != v1.IPFamilyPolicySingleStack {
+		return 0, fmt.Errorf("annotation '%s' is only supported by single stack services", LoadbalancerIPCountAnnotation)
+	}
+	if maxValue, ok := cm.Data["max-vips-per-service"]; ok {
+		maxVIPs, err := strconv.Atoi(maxValue)
+		if err != nil || maxVIPs < 1 {
+			return 0, fmt.Errorf("invalid value [%s] for max-vips-per-service, must be a positive integer", maxValue)
+		}
+		if count > maxVIPs {
+			return 0, fmt.Errorf("service requests %d addresses, but max-vips-per-service only allows %d addresses per service", count, maxVIPs)
+		}
+	}
+	return count, nil
+}
+
+// applyMaxVIPsPerService returns the IP family policy the addresses of the service are allocated with, limited
+// by the max-vips-per-service of the configmap. With a limit of one address a RequireDualStack service is
+// refused, while a PreferDualStack service is only allocated an address of its first IP family.
+func applyMaxVIPsPerService(cm *v1.ConfigMap, service *v1.Service) (*v1.IPFamilyPolicy, error) {
+	policy := service.Spec.IPFamilyPolicy
+	value, ok := cm.Data["max-vips-per-service"]
+	if !ok || policy == nil || *policy == v1.IPFamilyPolicySingleStack {
+		return policy, nil
+	}
+	maxVIPs, err := strconv.Atoi(value)
+	if err != nil || maxVIPs < 1 {
+		return nil, fmt.Errorf("invalid value [%s] for max-vips-per-service, must be a positive integer", value)
+	}
+	// A dual stack service is allocated at most one address per IP family
+	if maxVIPs >= 2 {
+		return policy, nil
+	}
+	if *policy == v1.IPFamilyPolicyRequireDualStack {
+		return nil, fmt.Errorf("service requires dual-stack addresses, but max-vips-per-service only allows %d address per service", maxVIPs)
+	}
+	klog.InfoS("Service prefers dual-stack addresses, but max-vips-per-service only allows a single address, allocating a single address",
+		"service", klog.KObj(service), "maxVIPs", maxVIPs)
+	singleStack := v1.IPFamilyPolicySingleStack
+	return &singleStack, nil
+}
+
+// renderFamilyResult renders the outcome of the allocation of one IP family of a dual-stack service
+func renderFamilyResult(family v1.IPFamily, vip string, err error) string {
+	if err != nil {
+		return fmt.Sprintf("\n\t- %s: %s", family, err)
+	}
+	return fmt.Sprintf("\n\t- %s: address [%s] is available", family, vip)
+}
+
+// MultiError aggregates the errors of the IP families of a dual-stack service. The message renders them for the
+// logs and events, errors.As and errors.Is find the aggregated errors, i.e. an ipam.OutOfIPsError
+type MultiError struct {
+	msg  string
+	errs []error
+}
+
+// newMultiError returns a MultiError with the message and the errors that aren't nil
+func newMultiError(msg string, errs ...error) *MultiError {
+	e := &MultiError{msg: msg}
+	for _, err := range errs {
+		if err != nil {
+			e.errs = append(e.errs, err)
+		}
+	}
+	return e
+}
+
+func (e *MultiError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the aggregated errors
+func (e *MultiError) Unwrap() []error {
+	return e.errs
+}
+
 func renderErrors(errs ...error) string {
 	s := strings.Builder{}
 	for _, err := range errs {
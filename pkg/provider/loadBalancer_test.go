@@ -1,15 +1,31 @@
 package provider
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
 	"github.com/stretchr/testify/assert"
 	"go4.org/netipx"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/cloud-provider/api"
+	servicehelper "k8s.io/cloud-provider/service/helpers"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
 )
 
 func Test_DiscoveryPoolCIDR(t *testing.T) {
@@ -67,11 +83,12 @@ func Test_DiscoveryPoolCIDR(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotString, gotBool, err := discoverPool(&tt.args.data, tt.args.cidr, "") // #nosec G601
+			gotPool, err := discoverPool(&tt.args.data, tt.args.cidr, "", "") // #nosec G601
 			if (err != nil) != tt.wantErr {
 				t.Errorf("discoverPool() error: %v, expected: %v", err, tt.wantErr)
 				return
 			}
+			gotString, gotBool := gotPool.addresses, gotPool.global
 			if !assert.EqualValues(t, gotString, tt.want) && !assert.EqualValues(t, gotBool, tt.wantBool) {
 				t.Errorf("discoverPool() returned: %s : %v, expected: %s : %v", gotString, gotBool, tt.want, tt.wantBool)
 			}
@@ -134,11 +151,12 @@ func Test_DiscoveryPoolRange(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotString, gotBool, err := discoverPool(&tt.args.data, tt.args.ipRange, "") // #nosec G601
+			gotPool, err := discoverPool(&tt.args.data, tt.args.ipRange, "", "") // #nosec G601
 			if (err != nil) != tt.wantErr {
 				t.Errorf("discoverPool() error: %v, expected: %v", err, tt.wantErr)
 				return
 			}
+			gotString, gotBool := gotPool.addresses, gotPool.global
 			if !assert.EqualValues(t, gotString, tt.want) && !assert.EqualValues(t, gotBool, tt.wantBool) {
 				t.Errorf("discoverPool() returned: %s : %v, expected: %s : %v", gotString, gotBool, tt.want, tt.wantBool)
 			}
@@ -218,7 +236,7 @@ func Test_DiscoveryAddressCIDR(t *testing.T) {
 				return
 			}
 
-			gotString, err := discoverAddress(tt.args.namespace, tt.args.pool, s, false)
+			gotString, err := discoverAddress(context.Background(), tt.args.namespace, tt.args.pool, s, allocationOptions{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("discoverAddress() error: %v, expected: %v", err, tt.wantErr)
 				return
@@ -302,7 +320,7 @@ func Test_DiscoveryAddressRange(t *testing.T) {
 				return
 			}
 
-			gotString, err := discoverAddress(tt.args.namespace, tt.args.pool, s, false)
+			gotString, err := discoverAddress(context.Background(), tt.args.namespace, tt.args.pool, s, allocationOptions{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("discoverAddress() error: %v, expected: %v", err, tt.wantErr)
 				return
@@ -314,6 +332,90 @@ func Test_DiscoveryAddressRange(t *testing.T) {
 	}
 }
 
+func Test_DiscoveryAddressMultiplePools(t *testing.T) {
+	type args struct {
+		pool               string
+		existingServiceIPS []string
+		descOrder          bool
+	}
+
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "first cidr has free addresses",
+			args: args{
+				pool:               "192.168.5.0/29,192.168.1.0/29",
+				existingServiceIPS: []string{"192.168.5.1"},
+			},
+			want: "192.168.5.2",
+		},
+		{
+			name: "first cidr exhausted, rolls over to the second cidr",
+			args: args{
+				pool:               "192.168.5.0/30,192.168.1.0/30",
+				existingServiceIPS: []string{"192.168.5.1", "192.168.5.2"},
+			},
+			want: "192.168.1.1",
+		},
+		{
+			name: "first cidr exhausted, rolls over to the second cidr, desc order",
+			args: args{
+				pool:               "192.168.5.0/29,192.168.1.0/29",
+				existingServiceIPS: []string{"192.168.5.1", "192.168.5.2", "192.168.5.3", "192.168.5.4", "192.168.5.5", "192.168.5.6"},
+				descOrder:          true,
+			},
+			want: "192.168.1.6",
+		},
+		{
+			name: "first range exhausted, rolls over to the second range",
+			args: args{
+				pool:               "10.10.10.8-10.10.10.9,10.10.10.2-10.10.10.3",
+				existingServiceIPS: []string{"10.10.10.8", "10.10.10.9"},
+			},
+			want: "10.10.10.2",
+		},
+		{
+			name: "all cidrs exhausted",
+			args: args{
+				pool:               "192.168.5.0/30,192.168.1.0/30",
+				existingServiceIPS: []string{"192.168.5.1", "192.168.5.2", "192.168.1.1", "192.168.1.2"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for i := range tt.args.existingServiceIPS {
+				builder.Add(netip.MustParseAddr(tt.args.existingServiceIPS[i]))
+			}
+			s, err := builder.IPSet()
+			if err != nil {
+				t.Errorf("discoverAddress() error = %v", err)
+				return
+			}
+
+			gotString, err := discoverAddress(context.Background(), "multiple-pools", tt.args.pool, s, allocationOptions{descOrder: tt.args.descOrder})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("discoverAddress() error: %v, expected: %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				if _, outOfIPs := err.(*ipam.OutOfIPsError); !outOfIPs {
+					t.Errorf("discoverAddress() error: %v, expected OutOfIPsError", err)
+				}
+				return
+			}
+			assert.EqualValues(t, tt.want, gotString)
+		})
+	}
+}
+
 func ipFamilyPolicyPtr(p v1.IPFamilyPolicy) *v1.IPFamilyPolicy {
 	return &p
 }
@@ -637,7 +739,7 @@ func Test_discoverVIPs(t *testing.T) {
 				return
 			}
 
-			gotString, err := discoverVIPs("discover-vips-test-ns", tt.args.pool, s, false, tt.args.ipFamilyPolicy, tt.args.ipFamilies)
+			gotString, err := discoverVIPs(context.Background(), "discover-vips-test-ns", tt.args.pool, s, allocationOptions{}, tt.args.ipFamilyPolicy, tt.args.ipFamilies)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("discoverVIP() error: %v, expected: %v", err, tt.wantErr)
 				return
@@ -717,7 +819,8 @@ func Test_syncLoadBalancer(t *testing.T) {
 						"implementation": "kube-vip",
 					},
 					Annotations: map[string]string{
-						"kube-vip.io/loadbalancerIPs": "192.168.1.1",
+						"kube-vip.io/loadbalancerIPs":  "192.168.1.1",
+						"kube-vip.io/allocationSource": "pool:cidr-global",
 					},
 				},
 				Spec: v1.ServiceSpec{
@@ -775,7 +878,8 @@ func Test_syncLoadBalancer(t *testing.T) {
 						"implementation": "kube-vip",
 					},
 					Annotations: map[string]string{
-						"kube-vip.io/loadbalancerIPs": "fe80::10",
+						"kube-vip.io/loadbalancerIPs":  "fe80::10",
+						"kube-vip.io/allocationSource": "pool:cidr-global",
 					},
 				},
 				Spec: v1.ServiceSpec{
@@ -809,7 +913,8 @@ func Test_syncLoadBalancer(t *testing.T) {
 						"implementation": "kube-vip",
 					},
 					Annotations: map[string]string{
-						"kube-vip.io/loadbalancerIPs": "192.168.1.1",
+						"kube-vip.io/loadbalancerIPs":  "192.168.1.1",
+						"kube-vip.io/allocationSource": "pool:cidr-global",
 					},
 				},
 				Spec: v1.ServiceSpec{
@@ -847,7 +952,8 @@ func Test_syncLoadBalancer(t *testing.T) {
 						"implementation": "kube-vip",
 					},
 					Annotations: map[string]string{
-						"kube-vip.io/loadbalancerIPs": "fe80::10,10.120.120.1",
+						"kube-vip.io/loadbalancerIPs":  "fe80::10,10.120.120.1",
+						"kube-vip.io/allocationSource": "pool:cidr-global",
 					},
 				},
 				Spec: v1.ServiceSpec{
@@ -857,6 +963,51 @@ func Test_syncLoadBalancer(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "dualstack loadbalancer with IP family order annotation",
+			originalService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Annotations: map[string]string{
+						"kube-vip.io/loadbalancerIPFamilyOrder": "ipv6,ipv4",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+					IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+				},
+			},
+
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-global": "10.120.120.1/24,fe80::10/126",
+				},
+			},
+			expectedService: v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						"implementation": "kube-vip",
+					},
+					Annotations: map[string]string{
+						"kube-vip.io/loadbalancerIPFamilyOrder": "ipv6,ipv4",
+						"kube-vip.io/loadbalancerIPs":           "fe80::10,10.120.120.1",
+						"kube-vip.io/allocationSource":          "pool:cidr-global",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+					IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+					LoadBalancerIP: "fe80::10",
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -868,11 +1019,7 @@ func Test_syncLoadBalancer(t *testing.T) {
 				cm = tt.poolConfigMap.GetObjectMeta().GetName()
 			}
 
-			mgr := &kubevipLoadBalancerManager{
-				kubeClient:     fake.NewSimpleClientset(),
-				namespace:      ns,
-				cloudConfigMap: cm,
-			}
+			mgr := newLoadBalancer(fake.NewSimpleClientset(), ns, cm, nil)
 
 			// create dummy service
 			_, err := mgr.kubeClient.CoreV1().Services("test").Create(context.Background(), &tt.originalService, metav1.CreateOptions{}) // #nosec G601
@@ -888,7 +1035,7 @@ func Test_syncLoadBalancer(t *testing.T) {
 				}
 			}
 
-			_, err = syncLoadBalancer(context.Background(), mgr.kubeClient, &tt.originalService, cm, ns) // #nosec G601
+			_, err = mgr.syncLoadBalancer(context.Background(), &tt.originalService, nil) // #nosec G601
 			if err != nil {
 				t.Error(err)
 			}
@@ -907,3 +1054,3984 @@ func Test_syncLoadBalancer(t *testing.T) {
 		})
 	}
 }
+
+func Test_syncLoadBalancerEvents(t *testing.T) {
+	tests := []struct {
+		name          string
+		poolConfigMap *v1.ConfigMap
+		inUseIP       string
+		wantErr       bool
+		wantEvent     string
+	}{
+		{
+			name: "allocated address emits normal event",
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-test": "192.168.1.1/24",
+				},
+			},
+			wantEvent: "Normal IPAllocated Allocated address(es) [192.168.1.1] from pool [cidr-test]",
+		},
+		{
+			name: "exhausted pool emits warning event",
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"range-global": "192.168.1.1-192.168.1.1",
+				},
+			},
+			inUseIP:   "192.168.1.1",
+			wantErr:   true,
+			wantEvent: "Warning IPAllocationFailed Unable to allocate address from pool [range-global]: no addresses available in [test] range [192.168.1.1-192.168.1.1]",
+		},
+		{
+			name: "missing pool emits warning event",
+			poolConfigMap: &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      KubeVipClientConfig,
+					Namespace: KubeVipClientConfigNamespace,
+				},
+				Data: map[string]string{
+					"cidr-other": "192.168.1.1/24",
+				},
+			},
+			wantErr:   true,
+			wantEvent: "Warning IPAllocationFailed Unable to find an address pool: no address pools could be found for namespace [test] in configMap [kubevip]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			mgr := newLoadBalancer(fake.NewSimpleClientset(), KubeVipClientConfigNamespace, KubeVipClientConfig, recorder)
+
+			if tt.inUseIP != "" {
+				existing := &v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "test",
+						Name:      "existing",
+						Labels: map[string]string{
+							ImplementationLabelKey: ImplementationLabelValue,
+						},
+						Annotations: map[string]string{
+							LoadbalancerIPsAnnotations: tt.inUseIP,
+						},
+					},
+				}
+				if _, err := mgr.kubeClient.CoreV1().Services("test").Create(context.Background(), existing, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+			}
+			if _, err := mgr.kubeClient.CoreV1().Services("test").Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := mgr.kubeClient.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Create(context.Background(), tt.poolConfigMap, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := mgr.syncLoadBalancer(context.Background(), svc, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("syncLoadBalancer() error: %v, expected: %v", err, tt.wantErr)
+			}
+
+			select {
+			case event := <-recorder.Events:
+				assert.Equal(t, tt.wantEvent, event)
+			default:
+				t.Errorf("expected event %q, got none", tt.wantEvent)
+			}
+		})
+	}
+}
+
+func Test_deleteLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name      string
+		service   *v1.Service
+		wantEvent string
+	}{
+		{
+			name: "kube-vip service releases its address",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						ImplementationLabelKey: ImplementationLabelValue,
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotations: "192.168.1.1",
+					},
+				},
+			},
+			wantEvent: "Normal IPReleased Released address(es) [192.168.1.1]",
+		},
+		{
+			name: "non kube-vip service is ignored",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+					Labels: map[string]string{
+						ImplementationLabelKey: "other",
+					},
+					Annotations: map[string]string{
+						LoadbalancerIPsAnnotations: "192.168.1.1",
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			mgr := newLoadBalancer(fake.NewSimpleClientset(), KubeVipClientConfigNamespace, KubeVipClientConfig, recorder)
+
+			if err := mgr.EnsureLoadBalancerDeleted(context.Background(), "", tt.service); err != nil {
+				t.Error(err)
+			}
+
+			select {
+			case event := <-recorder.Events:
+				assert.Equal(t, tt.wantEvent, event)
+			default:
+				if tt.wantEvent != "" {
+					t.Errorf("expected event %q, got none", tt.wantEvent)
+				}
+			}
+		})
+	}
+}
+
+func Test_deleteLoadBalancerClearsService(t *testing.T) {
+	tests := []struct {
+		name    string
+		lbClass *string
+		// deleteLoadBalancer is called by the controller syncing the service
+		deleteLoadBalancer func(mgr *kubevipLoadBalancerManager, svc *v1.Service) error
+	}{
+		{
+			name: "cloud-provider service controller",
+			deleteLoadBalancer: func(mgr *kubevipLoadBalancerManager, svc *v1.Service) error {
+				return mgr.EnsureLoadBalancerDeleted(context.Background(), "", svc)
+			},
+		},
+		{
+			name:    "loadBalancerClass controller",
+			lbClass: ptr.To(LoadbalancerClass),
+			deleteLoadBalancer: func(mgr *kubevipLoadBalancerManager, svc *v1.Service) error {
+				c := &loadbalancerClassServiceController{kubeClient: mgr.kubeClient, recorder: mgr.recorder, lbManager: mgr}
+				return c.processServiceCreateOrUpdate(svc)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newKubevipService("test", "svc", "10.0.0.1")
+			svc.Annotations[AllocationSourceAnnotation] = "pool:cidr-global"
+			svc.Spec.Type = v1.ServiceTypeLoadBalancer
+			svc.Spec.LoadBalancerClass = tt.lbClass
+			svc.Finalizers = []string{servicehelper.LoadBalancerCleanupFinalizer}
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, svc)
+
+			// The service is changed to a ClusterIP service
+			svc.Spec.Type = v1.ServiceTypeClusterIP
+			svc.Spec.LoadBalancerClass = nil
+			if err := tt.deleteLoadBalancer(mgr, svc); err != nil {
+				t.Fatal(err)
+			}
+			updated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NotContains(t, updated.Annotations, IPsAnnotation)
+			assert.NotContains(t, updated.Annotations, AllocationSourceAnnotation)
+			assert.NotContains(t, updated.Labels, ImplementationLabel)
+
+			// The address is allocatable again
+			got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "new"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "10.0.0.1", got)
+		})
+	}
+}
+
+func Test_getIPFamilyOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		policy     *v1.IPFamilyPolicy
+		families   []v1.IPFamily
+		pool       string
+		want       []v1.IPFamily
+		wantErr    bool
+	}{
+		{
+			name:     "no annotation uses service ip families",
+			policy:   ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+			families: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			pool:     "10.10.10.8-10.10.10.15,fd00::1-fd00::10",
+			want:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+		{
+			name:       "annotation overrides service ip families",
+			annotation: "ipv6,ipv4",
+			policy:     ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+			families:   []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			pool:       "10.10.10.8-10.10.10.15,fd00::1-fd00::10",
+			want:       []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+		},
+		{
+			name:       "annotation is case insensitive",
+			annotation: "IPv6, IPv4",
+			policy:     ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			pool:       "10.10.10.8/29,fd00::1/120",
+			want:       []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+		},
+		{
+			name:       "annotation lists a family without pool",
+			annotation: "ipv6,ipv4",
+			policy:     ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+			pool:       "10.10.10.8-10.10.10.15",
+			wantErr:    true,
+		},
+		{
+			name:       "annotation lists an invalid family",
+			annotation: "ipv5",
+			policy:     ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+			pool:       "10.10.10.8-10.10.10.15",
+			wantErr:    true,
+		},
+		{
+			name:       "annotation lists a family twice",
+			annotation: "ipv4,ipv4",
+			policy:     ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+			pool:       "10.10.10.8-10.10.10.15",
+			wantErr:    true,
+		},
+		{
+			name:       "single stack service uses annotation with one family",
+			annotation: "ipv6",
+			pool:       "10.10.10.8-10.10.10.15,fd00::1-fd00::10",
+			want:       []v1.IPFamily{v1.IPv6Protocol},
+		},
+		{
+			name:       "single stack service ignores annotation with two families",
+			annotation: "ipv6,ipv4",
+			policy:     ipFamilyPolicyPtr(v1.IPFamilyPolicySingleStack),
+			families:   []v1.IPFamily{v1.IPv4Protocol},
+			pool:       "10.10.10.8-10.10.10.15",
+			want:       []v1.IPFamily{v1.IPv4Protocol},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "name",
+				},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: tt.policy,
+					IPFamilies:     tt.families,
+				},
+			}
+			if tt.annotation != "" {
+				svc.Annotations = map[string]string{IPFamilyOrderAnnotation: tt.annotation}
+			}
+
+			got, err := getIPFamilyOrder(svc, tt.pool)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getIPFamilyOrder() error: %v, expected: %v", err, tt.wantErr)
+				return
+			}
+			assert.EqualValues(t, tt.want, got)
+		})
+	}
+}
+
+// newTestLoadBalancer returns a manager backed by a fake clientset that holds the pool config map and the services
+func newTestLoadBalancer(t *testing.T, data map[string]string, services ...*v1.Service) *kubevipLoadBalancerManager {
+	t.Helper()
+	mgr := newLoadBalancer(fake.NewSimpleClientset(), KubeVipClientConfigNamespace, KubeVipClientConfig, record.NewFakeRecorder(100))
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      KubeVipClientConfig,
+			Namespace: KubeVipClientConfigNamespace,
+		},
+		Data: data,
+	}
+	if _, err := mgr.kubeClient.CoreV1().ConfigMaps(cm.Namespace).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, svc := range services {
+		if _, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mgr
+}
+
+// newKubevipService returns a service that has been allocated the addresses by kube-vip
+func newKubevipService(namespace, name, addresses string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels: map[string]string{
+				ImplementationLabel: ImplementationValue,
+			},
+			Annotations: map[string]string{
+				IPsAnnotation: addresses,
+			},
+		},
+	}
+}
+
+// syncNewService creates a service without an address and returns the address(es) kube-vip allocated to it
+func syncNewService(t *testing.T, mgr *kubevipLoadBalancerManager, svc *v1.Service) (string, error) {
+	t.Helper()
+	if _, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.syncLoadBalancer(context.Background(), svc, nil); err != nil {
+		return "", err
+	}
+	updated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return updated.Annotations[IPsAnnotation], nil
+}
+
+func Test_syncLoadBalancerPoolReservedKey(t *testing.T) {
+	// exclude-reserved-team-a holds the addresses reserved in cidr-team-a, reserved-team-a the address of the service
+	// a of namespace team
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-global":             "10.0.1.0/29",
+		"cidr-team-a":             "10.0.0.0/29",
+		"exclude-reserved-team-a": "10.0.0.1",
+		"reserved-team-a":         "10.0.2.5",
+	})
+
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.2.5", got)
+	got, err = syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "svc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", got)
+}
+
+func Test_syncLoadBalancerExclusions(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		services []*v1.Service
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "first host of the cidr is excluded",
+			data: map[string]string{
+				"cidr-global":         "10.0.0.0/29",
+				"exclude-cidr-global": "10.0.0.1,10.0.0.6",
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "last host of the cidr is excluded",
+			data: map[string]string{
+				"cidr-global":         "10.0.0.0/29",
+				"exclude-cidr-global": "10.0.0.1,10.0.0.6",
+				"search-order":        "desc",
+			},
+			want: "10.0.0.5",
+		},
+		{
+			name: "excluded cidr in a namespace range",
+			data: map[string]string{
+				"range-test":         "10.0.0.1-10.0.0.10",
+				"exclude-range-test": "10.0.0.0/30",
+			},
+			want: "10.0.0.4",
+		},
+		{
+			name: "excluded address already assigned to a service",
+			data: map[string]string{
+				"cidr-global":         "10.0.0.0/29",
+				"exclude-cidr-global": "10.0.0.1",
+			},
+			services: []*v1.Service{newKubevipService("test", "existing", "10.0.0.1")},
+			want:     "10.0.0.2",
+		},
+		{
+			name: "every address excluded",
+			data: map[string]string{
+				"cidr-global":         "10.0.0.0/30",
+				"exclude-cidr-global": "10.0.0.0/30",
+			},
+			wantErr: true,
+		},
+		{
+			name: "malformed exclusion",
+			data: map[string]string{
+				"cidr-global":         "10.0.0.0/29",
+				"exclude-cidr-global": "10.0.0.300",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, tt.data, tt.services...)
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+
+			got, err := syncNewService(t, mgr, svc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("syncLoadBalancer() error: %v, expected: %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_syncLoadBalancerSearchOrderAnnotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		searchOrder string
+		annotation  string
+		fromEnd     string
+		want        string
+	}{
+		{
+			name: "configmap default",
+			want: "10.0.0.10",
+		},
+		{
+			name:       "annotation descending",
+			annotation: "desc",
+			want:       "10.0.0.12",
+		},
+		{
+			name:        "annotation ascending overrides descending configmap",
+			searchOrder: "desc",
+			annotation:  "asc",
+			want:        "10.0.0.10",
+		},
+		{
+			name:        "invalid annotation falls back to the configmap",
+			searchOrder: "desc",
+			annotation:  "DESCENDING",
+			want:        "10.0.0.12",
+		},
+		{
+			name:    "from the end with the ascending configmap default",
+			fromEnd: "true",
+			want:    "10.0.0.12",
+		},
+		{
+			name:        "from the end with a descending configmap",
+			searchOrder: "desc",
+			fromEnd:     "true",
+			want:        "10.0.0.12",
+		},
+		{
+			name:       "from the end overrides the ascending annotation",
+			annotation: "asc",
+			fromEnd:    "true",
+			want:       "10.0.0.12",
+		},
+		{
+			name:        "not from the end keeps the descending configmap",
+			searchOrder: "desc",
+			fromEnd:     "false",
+			want:        "10.0.0.12",
+		},
+		{
+			name:    "invalid from the end is ignored",
+			fromEnd: "yes",
+			want:    "10.0.0.10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{"range-global": "10.0.0.10-10.0.0.12"}
+			if tt.searchOrder != "" {
+				data["search-order"] = tt.searchOrder
+			}
+			mgr := newTestLoadBalancer(t, data)
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name", Annotations: map[string]string{}}}
+			if tt.annotation != "" {
+				svc.Annotations[SearchOrderAnnotation] = tt.annotation
+			}
+			if tt.fromEnd != "" {
+				svc.Annotations[FromEndAnnotation] = tt.fromEnd
+			}
+
+			got, err := syncNewService(t, mgr, svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("syncLoadBalancer() allocated %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerFamilySearchOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       map[string]string
+		annotation string
+		want       string
+	}{
+		{
+			name: "IPv4 ascending and IPv6 descending",
+			data: map[string]string{"search-order-ipv6": "desc"},
+			want: "10.0.0.10,fd00::12",
+		},
+		{
+			name: "IPv4 descending and IPv6 ascending",
+			data: map[string]string{"search-order": "desc", "search-order-ipv6": "asc"},
+			want: "10.0.0.12,fd00::10",
+		},
+		{
+			name: "both families override the configmap",
+			data: map[string]string{"search-order": "asc", "search-order-ipv4": "desc", "search-order-ipv6": "desc"},
+			want: "10.0.0.12,fd00::12",
+		},
+		{
+			name:       "the annotation takes precedence",
+			data:       map[string]string{"search-order-ipv4": "desc"},
+			annotation: "asc",
+			want:       "10.0.0.10,fd00::10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.data["range-global"] = "10.0.0.10-10.0.0.12,fd00::10-fd00::12"
+			mgr := newTestLoadBalancer(t, tt.data)
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name", Annotations: map[string]string{}},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+					IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+				},
+			}
+			if tt.annotation != "" {
+				svc.Annotations[SearchOrderAnnotation] = tt.annotation
+			}
+
+			got, err := syncNewService(t, mgr, svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("syncLoadBalancer() allocated %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerFamilySearchOrderIPv6Scope(t *testing.T) {
+	for scope, want := range map[string]string{IPv6ScopeULA: "fd00::12", IPv6ScopeGUA: "2001:db8::12"} {
+		t.Run(scope, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{
+				"range-global":      "10.0.0.10-10.0.0.12,fd00::10-fd00::12,2001:db8::10-2001:db8::12",
+				"search-order-ipv4": "asc",
+				"search-order-ipv6": "desc",
+			})
+
+			// The scoped IPv6 address is searched with the search order of IPv6
+			got, err := syncNewService(t, mgr, &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name", Annotations: map[string]string{IPv6ScopeAnnotation: scope}},
+				Spec:       v1.ServiceSpec{IPFamilies: []v1.IPFamily{v1.IPv6Protocol}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func Test_discoverVIPsFamilySearchOrder(t *testing.T) {
+	opts := allocationOptions{familyDescOrder: map[v1.IPFamily]bool{v1.IPv6Protocol: true}}
+	got, err := discoverVIPs(context.Background(), "discover-vips-family-search-order", "10.0.0.0/30,fd00::/126", &netipx.IPSet{}, opts,
+		nil, []v1.IPFamily{v1.IPv6Protocol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "fd00::3", got)
+}
+
+func Test_syncLoadBalancerSkipManagement(t *testing.T) {
+	unmanaged := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "unmanaged",
+			Annotations: map[string]string{
+				LoadbalancerIPsAnnotations: "10.0.0.1",
+				SkipManagementAnnotation:   "true",
+			},
+		},
+	}
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-global":         "10.0.0.0/29",
+		"exclude-cidr-global": "10.0.0.1",
+	}, unmanaged)
+
+	// The unmanaged service is not mutated
+	if _, err := mgr.syncLoadBalancer(context.Background(), unmanaged, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := mgr.kubeClient.CoreV1().Services(unmanaged.Namespace).Get(context.Background(), unmanaged.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, unmanaged.Labels, got.Labels)
+	assert.Equal(t, unmanaged.Annotations, got.Annotations)
+	assert.Empty(t, got.Spec.LoadBalancerIP)
+
+	// An unmanaged service without an address doesn't get one either
+	empty := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "empty",
+			Annotations: map[string]string{SkipManagementAnnotation: "true"},
+		},
+	}
+	addresses, err := syncNewService(t, mgr, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, addresses)
+
+	// The excluded address of the unmanaged service isn't allocated to a managed service
+	addresses, err = syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "managed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", addresses)
+}
+
+func Test_syncLoadBalancerManualAssignment(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	recorder := mgr.recorder.(*record.FakeRecorder)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "manual",
+			Annotations: map[string]string{ManualAssignmentRequiredAnnotation: "true"},
+		},
+	}
+	if _, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every sync leaves the service pending and records that it waits for an address
+	for i := 0; i < 2; i++ {
+		status, err := mgr.syncLoadBalancer(context.Background(), svc, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, status.Ingress)
+		assert.Equal(t, "Normal ManualAssignmentRequired Waiting for an address to be set with the kube-vip.io/loadbalancerIPs annotation", <-recorder.Events)
+	}
+	got, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, got.Annotations[IPsAnnotation])
+	assert.NotContains(t, got.Labels, ImplementationLabel)
+
+	// The address set by the operator is kept and the service is labeled, reallocation doesn't apply
+	got.Annotations[IPsAnnotation] = "10.0.0.5"
+	got.Annotations[ReallocateAnnotation] = "true"
+	got, err = mgr.kubeClient.CoreV1().Services(got.Namespace).Update(context.Background(), got, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.syncLoadBalancer(context.Background(), got, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err = mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.5", got.Annotations[IPsAnnotation])
+	assert.Equal(t, ImplementationValue, got.Labels[ImplementationLabel])
+}
+
+func Test_syncLoadBalancerDuplicateIPs(t *testing.T) {
+	tests := []struct {
+		name               string
+		services           []*v1.Service
+		refuseDuplicateIPs bool
+		wantEvents         []string
+		wantErr            bool
+	}{
+		{
+			name: "no duplicates",
+			services: []*v1.Service{
+				newKubevipService("ns1", "a", "10.0.0.1"),
+				newKubevipService("ns2", "b", "10.0.0.2"),
+			},
+			wantEvents: []string{"Normal IPAllocated Allocated address(es) [10.0.0.3] from pool [cidr-global]"},
+		},
+		{
+			name: "duplicate ipv4 address across namespaces",
+			services: []*v1.Service{
+				newKubevipService("ns1", "a", "10.0.0.1"),
+				newKubevipService("ns2", "b", "10.0.0.1"),
+			},
+			wantEvents: []string{
+				"Warning DuplicateIP Address [10.0.0.1] is assigned to more than one service [ns1/a,ns2/b]",
+				"Warning DuplicateIP Address [10.0.0.1] is assigned to more than one service [ns1/a,ns2/b]",
+				"Normal IPAllocated Allocated address(es) [10.0.0.2] from pool [cidr-global]",
+			},
+		},
+		{
+			name: "duplicate ipv6 address in a different notation",
+			services: []*v1.Service{
+				newKubevipService("ns1", "a", "10.0.0.1,fe80::1"),
+				newKubevipService("ns2", "b", "fe80:0:0::0001"),
+			},
+			wantEvents: []string{
+				"Warning DuplicateIP Address [fe80::1] is assigned to more than one service [ns1/a,ns2/b]",
+				"Warning DuplicateIP Address [fe80::1] is assigned to more than one service [ns1/a,ns2/b]",
+				"Normal IPAllocated Allocated address(es) [10.0.0.2] from pool [cidr-global]",
+			},
+		},
+		{
+			name: "allocation refused",
+			services: []*v1.Service{
+				newKubevipService("ns1", "a", "10.0.0.1"),
+				newKubevipService("ns2", "b", "10.0.0.1"),
+			},
+			refuseDuplicateIPs: true,
+			wantEvents: []string{
+				"Warning DuplicateIP Address [10.0.0.1] is assigned to more than one service [ns1/a,ns2/b]",
+				"Warning DuplicateIP Address [10.0.0.1] is assigned to more than one service [ns1/a,ns2/b]",
+				"Warning IPAllocationFailed Unable to allocate address from pool [cidr-global]: addresses of pool [cidr-global] are assigned to more than one service, refusing to allocate until resolved",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, tt.services...)
+			mgr.refuseDuplicateIPs = tt.refuseDuplicateIPs
+
+			_, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("syncLoadBalancer() error: %v, expected: %v", err, tt.wantErr)
+			}
+
+			recorder := mgr.recorder.(*record.FakeRecorder)
+			for _, want := range tt.wantEvents {
+				select {
+				case event := <-recorder.Events:
+					assert.Equal(t, want, event)
+				default:
+					t.Errorf("expected event %q, got none", want)
+				}
+			}
+		})
+	}
+}
+
+func Test_DiscoveryPoolNamed(t *testing.T) {
+	data := map[string]string{
+		"cidr-pool-edge":   "10.0.1.0/24",
+		"range-pool-infra": "10.0.2.1-10.0.2.10",
+		"cidr-test":        "10.0.3.0/24",
+		"range-global":     "10.0.4.1-10.0.4.10",
+	}
+	tests := []struct {
+		name      string
+		namespace string
+		poolName  string
+		wantKey   string
+		wantPool  string
+		global    bool
+	}{
+		{
+			name:      "named cidr pool takes precedence over the namespace pool",
+			namespace: "test",
+			poolName:  "edge",
+			wantKey:   "cidr-pool-edge",
+			wantPool:  "10.0.1.0/24",
+			global:    true,
+		},
+		{
+			name:      "named range pool",
+			namespace: "other",
+			poolName:  "infra",
+			wantKey:   "range-pool-infra",
+			wantPool:  "10.0.2.1-10.0.2.10",
+			global:    true,
+		},
+		{
+			name:      "unknown named pool falls back to the namespace pool",
+			namespace: "test",
+			poolName:  "unknown",
+			wantKey:   "cidr-test",
+			wantPool:  "10.0.3.0/24",
+		},
+		{
+			name:      "unknown named pool falls back to the global pool",
+			namespace: "other",
+			poolName:  "unknown",
+			wantKey:   "range-global",
+			wantPool:  "10.0.4.1-10.0.4.10",
+			global:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPool, err := discoverPool(&v1.ConfigMap{Data: data}, tt.namespace, tt.poolName, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantKey, gotPool.key)
+			assert.Equal(t, tt.wantPool, gotPool.addresses)
+			assert.Equal(t, tt.global, gotPool.global)
+		})
+	}
+}
+
+func Test_syncLoadBalancerNamedPool(t *testing.T) {
+	// The named pool is shared across namespaces, so addresses in use in other namespaces are skipped
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-pool-edge": "10.0.1.0/29",
+		"cidr-test":      "10.0.3.0/29",
+	}, newKubevipService("other", "existing", "10.0.1.1"))
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "name",
+			Annotations: map[string]string{LoadbalancerPoolAnnotation: "edge"},
+		},
+	}
+	got, err := syncNewService(t, mgr, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.1.2", got)
+}
+
+func Test_syncLoadBalancerMissingConfigMap(t *testing.T) {
+	tests := []struct {
+		name                string
+		autoCreateConfigMap bool
+		wantErr             string
+	}{
+		{
+			name:    "configmap is not created",
+			wantErr: "unable to retrieve kube-vip ipam config from configMap [kubevip] in namespace [kube-system]",
+		},
+		{
+			name:                "empty configmap is created",
+			autoCreateConfigMap: true,
+			wantErr:             "no address pools could be found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newLoadBalancer(fake.NewSimpleClientset(), KubeVipClientConfigNamespace, KubeVipClientConfig, record.NewFakeRecorder(100))
+			mgr.autoCreateConfigMap = tt.autoCreateConfigMap
+
+			_, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}})
+			if err == nil {
+				t.Fatal("expected syncLoadBalancer() to fail")
+			}
+			assert.Contains(t, err.Error(), tt.wantErr)
+
+			cm, err := mgr.kubeClient.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Get(context.Background(), KubeVipClientConfig, metav1.GetOptions{})
+			if !tt.autoCreateConfigMap {
+				assert.True(t, apierrors.IsNotFound(err), "expected configmap to not exist, got %v", err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "true", cm.Annotations[AutoGeneratedConfigMapAnnotation])
+		})
+	}
+}
+
+func Test_discoverVIPsMalformedRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    string
+		wantErr string
+	}{
+		{
+			name:    "start after end",
+			pool:    "192.168.0.20-192.168.0.10",
+			wantErr: "start address is after the end address",
+		},
+		{
+			name:    "start and end of different families",
+			pool:    "192.168.0.10-fe80::10",
+			wantErr: "start and end address are of different IP families",
+		},
+		{
+			name:    "whitespace",
+			pool:    "192.168.0.10 -192.168.0.20",
+			wantErr: "range must not contain whitespace",
+		},
+		{
+			name:    "malformed second range is not partially processed",
+			pool:    "192.168.0.10-192.168.0.20,192.168.0.40-192.168.0.30",
+			wantErr: "start address is after the end address",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := discoverVIPs(context.Background(), "discover-vips-malformed-range", tt.pool, &netipx.IPSet{}, allocationOptions{}, nil, nil)
+			if err == nil {
+				t.Fatal("expected discoverVIPs() to fail")
+			}
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func Test_discoverVIPsRangeExhaustion(t *testing.T) {
+	pool := "192.168.0.10-192.168.0.14"
+	builder := &netipx.IPSetBuilder{}
+	want := []string{"192.168.0.10", "192.168.0.11", "192.168.0.12", "192.168.0.13", "192.168.0.14"}
+	for _, w := range want {
+		inUseIPSet, err := builder.IPSet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := discoverVIPs(context.Background(), "discover-vips-range-exhaustion", pool, inUseIPSet, allocationOptions{}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, w, got)
+		builder.Add(netip.MustParseAddr(got))
+	}
+
+	inUseIPSet, err := builder.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = discoverVIPs(context.Background(), "discover-vips-range-exhaustion", pool, inUseIPSet, allocationOptions{}, nil, nil)
+	if _, outOfIPs := err.(*ipam.OutOfIPsError); !outOfIPs {
+		t.Errorf("expected OutOfIPsError, got %v", err)
+	}
+}
+
+func Test_discoverVIPsRequireDualStackPartial(t *testing.T) {
+	// The IPv6 range is exhausted, the IPv4 address that could be allocated is reported with the exhausted pool
+	inUseIPSet, err := ipam.BuildPoolSet("fe80::10-fe80::11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = discoverVIPs(context.Background(), "discover-vips-partial", "10.10.10.8-10.10.10.15,fe80::10-fe80::11", inUseIPSet, allocationOptions{},
+		ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack), []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol})
+	if err == nil {
+		t.Fatal("expected discoverVIPs() to fail")
+	}
+	assert.Equal(t, "could not allocate required IP addresses for RequireDualStack service: "+
+		"\n\t- IPv4: address [10.10.10.8] is available"+
+		"\n\t- IPv6: no addresses available in [discover-vips-partial] range [fe80::10-fe80::11]", err.Error())
+	var outOfIPs *ipam.OutOfIPsError
+	assert.True(t, errors.As(err, &outOfIPs), "the OutOfIPsError of the IPv6 range is found through the aggregate")
+}
+
+func Test_discoverVIPsPreferDualStackExhausted(t *testing.T) {
+	inUseIPSet, err := ipam.BuildPoolSet("10.10.10.8-10.10.10.9,fe80::10-fe80::11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = discoverVIPs(context.Background(), "discover-vips-exhausted", "10.10.10.8-10.10.10.9,fe80::10-fe80::11", inUseIPSet, allocationOptions{},
+		ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack), []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol})
+	var multiErr *MultiError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("expected a MultiError, got: %v", err)
+	}
+	assert.Len(t, multiErr.Unwrap(), 2)
+	var outOfIPs *ipam.OutOfIPsError
+	assert.True(t, errors.As(err, &outOfIPs))
+	assert.Equal(t, allocationFailureOutOfIPs, allocationFailureReason(err))
+	assert.Equal(t, "could not allocate any IP address for PreferDualStack service: "+
+		"\n\t- no addresses available in [discover-vips-exhausted] range [10.10.10.8-10.10.10.9]"+
+		"\n\t- no addresses available in [discover-vips-exhausted] range [fe80::10-fe80::11]", err.Error())
+}
+
+func Test_syncLoadBalancerDualStackPoolOrder(t *testing.T) {
+	// The IPv6 range of the first pool is exhausted, the RequireDualStack service falls back to the next pool
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"range-global": "10.0.0.10-10.0.0.20,fe80::10-fe80::10",
+		"cidr-global":  "10.1.0.0/29,fe80::1:0/125",
+		"pool-order":   "range-global,cidr-global",
+	}, newKubevipService("test", "existing", "fe80::10"))
+
+	got, err := syncNewService(t, mgr, &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"},
+		Spec: v1.ServiceSpec{
+			IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.1.0.1,fe80::1:0", got)
+}
+
+func Test_PlanLoadBalancer(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, newKubevipService("other", "existing", "10.0.0.1"))
+	ctx := context.Background()
+
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+	if _, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The plan skips the in-use address and doesn't update the service
+	planned, err := PlanLoadBalancer(ctx, mgr.kubeClient, svc, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", planned)
+	got, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, got.Labels)
+	assert.Empty(t, got.Annotations)
+	assert.Empty(t, got.Spec.LoadBalancerIP)
+
+	// The plan matches the actual allocation, which is then accounted for by the next plan
+	if _, err := mgr.syncLoadBalancer(ctx, svc, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err = mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, planned, got.Annotations[LoadbalancerIPsAnnotations])
+
+	planned, err = PlanLoadBalancer(ctx, mgr.kubeClient, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "next"}}, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.3", planned)
+
+	// A service that already has an address keeps it
+	planned, err = PlanLoadBalancer(ctx, mgr.kubeClient, got, KubeVipClientConfig, KubeVipClientConfigNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", planned)
+
+	// A missing configmap is never created by a plan
+	_, err = PlanLoadBalancer(ctx, mgr.kubeClient, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "next"}}, "missing", KubeVipClientConfigNamespace)
+	assert.Error(t, err)
+	_, err = mgr.kubeClient.CoreV1().ConfigMaps(KubeVipClientConfigNamespace).Get(ctx, "missing", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func Test_syncLoadBalancerClass(t *testing.T) {
+	tests := []struct {
+		name              string
+		loadBalancerClass *string
+		want              string
+	}{
+		{
+			name: "no class",
+			want: "10.0.0.1",
+		},
+		{
+			name:              "empty class",
+			loadBalancerClass: ptr.To(""),
+			want:              "10.0.0.1",
+		},
+		{
+			name:              "matching class",
+			loadBalancerClass: ptr.To(LoadbalancerClass),
+			want:              "10.0.0.1",
+		},
+		{
+			name:              "other class",
+			loadBalancerClass: ptr.To("example.com/other-lb"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"},
+				Spec:       v1.ServiceSpec{LoadBalancerClass: tt.loadBalancerClass},
+			}
+			got, err := syncNewService(t, mgr, svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+
+			updated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				assert.Empty(t, updated.Labels)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerAllocationSource(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-dev":       "10.0.0.0/29",
+		"range-global":   "10.0.1.1-10.0.1.10",
+		"cidr-pool-edge": "10.0.2.0/29",
+	})
+	tests := []struct {
+		name string
+		svc  *v1.Service
+		want string
+	}{
+		{
+			name: "namespace pool",
+			svc:  &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "name"}},
+			want: "pool:cidr-dev",
+		},
+		{
+			name: "global pool",
+			svc:  &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}},
+			want: "pool:range-global",
+		},
+		{
+			name: "named pool",
+			svc: &v1.Service{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        "edge",
+				Annotations: map[string]string{LoadbalancerPoolAnnotation: "edge"},
+			}},
+			want: "pool:cidr-pool-edge",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := syncNewService(t, mgr, tt.svc); err != nil {
+				t.Fatal(err)
+			}
+			got, err := mgr.kubeClient.CoreV1().Services(tt.svc.Namespace).Get(context.Background(), tt.svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got.Annotations[AllocationSourceAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerUpdateRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     int
+		conflicts int
+		wantErr   bool
+	}{
+		{
+			name:      "conflicts within the configured steps",
+			steps:     10,
+			conflicts: 9,
+		},
+		{
+			name:      "conflicts exceed the configured steps",
+			steps:     10,
+			conflicts: 10,
+			wantErr:   true,
+		},
+		{
+			name:      "single step",
+			steps:     1,
+			conflicts: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+			mgr.updateRetry = wait.Backoff{Steps: tt.steps, Duration: time.Millisecond, Factor: 1.0}
+
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+			if _, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			updates := 0
+			mgr.kubeClient.(*fake.Clientset).PrependReactor("update", "services", func(_ k8stesting.Action) (bool, runtime.Object, error) {
+				updates++
+				if updates <= tt.conflicts {
+					return true, nil, apierrors.NewConflict(v1.Resource("services"), svc.Name, fmt.Errorf("conflict"))
+				}
+				return false, nil, nil
+			})
+
+			_, err := mgr.syncLoadBalancer(context.Background(), svc, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("syncLoadBalancer() error: %v, expected: %v", err, tt.wantErr)
+			}
+			assert.Equal(t, min(tt.conflicts+1, tt.steps), updates)
+		})
+	}
+}
+
+func Test_discoverPoolStep(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]string
+		wantPool  string
+		wantStep  int
+		wantError string
+	}{
+		{
+			name:     "without step",
+			data:     map[string]string{"cidr-global": "10.0.0.0/24"},
+			wantPool: "10.0.0.0/24",
+			wantStep: 1,
+		},
+		{
+			name:     "with step",
+			data:     map[string]string{"cidr-global": "10.0.0.0/24,10.0.1.0/24;step=4"},
+			wantPool: "10.0.0.0/24,10.0.1.0/24",
+			wantStep: 4,
+		},
+		{
+			name:      "step is not a number",
+			data:      map[string]string{"cidr-global": "10.0.0.0/24;step=four"},
+			wantError: "invalid step [four] for pool [cidr-global], must be a positive integer",
+		},
+		{
+			name:      "step is zero",
+			data:      map[string]string{"cidr-global": "10.0.0.0/24;step=0"},
+			wantError: "invalid step [0] for pool [cidr-global], must be a positive integer",
+		},
+		{
+			name:      "step of a range pool",
+			data:      map[string]string{"range-global": "10.0.0.1-10.0.0.10;step=2"},
+			wantError: "step is only supported by cidr pools",
+		},
+		{
+			name:      "unknown option",
+			data:      map[string]string{"cidr-global": "10.0.0.0/24;size=4"},
+			wantError: "unknown option [size=4] for pool [cidr-global]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPool, err := discoverPool(&v1.ConfigMap{Data: tt.data}, "test", "", "")
+			if len(tt.wantError) != 0 {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantPool, gotPool.addresses)
+			assert.Equal(t, tt.wantStep, gotPool.step)
+		})
+	}
+}
+
+func Test_syncLoadBalancerSteppedPool(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-global": "10.0.0.0/28;step=4",
+	}, newKubevipService("other", "existing", "10.0.0.4"))
+
+	newService := func(name string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name}}
+	}
+
+	// The network address 10.0.0.0 is skipped and 10.0.0.4 is in use
+	for i, want := range []string{"10.0.0.8", "10.0.0.12"} {
+		got, err := syncNewService(t, mgr, newService(fmt.Sprintf("svc-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+	}
+
+	// Addresses between the steps are free, but every stepped address is taken
+	_, err := syncNewService(t, mgr, newService("svc-full"))
+	var outOfIPs *ipam.OutOfIPsError
+	if !errors.As(err, &outOfIPs) {
+		t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+	}
+}
+
+func Test_discoverPoolHostWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		value     string
+		wantMin   string
+		wantMax   string
+		wantError string
+	}{
+		{
+			name:    "offsets",
+			key:     "cidr-global",
+			value:   "10.0.0.0/24;min=.100;max=.200",
+			wantMin: ".100",
+			wantMax: ".200",
+		},
+		{
+			name:    "addresses",
+			key:     "cidr-global",
+			value:   "10.0.0.0/24,fe80::/120;min=10.0.0.100;max=fe80::20",
+			wantMin: "10.0.0.100",
+			wantMax: "fe80::20",
+		},
+		{
+			name:      "min after max",
+			key:       "cidr-global",
+			value:     "10.0.0.0/24;min=.200;max=.100",
+			wantError: "min [10.0.0.200] is after max [10.0.0.100] in cidr [10.0.0.0/24]",
+		},
+		{
+			name:      "offset outside of the cidr",
+			key:       "cidr-global",
+			value:     "10.0.0.0/24;max=.300",
+			wantError: "[.300] is not an address of cidr [10.0.0.0/24]",
+		},
+		{
+			name:      "address outside of the cidr",
+			key:       "cidr-global",
+			value:     "10.0.0.0/24;min=10.0.1.1",
+			wantError: "[10.0.1.1] is not an address of cidr [10.0.0.0/24]",
+		},
+		{
+			name:      "combined with step",
+			key:       "cidr-global",
+			value:     "10.0.0.0/24;step=4;min=.100",
+			wantError: "min and max can't be combined with step",
+		},
+		{
+			name:      "range pool",
+			key:       "range-global",
+			value:     "10.0.0.1-10.0.0.10;min=.5",
+			wantError: "min is only supported by cidr pools",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPool, err := discoverPool(&v1.ConfigMap{Data: map[string]string{tt.key: tt.value}}, "test", "", "")
+			if len(tt.wantError) != 0 {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantMin, gotPool.hostMin)
+			assert.Equal(t, tt.wantMax, gotPool.hostMax)
+		})
+	}
+}
+
+func Test_syncLoadBalancerHostWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     string
+		wantOrder []string
+	}{
+		{
+			name:      "ascending order starts at min",
+			order:     "asc",
+			wantOrder: []string{"10.0.0.100", "10.0.0.102"},
+		},
+		{
+			name:      "descending order starts at max",
+			order:     "desc",
+			wantOrder: []string{"10.0.0.102", "10.0.0.100"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{
+				"cidr-prod":    "10.0.0.0/24;min=.100;max=.102",
+				"search-order": tt.order,
+			}, newKubevipService("prod", "existing", "10.0.0.101"))
+			for i, want := range tt.wantOrder {
+				got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: fmt.Sprintf("svc-%d", i)}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, want, got)
+			}
+
+			// The addresses outside of the window are free, but the window is exhausted
+			_, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "svc-full"}})
+			var outOfIPs *ipam.OutOfIPsError
+			if !errors.As(err, &outOfIPs) {
+				t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerMaxVIPsPerService(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxVIPs   string
+		policy    v1.IPFamilyPolicy
+		want      string
+		wantError string
+	}{
+		{
+			name:      "cap of one refuses a RequireDualStack service",
+			maxVIPs:   "1",
+			policy:    v1.IPFamilyPolicyRequireDualStack,
+			wantError: "max-vips-per-service only allows 1 address per service",
+		},
+		{
+			name:    "cap of one allocates a single address to a PreferDualStack service",
+			maxVIPs: "1",
+			policy:  v1.IPFamilyPolicyPreferDualStack,
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "cap of two allows a RequireDualStack service",
+			maxVIPs: "2",
+			policy:  v1.IPFamilyPolicyRequireDualStack,
+			want:    "10.0.0.1,fe80::10",
+		},
+		{
+			name:      "invalid cap",
+			maxVIPs:   "none",
+			policy:    v1.IPFamilyPolicyRequireDualStack,
+			wantError: "invalid value [none] for max-vips-per-service",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{
+				"cidr-global":          "10.0.0.0/29,fe80::10/127",
+				"max-vips-per-service": tt.maxVIPs,
+			})
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ptr.To(tt.policy),
+					IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+				},
+			}
+			got, err := syncNewService(t, mgr, svc)
+			if len(tt.wantError) != 0 {
+				assert.ErrorContains(t, err, tt.wantError)
+				// The service is left untouched
+				updated, getErr := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+				if getErr != nil {
+					t.Fatal(getErr)
+				}
+				assert.NotContains(t, updated.Annotations, LoadbalancerIPsAnnotations)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_syncLoadBalancerStructuredLogging(t *testing.T) {
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(io.Discard)
+		klog.LogToStderr(true)
+	}()
+
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}}
+	if _, err := syncNewService(t, mgr, svc); err != nil {
+		t.Fatal(err)
+	}
+	klog.Flush()
+
+	logs := buf.String()
+	for _, want := range []string{
+		`"Syncing service" service="test/name"`,
+		`"Taking address from pool" namespace="test" pool="cidr-global"`,
+		`"Discovered address" namespace="test" address="10.0.0.1" family="IPv4"`,
+		`"Updating service with load balancer IPAM address(es)" service="test/name" pool="cidr-global" address="10.0.0.1"`,
+	} {
+		assert.Contains(t, logs, want)
+	}
+}
+
+func Test_ListAllocatedIPs(t *testing.T) {
+	unlabeled := newKubevipService("test", "unlabeled", "10.0.0.9")
+	delete(unlabeled.Labels, ImplementationLabelKey)
+
+	mgr := newTestLoadBalancer(t, nil,
+		newKubevipService("test", "ipv4", "10.0.0.1"),
+		newKubevipService("test", "dualstack", "10.0.0.2,fe80::10"),
+		newKubevipService("test", "pending", ""),
+		newKubevipService("other", "ipv6", "fe80::20"),
+		unlabeled,
+	)
+
+	testIPs := []AllocatedIP{
+		{Address: netip.MustParseAddr("10.0.0.1"), Family: v1.IPv4Protocol, ServiceName: "ipv4", ServiceNamespace: "test"},
+		{Address: netip.MustParseAddr("10.0.0.2"), Family: v1.IPv4Protocol, ServiceName: "dualstack", ServiceNamespace: "test"},
+		{Address: netip.MustParseAddr("fe80::10"), Family: v1.IPv6Protocol, ServiceName: "dualstack", ServiceNamespace: "test"},
+	}
+
+	got, err := ListAllocatedIPs(context.Background(), mgr.kubeClient, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, testIPs, got)
+
+	got, err = ListAllocatedIPs(context.Background(), mgr.kubeClient, "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, append(testIPs,
+		AllocatedIP{Address: netip.MustParseAddr("fe80::20"), Family: v1.IPv6Protocol, ServiceName: "ipv6", ServiceNamespace: "other"},
+	), got)
+
+	// Addresses that can't be parsed are skipped, as they are when an address is allocated
+	if _, err := mgr.kubeClient.CoreV1().Services("broken").Create(context.Background(), newKubevipService("broken", "svc", "10.0.0,10.0.0.3"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ListAllocatedIPs(context.Background(), mgr.kubeClient, "broken", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []AllocatedIP{
+		{Address: netip.MustParseAddr("10.0.0.3"), Family: v1.IPv4Protocol, ServiceName: "svc", ServiceNamespace: "broken"},
+	}, got)
+}
+
+func Test_discoverVIPsDHCP(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     *v1.IPFamilyPolicy
+		ipFamilies []v1.IPFamily
+		wantError  string
+	}{
+		{name: "no policy"},
+		{name: "no policy IPv4", ipFamilies: []v1.IPFamily{v1.IPv4Protocol}},
+		{
+			name:       "no policy IPv6",
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			wantError:  "provides DHCP addresses, which are IPv4 only, but the service requires IP family [IPv6]",
+		},
+		{name: "SingleStack IPv4", policy: ptr.To(v1.IPFamilyPolicySingleStack), ipFamilies: []v1.IPFamily{v1.IPv4Protocol}},
+		{
+			name:       "SingleStack IPv6",
+			policy:     ptr.To(v1.IPFamilyPolicySingleStack),
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			wantError:  "provides DHCP addresses, which are IPv4 only, but the service requires IP family [IPv6]",
+		},
+		{name: "PreferDualStack", policy: ptr.To(v1.IPFamilyPolicyPreferDualStack), ipFamilies: []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}},
+		{
+			name:       "RequireDualStack",
+			policy:     ptr.To(v1.IPFamilyPolicyRequireDualStack),
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			wantError:  "provides DHCP addresses, which are IPv4 only, but the service requires dual-stack",
+		},
+	}
+	pools := []string{"0.0.0.0/32", "0.0.0.0/32,fe80::10/127", "fe80::10/127,0.0.0.0/32"}
+	for _, tt := range tests {
+		for _, pool := range pools {
+			t.Run(fmt.Sprintf("%s %s", tt.name, pool), func(t *testing.T) {
+				got, err := discoverVIPs(context.Background(), "discover-vips-dhcp", pool, &netipx.IPSet{}, allocationOptions{}, tt.policy, tt.ipFamilies)
+				if len(tt.wantError) != 0 {
+					assert.EqualError(t, err, fmt.Sprintf("pool [%s] %s", pool, tt.wantError))
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, "0.0.0.0", got)
+			})
+		}
+	}
+}
+
+func Test_syncLoadBalancerCIDRHint(t *testing.T) {
+	tests := []struct {
+		name      string
+		hint      string
+		policy    *v1.IPFamilyPolicy
+		want      string
+		wantError string
+	}{
+		{
+			name: "without hint the cidrs are searched in order",
+			want: "10.0.0.1",
+		},
+		{
+			name: "hinted cidr",
+			hint: "203.0.113.0/28",
+			want: "203.0.113.1",
+		},
+		{
+			name:   "hinted cidr doesn't restrict the other IP family",
+			hint:   "203.0.113.0/28",
+			policy: ptr.To(v1.IPFamilyPolicyRequireDualStack),
+			want:   "203.0.113.1,fe80::10",
+		},
+		{
+			name:      "hinted cidr isn't part of the pool",
+			hint:      "198.51.100.0/28",
+			wantError: "cidr [198.51.100.0/28] in annotation 'kube-vip.io/loadbalancerCIDR' is not one of the cidrs of the pool",
+		},
+		{
+			name:      "invalid hint",
+			hint:      "203.0.113.0",
+			wantError: "invalid cidr [203.0.113.0] in annotation 'kube-vip.io/loadbalancerCIDR'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29,203.0.113.0/28,fe80::10/127"})
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name", Annotations: map[string]string{}},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: tt.policy,
+					IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+				},
+			}
+			if len(tt.hint) != 0 {
+				svc.Annotations[LoadbalancerCIDRAnnotation] = tt.hint
+			}
+			got, err := syncNewService(t, mgr, svc)
+			if len(tt.wantError) != 0 {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_ValidateRequestedIPs(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		pool      string
+		wantError string
+	}{
+		{
+			name:  "address in cidr pool",
+			value: "192.168.0.201",
+			pool:  "192.168.0.200/29",
+		},
+		{
+			name:  "address in range pool",
+			value: "192.168.0.215",
+			pool:  "192.168.0.210-192.168.0.219",
+		},
+		{
+			name:      "network address of the cidr",
+			value:     "192.168.0.200",
+			pool:      "192.168.0.200/29",
+			wantError: "address [192.168.0.200] is not part of the pool",
+		},
+		{
+			name:      "address outside of the pool",
+			value:     "192.168.1.201",
+			pool:      "192.168.0.200/29",
+			wantError: "address [192.168.1.201] is not part of the pool",
+		},
+		{
+			name:      "malformed address",
+			value:     "192.168.0",
+			pool:      "192.168.0.200/29",
+			wantError: "invalid value [192.168.0] for annotation 'kube-vip.io/loadbalancerIPs'",
+		},
+		{
+			name:      "empty value",
+			value:     "",
+			pool:      "192.168.0.200/29",
+			wantError: "has no addresses",
+		},
+		{
+			name:  "mixed families in the pool",
+			value: "192.168.0.201,fe80::10",
+			pool:  "192.168.0.200/29,fe80::10/127",
+		},
+		{
+			name:      "mixed families with the IPv6 address outside of the pool",
+			value:     "192.168.0.201,fe80::20",
+			pool:      "192.168.0.200/29,fe80::10/127",
+			wantError: "address [fe80::20] is not part of the pool",
+		},
+		{
+			name:  "pool with options",
+			value: "10.0.0.5",
+			pool:  "10.0.0.0/24;step=4",
+		},
+		{
+			name:  "dhcp pool",
+			value: "0.0.0.0",
+			pool:  "0.0.0.0/32",
+		},
+		{
+			name:      "address of the dhcp pool",
+			value:     "192.168.0.201",
+			pool:      "0.0.0.0/32",
+			wantError: "only 0.0.0.0 is",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRequestedIPs(tt.value, tt.pool)
+			if len(tt.wantError) != 0 {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_syncLoadBalancerPoolOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		services []*v1.Service
+		want     []string
+	}{
+		{
+			name: "without pool-order the cidr pool is used",
+			data: map[string]string{
+				"cidr-global":  "10.0.0.0/30",
+				"range-global": "10.0.1.1-10.0.1.2",
+			},
+			want: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name: "pool-order rolls over to the next pool once the first is exhausted",
+			data: map[string]string{
+				"cidr-global":  "10.0.0.0/30",
+				"range-global": "10.0.1.1-10.0.1.2",
+				"pool-order":   "range-global,cidr-global",
+			},
+			services: []*v1.Service{newKubevipService("other", "existing", "10.0.1.1")},
+			want:     []string{"10.0.1.2", "10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name: "pools of other namespaces and missing pools are skipped",
+			data: map[string]string{
+				"cidr-other":   "10.0.2.0/30",
+				"cidr-test":    "10.0.3.0/30",
+				"range-global": "10.0.1.1-10.0.1.1",
+				"pool-order":   "cidr-other,range-global,range-test,cidr-test",
+			},
+			want: []string{"10.0.1.1", "10.0.3.1", "10.0.3.2"},
+		},
+		{
+			name: "the addresses in use are gathered in the scope of each pool",
+			data: map[string]string{
+				"cidr-test":    "10.0.3.0/30",
+				"range-global": "10.0.1.1-10.0.1.2",
+				"pool-order":   "cidr-test,range-global",
+			},
+			services: []*v1.Service{
+				// Only the services of the namespace use the addresses of the namespace pool
+				newKubevipService("other", "namespace", "10.0.3.1"),
+				// The services of all namespaces use the addresses of the global pool
+				newKubevipService("other", "global", "10.0.1.1"),
+			},
+			want: []string{"10.0.3.1", "10.0.3.2", "10.0.1.2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, tt.data, tt.services...)
+			for i, want := range tt.want {
+				svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: fmt.Sprintf("svc-%d", i)}}
+				got, err := syncNewService(t, mgr, svc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, want, got)
+			}
+			// Every pool is exhausted
+			_, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc-full"}})
+			var outOfIPs *ipam.OutOfIPsError
+			if !errors.As(err, &outOfIPs) {
+				t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerNamespacePoolOverflow(t *testing.T) {
+	data := map[string]string{
+		"cidr-test":     "10.0.1.0/30",
+		"cidr-global":   "10.0.0.0/30",
+		"cidr-udp-test": "10.0.2.1/32",
+	}
+	// The address in use in the global pool is skipped, the namespace pool only holds the addresses of its namespace
+	services := []*v1.Service{newKubevipService("other", "global", "10.0.0.1"), newKubevipService("other", "namespace", "10.0.1.1")}
+
+	// Without overflow the namespace pool is the only pool of the services
+	mgr := newTestLoadBalancer(t, data, services...)
+	for i, want := range []string{"10.0.1.1", "10.0.1.2"} {
+		got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: fmt.Sprintf("svc-%d", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+	}
+	_, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc-full"}})
+	var outOfIPs *ipam.OutOfIPsError
+	if !errors.As(err, &outOfIPs) {
+		t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+	}
+
+	// With overflow the global pool is used once the namespace pool is exhausted
+	mgr = newTestLoadBalancer(t, data, services...)
+	mgr.namespacePoolOverflow = true
+	for i, want := range []string{"10.0.1.1", "10.0.1.2", "10.0.0.2"} {
+		got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: fmt.Sprintf("svc-%d", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+	}
+	_, err = syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc-full"}})
+	if !errors.As(err, &outOfIPs) {
+		t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+	}
+
+	// The overflow address is part of the pools of the service
+	outside, err := mgr.outOfPoolAddresses(context.Background(), &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc-2"}}, "10.0.0.2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, outside)
+
+	// Protocol pools don't overflow
+	udp := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "udp-0"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 53, Protocol: v1.ProtocolUDP}}},
+	}
+	got, err := syncNewService(t, mgr, udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.2.1", got)
+	udp = udp.DeepCopy()
+	udp.Name = "udp-1"
+	_, err = syncNewService(t, mgr, udp)
+	if !errors.As(err, &outOfIPs) {
+		t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+	}
+}
+
+func Test_discoverVIPsSingleStackFamily(t *testing.T) {
+	tests := []struct {
+		name       string
+		pool       string
+		ipFamilies []v1.IPFamily
+		want       string
+		wantError  string
+	}{
+		{
+			name: "no IP family, IPv4 and IPv6 pools prefer IPv4",
+			pool: "10.0.0.0/30,fe80::10/127",
+			want: "10.0.0.1",
+		},
+		{
+			name: "no IP family, only an IPv6 pool",
+			pool: "fe80::10/127",
+			want: "fe80::10",
+		},
+		{
+			name:       "explicit IP family with a pool",
+			pool:       "10.0.0.0/30,fe80::10/127",
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			want:       "fe80::10",
+		},
+		{
+			name:       "explicit IPv4 family without a pool",
+			pool:       "fe80::10/127",
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol},
+			wantError:  "service requires IP family [IPv4], but the pool has no IPv4 addresses configured",
+		},
+		{
+			name:       "explicit IPv6 family without a pool",
+			pool:       "10.0.0.0/30",
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			wantError:  "service requires IP family [IPv6], but the pool has no IPv6 addresses configured",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, policy := range []*v1.IPFamilyPolicy{nil, ptr.To(v1.IPFamilyPolicySingleStack)} {
+				got, err := discoverVIPs(context.Background(), "discover-vips-single-stack", tt.pool, &netipx.IPSet{}, allocationOptions{}, policy, tt.ipFamilies)
+				if len(tt.wantError) != 0 {
+					assert.EqualError(t, err, tt.wantError)
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_discoverVIPsIPv6Scope(t *testing.T) {
+	tests := []struct {
+		name       string
+		pool       string
+		scope      string
+		policy     *v1.IPFamilyPolicy
+		ipFamilies []v1.IPFamily
+		want       string
+		wantError  string
+	}{
+		{
+			name:       "ula addresses of a cidr pool",
+			pool:       "10.0.0.0/30,2001:db8::/126,fd00::/126",
+			scope:      IPv6ScopeULA,
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			want:       "fd00::",
+		},
+		{
+			name:       "gua addresses of a range pool",
+			pool:       "fd00::10-fd00::20,2001:db8::10-2001:db8::20",
+			scope:      IPv6ScopeGUA,
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			want:       "2001:db8::10",
+		},
+		{
+			name:       "the scope doesn't apply to IPv4 addresses",
+			pool:       "10.0.0.0/30,2001:db8::/126",
+			scope:      IPv6ScopeULA,
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "dual-stack service",
+			pool:       "10.0.0.0/30,2001:db8::/126,fd00::/126",
+			scope:      IPv6ScopeULA,
+			policy:     ptr.To(v1.IPFamilyPolicyRequireDualStack),
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			want:       "10.0.0.1,fd00::",
+		},
+		{
+			name:       "PreferDualStack service is single stack without an address of the scope",
+			pool:       "10.0.0.0/30,2001:db8::/126",
+			scope:      IPv6ScopeULA,
+			policy:     ptr.To(v1.IPFamilyPolicyPreferDualStack),
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "single stack service without an address of the scope",
+			pool:       "10.0.0.0/30,2001:db8::/126",
+			scope:      IPv6ScopeULA,
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			wantError:  "service requires IPv6 scope [ula], but the pool has no fc00::/7 addresses configured",
+		},
+		{
+			name:       "RequireDualStack service without an address of the scope",
+			pool:       "10.0.0.0/30,fd00::/126",
+			scope:      IPv6ScopeGUA,
+			policy:     ptr.To(v1.IPFamilyPolicyRequireDualStack),
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			wantError:  "service requires IPv6 scope [gua], but the pool has no 2000::/3 addresses configured",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := discoverVIPs(context.Background(), "discover-vips-ipv6-scope", tt.pool, &netipx.IPSet{}, allocationOptions{ipv6Scope: tt.scope}, tt.policy, tt.ipFamilies)
+			if len(tt.wantError) != 0 {
+				assert.EqualError(t, err, tt.wantError)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_syncLoadBalancerIPv6Scope(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "2001:db8::/126,fd00::/126"})
+	newService := func(name, scope string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name, Annotations: map[string]string{IPv6ScopeAnnotation: scope}},
+			Spec:       v1.ServiceSpec{IPFamilies: []v1.IPFamily{v1.IPv6Protocol}},
+		}
+	}
+
+	got, err := syncNewService(t, mgr, newService("ula", "ULA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "fd00::", got)
+
+	_, err = syncNewService(t, mgr, newService("invalid", "site"))
+	assert.EqualError(t, err, "invalid IPv6 scope [site] in annotation 'kube-vip.io/ipv6Scope', must be one of ula or gua")
+}
+
+func Test_syncLoadBalancerRangeExcludeEndpoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		pool      string
+		want      []string
+		wantError string
+	}{
+		{
+			name: "endpoints are allocated by default",
+			pool: "10.0.0.10-10.0.0.12",
+			want: []string{"10.0.0.10", "10.0.0.11", "10.0.0.12"},
+		},
+		{
+			name: "endpoints are allocated when disabled",
+			pool: "10.0.0.10-10.0.0.12;exclude-endpoints=false",
+			want: []string{"10.0.0.10", "10.0.0.11", "10.0.0.12"},
+		},
+		{
+			name: "endpoints of every range are skipped when enabled",
+			pool: "10.0.0.10-10.0.0.12,10.0.1.10-10.0.1.12;exclude-endpoints=true",
+			want: []string{"10.0.0.11", "10.0.1.11"},
+		},
+		{
+			name:      "invalid value",
+			pool:      "10.0.0.10-10.0.0.12;exclude-endpoints=yes please",
+			wantError: "invalid exclude-endpoints [yes please] for pool [range-global], must be true or false",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"range-global": tt.pool})
+			for i, want := range tt.want {
+				got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: fmt.Sprintf("svc-%d", i)}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, want, got)
+			}
+			_, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc-last"}})
+			if len(tt.wantError) != 0 {
+				assert.EqualError(t, err, tt.wantError)
+				return
+			}
+			var outOfIPs *ipam.OutOfIPsError
+			if !errors.As(err, &outOfIPs) {
+				t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+			}
+		})
+	}
+}
+
+func Test_discoverPoolNoPoolError(t *testing.T) {
+	_, err := discoverPool(&v1.ConfigMap{Data: map[string]string{"cidr-other": "10.0.0.0/24"}}, "test", "", KubeVipClientConfig)
+	var noPool *NoPoolError
+	if !errors.As(err, &noPool) {
+		t.Fatalf("discoverPool() error = %v, want NoPoolError", err)
+	}
+	assert.Equal(t, "test", noPool.Namespace)
+	assert.Equal(t, KubeVipClientConfig, noPool.ConfigMap)
+
+	// The error is returned as is when syncing the service
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-other": "10.0.0.0/24"})
+	_, err = syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"}})
+	assert.Equal(t, NewNoPoolError("test", KubeVipClientConfig), err)
+	if assert.ErrorAs(t, err, &noPool) {
+		assert.Equal(t, "test", noPool.Namespace)
+		assert.Equal(t, KubeVipClientConfig, noPool.ConfigMap)
+	}
+}
+
+func Test_syncLoadBalancerOutOfIPsRetry(t *testing.T) {
+	first := newKubevipService("test", "first", "10.0.0.1")
+	mgr := newTestLoadBalancer(t, map[string]string{"range-global": "10.0.0.1-10.0.0.1"}, first)
+	recorder := mgr.recorder.(*record.FakeRecorder)
+
+	// The only address of the pool is taken, the service is retried after the configured delay
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "second"}}
+	_, err := syncNewService(t, mgr, svc)
+	var re *api.RetryError
+	if !errors.As(err, &re) {
+		t.Fatalf("syncLoadBalancer() error = %v, want RetryError", err)
+	}
+	assert.Equal(t, OutOfIPsRetryInterval, re.RetryAfter())
+	var outOfIPs *ipam.OutOfIPsError
+	if !errors.As(err, &outOfIPs) {
+		t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+	}
+	assert.Equal(t, fmt.Sprintf("Warning %s Unable to allocate address from pool [range-global]: %v", IPAllocationFailedReason, err), <-recorder.Events)
+
+	// The address is picked up once it is freed
+	if err := mgr.kubeClient.CoreV1().Services(first.Namespace).Delete(context.Background(), first.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.syncLoadBalancer(context.Background(), svc, nil); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.1", updated.Annotations[LoadbalancerIPsAnnotations])
+
+	// Without a delay the error is left to the backoff of the controller
+	mgr = newTestLoadBalancer(t, map[string]string{"range-global": "10.0.0.1-10.0.0.1"}, first)
+	mgr.outOfIPsRetry = 0
+	_, err = syncNewService(t, mgr, svc)
+	if errors.As(err, &re) {
+		t.Errorf("syncLoadBalancer() error = %v, want no RetryError", err)
+	}
+}
+
+func Test_syncLoadBalancerReservedAddress(t *testing.T) {
+	data := map[string]string{
+		"cidr-global":         "10.0.0.0/29",
+		"reserved-test-dns":   "10.0.0.50",
+		"reserved-test-proxy": "10.0.0.51, fe80::51",
+	}
+
+	tests := []struct {
+		name       string
+		service    *v1.Service
+		services   []*v1.Service
+		ledger     map[string]string
+		want       string
+		wantSource string
+		wantEvent  string
+	}{
+		{
+			name:       "reserved address is free",
+			service:    &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "dns"}},
+			want:       "10.0.0.50",
+			wantSource: "pool:reserved-test-dns",
+		},
+		{
+			name:       "reserved addresses of both families",
+			service:    &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "proxy"}},
+			want:       "10.0.0.51,fe80::51",
+			wantSource: "pool:reserved-test-proxy",
+		},
+		{
+			name:    "reserved address is already held by the service",
+			service: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "dns", UID: "uid-dns"}},
+			// The address of the service was recorded before its annotation was lost
+			ledger:     map[string]string{"10.0.0.50": "uid-dns"},
+			want:       "10.0.0.50",
+			wantSource: "pool:reserved-test-dns",
+		},
+		{
+			name:       "reserved address is held by another service",
+			service:    &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "dns"}},
+			services:   []*v1.Service{newKubevipService("other", "squatter", "10.0.0.50")},
+			want:       "10.0.0.1",
+			wantSource: "pool:cidr-global",
+			wantEvent:  "Warning ReservedIPConflict Reserved address [10.0.0.50] is held by service 'other/squatter', allocating from the pool",
+		},
+		{
+			name:       "reserved address is recorded for another service",
+			service:    &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "dns", UID: "uid-dns"}},
+			ledger:     map[string]string{"10.0.0.50": "uid-other"},
+			want:       "10.0.0.1",
+			wantSource: "pool:cidr-global",
+			wantEvent:  "Warning ReservedIPConflict Reserved address [10.0.0.50] is held by service with uid [uid-other], allocating from the pool",
+		},
+		{
+			name:       "service without reservation",
+			service:    &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "dns"}},
+			want:       "10.0.0.1",
+			wantSource: "pool:cidr-global",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, data, tt.services...)
+			if tt.ledger != nil {
+				mgr.allocationLedger = true
+				ledger := &v1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: AllocationLedgerConfigMap, Namespace: KubeVipClientConfigNamespace},
+					Data:       tt.ledger,
+				}
+				if _, err := mgr.kubeClient.CoreV1().ConfigMaps(ledger.Namespace).Create(context.Background(), ledger, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			recorder := mgr.recorder.(*record.FakeRecorder)
+
+			got, err := syncNewService(t, mgr, tt.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+
+			svc, err := mgr.kubeClient.CoreV1().Services(tt.service.Namespace).Get(context.Background(), tt.service.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantSource, svc.Annotations[AllocationSourceAnnotation])
+			if len(tt.wantEvent) != 0 {
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerWriteLegacyLoadBalancerIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		writeLegacy bool
+		want        string
+	}{
+		{
+			name:        "spec field is written",
+			writeLegacy: true,
+			want:        "10.0.0.1",
+		},
+		{
+			name:        "only the annotation is written",
+			writeLegacy: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29,fe80::10/127"})
+			mgr.writeLegacyLoadBalancerIP = tt.writeLegacy
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec: v1.ServiceSpec{
+					IPFamilyPolicy: ptr.To(v1.IPFamilyPolicyRequireDualStack),
+					IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+				},
+			}
+			got, err := syncNewService(t, mgr, svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "10.0.0.1,fe80::10", got)
+
+			updated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, updated.Spec.LoadBalancerIP)
+
+			// The service keeps its addresses on the next sync
+			if _, err := mgr.syncLoadBalancer(context.Background(), updated, nil); err != nil {
+				t.Fatal(err)
+			}
+			updated, err = mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "10.0.0.1,fe80::10", updated.Annotations[LoadbalancerIPsAnnotations])
+			assert.Equal(t, tt.want, updated.Spec.LoadBalancerIP)
+		})
+	}
+}
+
+func Test_syncLoadBalancerIPCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]string
+		services  []*v1.Service
+		count     string
+		policy    v1.IPFamilyPolicy
+		want      string
+		wantError string
+		wantBlock bool
+	}{
+		{
+			name:  "block at the start of the pool",
+			data:  map[string]string{"cidr-global": "10.0.0.0/28"},
+			count: "4",
+			want:  "10.0.0.1,10.0.0.2,10.0.0.3,10.0.0.4",
+		},
+		{
+			name:     "block after a gap",
+			data:     map[string]string{"range-global": "10.0.0.10-10.0.0.20"},
+			services: []*v1.Service{newKubevipService("test", "first", "10.0.0.11")},
+			count:    "3",
+			want:     "10.0.0.12,10.0.0.13,10.0.0.14",
+		},
+		{
+			name: "fragmented pool",
+			data: map[string]string{"range-global": "10.0.0.10-10.0.0.14"},
+			services: []*v1.Service{
+				newKubevipService("test", "first", "10.0.0.11"),
+				newKubevipService("test", "second", "10.0.0.13"),
+			},
+			count:     "2",
+			wantBlock: true,
+		},
+		{
+			name:      "dual stack service",
+			data:      map[string]string{"cidr-global": "10.0.0.0/28,fe80::/124"},
+			count:     "2",
+			policy:    v1.IPFamilyPolicyPreferDualStack,
+			wantError: "annotation 'kube-vip.io/loadbalancerIPCount' is only supported by single stack services",
+		},
+		{
+			name:      "more addresses than max-vips-per-service",
+			data:      map[string]string{"cidr-global": "10.0.0.0/28", "max-vips-per-service": "2"},
+			count:     "3",
+			wantError: "service requests 3 addresses, but max-vips-per-service only allows 2 addresses per service",
+		},
+		{
+			name:      "invalid count",
+			data:      map[string]string{"cidr-global": "10.0.0.0/28"},
+			count:     "0",
+			wantError: "invalid value [0] for annotation 'kube-vip.io/loadbalancerIPCount', must be a positive integer",
+		},
+		{
+			name:      "stepped pool",
+			data:      map[string]string{"cidr-global": "10.0.0.0/28;step=4"},
+			count:     "2",
+			wantError: "a block of addresses can't be allocated from the stepped pool [10.0.0.0/28]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, tt.data, tt.services...)
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "svc",
+					Annotations: map[string]string{LoadbalancerIPCountAnnotation: tt.count},
+				},
+			}
+			if len(tt.policy) != 0 {
+				svc.Spec.IPFamilyPolicy = ptr.To(tt.policy)
+			}
+
+			got, err := syncNewService(t, mgr, svc)
+			switch {
+			case len(tt.wantError) != 0:
+				assert.EqualError(t, err, tt.wantError)
+			case tt.wantBlock:
+				var noBlock *ipam.NoContiguousBlockError
+				if !errors.As(err, &noBlock) {
+					t.Errorf("syncLoadBalancer() error = %v, want NoContiguousBlockError", err)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerMalformedAnnotation(t *testing.T) {
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(io.Discard)
+		klog.LogToStderr(true)
+	}()
+
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"},
+		newKubevipService("test", "valid", "10.0.0.1"),
+		newKubevipService("test", "malformed", "10.0.0.2.5,10.0.0.2"),
+	)
+
+	// The valid addresses of both services stay in use
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.3", got)
+
+	klog.Flush()
+	assert.Contains(t, buf.String(), `"Ignoring invalid address in annotation" err="ParseAddr(\"10.0.0.2.5\"): IPv4 address too long" service="test/malformed" annotation="kube-vip.io/loadbalancerIPs" address="10.0.0.2.5"`)
+}
+
+func Test_syncLoadBalancerManagedNamespaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		managed  []string
+		excluded []string
+		want     string
+	}{
+		{
+			name: "all namespaces managed",
+			want: "10.0.0.2",
+		},
+		{
+			name:    "managed namespace",
+			managed: []string{"team-a", "team-b"},
+			// The address held by the service of the unmanaged legacy namespace isn't in use
+			want: "10.0.0.1",
+		},
+		{
+			name:    "namespace that isn't managed",
+			managed: []string{"team-a"},
+		},
+		{
+			name:     "excluded namespace",
+			excluded: []string{"team-b"},
+		},
+		{
+			name:     "namespace that isn't excluded",
+			excluded: []string{"legacy"},
+			want:     "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/30"},
+				newKubevipService("legacy", "labeled", "10.0.0.1"))
+			mgr.managedNamespaces = tt.managed
+			mgr.excludedNamespaces = tt.excluded
+
+			got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "name"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+			// The service of an unmanaged namespace is never labeled
+			svc, err := mgr.kubeClient.CoreV1().Services("team-b").Get(context.Background(), "name", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, len(tt.want) != 0, svc.Labels[ImplementationLabel] == ImplementationValue)
+		})
+	}
+}
+
+func Test_syncLoadBalancerDefaultIPFamilyPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultPolicy *v1.IPFamilyPolicy
+		policy        *v1.IPFamilyPolicy
+		want          string
+	}{
+		{
+			name: "no default",
+			want: "10.0.0.1",
+		},
+		{
+			name:          "PreferDualStack default",
+			defaultPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+			want:          "10.0.0.1,fd00::",
+		},
+		{
+			name:          "RequireDualStack default",
+			defaultPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			want:          "10.0.0.1,fd00::",
+		},
+		{
+			name:          "explicit policy isn't overridden",
+			defaultPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+			policy:        ipFamilyPolicyPtr(v1.IPFamilyPolicySingleStack),
+			want:          "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/30,fd00::/126"})
+			mgr.defaultIPFamilyPolicy = tt.defaultPolicy
+
+			got, err := syncNewService(t, mgr, &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"},
+				Spec:       v1.ServiceSpec{IPFamilyPolicy: tt.policy},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+			// The default is never written to the service
+			svc, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "name", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.policy, svc.Spec.IPFamilyPolicy)
+		})
+	}
+}
+
+func Test_syncLoadBalancerGateway(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		policy    *v1.IPFamilyPolicy
+		wantIPs   string
+		want      string
+	}{
+		{
+			name:      "gateway of the global pool",
+			namespace: "other",
+			wantIPs:   "10.0.0.1",
+			want:      "10.0.0.254",
+		},
+		{
+			name:      "gateway of the namespace pool",
+			namespace: "team-a",
+			wantIPs:   "10.1.0.1",
+			want:      "10.1.0.254",
+		},
+		{
+			name:      "gateway of each IP family",
+			namespace: "other",
+			policy:    ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			wantIPs:   "10.0.0.1,fd00::",
+			want:      "10.0.0.254,fd00::fe",
+		},
+		{
+			name:      "pool without gateway",
+			namespace: "team-b",
+			wantIPs:   "10.2.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{
+				"cidr-global":         "10.0.0.0/30,fd00::/126",
+				"gateway-cidr-global": "fd00::fe, 10.0.0.254",
+				"cidr-team-a":         "10.1.0.0/30",
+				"gateway-cidr-team-a": "10.1.0.254",
+				"cidr-team-b":         "10.2.0.0/30",
+			})
+
+			got, err := syncNewService(t, mgr, &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "name"},
+				Spec:       v1.ServiceSpec{IPFamilyPolicy: tt.policy},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantIPs, got)
+			svc, err := mgr.kubeClient.CoreV1().Services(tt.namespace).Get(context.Background(), "name", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gateway, ok := svc.Annotations[LoadbalancerGatewayAnnotation]
+			assert.Equal(t, len(tt.want) != 0, ok)
+			assert.Equal(t, tt.want, gateway)
+		})
+	}
+}
+
+func Test_syncLoadBalancerMultiHomed(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29,10.0.1.0/29,fd00::/125"},
+		// One address per VLAN, listed by hand with spaces
+		newKubevipService("test", "multi-homed", "10.0.0.1, 10.0.1.1, fd00::"),
+	)
+	mgr.populateIngress = true
+
+	// Every address of the multi-homed service is in use
+	got, err := syncNewService(t, mgr, &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "dual-stack"},
+		Spec: v1.ServiceSpec{
+			IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2,fd00::1", got)
+
+	// A service created with the addresses is labeled and reports all of them
+	predefined := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "predefined",
+		Annotations: map[string]string{IPsAnnotation: "10.0.0.5, 10.0.1.5,fd00::5,"}}}
+	if _, err := mgr.kubeClient.CoreV1().Services("test").Create(context.Background(), predefined, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := mgr.syncLoadBalancer(context.Background(), predefined, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "10.0.0.5"}, {IP: "10.0.1.5"}, {IP: "fd00::5"}}, status.Ingress)
+	svc, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "predefined", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ImplementationValue, svc.Labels[ImplementationLabel])
+
+	// A service created with an invalid address is refused rather than labeled
+	invalid := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "invalid",
+		Annotations: map[string]string{IPsAnnotation: "10.0.0.6,10.0.1.6.1"}}}
+	if _, err := mgr.kubeClient.CoreV1().Services("test").Create(context.Background(), invalid, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = mgr.syncLoadBalancer(context.Background(), invalid, nil)
+	assert.ErrorContains(t, err, "invalid value [10.0.0.6,10.0.1.6.1] for annotation 'kube-vip.io/loadbalancerIPs' of service 'test/invalid'")
+	svc, err = mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "invalid", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, svc.Labels[ImplementationLabel])
+}
+
+func Test_discoverPoolAlias(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           map[string]string
+		namespace      string
+		wantKey        string
+		wantNamespaces []string
+		wantError      string
+	}{
+		{
+			name:           "simple alias",
+			data:           map[string]string{"cidr-shared": "10.0.0.0/29", "alias-team": "shared", "cidr-global": "10.1.0.0/29"},
+			namespace:      "team",
+			wantKey:        "cidr-shared",
+			wantNamespaces: []string{"shared", "team"},
+		},
+		{
+			name:           "chained alias",
+			data:           map[string]string{"range-shared": "10.0.0.1-10.0.0.5", "alias-team": "middle", "alias-middle": "shared"},
+			namespace:      "team",
+			wantKey:        "range-shared",
+			wantNamespaces: []string{"shared", "middle", "team"},
+		},
+		{
+			name:           "the target of an alias shares its pool",
+			data:           map[string]string{"cidr-shared": "10.0.0.0/29", "alias-team": "shared"},
+			namespace:      "shared",
+			wantKey:        "cidr-shared",
+			wantNamespaces: []string{"shared", "team"},
+		},
+		{
+			name:      "missing target",
+			data:      map[string]string{"alias-team": "shared", "cidr-global": "10.1.0.0/29"},
+			namespace: "team",
+			wantError: "namespace [team] is aliased to namespace [shared], which has no cidr, range or hosts pool",
+		},
+		{
+			name:      "two-node cycle",
+			data:      map[string]string{"alias-team": "shared", "alias-shared": "team", "cidr-team": "10.0.0.0/29"},
+			namespace: "team",
+			wantError: "alias cycle [team -> shared -> team]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := discoverPool(&v1.ConfigMap{Data: tt.data}, tt.namespace, "", KubeVipClientConfig)
+			if len(tt.wantError) != 0 {
+				assert.EqualError(t, err, tt.wantError)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantKey, pool.key)
+			assert.False(t, pool.global)
+			assert.Equal(t, tt.wantNamespaces, pool.namespaces)
+		})
+	}
+}
+
+func Test_syncLoadBalancerAlias(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-shared": "10.0.0.0/29", "alias-team": "shared"},
+		newKubevipService("shared", "first", "10.0.0.1"),
+		// The namespace doesn't share the pool
+		newKubevipService("other", "other", "10.0.0.2"),
+	)
+
+	// The addresses of the services of the aliased namespace are in use
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", got)
+
+	// The addresses of the services of the namespaces aliased to the pool are in use
+	got, err = syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "shared", Name: "third"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.3", got)
+}
+
+func Test_syncLoadBalancerSkipsNoopUpdates(t *testing.T) {
+	labeled := newKubevipService("test", "labeled", "10.0.0.1")
+
+	// The queued copy of the service lacks the label, which was written since
+	stale := newKubevipService("test", "stale", "10.0.0.2")
+	queuedStale := stale.DeepCopy()
+	delete(queuedStale.Labels, ImplementationLabelKey)
+
+	// The queued copy of the legacy service lacks the annotation, which was written since
+	legacy := newKubevipService("test", "legacy", "10.0.0.3")
+	legacy.Spec.LoadBalancerIP = "10.0.0.3"
+	queuedLegacy := legacy.DeepCopy()
+	delete(queuedLegacy.Annotations, LoadbalancerIPsAnnotations)
+
+	// The label is missing
+	unlabeled := newKubevipService("test", "unlabeled", "10.0.0.4")
+	delete(unlabeled.Labels, ImplementationLabelKey)
+
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, labeled, stale, legacy, unlabeled)
+	client := mgr.kubeClient.(*fake.Clientset)
+
+	for _, svc := range []*v1.Service{labeled, queuedStale, queuedLegacy} {
+		client.ClearActions()
+		if _, err := mgr.syncLoadBalancer(context.Background(), svc, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "update" {
+				t.Errorf("syncLoadBalancer() of service %s updated it, want no update", svc.Name)
+			}
+		}
+	}
+
+	client.ClearActions()
+	if _, err := mgr.syncLoadBalancer(context.Background(), unlabeled, nil); err != nil {
+		t.Fatal(err)
+	}
+	var updates int
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			updates++
+		}
+	}
+	assert.Equal(t, 1, updates)
+}
+
+func Test_syncLoadBalancerRangeSegments(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     string
+		wantOrder []string
+	}{
+		{
+			name:      "ascending order rolls into the second segment",
+			order:     "asc",
+			wantOrder: []string{"10.0.0.10", "10.0.0.11", "10.0.0.40", "10.0.0.41"},
+		},
+		{
+			name:      "descending order starts at the end of the last segment",
+			order:     "desc",
+			wantOrder: []string{"10.0.0.41", "10.0.0.40", "10.0.0.11", "10.0.0.10"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{
+				"range-prod":   "10.0.0.10-10.0.0.11,10.0.0.40-10.0.0.41",
+				"search-order": tt.order,
+			})
+			for i, want := range tt.wantOrder {
+				got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: fmt.Sprintf("svc-%d", i)}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, want, got)
+			}
+			_, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "svc-full"}})
+			var outOfIPs *ipam.OutOfIPsError
+			if !errors.As(err, &outOfIPs) {
+				t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerReallocate(t *testing.T) {
+	annotated := newKubevipService("test", "annotated", "10.0.0.1")
+	annotated.Annotations[ReallocateAnnotation] = "true"
+
+	// The legacy service only has spec.loadBalancerIP, its address isn't gathered as in use
+	legacy := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "legacy",
+			Annotations: map[string]string{ReallocateAnnotation: "true"},
+		},
+		Spec: v1.ServiceSpec{LoadBalancerIP: "10.0.0.1"},
+	}
+
+	for _, svc := range []*v1.Service{annotated, legacy} {
+		t.Run(svc.Name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, svc)
+			recorder := mgr.recorder.(*record.FakeRecorder)
+
+			if _, err := mgr.syncLoadBalancer(context.Background(), svc, nil); err != nil {
+				t.Fatal(err)
+			}
+			got, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "10.0.0.2", got.Annotations[LoadbalancerIPsAnnotations])
+			assert.Equal(t, "10.0.0.2", got.Spec.LoadBalancerIP)
+			assert.NotContains(t, got.Annotations, ReallocateAnnotation)
+			assert.Equal(t, "Normal IPAllocated Reallocated address(es) [10.0.0.2] from pool [cidr-global], replacing [10.0.0.1]", <-recorder.Events)
+
+			// The previous address is free again for other services
+			next, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "next"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "10.0.0.1", next)
+		})
+	}
+}
+
+func Test_syncLoadBalancerCustomKeys(t *testing.T) {
+	defer func(annotation, label, value string) {
+		IPsAnnotation, ImplementationLabel, ImplementationValue = annotation, label, value
+	}(IPsAnnotation, ImplementationLabel, ImplementationValue)
+	IPsAnnotation, ImplementationLabel, ImplementationValue = "example.com/vips", "example.com/implementation", "custom-vip"
+	if err := validateServiceKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The address of a service with the default keys isn't in use for the custom build
+	defaultKeys := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "default-keys",
+			Labels:      map[string]string{ImplementationLabelKey: ImplementationLabelValue},
+			Annotations: map[string]string{LoadbalancerIPsAnnotations: "10.0.0.2"},
+		},
+	}
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"},
+		newKubevipService("test", "existing", "10.0.0.1"), defaultKeys)
+
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", got)
+
+	svc, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "svc", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "custom-vip", svc.Labels["example.com/implementation"])
+	assert.NotContains(t, svc.Annotations, LoadbalancerIPsAnnotations)
+
+	allocated, err := ListAllocatedIPs(context.Background(), mgr.kubeClient, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	for _, ip := range allocated {
+		addresses = append(addresses, ip.ServiceName+"="+ip.Address.String())
+	}
+	assert.ElementsMatch(t, []string{"existing=10.0.0.1", "svc=10.0.0.2"}, addresses)
+}
+
+func Test_syncLoadBalancerForeignImplementation(t *testing.T) {
+	defer func(value string) {
+		ImplementationValue = value
+	}(ImplementationValue)
+	ImplementationValue = "kube-vip-edge"
+
+	// Another controller labels its services with the same key, their addresses aren't in use for kube-vip
+	foreign := newKubevipService("test", "foreign", "10.0.0.1")
+	foreign.Labels[ImplementationLabel] = "other-lb"
+	held := newKubevipService("other", "held", "10.0.0.5")
+	held.Labels[ImplementationLabel] = ImplementationLabelValue
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-global":         "10.0.0.0/29",
+		"reserved-test-fixed": "10.0.0.5",
+	}, foreign, held)
+
+	status, err := mgr.getPoolStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, big.NewInt(0), status[0].InUse)
+
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.1", got)
+
+	// The reserved address is only held by a foreign service, it is assigned
+	got, err = syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "fixed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.5", got)
+}
+
+func Test_validateServiceKeys(t *testing.T) {
+	defer func(annotation, label, value string) {
+		IPsAnnotation, ImplementationLabel, ImplementationValue = annotation, label, value
+	}(IPsAnnotation, ImplementationLabel, ImplementationValue)
+
+	assert.NoError(t, validateServiceKeys())
+	ImplementationLabel = "not a key"
+	assert.ErrorContains(t, validateServiceKeys(), "invalid service annotation or label key [not a key]")
+	ImplementationLabel, ImplementationValue = ImplementationLabelKey, ""
+	assert.ErrorContains(t, validateServiceKeys(), "the implementation label value must not be empty")
+	ImplementationValue = "kube vip"
+	assert.ErrorContains(t, validateServiceKeys(), "invalid implementation label value [kube vip]")
+}
+
+func Test_discoverPoolHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		poolName string
+		wantKey  string
+	}{
+		{
+			name:    "namespace hosts",
+			data:    map[string]string{"hosts-test": "10.0.0.5,10.0.0.9", "hosts-global": "10.0.1.5"},
+			wantKey: "hosts-test",
+		},
+		{
+			name:    "global hosts",
+			data:    map[string]string{"hosts-global": "10.0.1.5"},
+			wantKey: "hosts-global",
+		},
+		{
+			name:    "ranges take precedence over hosts",
+			data:    map[string]string{"hosts-test": "10.0.0.5", "range-global": "10.0.1.1-10.0.1.10"},
+			wantKey: "range-global",
+		},
+		{
+			name:     "named hosts",
+			data:     map[string]string{"hosts-pool-edge": "10.0.2.5", "cidr-global": "10.0.1.0/24"},
+			poolName: "edge",
+			wantKey:  "hosts-pool-edge",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := discoverPool(&v1.ConfigMap{Data: tt.data}, "test", tt.poolName, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantKey, pool.key)
+		})
+	}
+}
+
+func Test_syncLoadBalancerHostList(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     string
+		wantOrder []string
+	}{
+		{
+			name:      "hosts are allocated in the configured order",
+			order:     "asc",
+			wantOrder: []string{"10.0.0.17", "10.0.0.9"},
+		},
+		{
+			name:      "descending order starts at the last host",
+			order:     "desc",
+			wantOrder: []string{"10.0.0.9", "10.0.0.17"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{
+				"hosts-prod":   "10.0.0.17,10.0.0.5,10.0.0.9",
+				"search-order": tt.order,
+			}, newKubevipService("prod", "existing", "10.0.0.5"))
+			for i, want := range tt.wantOrder {
+				got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: fmt.Sprintf("svc-%d", i)}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, want, got)
+			}
+
+			// The addresses between the hosts are never allocated
+			_, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "svc-full"}})
+			var outOfIPs *ipam.OutOfIPsError
+			if !errors.As(err, &outOfIPs) {
+				t.Errorf("syncLoadBalancer() error = %v, want OutOfIPsError", err)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerReallocateOutOfPool(t *testing.T) {
+	newAllocated := func(name, address string) *v1.Service {
+		svc := newKubevipService("test", name, address)
+		svc.Annotations[AllocationSourceAnnotation] = "pool:cidr-global"
+		return svc
+	}
+	userDefined := newKubevipService("test", "user-defined", "10.0.1.9")
+
+	tests := []struct {
+		name       string
+		svc        *v1.Service
+		reallocate bool
+		want       string
+		wantEvents []string
+	}{
+		{
+			name:       "address in the pool is kept",
+			svc:        newAllocated("in-pool", "10.0.0.3"),
+			reallocate: true,
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "address outside of the shrunk pool is reallocated",
+			svc:        newAllocated("out-of-pool", "10.0.0.12"),
+			reallocate: true,
+			want:       "10.0.0.1",
+			wantEvents: []string{
+				"Normal IPOutOfPool Address(es) [10.0.0.12] are no longer part of the pool, reallocating",
+				"Normal IPAllocated Reallocated address(es) [10.0.0.1] from pool [cidr-global], replacing [10.0.0.12]",
+			},
+		},
+		{
+			name: "address outside of the pool is kept by default",
+			svc:  newAllocated("disabled", "10.0.0.12"),
+			want: "10.0.0.12",
+		},
+		{
+			name:       "address set by the user is kept",
+			svc:        userDefined,
+			reallocate: true,
+			want:       "10.0.1.9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The pool was shrunk from 10.0.0.0/28 to 10.0.0.0/29
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, tt.svc)
+			mgr.reallocateOutOfPool = tt.reallocate
+			recorder := mgr.recorder.(*record.FakeRecorder)
+
+			// A second sync doesn't change the service again
+			for range 2 {
+				svc, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), tt.svc.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := mgr.syncLoadBalancer(context.Background(), svc, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), tt.svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got.Annotations[LoadbalancerIPsAnnotations])
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			assert.Equal(t, tt.wantEvents, events)
+		})
+	}
+}
+
+func Test_syncLoadBalancerWriteIPFamilies(t *testing.T) {
+	tests := []struct {
+		name            string
+		pool            string
+		writeIPFamilies bool
+		ipFamilies      []v1.IPFamily
+		want            []v1.IPFamily
+	}{
+		{
+			name:            "ipv4 pool",
+			pool:            "10.0.0.0/29",
+			writeIPFamilies: true,
+			want:            []v1.IPFamily{v1.IPv4Protocol},
+		},
+		{
+			name:            "ipv6 pool",
+			pool:            "fe80::10/126",
+			writeIPFamilies: true,
+			want:            []v1.IPFamily{v1.IPv6Protocol},
+		},
+		{
+			name:            "families listed by the service are kept",
+			pool:            "10.0.0.0/29,fe80::10/126",
+			writeIPFamilies: true,
+			ipFamilies:      []v1.IPFamily{v1.IPv6Protocol},
+			want:            []v1.IPFamily{v1.IPv6Protocol},
+		},
+		{
+			name: "disabled",
+			pool: "10.0.0.0/29",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": tt.pool})
+			mgr.writeIPFamilies = tt.writeIPFamilies
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec:       v1.ServiceSpec{IPFamilies: tt.ipFamilies},
+			}
+			if _, err := syncNewService(t, mgr, svc); err != nil {
+				t.Fatal(err)
+			}
+			got, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "svc", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got.Spec.IPFamilies)
+		})
+	}
+}
+
+func Test_discoverAddressDeterministic(t *testing.T) {
+	inUseIPSet, err := ipam.BuildAddressSet("10.0.0.1,fd00::")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		pool string
+		want string
+	}{
+		{
+			name: "cidrs are searched from the lowest",
+			pool: "10.0.1.0/30,10.0.0.0/30",
+			want: "10.0.0.2",
+		},
+		{
+			name: "ranges are searched from the lowest",
+			pool: "10.0.1.1-10.0.1.2,10.0.0.1-10.0.0.2",
+			want: "10.0.0.2",
+		},
+		{
+			name: "hosts are searched from the lowest",
+			pool: "10.0.0.9,10.0.0.1,10.0.0.3",
+			want: "10.0.0.3",
+		},
+		{
+			name: "large IPv6 cidrs are searched sequentially",
+			pool: "fd00::/64",
+			want: "fd00::1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The search order is ignored and the result is the same on every run
+			for _, descOrder := range []bool{false, true, false} {
+				got, err := discoverAddress(context.Background(), "discover-address-deterministic", tt.pool, inUseIPSet,
+					allocationOptions{descOrder: descOrder, deterministic: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerDeterministic(t *testing.T) {
+	data := map[string]string{
+		"cidr-global":  "10.0.1.0/29,10.0.0.0/30",
+		"search-order": "desc",
+	}
+	allocate := func() []string {
+		mgr := newTestLoadBalancer(t, data)
+		mgr.deterministic = true
+		var got []string
+		for i := range 3 {
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: fmt.Sprintf("svc-%d", i)}}
+			svc.Annotations = map[string]string{SearchOrderAnnotation: "desc"}
+			addr, err := syncNewService(t, mgr, svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, addr)
+		}
+		return got
+	}
+	first := allocate()
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.1.1"}, first)
+	assert.Equal(t, first, allocate())
+}
+
+func Test_syncLoadBalancerVerifyAllocation(t *testing.T) {
+	tests := []struct {
+		name             string
+		verifyAllocation bool
+		want             string
+	}{
+		{
+			name: "without verification the concurrently assigned address is allocated again",
+			want: "10.0.0.1",
+		},
+		{
+			name:             "the concurrently assigned address is detected and the service allocated again",
+			verifyAllocation: true,
+			want:             "10.0.0.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+			mgr.verifyAllocation = tt.verifyAllocation
+
+			// Another replica assigns the first free address once the in-use addresses were gathered, right
+			// before the service is updated
+			client := mgr.kubeClient.(*fake.Clientset)
+			assigned := false
+			client.PrependReactor("get", "services", func(_ k8stesting.Action) (bool, runtime.Object, error) {
+				if !assigned {
+					assigned = true
+					if err := client.Tracker().Add(newKubevipService("other", "concurrent", "10.0.0.1")); err != nil {
+						return true, nil, err
+					}
+				}
+				return false, nil, nil
+			})
+
+			got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, assigned)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_syncLoadBalancerMappedAddress(t *testing.T) {
+	// The IPv4-mapped IPv6 address is in use as the IPv4 address
+	mapped := newKubevipService("other", "mapped", "::ffff:10.0.0.1")
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29,fe80::10/127"}, mapped)
+
+	pool := &ipPool{addresses: "10.0.0.0/29", key: "cidr-global", global: true}
+	inUseSet, _, err := mgr.gatherInUseAddresses(context.Background(), "test", pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, inUseSet.Contains(netip.MustParseAddr("10.0.0.1")))
+
+	got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", got)
+}
+
+func Test_syncLoadBalancerDrainPool(t *testing.T) {
+	// The namespace is migrated from 10.0.0.0/24 to 10.1.0.0/24
+	existing := newKubevipService("prod", "existing", "10.0.0.5")
+	existing.Annotations[AllocationSourceAnnotation] = "pool:cidr-prod"
+
+	tests := []struct {
+		name     string
+		data     map[string]string
+		wantKept string
+		wantNew  string
+	}{
+		{
+			name:     "without a drain pool the existing address is reallocated",
+			data:     map[string]string{"cidr-prod": "10.1.0.0/24"},
+			wantKept: "10.1.0.1",
+			wantNew:  "10.1.0.2",
+		},
+		{
+			name: "new services are allocated from the primary pool, the existing address is kept",
+			data: map[string]string{
+				"cidr-prod":       "10.1.0.0/24",
+				"drain-cidr-prod": "10.0.0.0/24",
+			},
+			wantKept: "10.0.0.5",
+			wantNew:  "10.1.0.1",
+		},
+		{
+			name: "the addresses of the drain pool are never allocated",
+			data: map[string]string{
+				"cidr-prod":       "10.0.0.0/23",
+				"drain-cidr-prod": "10.0.0.0/24",
+			},
+			wantKept: "10.0.0.5",
+			wantNew:  "10.0.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, tt.data, existing.DeepCopy())
+			mgr.reallocateOutOfPool = true
+
+			if _, err := mgr.syncLoadBalancer(context.Background(), existing.DeepCopy(), nil); err != nil {
+				t.Fatal(err)
+			}
+			kept, err := mgr.kubeClient.CoreV1().Services("prod").Get(context.Background(), existing.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantKept, kept.Annotations[IPsAnnotation])
+
+			got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "new"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantNew, got)
+		})
+	}
+}
+
+func Test_syncLoadBalancerInternalPool(t *testing.T) {
+	internal := func(name string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        name,
+			Annotations: map[string]string{InternalAnnotation: "true"},
+		}}
+	}
+	tests := []struct {
+		name    string
+		data    map[string]string
+		service *v1.Service
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "internal service takes the internal pool of the namespace",
+			data: map[string]string{
+				"cidr-test":            "192.168.0.0/24",
+				"internal-cidr-test":   "10.0.0.0/24",
+				"internal-cidr-global": "10.1.0.0/24",
+			},
+			service: internal("svc"),
+			want:    "10.0.0.1",
+		},
+		{
+			name: "internal service takes the global internal pool",
+			data: map[string]string{
+				"cidr-test":             "192.168.0.0/24",
+				"internal-range-global": "10.1.0.10-10.1.0.20",
+			},
+			service: internal("svc"),
+			want:    "10.1.0.10",
+		},
+		{
+			name: "other services take the standard pool",
+			data: map[string]string{
+				"cidr-test":          "192.168.0.0/24",
+				"internal-cidr-test": "10.0.0.0/24",
+			},
+			service: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}},
+			want:    "192.168.0.1",
+		},
+		{
+			name: "internal service ignores the named pool",
+			data: map[string]string{
+				"cidr-pool-edge":     "192.168.1.0/24",
+				"internal-cidr-test": "10.0.0.0/24",
+			},
+			service: func() *v1.Service {
+				svc := internal("svc")
+				svc.Annotations[LoadbalancerPoolAnnotation] = "edge"
+				return svc
+			}(),
+			want: "10.0.0.1",
+		},
+		{
+			name:    "step of the internal cidr pool",
+			data:    map[string]string{"internal-cidr-test": "10.0.0.0/24;step=4"},
+			service: internal("svc"),
+			want:    "10.0.0.4",
+		},
+		{
+			name:    "min and max of the internal cidr pool",
+			data:    map[string]string{"internal-cidr-test": "10.0.0.0/24;min=.100;max=.200"},
+			service: internal("svc"),
+			want:    "10.0.0.100",
+		},
+		{
+			name:    "exclude-endpoints of the internal range pool",
+			data:    map[string]string{"internal-range-global": "10.1.0.10-10.1.0.20;exclude-endpoints=true"},
+			service: internal("svc"),
+			want:    "10.1.0.11",
+		},
+		{
+			name:    "internal service without an internal pool isn't exposed on the standard pool",
+			data:    map[string]string{"cidr-test": "192.168.0.0/24"},
+			service: internal("svc"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, tt.data)
+			got, err := syncNewService(t, mgr, tt.service)
+			if tt.wantErr {
+				assert.EqualError(t, err, "no internal address pools could be found for namespace [test] in configMap [kubevip]")
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func newZoneNode(name, zone string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if len(zone) != 0 {
+		node.Labels = map[string]string{v1.LabelTopologyZone: zone}
+	}
+	return node
+}
+
+func Test_serviceZone(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []*v1.Node
+		want  string
+	}{
+		{
+			name:  "single zone",
+			nodes: []*v1.Node{newZoneNode("a1", "zone-a"), newZoneNode("a2", "zone-a")},
+			want:  "zone-a",
+		},
+		{
+			name:  "zone of most nodes",
+			nodes: []*v1.Node{newZoneNode("a1", "zone-a"), newZoneNode("b1", "zone-b"), newZoneNode("b2", "zone-b")},
+			want:  "zone-b",
+		},
+		{
+			name:  "first zone by name on a tie",
+			nodes: []*v1.Node{newZoneNode("b1", "zone-b"), newZoneNode("a1", "zone-a"), newZoneNode("none", "")},
+			want:  "zone-a",
+		},
+		{
+			name:  "nodes without zone",
+			nodes: []*v1.Node{newZoneNode("none", "")},
+		},
+		{
+			name: "no nodes",
+		},
+	}
+	mgr := newLoadBalancer(fake.NewSimpleClientset(), KubeVipClientConfigNamespace, KubeVipClientConfig, nil)
+	mgr.zonePools = true
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, mgr.serviceZone(tt.nodes))
+		})
+	}
+
+	mgr.zonePools = false
+	assert.Empty(t, mgr.serviceZone([]*v1.Node{newZoneNode("a1", "zone-a")}))
+}
+
+func Test_syncLoadBalancerZonePools(t *testing.T) {
+	data := map[string]string{
+		"cidr-zone-eu-1a":  "10.1.0.0/24",
+		"range-zone-eu-1b": "10.2.0.10-10.2.0.20",
+		"cidr-pool-edge":   "10.3.0.0/24",
+		"cidr-global":      "10.0.0.0/24",
+	}
+	tests := []struct {
+		name      string
+		nodes     []*v1.Node
+		poolName  string
+		zonePools bool
+		want      string
+	}{
+		{
+			name:      "nodes in the first zone",
+			nodes:     []*v1.Node{newZoneNode("a1", "eu-1a"), newZoneNode("a2", "eu-1a")},
+			zonePools: true,
+			want:      "10.1.0.1",
+		},
+		{
+			name:      "nodes in the second zone",
+			nodes:     []*v1.Node{newZoneNode("b1", "eu-1b")},
+			zonePools: true,
+			want:      "10.2.0.10",
+		},
+		{
+			name:      "zone without pool takes the global pool",
+			nodes:     []*v1.Node{newZoneNode("c1", "eu-1c")},
+			zonePools: true,
+			want:      "10.0.0.1",
+		},
+		{
+			name:      "named pool takes precedence over the zone",
+			nodes:     []*v1.Node{newZoneNode("a1", "eu-1a")},
+			poolName:  "edge",
+			zonePools: true,
+			want:      "10.3.0.1",
+		},
+		{
+			name:  "zone pools disabled",
+			nodes: []*v1.Node{newZoneNode("a1", "eu-1a")},
+			want:  "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, data)
+			mgr.zonePools = tt.zonePools
+			svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}}
+			if len(tt.poolName) != 0 {
+				svc.Annotations = map[string]string{LoadbalancerPoolAnnotation: tt.poolName}
+			}
+			if _, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := mgr.UpdateLoadBalancer(context.Background(), "", svc, tt.nodes); err != nil {
+				t.Fatal(err)
+			}
+			updated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, updated.Annotations[IPsAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerIPConflict(t *testing.T) {
+	tests := []struct {
+		name           string
+		spec           string
+		annotation     string
+		winner         string
+		wantAnnotation string
+		wantStatus     string
+		wantEvent      string
+	}{
+		{
+			name:           "matching values",
+			spec:           "10.0.0.5",
+			annotation:     "10.0.0.5",
+			winner:         LoadBalancerIPConflictAnnotation,
+			wantAnnotation: "10.0.0.5",
+			wantStatus:     "10.0.0.5",
+		},
+		{
+			name:           "spec is the first address of a dual-stack service",
+			spec:           "10.0.0.5",
+			annotation:     "10.0.0.5,fe80::5",
+			winner:         LoadBalancerIPConflictSpec,
+			wantAnnotation: "10.0.0.5,fe80::5",
+			wantStatus:     "10.0.0.5",
+		},
+		{
+			name:           "spec only",
+			spec:           "10.0.0.5",
+			winner:         LoadBalancerIPConflictAnnotation,
+			wantAnnotation: "10.0.0.5",
+			wantStatus:     "10.0.0.5",
+		},
+		{
+			name:           "annotation only",
+			annotation:     "10.0.0.6",
+			winner:         LoadBalancerIPConflictSpec,
+			wantAnnotation: "10.0.0.6",
+			wantStatus:     "10.0.0.6",
+		},
+		{
+			name:           "conflicting values, the annotation wins",
+			spec:           "10.0.0.5",
+			annotation:     "10.0.0.6",
+			winner:         LoadBalancerIPConflictAnnotation,
+			wantAnnotation: "10.0.0.6",
+			wantStatus:     "10.0.0.6",
+			wantEvent:      "Warning LoadBalancerIPConflict spec.loadBalancerIP [10.0.0.5] isn't one of the address(es) [10.0.0.6] of the annotation, keeping the annotation",
+		},
+		{
+			name:           "conflicting values, the spec wins",
+			spec:           "10.0.0.5",
+			annotation:     "10.0.0.6",
+			winner:         LoadBalancerIPConflictSpec,
+			wantAnnotation: "10.0.0.5",
+			wantStatus:     "10.0.0.5",
+			wantEvent:      "Warning LoadBalancerIPConflict spec.loadBalancerIP [10.0.0.5] isn't one of the address(es) [10.0.0.6] of the annotation, keeping the spec",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec:       v1.ServiceSpec{LoadBalancerIP: tt.spec},
+			}
+			if len(tt.annotation) != 0 {
+				svc.Annotations = map[string]string{IPsAnnotation: tt.annotation}
+			}
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/24"}, svc)
+			mgr.loadBalancerIPConflictWinner = tt.winner
+			mgr.populateIngress = true
+			recorder := mgr.recorder.(*record.FakeRecorder)
+
+			status, err := mgr.syncLoadBalancer(context.Background(), svc, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantStatus, status.Ingress[0].IP)
+			updated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.wantAnnotation, updated.Annotations[IPsAnnotation])
+			// The spec is never changed
+			assert.Equal(t, tt.spec, updated.Spec.LoadBalancerIP)
+			if len(tt.wantEvent) != 0 {
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			} else {
+				assert.Empty(t, recorder.Events)
+			}
+		})
+	}
+}
+
+func Test_syncLoadBalancerIPConflictReportedOnce(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc", Annotations: map[string]string{IPsAnnotation: "10.0.0.6"}},
+		Spec:       v1.ServiceSpec{LoadBalancerIP: "10.0.0.5"},
+	}
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/24"}, svc)
+	mgr.loadBalancerIPConflictWinner = LoadBalancerIPConflictAnnotation
+	recorder := mgr.recorder.(*record.FakeRecorder)
+	sync := func() {
+		t.Helper()
+		current, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mgr.syncLoadBalancer(context.Background(), current, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The spec is never changed, the conflict is only reported when it is first seen
+	sync()
+	sync()
+	assert.Equal(t, "Warning LoadBalancerIPConflict spec.loadBalancerIP [10.0.0.5] isn't one of the address(es) [10.0.0.6] of the annotation, keeping the annotation", <-recorder.Events)
+	assert.Empty(t, recorder.Events)
+
+	// Another conflict is reported again
+	current, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Spec.LoadBalancerIP = "10.0.0.7"
+	if _, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Update(context.Background(), current, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	sync()
+	assert.Equal(t, "Warning LoadBalancerIPConflict spec.loadBalancerIP [10.0.0.7] isn't one of the address(es) [10.0.0.6] of the annotation, keeping the annotation", <-recorder.Events)
+	assert.Empty(t, recorder.Events)
+}
+
+func Test_syncLoadBalancerProtocolPools(t *testing.T) {
+	ports := func(protocols ...v1.Protocol) []v1.ServicePort {
+		var ports []v1.ServicePort
+		for i, protocol := range protocols {
+			ports = append(ports, v1.ServicePort{Name: fmt.Sprintf("port-%d", i), Port: int32(80 + i), Protocol: protocol})
+		}
+		return ports
+	}
+	tests := []struct {
+		name  string
+		data  map[string]string
+		ports []v1.ServicePort
+		want  string
+	}{
+		{
+			name:  "TCP service",
+			data:  map[string]string{"cidr-tcp-test": "10.1.0.0/24", "cidr-udp-test": "10.2.0.0/24", "cidr-test": "10.0.0.0/24"},
+			ports: ports(v1.ProtocolTCP, ""),
+			want:  "10.1.0.1",
+		},
+		{
+			name:  "UDP service",
+			data:  map[string]string{"cidr-tcp-test": "10.1.0.0/24", "cidr-udp-test": "10.2.0.0/24", "cidr-test": "10.0.0.0/24"},
+			ports: ports(v1.ProtocolUDP, v1.ProtocolUDP),
+			want:  "10.2.0.1",
+		},
+		{
+			name:  "mixed service takes the generic pool",
+			data:  map[string]string{"cidr-tcp-test": "10.1.0.0/24", "cidr-udp-test": "10.2.0.0/24", "cidr-test": "10.0.0.0/24"},
+			ports: ports(v1.ProtocolTCP, v1.ProtocolUDP),
+			want:  "10.0.0.1",
+		},
+		{
+			name:  "global pool of the protocol",
+			data:  map[string]string{"range-udp-global": "10.3.0.10-10.3.0.20", "cidr-test": "10.0.0.0/24"},
+			ports: ports(v1.ProtocolUDP),
+			want:  "10.3.0.10",
+		},
+		{
+			name:  "no pool for the protocol",
+			data:  map[string]string{"cidr-udp-test": "10.2.0.0/24", "cidr-test": "10.0.0.0/24"},
+			ports: ports(v1.ProtocolTCP),
+			want:  "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, tt.data)
+			got, err := syncNewService(t, mgr, &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec:       v1.ServiceSpec{Ports: tt.ports},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_syncLoadBalancerPopulateIngress(t *testing.T) {
+	dualStack := func(name string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name},
+			Spec: v1.ServiceSpec{
+				IPFamilyPolicy: ptr.To(v1.IPFamilyPolicyRequireDualStack),
+				IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			},
+		}
+	}
+	tests := []struct {
+		name     string
+		data     map[string]string
+		services []*v1.Service
+		service  *v1.Service
+		populate bool
+		want     []v1.LoadBalancerIngress
+	}{
+		{
+			name:     "allocated addresses",
+			data:     map[string]string{"cidr-global": "10.0.0.0/29,fe80::10/127"},
+			service:  dualStack("svc"),
+			populate: true,
+			want:     []v1.LoadBalancerIngress{{IP: "10.0.0.1"}, {IP: "fe80::10"}},
+		},
+		{
+			name:     "existing addresses",
+			data:     map[string]string{"cidr-global": "10.0.0.0/29"},
+			services: []*v1.Service{newKubevipService("test", "svc", "10.0.0.5")},
+			service:  newKubevipService("test", "svc", "10.0.0.5"),
+			populate: true,
+			want:     []v1.LoadBalancerIngress{{IP: "10.0.0.5"}},
+		},
+		{
+			name:     "the DHCP address is left to kube-vip",
+			data:     map[string]string{"cidr-global": "0.0.0.0/32"},
+			service:  &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}},
+			populate: true,
+		},
+		{
+			name:    "disabled",
+			data:    map[string]string{"cidr-global": "10.0.0.0/29"},
+			service: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, tt.data, tt.services...)
+			mgr.populateIngress = tt.populate
+			if len(tt.services) == 0 {
+				if _, err := mgr.kubeClient.CoreV1().Services(tt.service.Namespace).Create(context.Background(), tt.service, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			status, err := mgr.syncLoadBalancer(context.Background(), tt.service, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, status.Ingress)
+		})
+	}
+}
+
+func Test_ValidateDualStackPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    string
+		policy  *v1.IPFamilyPolicy
+		missing v1.IPFamily
+	}{
+		{
+			name:    "IPv4 cidrs",
+			pool:    "10.0.0.0/24",
+			policy:  ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			missing: v1.IPv6Protocol,
+		},
+		{
+			name:    "IPv6 ranges",
+			pool:    "fd00::1-fd00::10",
+			policy:  ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			missing: v1.IPv4Protocol,
+		},
+		{
+			name:    "IPv4 hosts",
+			pool:    "10.0.0.1,10.0.0.5",
+			policy:  ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			missing: v1.IPv6Protocol,
+		},
+		{
+			name:   "dual-stack ranges",
+			pool:   "10.0.0.1-10.0.0.5,fd00::1-fd00::10",
+			policy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+		},
+		{
+			name:   "IPv4 cidrs with PreferDualStack",
+			pool:   "10.0.0.0/24",
+			policy: ipFamilyPolicyPtr(v1.IPFamilyPolicyPreferDualStack),
+		},
+		{
+			name: "IPv4 cidrs without policy",
+			pool: "10.0.0.0/24",
+		},
+		{
+			name:   "DHCP",
+			pool:   "0.0.0.0/32",
+			policy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDualStackPool("cidr-global", tt.pool, tt.policy)
+			if tt.missing == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, NewDualStackUnsupportedError("cidr-global", tt.missing), err)
+		})
+	}
+}
+
+func Test_syncLoadBalancerDualStackUnsupported(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"},
+		Spec: v1.ServiceSpec{
+			IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+	client := mgr.kubeClient.(*fake.Clientset)
+	client.ClearActions()
+
+	_, err := syncNewService(t, mgr, svc)
+	var dualStackErr *DualStackUnsupportedError
+	if !errors.As(err, &dualStackErr) {
+		t.Fatalf("expected a DualStackUnsupportedError, got: %v", err)
+	}
+	assert.EqualError(t, err, "service requires dual-stack, but pool [cidr-global] has no IPv6 addresses configured")
+	// The service is refused before the in-use addresses are gathered
+	for _, action := range client.Actions() {
+		if action.Matches("list", "services") {
+			t.Errorf("unexpected list of services")
+		}
+	}
+}
+
+func Test_discoverVIPsAlignOffsets(t *testing.T) {
+	tests := []struct {
+		name       string
+		pool       string
+		inUse      []string
+		opts       allocationOptions
+		ipFamilies []v1.IPFamily
+		want       string
+	}{
+		{
+			name:       "both offsets free",
+			pool:       "10.0.0.0/24,fd00::/120",
+			inUse:      []string{"10.0.0.1", "10.0.0.2", "fd00::1"},
+			opts:       allocationOptions{alignOffsets: true},
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			want:       "10.0.0.3,fd00::3",
+		},
+		{
+			name:       "IPv6 first",
+			pool:       "10.0.1.10-10.0.1.20,fd00::10-fd00::20",
+			inUse:      []string{"fd00::10", "fd00::11"},
+			opts:       allocationOptions{alignOffsets: true},
+			ipFamilies: []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+			want:       "fd00::12,10.0.1.12",
+		},
+		{
+			name:       "offset in use falls back to the next free address",
+			pool:       "10.0.0.0/24,fd00::/120",
+			inUse:      []string{"10.0.0.1", "10.0.0.2", "fd00::3"},
+			opts:       allocationOptions{alignOffsets: true},
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			want:       "10.0.0.3,fd00::",
+		},
+		{
+			name:       "not aligned by default",
+			pool:       "10.0.0.0/24,fd00::/120",
+			inUse:      []string{"10.0.0.1", "10.0.0.2"},
+			ipFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			want:       "10.0.0.3,fd00::",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &netipx.IPSetBuilder{}
+			for _, address := range tt.inUse {
+				builder.Add(netip.MustParseAddr(address))
+			}
+			inUseIPSet, err := builder.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := discoverVIPs(context.Background(), "discover-vips-align-offsets", tt.pool, inUseIPSet, tt.opts,
+				ptr.To(v1.IPFamilyPolicyRequireDualStack), tt.ipFamilies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"time"
@@ -13,12 +14,14 @@ import (
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
+	"k8s.io/cloud-provider/api"
 	servicehelper "k8s.io/cloud-provider/service/helpers"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -26,7 +29,7 @@ const (
 )
 
 // loadbalancerClassServiceController starts a controller that reconcile type loadbalancer service with
-// loadbalancerclass set to kube-vip.io/kube-vip-class.
+// loadbalancerclass set to kube-vip.io/kube-vip-class, or the name configured by KUBEVIP_LOADBALANCERCLASS_NAME.
 // no need to add node controller since kube-vip-cp itself doesn't use node info to update loadbalancer
 type loadbalancerClassServiceController struct {
 	kubeClient          kubernetes.Interface
@@ -37,17 +40,20 @@ type loadbalancerClassServiceController struct {
 	recorder  record.EventRecorder
 	workqueue workqueue.RateLimitingInterface
 
-	cmName      string
-	cmNamespace string
+	lbManager *kubevipLoadBalancerManager
 }
 
+// newLoadbalancerClassServiceController returns the controller syncing the services of the loadbalancerClass of the
+// manager. The manager is shared with the service controller of the cloud-provider, so both see the same withheld
+// addresses and back off the reads of the configmap together.
 func newLoadbalancerClassServiceController(
 	sharedInformer informers.SharedInformerFactory,
 	kubeClient kubernetes.Interface,
-	cmName, cmNamespace string,
+	lbManager *kubevipLoadBalancerManager,
 ) *loadbalancerClassServiceController {
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerName})
 	serviceInformer := sharedInformer.Core().V1().Services().Informer()
 	c := &loadbalancerClassServiceController{
@@ -59,20 +65,24 @@ func newLoadbalancerClassServiceController(
 		recorder:  recorder,
 		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Services"),
 
-		cmName:      cmName,
-		cmNamespace: cmNamespace,
+		lbManager: lbManager,
 	}
 
 	_, _ = serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(cur interface{}) {
-			if svc, ok := cur.(*corev1.Service); ok && wantsLoadBalancer(svc) {
+			if svc, ok := cur.(*corev1.Service); ok && c.wantsLoadBalancer(svc) {
 				c.enqueueService(svc)
 			}
 		},
 		UpdateFunc: func(old interface{}, cur interface{}) {
 			oldSvc, ok1 := old.(*corev1.Service)
 			curSvc, ok2 := cur.(*corev1.Service)
-			if ok1 && ok2 && wantsLoadBalancer(curSvc) && (c.needsUpdate(oldSvc, curSvc) || needsCleanup(curSvc)) {
+			if !ok1 || !ok2 {
+				return
+			}
+			// A service that is no longer a load balancer of the class is queued to release its address(es)
+			if c.wantsLoadBalancer(curSvc) && (c.needsUpdate(oldSvc, curSvc) || needsCleanup(curSvc)) ||
+				c.wantsLoadBalancer(oldSvc) && !c.wantsLoadBalancer(curSvc) {
 				c.enqueueService(curSvc)
 			}
 		},
@@ -140,6 +150,13 @@ func (c *loadbalancerClassServiceController) processNextWorkItem() bool {
 		// Run the syncHandler, passing it the key of the
 		// IPPool resource to be synced.
 		if err := c.syncService(key); err != nil {
+			var re *api.RetryError
+			if errors.As(err, &re) {
+				// Retry after the delay of the error, like the service controller of the cloud-provider
+				klog.ErrorS(err, "Error syncing service, retrying", "key", key, "retryAfter", re.RetryAfter())
+				c.workqueue.AddAfter(key, re.RetryAfter())
+				return nil
+			}
 			// Put the item back on the workqueue to handle any transient errors.
 			c.workqueue.AddRateLimited(key)
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
@@ -177,7 +194,7 @@ func (c *loadbalancerClassServiceController) syncService(key string) error {
 		utilruntime.HandleError(fmt.Errorf("unable to retrieve service %v from store: %v", key, err))
 		return err
 	default:
-		klog.Infof("Reconcile service %s/%s, since loadbalancerClass match", svc.Namespace, svc.Name)
+		klog.InfoS("Reconcile service, since loadbalancerClass match", "service", klog.KObj(svc))
 		if err = c.processServiceCreateOrUpdate(svc); err != nil {
 			return err
 		}
@@ -189,13 +206,17 @@ func (c *loadbalancerClassServiceController) syncService(key string) error {
 func (c *loadbalancerClassServiceController) processServiceCreateOrUpdate(svc *corev1.Service) error {
 	startTime := time.Now()
 	defer func() {
-		klog.Infof("Finished processing service %s/%s (%v)", svc.Namespace, svc.Name, time.Since(startTime))
+		klog.InfoS("Finished processing service", "service", klog.KObj(svc), "duration", time.Since(startTime))
 	}()
 
-	// if it's getting deleted, remove the finalizer
-	if !svc.DeletionTimestamp.IsZero() {
+	// if it's getting deleted or no longer a load balancer of the class, release its address(es) and remove the finalizer
+	if !svc.DeletionTimestamp.IsZero() || !c.wantsLoadBalancer(svc) {
+		if err := c.lbManager.deleteLoadBalancer(context.Background(), svc); err != nil {
+			c.recorder.Eventf(svc, corev1.EventTypeWarning, "DeleteLoadBalancerFailed", "Error deleting load balancer: %v", err)
+			return err
+		}
 		if err := c.removeFinalizer(svc); err != nil {
-			klog.Infof("Error removing finalizer from service %s/%s", svc.Namespace, svc.Name)
+			klog.ErrorS(err, "Error removing finalizer from service", "service", klog.KObj(svc))
 			return err
 		}
 		c.recorder.Event(svc, corev1.EventTypeNormal, "LoadBalancerDeleted", "Deleted load balancer")
@@ -205,15 +226,30 @@ func (c *loadbalancerClassServiceController) processServiceCreateOrUpdate(svc *c
 	c.recorder.Event(svc, corev1.EventTypeNormal, "EnsuringLoadBalancer", "Ensuring load balancer")
 
 	if err := c.addFinalizer(svc); err != nil {
-		klog.Infof("Error adding finalizer to service %s/%s", svc.Namespace, svc.Name)
+		klog.ErrorS(err, "Error adding finalizer to service", "service", klog.KObj(svc))
 		return err
 	}
 
-	if _, err := syncLoadBalancer(context.Background(), c.kubeClient, svc, c.cmName, c.cmNamespace); err != nil {
+	nodes, err := c.lbManager.listNodes(context.Background())
+	if err != nil {
+		return err
+	}
+	status, err := c.lbManager.syncLoadBalancer(context.Background(), svc, nodes)
+	if err != nil {
 		c.recorder.Eventf(svc, corev1.EventTypeWarning, "syncLoadBalancer", "Error syncing load balancer: %v", err)
 		return err
 	}
 
+	// Without the service controller of the cloud-provider the populated status has to be written here
+	if c.lbManager.populateIngress && !servicehelper.LoadBalancerStatusEqual(&svc.Status.LoadBalancer, status) {
+		updated := svc.DeepCopy()
+		updated.Status.LoadBalancer = *status
+		if _, err := servicehelper.PatchService(c.kubeClient.CoreV1(), svc, updated); err != nil {
+			klog.ErrorS(err, "Error updating the load balancer status of service", "service", klog.KObj(svc))
+			return err
+		}
+	}
+
 	c.recorder.Event(svc, corev1.EventTypeNormal, "EnsuredLoadBalancer", "Ensured load balancer")
 
 	return nil
@@ -229,7 +265,7 @@ func (c *loadbalancerClassServiceController) addFinalizer(service *corev1.Servic
 	updated := service.DeepCopy()
 	updated.ObjectMeta.Finalizers = append(updated.ObjectMeta.Finalizers, servicehelper.LoadBalancerCleanupFinalizer)
 
-	klog.Infof("Adding finalizer to service %s/%s", updated.Namespace, updated.Name)
+	klog.InfoS("Adding finalizer to service", "service", klog.KObj(updated))
 	_, err := servicehelper.PatchService(c.kubeClient.CoreV1(), service, updated)
 	return err
 }
@@ -244,14 +280,14 @@ func (c *loadbalancerClassServiceController) removeFinalizer(service *corev1.Ser
 	updated := service.DeepCopy()
 	updated.ObjectMeta.Finalizers = removeString(updated.ObjectMeta.Finalizers, servicehelper.LoadBalancerCleanupFinalizer)
 
-	klog.Infof("Removing finalizer from service %s/%s", updated.Namespace, updated.Name)
+	klog.InfoS("Removing finalizer from service", "service", klog.KObj(updated))
 	_, err := servicehelper.PatchService(c.kubeClient.CoreV1(), service, updated)
 	return err
 }
 
 // needsUpdate checks if load balancer needs to be updated due to change in attributes.
 func (c *loadbalancerClassServiceController) needsUpdate(oldService *corev1.Service, newService *corev1.Service) bool {
-	if wantsLoadBalancer(newService) && !reflect.DeepEqual(oldService.Spec.LoadBalancerSourceRanges, newService.Spec.LoadBalancerSourceRanges) {
+	if c.wantsLoadBalancer(newService) && !reflect.DeepEqual(oldService.Spec.LoadBalancerSourceRanges, newService.Spec.LoadBalancerSourceRanges) {
 		c.recorder.Eventf(newService, corev1.EventTypeNormal, "LoadBalancerSourceRanges", "%v -> %v",
 			oldService.Spec.LoadBalancerSourceRanges, newService.Spec.LoadBalancerSourceRanges)
 		return true
@@ -313,8 +349,8 @@ func (c *loadbalancerClassServiceController) needsUpdate(oldService *corev1.Serv
 }
 
 // only return service that's service type loadbalancer and loadbalancerclass match
-func wantsLoadBalancer(svc *corev1.Service) bool {
-	return svc != nil && svc.Spec.Type == corev1.ServiceTypeLoadBalancer && svc.Spec.LoadBalancerClass != nil && *svc.Spec.LoadBalancerClass == LoadbalancerClass
+func (c *loadbalancerClassServiceController) wantsLoadBalancer(svc *corev1.Service) bool {
+	return svc != nil && svc.Spec.Type == corev1.ServiceTypeLoadBalancer && svc.Spec.LoadBalancerClass != nil && *svc.Spec.LoadBalancerClass == c.lbManager.loadBalancerClass
 }
 
 // removeString returns a newly created []string that contains all items from slice that
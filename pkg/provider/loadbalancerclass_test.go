@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
@@ -13,6 +14,7 @@ import (
 	"k8s.io/client-go/util/workqueue"
 	servicehelper "k8s.io/cloud-provider/service/helpers"
 	klog "k8s.io/klog/v2"
+	clocktesting "k8s.io/utils/clock/testing"
 	"k8s.io/utils/ptr"
 
 	tu "github.com/kube-vip/kube-vip-cloud-provider/pkg/testutil"
@@ -25,17 +27,18 @@ func newController(kubeClient *fake.Clientset) *loadbalancerClassServiceControll
 	eventBroadcaster.StartLogging(klog.Infof)
 	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
 	serviceInformer := informerFactory.Core().V1().Services()
+	recorder := record.NewFakeRecorder(100)
 
 	c := &loadbalancerClassServiceController{
 		serviceInformer:     serviceInformer.Informer(),
 		serviceLister:       serviceInformer.Lister(),
 		serviceListerSynced: alwaysReady,
 		kubeClient:          kubeClient,
-		cmName:              KubeVipClientConfig,
-		cmNamespace:         KubeVipClientConfigNamespace,
 
-		recorder:  record.NewFakeRecorder(100),
+		recorder:  recorder,
 		workqueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Nodes"),
+
+		lbManager: newLoadBalancer(kubeClient, KubeVipClientConfigNamespace, KubeVipClientConfig, recorder),
 	}
 	kubeClient.ClearActions()
 	return c
@@ -242,3 +245,112 @@ func TestNeedsCleanup(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessServicePopulateIngress(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx := context.Background()
+	cm := newIPPoolConfigMap()
+	if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := tu.NewService("populated", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	if _, err := client.CoreV1().Services(svc.Namespace).Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := newController(client)
+	c.lbManager.populateIngress = true
+
+	if err := c.processServiceCreateOrUpdate(svc); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []corev1.LoadBalancerIngress{{IP: got.Annotations[IPsAnnotation]}}
+	if !servicehelper.LoadBalancerStatusEqual(&got.Status.LoadBalancer, &corev1.LoadBalancerStatus{Ingress: want}) {
+		t.Errorf("load balancer status = %v, want ingress %v", got.Status.LoadBalancer, want)
+	}
+}
+
+func TestProcessServiceDeletedReleasesLedger(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx := context.Background()
+	cm := newIPPoolConfigMap()
+	if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := tu.NewService("ledgered", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	svc.UID = "uid-ledgered"
+	if _, err := client.CoreV1().Services(svc.Namespace).Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := newController(client)
+	c.lbManager.allocationLedger = true
+
+	if err := c.processServiceCreateOrUpdate(svc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"10.0.0.1": "uid-ledgered"}, getLedger(t, c.lbManager))
+
+	// The service is deleted, its finalizer holds it until the addresses are released
+	deleted, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted.DeletionTimestamp = ptr.To(metav1.Now())
+	if err := c.processServiceCreateOrUpdate(deleted); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, getLedger(t, c.lbManager))
+	got, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, servicehelper.HasLBFinalizer(got))
+}
+
+func TestProcessServiceDeletedWithholdsAddress(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx := context.Background()
+	cm := newIPPoolConfigMap()
+	if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := newController(client)
+	c.lbManager.releasedAddresses = newReleasedAddresses(clocktesting.NewFakeClock(time.Now()), time.Minute)
+
+	process := func(svc *corev1.Service) *corev1.Service {
+		t.Helper()
+		if err := c.processServiceCreateOrUpdate(svc); err != nil {
+			t.Fatal(err)
+		}
+		got, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	svc := tu.NewService("withheld", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	if _, err := client.CoreV1().Services(svc.Namespace).Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deleted := process(svc)
+	assert.Equal(t, "10.0.0.1", deleted.Annotations[IPsAnnotation])
+	deleted.DeletionTimestamp = ptr.To(metav1.Now())
+	process(deleted)
+
+	// The address of the deleted service is withheld from the next service
+	next := tu.NewService("next", tu.TweakAddLBClass(ptr.To(LoadbalancerClass)))
+	if _, err := client.CoreV1().Services(next.Namespace).Create(ctx, next, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", process(next).Annotations[IPsAnnotation])
+}
+
+func TestNewLoadbalancerClassServiceControllerSharesManager(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	mgr := newLoadBalancer(client, KubeVipClientConfigNamespace, KubeVipClientConfig, record.NewFakeRecorder(100))
+	c := newLoadbalancerClassServiceController(informers.NewSharedInformerFactory(client, 0), client, mgr)
+	assert.Same(t, mgr, c.lbManager)
+}
@@ -0,0 +1,176 @@
+package provider
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go4.org/netipx"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	metricsNamespace = "kubevip"
+
+	// allocationFailureNoPool is the failure reason used when no pool is configured for the service
+	allocationFailureNoPool = "no_pool"
+	// allocationFailureOutOfIPs is the failure reason used when the pool has no free address left
+	allocationFailureOutOfIPs = "out_of_ips"
+	// allocationFailureInvalidConfig is the failure reason used when the pool configuration can't be used
+	allocationFailureInvalidConfig = "invalid_config"
+	// allocationFailureDuplicateIPs is the failure reason used when allocation is refused because of duplicate addresses
+	allocationFailureDuplicateIPs = "duplicate_ips"
+	// allocationFailureOther is the failure reason used for any other allocation error
+	allocationFailureOther = "other"
+
+	// syncResultAllocated is the sync result of a service that was allocated fresh address(es)
+	syncResultAllocated = "allocated"
+	// syncResultExisting is the sync result of a service that already held its address(es)
+	syncResultExisting = "existing"
+	// syncResultSkipped is the sync result of a service that isn't managed by kube-vip-cloud-provider
+	syncResultSkipped = "skipped"
+	// syncResultError is the result of a sync or a discovery that failed
+	syncResultError = "error"
+)
+
+var (
+	poolAddressesCapacity = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Name:           "pool_addresses_capacity",
+			Help:           "Number of addresses that can be allocated from the pool, the namespace is empty for global pools",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"pool", "namespace"},
+	)
+
+	poolAddressesUsed = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Name:           "pool_addresses_used",
+			Help:           "Number of addresses of the pool that are in use or excluded, the namespace is empty for global pools",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"pool", "namespace"},
+	)
+
+	ipAllocationFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "ip_allocation_failures_total",
+			Help:           "Number of services that could not be allocated an address, by reason",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+
+	syncDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      metricsNamespace,
+			Name:           "sync_duration_seconds",
+			Help:           "Duration of the sync of a service, by result",
+			Buckets:        metrics.ExponentialBuckets(0.001, 2, 15),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+
+	discoverDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      metricsNamespace,
+			Name:           "discover_duration_seconds",
+			Help:           "Duration of the search of the pool for free address(es), by result",
+			Buckets:        metrics.ExponentialBuckets(0.0001, 2, 17),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+
+	ledgerReclaimedAddresses = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "ledger_reclaimed_addresses_total",
+			Help:           "Number of addresses removed from the allocation ledger because their service no longer exists",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers the pool and latency metrics with the registry served by the cloud controller manager,
+// the metrics are no-ops until they are registered
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(poolAddressesCapacity)
+		legacyregistry.MustRegister(poolAddressesUsed)
+		legacyregistry.MustRegister(ipAllocationFailures)
+		legacyregistry.MustRegister(syncDuration)
+		legacyregistry.MustRegister(discoverDuration)
+		legacyregistry.MustRegister(ledgerReclaimedAddresses)
+	})
+}
+
+// updatePoolMetrics sets the total and used addresses of the pool
+func updatePoolMetrics(pool *ipPool, namespace string, inUseIPSet *netipx.IPSet) {
+	if !poolAddressesCapacity.IsCreated() || isDHCPPool(pool.addresses) {
+		return
+	}
+	if pool.global {
+		namespace = ""
+	}
+
+	poolIPSet, err := ipam.BuildPoolSet(pool.addresses)
+	if err != nil {
+		klog.Warningf("unable to compute metrics of pool [%s]: %v", pool.key, err)
+		return
+	}
+	builder := &netipx.IPSetBuilder{}
+	builder.AddSet(poolIPSet)
+	builder.Intersect(inUseIPSet)
+	usedIPSet, err := builder.IPSet()
+	if err != nil {
+		klog.Warningf("unable to compute metrics of pool [%s]: %v", pool.key, err)
+		return
+	}
+
+	poolAddressesCapacity.WithLabelValues(pool.key, namespace).Set(bigIntToFloat(ipam.CountAddresses(poolIPSet)))
+	poolAddressesUsed.WithLabelValues(pool.key, namespace).Set(bigIntToFloat(ipam.CountAddresses(usedIPSet)))
+}
+
+// recordAllocationFailure increments the allocation failure counter for the reason
+func recordAllocationFailure(reason string) {
+	ipAllocationFailures.WithLabelValues(reason).Inc()
+}
+
+// observeSyncDuration records the duration of the sync of a service started at start
+func observeSyncDuration(result string, start time.Time) {
+	syncDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// observeDiscoverDuration records the duration of the search of a pool started at start
+func observeDiscoverDuration(err error, start time.Time) {
+	result := syncResultAllocated
+	if err != nil {
+		result = syncResultError
+	}
+	discoverDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// allocationFailureReason returns the failure reason of an error returned while allocating addresses
+func allocationFailureReason(err error) string {
+	var outOfIPs *ipam.OutOfIPsError
+	if errors.As(err, &outOfIPs) {
+		return allocationFailureOutOfIPs
+	}
+	return allocationFailureOther
+}
+
+func bigIntToFloat(i *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(i).Float64()
+	return f
+}
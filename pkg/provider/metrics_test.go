@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func Test_poolMetrics(t *testing.T) {
+	registerMetrics()
+	poolAddressesCapacity.Reset()
+	poolAddressesUsed.Reset()
+	ipAllocationFailures.Reset()
+
+	mgr := newTestLoadBalancer(t,
+		map[string]string{
+			"cidr-global":         "192.168.0.200/29",
+			"exclude-cidr-global": "192.168.0.202",
+			"cidr-test":           "fe80::10/127",
+		},
+		newKubevipService("default", "existing", "192.168.0.201"),
+		newKubevipService("test", "existing", "fe80::10"),
+	)
+
+	newService := func(namespace, name string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+
+	// In-use and excluded addresses of the global pool are counted as used
+	if _, err := syncNewService(t, mgr, newService("default", "svc")); err != nil {
+		t.Fatal(err)
+	}
+	// The second address of the namespace pool is taken, the last sync runs out of addresses
+	if _, err := syncNewService(t, mgr, newService("test", "svc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncNewService(t, mgr, newService("test", "svc-2")); err == nil {
+		t.Fatal("expected the namespace pool to be out of addresses")
+	}
+
+	expected := `
+# HELP kubevip_ip_allocation_failures_total [ALPHA] Number of services that could not be allocated an address, by reason
+# TYPE kubevip_ip_allocation_failures_total counter
+kubevip_ip_allocation_failures_total{reason="out_of_ips"} 1
+# HELP kubevip_pool_addresses_capacity [ALPHA] Number of addresses that can be allocated from the pool, the namespace is empty for global pools
+# TYPE kubevip_pool_addresses_capacity gauge
+kubevip_pool_addresses_capacity{namespace="",pool="cidr-global"} 6
+kubevip_pool_addresses_capacity{namespace="test",pool="cidr-test"} 2
+# HELP kubevip_pool_addresses_used [ALPHA] Number of addresses of the pool that are in use or excluded, the namespace is empty for global pools
+# TYPE kubevip_pool_addresses_used gauge
+kubevip_pool_addresses_used{namespace="",pool="cidr-global"} 2
+kubevip_pool_addresses_used{namespace="test",pool="cidr-test"} 2
+`
+	if err := testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(expected),
+		"kubevip_pool_addresses_capacity", "kubevip_pool_addresses_used", "kubevip_ip_allocation_failures_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_poolMetricsReservedAddresses(t *testing.T) {
+	registerMetrics()
+	poolAddressesCapacity.Reset()
+	poolAddressesUsed.Reset()
+
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-prod":             "10.0.0.0/29",
+		"exclude-reserved-prod": "10.0.0.1, 10.0.0.6",
+	})
+
+	// The reserved addresses are never allocated
+	for i, want := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+		got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: fmt.Sprintf("svc-%d", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+	}
+	if _, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "svc"}}); err == nil {
+		t.Fatal("expected the pool to be out of addresses")
+	}
+
+	// The reserved addresses are counted as used
+	expected := `
+# HELP kubevip_pool_addresses_capacity [ALPHA] Number of addresses that can be allocated from the pool, the namespace is empty for global pools
+# TYPE kubevip_pool_addresses_capacity gauge
+kubevip_pool_addresses_capacity{namespace="prod",pool="cidr-prod"} 6
+# HELP kubevip_pool_addresses_used [ALPHA] Number of addresses of the pool that are in use or excluded, the namespace is empty for global pools
+# TYPE kubevip_pool_addresses_used gauge
+kubevip_pool_addresses_used{namespace="prod",pool="cidr-prod"} 6
+`
+	if err := testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(expected),
+		"kubevip_pool_addresses_capacity", "kubevip_pool_addresses_used"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_latencyMetrics(t *testing.T) {
+	registerMetrics()
+	syncDuration.Reset()
+	discoverDuration.Reset()
+
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "192.168.0.200/29"},
+		newKubevipService("default", "existing", "192.168.0.201"))
+
+	// A fresh allocation searches the pool, the existing service already holds its address
+	if _, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "svc"}}); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := mgr.kubeClient.CoreV1().Services("default").Get(context.Background(), "existing", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.syncLoadBalancer(context.Background(), existing, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		metric metrics.ObserverMetric
+		want   uint64
+	}{
+		{metric: syncDuration.WithLabelValues(syncResultAllocated), want: 1},
+		{metric: syncDuration.WithLabelValues(syncResultExisting), want: 1},
+		{metric: syncDuration.WithLabelValues(syncResultError), want: 0},
+		{metric: discoverDuration.WithLabelValues(syncResultAllocated), want: 1},
+	} {
+		got, err := testutil.GetHistogramMetricCount(tt.metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tt.want, got)
+	}
+}
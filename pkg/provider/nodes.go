@@ -0,0 +1,41 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listNodes returns the nodes of the cluster for the services synced without the nodes of the service controller,
+// i.e. by the loadBalancerClass controller. They are only listed when the nodes select the pool or gate the allocation.
+func (k *kubevipLoadBalancerManager) listNodes(ctx context.Context) ([]*v1.Node, error) {
+	if !k.zonePools && !k.requireReadyNodes {
+		return nil, nil
+	}
+	list, err := k.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes: %v", err)
+	}
+	nodes := make([]*v1.Node, 0, len(list.Items))
+	for x := range list.Items {
+		nodes = append(nodes, &list.Items[x])
+	}
+	return nodes, nil
+}
+
+// hasReadyNode returns true if one of the nodes is ready and schedulable
+func hasReadyNode(nodes []*v1.Node) bool {
+	for _, node := range nodes {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == v1.NodeReady && condition.Status == v1.ConditionTrue {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func newReadyNode(name string, ready, unschedulable bool) *v1.Node {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{Unschedulable: unschedulable},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func Test_hasReadyNode(t *testing.T) {
+	assert.False(t, hasReadyNode(nil))
+	assert.False(t, hasReadyNode([]*v1.Node{newReadyNode("not-ready", false, false), newReadyNode("cordoned", true, true)}))
+	assert.False(t, hasReadyNode([]*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "unknown"}}}))
+	assert.True(t, hasReadyNode([]*v1.Node{newReadyNode("not-ready", false, false), newReadyNode("ready", true, false)}))
+}
+
+func Test_syncLoadBalancerRequireReadyNodes(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, newKubevipService("test", "existing", "10.0.0.1"))
+	mgr.requireReadyNodes = true
+	recorder := mgr.recorder.(*record.FakeRecorder)
+
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc"}}
+	if _, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a ready node the allocation is deferred
+	_, err := mgr.EnsureLoadBalancer(context.Background(), "", svc, []*v1.Node{})
+	assert.EqualError(t, err, "no ready node can host the load balancer of service 'test/svc', deferring the allocation")
+	assert.Equal(t, "Warning NoReadyNodes No ready node can host the load balancer, deferring the allocation", <-recorder.Events)
+	updated, err := mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, updated.Annotations, IPsAnnotation)
+
+	// A service that already holds its address keeps it
+	existing, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), "existing", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.EnsureLoadBalancer(context.Background(), "", existing, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once a node is ready the address is allocated
+	if _, err := mgr.EnsureLoadBalancer(context.Background(), "", svc, []*v1.Node{newReadyNode("node", true, false)}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err = mgr.kubeClient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", updated.Annotations[IPsAnnotation])
+}
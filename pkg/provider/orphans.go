@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// sweepOrphanedAnnotations finds the services that have the IPsAnnotation but lost the
+// implementation label, i.e. after a manual edit. The in-use addresses are gathered with the label
+// selector, so the addresses of these services would be allocated again to another service.
+// Load balancer services are labeled again to keep their address(es), the annotations of services
+// that are no longer load balancers are cleared to release their address(es).
+func (k *kubevipLoadBalancerManager) sweepOrphanedAnnotations(ctx context.Context) error {
+	svcs, err := k.kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list services: %v", err)
+	}
+
+	var errs []error
+	for x := range svcs.Items {
+		svc := &svcs.Items[x]
+		if len(svc.Annotations[IPsAnnotation]) == 0 || svc.Labels[ImplementationLabel] == ImplementationValue {
+			continue
+		}
+		// The service is managed out of band or by another load balancer implementation
+		if svc.Annotations[SkipManagementAnnotation] == "true" {
+			continue
+		}
+		if class := svc.Spec.LoadBalancerClass; class != nil && len(*class) != 0 && *class != k.loadBalancerClass {
+			continue
+		}
+		if !k.namespaceManaged(svc.Namespace) {
+			continue
+		}
+
+		if err := k.reclaimOrphanedService(ctx, svc); err != nil {
+			errs = append(errs, fmt.Errorf("error updating service '%s/%s': %v", svc.Namespace, svc.Name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// reclaimOrphanedService labels the load balancer service again, or clears the annotations of a
+// service that is no longer a load balancer
+func (k *kubevipLoadBalancerManager) reclaimOrphanedService(ctx context.Context, service *v1.Service) error {
+	relabel := service.Spec.Type == v1.ServiceTypeLoadBalancer
+	if relabel {
+		klog.Infof("service '%s/%s' has address(es) [%s] but no '%s' label, labeling it again", service.Namespace, service.Name, service.Annotations[IPsAnnotation], ImplementationLabel)
+	} else {
+		klog.Infof("service '%s/%s' is not a load balancer but has address(es) [%s], clearing annotation '%s'", service.Namespace, service.Name, service.Annotations[IPsAnnotation], IPsAnnotation)
+	}
+
+	return retry.RetryOnConflict(k.updateRetry, func() error {
+		recentService, getErr := k.kubeClient.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if relabel {
+			if recentService.Labels == nil {
+				recentService.Labels = make(map[string]string)
+			}
+			recentService.Labels[ImplementationLabel] = ImplementationValue
+		} else {
+			delete(recentService.Annotations, IPsAnnotation)
+			delete(recentService.Annotations, AllocationSourceAnnotation)
+			delete(recentService.Annotations, LoadbalancerGatewayAnnotation)
+		}
+		_, updateErr := k.kubeClient.CoreV1().Services(recentService.Namespace).Update(ctx, recentService, metav1.UpdateOptions{})
+		return updateErr
+	})
+}
@@ -0,0 +1,73 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_sweepOrphanedAnnotations(t *testing.T) {
+	// The label of the load balancer was removed by a manual edit
+	orphaned := newKubevipService("other", "orphaned", "10.0.0.1")
+	orphaned.Spec.Type = v1.ServiceTypeLoadBalancer
+	delete(orphaned.Labels, ImplementationLabelKey)
+
+	// The service was changed to a ClusterIP service
+	clusterIP := newKubevipService("other", "cluster-ip", "10.0.0.2")
+	clusterIP.Spec.Type = v1.ServiceTypeClusterIP
+	delete(clusterIP.Labels, ImplementationLabelKey)
+
+	// The address of the service is managed out of band
+	skipped := newKubevipService("other", "skipped", "10.0.0.3")
+	skipped.Spec.Type = v1.ServiceTypeLoadBalancer
+	skipped.Annotations[SkipManagementAnnotation] = "true"
+	delete(skipped.Labels, ImplementationLabelKey)
+
+	newService := func(name string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name}}
+	}
+
+	// Without the sweep the address of the orphaned service is allocated a second time
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, orphaned.DeepCopy())
+	got, err := syncNewService(t, mgr, newService("svc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.1", got)
+
+	mgr = newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"}, orphaned, clusterIP, skipped)
+	if err := mgr.sweepOrphanedAnnotations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	services := mgr.kubeClient.CoreV1().Services("other")
+	svc, err := services.Get(context.Background(), orphaned.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ImplementationLabelValue, svc.Labels[ImplementationLabelKey])
+	assert.Equal(t, "10.0.0.1", svc.Annotations[LoadbalancerIPsAnnotations])
+
+	svc, err = services.Get(context.Background(), clusterIP.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, svc.Annotations, LoadbalancerIPsAnnotations)
+	assert.NotContains(t, svc.Labels, ImplementationLabelKey)
+
+	svc, err = services.Get(context.Background(), skipped.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, svc.Labels, ImplementationLabelKey)
+
+	// After the sweep the address of the orphaned service is in use again
+	got, err = syncNewService(t, mgr, newService("svc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", got)
+}
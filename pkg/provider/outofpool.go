@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+)
+
+// outOfPoolAddresses returns the address(es) of the service that are no longer part of any of the pools it takes
+// its address(es) from, i.e. after the cidr of the pool was shrunk. Only the address(es) allocated from a pool, as
+// recorded by the AllocationSourceAnnotation, are checked: addresses set by the user or reserved for the service
+// are kept as they are.
+func (k *kubevipLoadBalancerManager) outOfPoolAddresses(ctx context.Context, service *v1.Service, addresses string, nodes []*v1.Node) ([]netip.Addr, error) {
+	source, ok := strings.CutPrefix(service.Annotations[AllocationSourceAnnotation], "pool:")
+	if !ok || strings.HasPrefix(source, "reserved-") {
+		return nil, nil
+	}
+	addrs, err := parseAddresses(addresses)
+	if err != nil {
+		// Malformed addresses are reported when the in-use addresses are gathered
+		return nil, nil
+	}
+
+	pools, err := k.sourcePools(ctx, service, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := &netipx.IPSetBuilder{}
+	for _, pool := range pools {
+		// The DHCP address isn't managed by kube-vip-cloud-provider
+		if isDHCPPool(pool.addresses) {
+			return nil, nil
+		}
+		poolIPSet, err := ipam.BuildPoolSet(pool.addresses)
+		if err != nil {
+			return nil, err
+		}
+		builder.AddSet(poolIPSet)
+		// The addresses of the drain pool are kept until their services are recreated
+		if len(pool.drain) != 0 {
+			drainIPSet, err := ipam.BuildPoolSet(pool.drain)
+			if err != nil {
+				return nil, err
+			}
+			builder.AddSet(drainIPSet)
+		}
+	}
+	poolsIPSet, err := builder.IPSet()
+	if err != nil {
+		return nil, err
+	}
+
+	var outside []netip.Addr
+	for _, addr := range addrs {
+		if !poolsIPSet.Contains(addr) {
+			outside = append(outside, addr)
+		}
+	}
+	return outside, nil
+}
+
+// sourcePools returns the pools the service takes its address(es) from, the ad-hoc pool of its
+// LoadbalancerPoolCIDRAnnotation or the pools of the configmap
+func (k *kubevipLoadBalancerManager) sourcePools(ctx context.Context, service *v1.Service, nodes []*v1.Node) ([]*ipPool, error) {
+	if _, ok := service.Annotations[LoadbalancerPoolCIDRAnnotation]; ok {
+		pool, err := newServicePool(service)
+		if err != nil {
+			return nil, err
+		}
+		return []*ipPool{pool}, nil
+	}
+	controllerCM, err := k.getCloudConfigMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return k.servicePools(ctx, controllerCM, service, nodes)
+}
@@ -0,0 +1,112 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// PoolOverlap is a pair of pools of the configmap that share addresses
+type PoolOverlap struct {
+	// First is the configmap key of the first pool, it sorts before Second
+	First string `json:"first"`
+	// Second is the configmap key of the second pool
+	Second string `json:"second"`
+	// Addresses are the ranges of addresses that both pools can allocate
+	Addresses []string `json:"addresses"`
+}
+
+// DetectOverlappingPools returns every pair of cidr, range and hosts pools of the configmap whose addresses
+// intersect, sorted by key. Services allocated from overlapping pools can be given the same address, as the
+// addresses in use are only gathered from the services sharing a pool. The DHCP pool never overlaps.
+func DetectOverlappingPools(cm *v1.ConfigMap) ([]PoolOverlap, error) {
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		poolKey := strings.TrimPrefix(key, "internal-")
+		if strings.HasPrefix(poolKey, "cidr-") || strings.HasPrefix(poolKey, "range-") || strings.HasPrefix(poolKey, "hosts-") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	sets := make([]*netipx.IPSet, 0, len(keys))
+	poolKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		addresses, _, err := parsePoolOptions(key, cm.Data[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value [%s] for key [%s]: %v", cm.Data[key], key, err)
+		}
+		if isDHCPPool(addresses) {
+			continue
+		}
+		set, err := ipam.BuildPoolSet(addresses)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value [%s] for key [%s]: %v", cm.Data[key], key, err)
+		}
+		sets = append(sets, set)
+		poolKeys = append(poolKeys, key)
+	}
+
+	overlaps := []PoolOverlap{}
+	for i := range sets {
+		for j := i + 1; j < len(sets); j++ {
+			if !sets[i].Overlaps(sets[j]) {
+				continue
+			}
+			builder := &netipx.IPSetBuilder{}
+			builder.AddSet(sets[i])
+			builder.Intersect(sets[j])
+			shared, err := builder.IPSet()
+			if err != nil {
+				return nil, err
+			}
+			overlap := PoolOverlap{First: poolKeys[i], Second: poolKeys[j]}
+			for _, r := range shared.Ranges() {
+				overlap.Addresses = append(overlap.Addresses, r.String())
+			}
+			overlaps = append(overlaps, overlap)
+		}
+	}
+	return overlaps, nil
+}
+
+// overlapsHandler returns the pairs of overlapping pools of the configmap as json
+func (k *kubevipLoadBalancerManager) overlapsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	controllerCM, err := getConfigMap(r.Context(), k.kubeClient, k.cloudConfigMap, k.namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	overlaps, err := DetectOverlappingPools(controllerCM)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(overlaps); err != nil {
+		klog.Errorf("unable to write the overlaps debug response: %v", err)
+	}
+}
+
+// warnOverlappingPools logs the pairs of overlapping pools of the configmap
+func warnOverlappingPools(controllerCM *v1.ConfigMap) {
+	overlaps, err := DetectOverlappingPools(controllerCM)
+	if err != nil {
+		return
+	}
+	for _, overlap := range overlaps {
+		klog.Warningf("pools [%s] and [%s] of configMap [%s] overlap on [%s], their services can be allocated the same address",
+			overlap.First, overlap.Second, controllerCM.Name, strings.Join(overlap.Addresses, ","))
+	}
+}
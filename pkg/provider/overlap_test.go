@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func Test_DetectOverlappingPools(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    []PoolOverlap
+		wantErr string
+	}{
+		{
+			name: "disjoint pools",
+			data: map[string]string{
+				"cidr-global":       "10.0.0.0/24,fe80::/120",
+				"range-test":        "10.0.1.10-10.0.1.20",
+				"hosts-pool-edge":   "10.0.2.1,10.0.2.5",
+				"cidr-dhcp-test":    "0.0.0.0/32",
+				"cidr-other":        "0.0.0.0/32",
+				"exclude-cidr-test": "10.0.0.0/24",
+				"search-order":      "desc",
+			},
+			want: []PoolOverlap{},
+		},
+		{
+			name: "overlapping pools",
+			data: map[string]string{
+				"cidr-global":           "10.0.0.0/24,fe80::/120",
+				"range-test":            "10.0.0.250-10.0.1.20",
+				"hosts-pool-edge":       "10.0.1.5,10.0.2.5",
+				"internal-cidr-global":  "fe80::80/121",
+				"cidr-udp-global":       "10.0.3.0/24",
+				"range-test-unaffected": "10.0.4.1-10.0.4.2",
+			},
+			want: []PoolOverlap{
+				{First: "cidr-global", Second: "internal-cidr-global", Addresses: []string{"fe80::80-fe80::ff"}},
+				{First: "cidr-global", Second: "range-test", Addresses: []string{"10.0.0.250-10.0.0.254"}},
+				{First: "hosts-pool-edge", Second: "range-test", Addresses: []string{"10.0.1.5-10.0.1.5"}},
+			},
+		},
+		{
+			name:    "invalid pool",
+			data:    map[string]string{"cidr-global": "10.0.0.0/24", "range-test": "10.0.0.300-10.0.0.310"},
+			wantErr: "invalid value [10.0.0.300-10.0.0.310] for key [range-test]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DetectOverlappingPools(&v1.ConfigMap{Data: tt.data})
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_overlapsHandler(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{
+		"cidr-global": "10.0.0.0/29",
+		"range-test":  "10.0.0.6-10.0.0.10",
+	})
+
+	rec := httptest.NewRecorder()
+	mgr.overlapsHandler(rec, httptest.NewRequest(http.MethodGet, "/overlaps", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var got []PoolOverlap
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []PoolOverlap{{First: "cidr-global", Second: "range-test", Addresses: []string{"10.0.0.6-10.0.0.6"}}}, got)
+}
@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"net/netip"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	"go4.org/netipx"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// preferredAddress returns the address of the PreferredIPAnnotation of the service if it can be allocated from the
+// pool: it must be part of the pool, free, and of the IP family of the service. Only a single address is preferred,
+// dual-stack services and blocks of addresses are allocated normally. Any other case is no error, the address is
+// then allocated normally as well.
+func (k *kubevipLoadBalancerManager) preferredAddress(service *v1.Service, pool *ipPool, inUseSet *netipx.IPSet,
+	ipFamilyPolicy *v1.IPFamilyPolicy, ipFamilies []v1.IPFamily, count int) (string, bool) {
+	value, ok := service.Annotations[PreferredIPAnnotation]
+	if !ok || len(value) == 0 || isDHCPPool(pool.addresses) {
+		return "", false
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		k.ignorePreferredAddress(service, value, "it is not a valid address")
+		return "", false
+	}
+	addr = addr.Unmap()
+	if (ipFamilyPolicy != nil && *ipFamilyPolicy != v1.IPFamilyPolicySingleStack) || count > 1 {
+		k.ignorePreferredAddress(service, value, "the service isn't allocated a single address")
+		return "", false
+	}
+	if len(ipFamilies) != 0 && (ipFamilies[0] == v1.IPv6Protocol) != addr.Is6() {
+		k.ignorePreferredAddress(service, value, "it isn't of the IP family of the service")
+		return "", false
+	}
+	poolSet, err := ipam.BuildPoolSet(pool.addresses)
+	if err != nil || !poolSet.Contains(addr) {
+		k.ignorePreferredAddress(service, value, "it isn't part of pool ["+pool.key+"]")
+		return "", false
+	}
+	if inUseSet.Contains(addr) {
+		klog.InfoS("Preferred address is in use, allocating from the pool", "service", klog.KObj(service), "address", value, "pool", pool.key)
+		return "", false
+	}
+	return addr.String(), true
+}
+
+// ignorePreferredAddress logs and records that the preferred address of the service isn't used
+func (k *kubevipLoadBalancerManager) ignorePreferredAddress(service *v1.Service, value, reason string) {
+	klog.InfoS("Ignoring preferred address, allocating from the pool", "service", klog.KObj(service), "address", value, "reason", reason)
+	k.recordEventf(service, v1.EventTypeWarning, PreferredIPIgnoredReason, "Ignoring preferred address [%s] as %s", value, reason)
+}
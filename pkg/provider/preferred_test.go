@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_syncLoadBalancerPreferredIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		preferred string
+		spec      v1.ServiceSpec
+		want      string
+		wantEvent string
+	}{
+		{
+			name:      "preferred address is free",
+			preferred: "10.0.0.5",
+			want:      "10.0.0.5",
+		},
+		{
+			name:      "preferred address is taken",
+			preferred: "10.0.0.1",
+			want:      "10.0.0.2",
+		},
+		{
+			name:      "preferred address is excluded",
+			preferred: "10.0.0.6",
+			want:      "10.0.0.2",
+		},
+		{
+			name:      "preferred address is out of the pool",
+			preferred: "192.168.0.5",
+			want:      "10.0.0.2",
+			wantEvent: "Warning PreferredIPIgnored Ignoring preferred address [192.168.0.5] as it isn't part of pool [cidr-global]",
+		},
+		{
+			name:      "preferred address is invalid",
+			preferred: "10.0.0",
+			want:      "10.0.0.2",
+			wantEvent: "Warning PreferredIPIgnored Ignoring preferred address [10.0.0] as it is not a valid address",
+		},
+		{
+			name:      "preferred address of another family",
+			preferred: "10.0.0.5",
+			spec:      v1.ServiceSpec{IPFamilies: []v1.IPFamily{v1.IPv6Protocol}},
+			want:      "fe80::10",
+			wantEvent: "Warning PreferredIPIgnored Ignoring preferred address [10.0.0.5] as it isn't of the IP family of the service",
+		},
+		{
+			name:      "dual-stack service",
+			preferred: "10.0.0.5",
+			spec: v1.ServiceSpec{
+				IPFamilyPolicy: ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack),
+				IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			},
+			want:      "10.0.0.2,fe80::10",
+			wantEvent: "Warning PreferredIPIgnored Ignoring preferred address [10.0.0.5] as the service isn't allocated a single address",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, map[string]string{
+				"cidr-global":         "10.0.0.0/29,fe80::10/127",
+				"exclude-cidr-global": "10.0.0.6",
+			}, newKubevipService("test", "existing", "10.0.0.1"))
+			recorder := mgr.recorder.(*record.FakeRecorder)
+
+			got, err := syncNewService(t, mgr, &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "svc",
+					Annotations: map[string]string{PreferredIPAnnotation: tt.preferred},
+				},
+				Spec: tt.spec,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+			if len(tt.wantEvent) != 0 {
+				assert.Equal(t, tt.wantEvent, <-recorder.Events)
+			}
+		})
+	}
+}
@@ -7,12 +7,21 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/klog"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 
 	cloudprovider "k8s.io/cloud-provider"
 )
@@ -20,6 +29,150 @@ import (
 // OutSideCluster allows the controller to be started using a local kubeConfig for testing
 var OutSideCluster bool
 
+// EnablePoolMetrics registers the pool utilization and latency metrics with the metrics endpoint of the controller
+var EnablePoolMetrics bool
+
+// RefuseDuplicateIPs stops allocating addresses from a pool while one of its addresses is assigned to more than one service
+var RefuseDuplicateIPs bool
+
+// AutoCreateConfigMap creates an empty pool configmap if it doesn't exist
+var AutoCreateConfigMap bool
+
+// ValidateConfigOnStart fails the start of the controller if the pool configuration is invalid
+var ValidateConfigOnStart bool
+
+// OrphanedAnnotationSweepInterval is the interval the services that lost their implementation label are reclaimed at, 0 disables the sweep
+var OrphanedAnnotationSweepInterval time.Duration
+
+// ResyncInterval is the interval the services whose label and annotation drifted apart are synced at, 0 disables the resync
+var ResyncInterval time.Duration
+
+// EnableAllocationLedger records the allocated addresses in a configmap, so they stay in use if the annotation of their service is lost
+var EnableAllocationLedger bool
+
+// LedgerReclaimInterval is the interval the entries of the allocation ledger whose service no longer exists, and the
+// entries of the AffinityConfigMap whose namespace no longer exists, are removed at, 0 disables the reclaim
+var LedgerReclaimInterval time.Duration
+
+// WriteLegacyLoadBalancerIP sets the deprecated spec.loadBalancerIP of a service to its first allocated address,
+// for versions of kube-vip that don't read the LoadbalancerIPsAnnotations
+var WriteLegacyLoadBalancerIP = true
+
+// OutOfIPsRetryInterval is the delay before the service controller retries a service whose pool is out of addresses,
+// 0 leaves the retry to the exponential backoff of the controller
+var OutOfIPsRetryInterval = 30 * time.Second
+
+// ReallocateOutOfPool reallocates the address(es) of a service that are no longer part of its pool, i.e. after the
+// pool was shrunk. It is disabled by default, as the services change address when their pool is reconfigured
+var ReallocateOutOfPool bool
+
+// WriteIPFamilies sets spec.ipFamilies of a single stack service that doesn't list any to the family of the address
+// allocated to it. It is disabled by default, as the API server can refuse changes to the IP families of a service.
+// The API server fills in spec.ipFamilies of the services it creates and never lets their family change, so only the
+// services whose IP families are still empty are updated
+var WriteIPFamilies bool
+
+// Deterministic always allocates the numerically lowest free address of a pool, regardless of its search order, so
+// the same services are allocated the same addresses. Large IPv6 cidrs are searched sequentially instead of probed
+var Deterministic bool
+
+// VerifyAllocation checks that the allocated address(es) are still free right before the service is updated, and
+// allocates again if another replica or a concurrent sync assigned them in the meantime
+var VerifyAllocation bool
+
+// PopulateIngressStatus returns the address(es) of a service as the ingress of its load balancer status, instead of
+// leaving the status to kube-vip. It is disabled by default, as the status then lists addresses not advertised yet
+var PopulateIngressStatus bool
+
+// ZonePools allocates the address(es) of a service from the cidr-zone-<zone>, range-zone-<zone> or hosts-zone-<zone> pool
+// of the topology zone of its nodes, if the pool exists
+var ZonePools bool
+
+// RequireReadyNodes defers the allocation of a service until one of its nodes is ready and schedulable, so the service
+// doesn't look ready while no node can advertise its address(es)
+var RequireReadyNodes bool
+
+// LoadBalancerIPConflictWinner is the address kept when spec.loadBalancerIP of a service isn't one of the address(es)
+// of its IPsAnnotation, either LoadBalancerIPConflictAnnotation or LoadBalancerIPConflictSpec
+var LoadBalancerIPConflictWinner = LoadBalancerIPConflictAnnotation
+
+// ExternalReservationsEndpoint is the url of an HTTPReservations endpoint queried for the addresses another allocator
+// reserved in a pool, empty disables the query
+var ExternalReservationsEndpoint string
+
+// NamespacePoolOverflowToGlobal allocates the address(es) of a service from the global pool once the pool of its
+// namespace is out of addresses
+var NamespacePoolOverflowToGlobal bool
+
+// AddressAffinity records the address allocated to every service by namespace and name in the AffinityConfigMap, a
+// service that is deleted and created again is allocated the same address if it is still free. The entries of deleted
+// namespaces are pruned every LedgerReclaimInterval
+var AddressAffinity bool
+
+// IPPoolCRD reads the pools of the services from the IPPool custom resources, the pools of the configmap are used
+// for the services without an IPPool
+var IPPoolCRD bool
+
+// AlignDualStackOffsets allocates the second address of a dual-stack service at the host offset of its first address
+// in the pool of the other IP family, if that address is free
+var AlignDualStackOffsets bool
+
+// ReleaseGracePeriod is the time the address(es) of a deleted service are withheld before they can be allocated to
+// another service, 0 frees them immediately
+var ReleaseGracePeriod time.Duration
+
+// HealthzBindAddress is the address the /healthz endpoint is served on, empty disables the endpoint
+var HealthzBindAddress string
+
+// Tracing exports OpenTelemetry spans of the allocations with OTLP over gRPC, configured with the
+// OTEL_EXPORTER_OTLP_* environment variables
+var Tracing bool
+
+// ManagedNamespaces are the only namespaces whose services are allocated addresses, empty manages all namespaces
+var ManagedNamespaces []string
+
+// ExcludedNamespaces are the namespaces whose services are never allocated addresses
+var ExcludedNamespaces []string
+
+// DefaultIPFamilyPolicy is the IP family policy, SingleStack, PreferDualStack or RequireDualStack, the address(es)
+// of a service without spec.ipFamilyPolicy are allocated with, empty allocates a single address
+var DefaultIPFamilyPolicy string
+
+// ConfigMapFailureThreshold is the number of consecutive failed reads of the configmap after which it is read with an
+// exponential backoff until a read succeeds, 0 disables the backoff
+var ConfigMapFailureThreshold = 5
+
+// ConfigMapMaxBackoff is the longest delay the reads of the configmap are backed off for
+var ConfigMapMaxBackoff = 5 * time.Minute
+
+// EnableDNSExclusions excludes the free addresses of the pools that resolve in DNS, i.e. hosts assigned an address of
+// the subnet statically. The address(es) found in a pool are looked up when an address is allocated, and the pool is
+// searched again without those that resolve, at most DNSExclusionMaxLookups times per allocation
+var EnableDNSExclusions bool
+
+// DNSExclusionDomain only excludes the addresses whose names end with the domain, empty excludes every address with
+// a name
+var DNSExclusionDomain string
+
+// DNSExclusionMaxLookups is the maximum number of addresses looked up in DNS per allocation
+var DNSExclusionMaxLookups = 256
+
+// PoolsDebugBindAddress is the address the /pools and /overlaps debug endpoints are served on, empty disables the endpoints
+var PoolsDebugBindAddress string
+
+// IPsAnnotation is the annotation the address(es) of a service are written to, ImplementationLabel and
+// ImplementationValue are the label marking the services implemented by kube-vip. They default to
+// LoadbalancerIPsAnnotations and ImplementationLabelKey=ImplementationLabelValue, and only need to be
+// changed to match a customized kube-vip build reading different keys
+var (
+	IPsAnnotation       = LoadbalancerIPsAnnotations
+	ImplementationLabel = ImplementationLabelKey
+	ImplementationValue = ImplementationLabelValue
+)
+
+// ServiceUpdateRetry is the backoff used when updating a service conflicts with another update
+var ServiceUpdateRetry = retry.DefaultRetry
+
 const (
 	// ProviderName is the name of the cloud provider
 	ProviderName = "kubevip"
@@ -39,6 +192,9 @@ const (
 
 	// EnableLoadbalancerClassEnvKey environment key for enabling loadbalancerclass.
 	EnableLoadbalancerClassEnvKey = "KUBEVIP_ENABLE_LOADBALANCERCLASS"
+
+	// LoadbalancerClassNameEnvKey environment key for overriding the loadbalancerclass of the services managed by kube-vip.
+	LoadbalancerClassNameEnvKey = "KUBEVIP_LOADBALANCERCLASS_NAME"
 )
 
 func init() {
@@ -47,11 +203,12 @@ func init() {
 
 // KubeVipCloudProvider - contains all of the interfaces for the cloud provider
 type KubeVipCloudProvider struct {
-	lb            cloudprovider.LoadBalancer
+	lb            *kubevipLoadBalancerManager
 	kubeClient    kubernetes.Interface
 	namespace     string
 	configMapName string
 	enableLBClass bool
+	lbClassName   string
 }
 
 var _ cloudprovider.Interface = &KubeVipCloudProvider{}
@@ -60,6 +217,7 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 	ns := os.Getenv("KUBEVIP_NAMESPACE")
 	cm := os.Getenv("KUBEVIP_CONFIG_MAP")
 	lbc := os.Getenv(EnableLoadbalancerClassEnvKey)
+	lbClassName := os.Getenv(LoadbalancerClassNameEnvKey)
 
 	if cm == "" {
 		cm = KubeVipClientConfig
@@ -69,6 +227,10 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 		ns = KubeVipClientConfigNamespace
 	}
 
+	if lbClassName == "" {
+		lbClassName = LoadbalancerClass
+	}
+
 	var (
 		enableLBClass bool
 		err           error
@@ -81,11 +243,39 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 			return nil, fmt.Errorf("error parsing value of %s: %s", EnableLoadbalancerClassEnvKey, err.Error())
 		}
 	}
-	klog.Infof("staring with loadbalancerClass set to: %t", enableLBClass)
+	klog.Infof("staring with loadbalancerClass set to: %t, loadbalancerClass name: %s", enableLBClass, lbClassName)
+
+	if err := validateServiceKeys(); err != nil {
+		return nil, err
+	}
+
+	if LoadBalancerIPConflictWinner != LoadBalancerIPConflictAnnotation && LoadBalancerIPConflictWinner != LoadBalancerIPConflictSpec {
+		return nil, fmt.Errorf("invalid loadBalancerIP conflict winner [%s], must be %s or %s", LoadBalancerIPConflictWinner, LoadBalancerIPConflictAnnotation, LoadBalancerIPConflictSpec)
+	}
+
+	switch v1.IPFamilyPolicy(DefaultIPFamilyPolicy) {
+	case "", v1.IPFamilyPolicySingleStack, v1.IPFamilyPolicyPreferDualStack, v1.IPFamilyPolicyRequireDualStack:
+	default:
+		return nil, fmt.Errorf("invalid default IP family policy [%s], must be %s, %s or %s", DefaultIPFamilyPolicy,
+			v1.IPFamilyPolicySingleStack, v1.IPFamilyPolicyPreferDualStack, v1.IPFamilyPolicyRequireDualStack)
+	}
+
+	if EnablePoolMetrics {
+		klog.Info("Registering pool utilization and latency metrics")
+		registerMetrics()
+	}
+
+	if Tracing {
+		klog.Info("Exporting OpenTelemetry spans of the allocations")
+		if err := setupTracing(context.Background()); err != nil {
+			return nil, err
+		}
+	}
 
 	klog.Infof("Watching configMap for pool config with name: '%s', namespace: '%s'", cm, ns)
 
 	var cl *kubernetes.Clientset
+	var restConfig *rest.Config
 	if !OutSideCluster {
 		// This will attempt to load the configuration when running within a POD
 		cfg, err := rest.InClusterConfig()
@@ -96,6 +286,7 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 		if err != nil {
 			return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
 		}
+		restConfig = cfg
 		// use the current context in kubeconfig
 	} else {
 		config, err := clientcmd.BuildConfigFromFlags("", filepath.Join(os.Getenv("HOME"), ".kube", "config"))
@@ -106,19 +297,61 @@ func newKubeVipCloudProvider(io.Reader) (cloudprovider.Interface, error) {
 		if err != nil {
 			return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
 		}
+		restConfig = config
 	}
-	return &KubeVipCloudProvider{
-		lb:            newLoadBalancer(cl, ns, cm),
+
+	// Report configuration errors on startup rather than when the first service is synced
+	if err := validatePoolConfig(context.Background(), cl, cm, ns); err != nil {
+		klog.Errorf("Pool configuration is invalid: %v", err)
+		if ValidateConfigOnStart {
+			return nil, fmt.Errorf("pool configuration is invalid: %v", err)
+		}
+	}
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cl.CoreV1().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ProviderName})
+
+	lb := newLoadBalancer(cl, ns, cm, recorder)
+	lb.loadBalancerClass = lbClassName
+	if IPPoolCRD {
+		klog.Infof("Reading pools from the %s custom resources before configMap '%s'", IPPoolResource.GroupResource(), cm)
+		lb.dynamicClient, err = dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error creating dynamic client: %s", err.Error())
+		}
+	}
+
+	p := &KubeVipCloudProvider{
+		lb:            lb,
 		kubeClient:    cl,
 		namespace:     ns,
 		configMapName: cm,
 		enableLBClass: enableLBClass,
-	}, nil
+		lbClassName:   lbClassName,
+	}
+	p.serveEndpoints()
+	return p, nil
+}
+
+// serveEndpoints starts the HTTP endpoints of the controller. They are served by every replica, standby replicas
+// included, as Initialize is only called on the leader.
+func (p *KubeVipCloudProvider) serveEndpoints() {
+	if len(PoolsDebugBindAddress) != 0 {
+		go p.lb.servePoolsDebug(PoolsDebugBindAddress)
+	}
+	if len(HealthzBindAddress) != 0 {
+		go p.lb.serveHealthz(HealthzBindAddress)
+	}
 }
 
-// Initialize - starts the clound-provider controller
-func (p *KubeVipCloudProvider) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, _ <-chan struct{}) {
+// Initialize - starts the clound-provider controller. With leader election, which is enabled by default, it is only
+// called once the instance became the leader, and stop is closed when the leadership is lost: the controllers and
+// loops mutating services are stopped with it, so only the leader allocates addresses.
+func (p *KubeVipCloudProvider) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	klog.Info("Initing Kube-vip Cloud Provider")
+	ctx := wait.ContextForChannel(stop)
 
 	clientset := clientBuilder.ClientOrDie("do-shared-informers")
 	sharedInformer := informers.NewSharedInformerFactory(clientset, 0)
@@ -126,12 +359,44 @@ func (p *KubeVipCloudProvider) Initialize(clientBuilder cloudprovider.Controller
 	if p.enableLBClass {
 		klog.Info("staring a separate service controller that only monitors service with loadbalancerClass")
 		klog.Info("default cloud-provider service controller will ignore service with loadbalancerClass")
-		controller := newLoadbalancerClassServiceController(sharedInformer, p.kubeClient, p.configMapName, p.namespace)
-		go controller.Run(context.Background().Done())
+		controller := newLoadbalancerClassServiceController(sharedInformer, p.kubeClient, p.lb)
+		go controller.Run(stop)
+	}
+
+	if OrphanedAnnotationSweepInterval > 0 {
+		klog.Infof("sweeping services with orphaned address annotations every %s", OrphanedAnnotationSweepInterval)
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			if err := p.lb.sweepOrphanedAnnotations(ctx); err != nil {
+				klog.Errorf("unable to sweep services with orphaned address annotations: %v", err)
+			}
+		}, OrphanedAnnotationSweepInterval)
+	}
+
+	if EnableAllocationLedger && LedgerReclaimInterval > 0 {
+		klog.Infof("reclaiming the addresses of deleted services from the allocation ledger every %s", LedgerReclaimInterval)
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			if err := p.lb.reclaimLedger(ctx); err != nil {
+				klog.Errorf("unable to reclaim the addresses of deleted services from the allocation ledger: %v", err)
+			}
+		}, LedgerReclaimInterval)
+	}
+
+	if AddressAffinity && LedgerReclaimInterval > 0 {
+		klog.Infof("pruning the previous addresses of the services of deleted namespaces every %s", LedgerReclaimInterval)
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			if err := p.lb.pruneAffinity(ctx); err != nil {
+				klog.Errorf("unable to prune the previous addresses of the services of deleted namespaces: %v", err)
+			}
+		}, LedgerReclaimInterval)
+	}
+
+	if ResyncInterval > 0 {
+		klog.Infof("resyncing services with inconsistent labels and annotations every %s", ResyncInterval)
+		go p.lb.runResync(ctx, ResyncInterval, clock.RealClock{})
 	}
 
-	sharedInformer.Start(nil)
-	sharedInformer.WaitForCacheSync(nil)
+	sharedInformer.Start(stop)
+	sharedInformer.WaitForCacheSync(stop)
 }
 
 // LoadBalancer returns a loadbalancer interface. Also returns true if the interface is supported, false otherwise.
@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeClientBuilder hands out the client of the test to the controllers started by Initialize
+type fakeClientBuilder struct {
+	client kubernetes.Interface
+}
+
+func (b fakeClientBuilder) Config(string) (*rest.Config, error)         { return &rest.Config{}, nil }
+func (b fakeClientBuilder) ConfigOrDie(string) *rest.Config             { return &rest.Config{} }
+func (b fakeClientBuilder) Client(string) (kubernetes.Interface, error) { return b.client, nil }
+func (b fakeClientBuilder) ClientOrDie(string) kubernetes.Interface     { return b.client }
+
+func Test_InitializeLeadership(t *testing.T) {
+	interval := ResyncInterval
+	ResyncInterval = time.Millisecond
+	t.Cleanup(func() { ResyncInterval = interval })
+
+	tests := []struct {
+		name   string
+		leader bool
+	}{
+		{
+			name:   "the leader resyncs the services",
+			leader: true,
+		},
+		{
+			name: "the services are left alone once the leadership is lost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drifted := newKubevipService("test", "drifted", "10.0.0.5")
+			drifted.Spec.Type = v1.ServiceTypeLoadBalancer
+			delete(drifted.Labels, ImplementationLabel)
+			mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/24"}, drifted)
+			p := &KubeVipCloudProvider{lb: mgr, kubeClient: mgr.kubeClient, namespace: mgr.namespace, configMapName: mgr.cloudConfigMap}
+
+			stop := make(chan struct{})
+			if !tt.leader {
+				close(stop)
+			} else {
+				defer close(stop)
+			}
+			p.Initialize(fakeClientBuilder{client: mgr.kubeClient}, stop)
+
+			labeled := func(ctx context.Context) (bool, error) {
+				svc, err := mgr.kubeClient.CoreV1().Services("test").Get(ctx, drifted.Name, metav1.GetOptions{})
+				return err == nil && svc.Labels[ImplementationLabel] == ImplementationValue, err
+			}
+			err := wait.PollUntilContextTimeout(context.Background(), time.Millisecond, 100*time.Millisecond, true, labeled)
+			if tt.leader {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
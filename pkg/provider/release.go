@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+// releasedAddresses withholds the addresses of deleted services for a grace period, a service that is deleted and
+// created again in quick succession isn't beaten to its address by another service
+type releasedAddresses struct {
+	mu       sync.Mutex
+	clock    clock.PassiveClock
+	grace    time.Duration
+	released map[netip.Addr]time.Time
+}
+
+func newReleasedAddresses(c clock.PassiveClock, grace time.Duration) *releasedAddresses {
+	return &releasedAddresses{clock: c, grace: grace, released: map[netip.Addr]time.Time{}}
+}
+
+// release withholds the addresses until the grace period elapsed
+func (r *releasedAddresses) release(addrs []netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	for _, addr := range addrs {
+		r.released[addr] = now
+	}
+}
+
+// withheld returns the addresses released less than the grace period ago, the others are forgotten
+func (r *releasedAddresses) withheld() []netip.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	addrs := make([]netip.Addr, 0, len(r.released))
+	for addr, releasedAt := range r.released {
+		if now.Sub(releasedAt) >= r.grace {
+			delete(r.released, addr)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
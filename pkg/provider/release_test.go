@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func Test_syncLoadBalancerReleaseGracePeriod(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/29"})
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	mgr.releasedAddresses = newReleasedAddresses(fakeClock, time.Minute)
+
+	create := func(name, want string) {
+		t.Helper()
+		got, err := syncNewService(t, mgr, &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got)
+	}
+	remove := func(name string) {
+		t.Helper()
+		svc, err := mgr.kubeClient.CoreV1().Services("test").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.EnsureLoadBalancerDeleted(context.Background(), "", svc); err != nil {
+			t.Fatal(err)
+		}
+		if err := mgr.kubeClient.CoreV1().Services("test").Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	create("first", "10.0.0.1")
+	remove("first")
+
+	// The address is withheld during the grace period
+	fakeClock.Step(59 * time.Second)
+	create("second", "10.0.0.2")
+
+	// The address is free again once the grace period elapsed
+	fakeClock.Step(time.Second)
+	create("third", "10.0.0.1")
+	assert.Empty(t, mgr.releasedAddresses.withheld())
+}
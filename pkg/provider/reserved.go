@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+)
+
+// reservedKey returns the configmap key of the address(es) reserved for the service
+// Example: reserved-kube-system-kube-dns: 10.0.0.50
+func reservedKey(service *v1.Service) string {
+	return fmt.Sprintf("reserved-%s-%s", service.Namespace, service.Name)
+}
+
+// reservedAddresses returns the address(es) reserved for the service in the configmap, and whether they can be
+// assigned to it. Reserved addresses that are held by a different service are not assigned, the service then
+// takes its address(es) from its pool.
+func (k *kubevipLoadBalancerManager) reservedAddresses(ctx context.Context, service *v1.Service, controllerCM *v1.ConfigMap) (string, bool, error) {
+	key := reservedKey(service)
+	reserved, ok := controllerCM.Data[key]
+	if !ok {
+		return "", false, nil
+	}
+	addrs, err := parseAddresses(strings.ReplaceAll(reserved, " ", ""))
+	if err != nil {
+		recordAllocationFailure(allocationFailureInvalidConfig)
+		return "", false, fmt.Errorf("invalid value [%s] for key [%s]: %v", reserved, key, err)
+	}
+
+	// Reserved addresses don't belong to a pool, they must not be held by a service of any namespace
+	svcs, err := listKubevipServices(ctx, k.kubeClient, service.Namespace, true)
+	if err != nil {
+		return "", false, err
+	}
+	for x := range svcs.Items {
+		svc := &svcs.Items[x]
+		if svc.Namespace == service.Namespace && svc.Name == service.Name {
+			continue
+		}
+		svcAddrs := getServiceAddresses(svc)
+		for _, addr := range addrs {
+			for _, svcAddr := range svcAddrs {
+				if addr == svcAddr {
+					k.reportReservedConflict(service, key, addr.String(), fmt.Sprintf("service '%s/%s'", svc.Namespace, svc.Name))
+					return "", false, nil
+				}
+			}
+		}
+	}
+
+	if k.allocationLedger {
+		ledger, err := getConfigMap(ctx, k.kubeClient, AllocationLedgerConfigMap, k.namespace)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", false, fmt.Errorf("unable to read the allocation ledger: %v", err)
+		}
+		if err == nil {
+			for _, addr := range addrs {
+				if uid, ok := ledger.Data[ledgerKey(addr)]; ok && uid != string(service.UID) {
+					k.reportReservedConflict(service, key, addr.String(), fmt.Sprintf("service with uid [%s]", uid))
+					return "", false, nil
+				}
+			}
+		}
+	}
+
+	addresses := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addresses = append(addresses, addr.String())
+	}
+	return strings.Join(addresses, ","), true, nil
+}
+
+// reportReservedConflict logs and records that the address reserved for the service is held by another service
+func (k *kubevipLoadBalancerManager) reportReservedConflict(service *v1.Service, key, addr, holder string) {
+	klog.InfoS("Reserved address is held by another service, allocating from the pool", "service", klog.KObj(service), "key", key, "address", addr, "holder", holder)
+	k.recordEventf(service, v1.EventTypeWarning, ReservedIPConflictReason, "Reserved address [%s] is held by %s, allocating from the pool", addr, holder)
+}
@@ -0,0 +1,74 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// resyncJitterFactor spreads the resyncs of several controllers, the interval is extended by up to 20%
+const resyncJitterFactor = 0.2
+
+// runResync resyncs the services every interval, extended by a random jitter, until the context is done
+func (k *kubevipLoadBalancerManager) runResync(ctx context.Context, interval time.Duration, c clock.Clock) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.After(wait.Jitter(interval, resyncJitterFactor)):
+		}
+		if err := k.resyncServices(ctx); err != nil {
+			klog.Errorf("unable to resync services: %v", err)
+		}
+	}
+}
+
+// resyncServices syncs the load balancer services whose label and annotation drifted apart without an
+// event for the service, i.e. the label was removed or the annotation cleared by a manual edit
+func (k *kubevipLoadBalancerManager) resyncServices(ctx context.Context) error {
+	svcs, err := k.kubeClient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list services: %v", err)
+	}
+
+	nodes, err := k.listNodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for x := range svcs.Items {
+		svc := &svcs.Items[x]
+		if !k.needsResync(svc) {
+			continue
+		}
+		klog.InfoS("Resyncing service whose label and annotation are inconsistent", "service", klog.KObj(svc),
+			"label", ImplementationLabel, "annotation", IPsAnnotation)
+		if _, err := k.syncLoadBalancer(ctx, svc, nodes); err != nil {
+			errs = append(errs, fmt.Errorf("error syncing service '%s/%s': %v", svc.Namespace, svc.Name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// needsResync returns true if the service is a load balancer managed by kube-vip that is missing either the
+// implementation label or the address annotation
+func (k *kubevipLoadBalancerManager) needsResync(service *v1.Service) bool {
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer || service.Annotations[SkipManagementAnnotation] == "true" {
+		return false
+	}
+	if class := service.Spec.LoadBalancerClass; class != nil && len(*class) != 0 && *class != k.loadBalancerClass {
+		return false
+	}
+	if !k.namespaceManaged(service.Namespace) {
+		return false
+	}
+	return service.Labels[ImplementationLabel] != ImplementationValue || len(service.Annotations[IPsAnnotation]) == 0
+}
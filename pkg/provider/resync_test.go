@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func Test_runResync(t *testing.T) {
+	drifted := newKubevipService("test", "drifted", "10.0.0.5")
+	drifted.Spec.Type = v1.ServiceTypeLoadBalancer
+	delete(drifted.Labels, ImplementationLabel)
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/24"}, drifted)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	interval := time.Minute
+	done := make(chan struct{})
+	go func() {
+		mgr.runResync(ctx, interval, fakeClock)
+		close(done)
+	}()
+
+	// The service is left alone until the interval, extended by the jitter, elapsed
+	if err := wait.PollUntilContextTimeout(ctx, time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		return fakeClock.HasWaiters(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := mgr.kubeClient.CoreV1().Services("test").Get(ctx, drifted.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, svc.Labels[ImplementationLabel])
+
+	fakeClock.Step(time.Duration(float64(interval) * (1 + resyncJitterFactor)))
+	if err := wait.PollUntilContextTimeout(ctx, time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		svc, err = mgr.kubeClient.CoreV1().Services("test").Get(ctx, drifted.Name, metav1.GetOptions{})
+		return err == nil && svc.Labels[ImplementationLabel] == ImplementationValue, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.5", svc.Annotations[IPsAnnotation])
+
+	cancel()
+	<-done
+}
+
+func Test_needsResync(t *testing.T) {
+	mgr := newTestLoadBalancer(t, nil)
+	newService := func(mutate func(*v1.Service)) *v1.Service {
+		svc := newKubevipService("test", "name", "10.0.0.5")
+		svc.Spec.Type = v1.ServiceTypeLoadBalancer
+		mutate(svc)
+		return svc
+	}
+	tests := []struct {
+		name    string
+		service *v1.Service
+		want    bool
+	}{
+		{
+			name:    "consistent",
+			service: newService(func(*v1.Service) {}),
+		},
+		{
+			name:    "label missing",
+			service: newService(func(svc *v1.Service) { delete(svc.Labels, ImplementationLabel) }),
+			want:    true,
+		},
+		{
+			name:    "annotation missing",
+			service: newService(func(svc *v1.Service) { delete(svc.Annotations, IPsAnnotation) }),
+			want:    true,
+		},
+		{
+			name: "not a load balancer",
+			service: newService(func(svc *v1.Service) {
+				svc.Spec.Type = v1.ServiceTypeClusterIP
+				delete(svc.Labels, ImplementationLabel)
+			}),
+		},
+		{
+			name: "managed out of band",
+			service: newService(func(svc *v1.Service) {
+				svc.Annotations[SkipManagementAnnotation] = "true"
+				delete(svc.Labels, ImplementationLabel)
+			}),
+		},
+		{
+			name: "other loadBalancerClass",
+			service: newService(func(svc *v1.Service) {
+				class := "other"
+				svc.Spec.LoadBalancerClass = &class
+				delete(svc.Labels, ImplementationLabel)
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, mgr.needsResync(tt.service))
+		})
+	}
+}
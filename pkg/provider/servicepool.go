@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/kube-vip/kube-vip-cloud-provider/pkg/ipam"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+)
+
+// servicePoolKey returns the key of the ad-hoc pool defined by the LoadbalancerPoolCIDRAnnotation of the service,
+// it is reported in events and in the AllocationSourceAnnotation like the configmap key of a pool
+func servicePoolKey(service *v1.Service) string {
+	return fmt.Sprintf("service-%s-%s", service.Namespace, service.Name)
+}
+
+// newServicePool returns the ad-hoc pool defined by the LoadbalancerPoolCIDRAnnotation of the service. The pool
+// isn't part of the configmap, so its addresses could belong to any pool: the in-use addresses are gathered from
+// the services of all namespaces.
+func newServicePool(service *v1.Service) (*ipPool, error) {
+	value := service.Annotations[LoadbalancerPoolCIDRAnnotation]
+	cidrs := strings.Split(value, ",")
+	for i, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value [%s] for annotation [%s]: %v", value, LoadbalancerPoolCIDRAnnotation, err)
+		}
+		cidrs[i] = prefix.String()
+	}
+	return &ipPool{
+		addresses: strings.Join(cidrs, ","),
+		key:       servicePoolKey(service),
+		global:    true,
+		step:      1,
+	}, nil
+}
+
+// allocateFromServicePool finds free address(es) for the service in the ad-hoc pool of its
+// LoadbalancerPoolCIDRAnnotation, the pools of the configmap are not looked up
+func (k *kubevipLoadBalancerManager) allocateFromServicePool(ctx context.Context, service *v1.Service) (string, *ipPool, error) {
+	pool, err := newServicePool(service)
+	if err != nil {
+		recordAllocationFailure(allocationFailureInvalidConfig)
+		k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to find an address pool: %v", err)
+		return "", nil, err
+	}
+
+	// The configmap only provides the search order and the limits of the service, without it the defaults apply
+	controllerCM, err := k.getCloudConfigMap(ctx)
+	if apierrors.IsNotFound(err) {
+		controllerCM = &v1.ConfigMap{}
+	} else if err != nil {
+		// The failures of backed off reads were already logged
+		var backoffErr *configMapBackoffError
+		if !errors.As(err, &backoffErr) {
+			klog.ErrorS(err, "Unable to retrieve kube-vip ipam config", "service", klog.KObj(service), "configMap", klog.KRef(k.namespace, k.cloudConfigMap))
+		}
+		return "", nil, fmt.Errorf("unable to retrieve kube-vip ipam config from configMap [%s] in namespace [%s]: %v", k.cloudConfigMap, k.namespace, err)
+	}
+
+	klog.InfoS("Allocating from the pool of the service annotation", "service", klog.KObj(service), "annotation", LoadbalancerPoolCIDRAnnotation, "pool", pool.addresses)
+	loadBalancerIPs, err := k.allocateFromPool(ctx, service, controllerCM, pool)
+	if err != nil {
+		var outOfIPs *ipam.OutOfIPsError
+		if errors.As(err, &outOfIPs) {
+			recordAllocationFailure(allocationFailureOutOfIPs)
+			k.recordEventf(service, v1.EventTypeWarning, IPAllocationFailedReason, "Unable to allocate address from pool [%s]: %v", pool.key, err)
+		}
+		return "", nil, err
+	}
+	return loadBalancerIPs, pool, nil
+}
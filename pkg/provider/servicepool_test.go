@@ -0,0 +1,121 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_syncLoadBalancerServicePool(t *testing.T) {
+	newService := func(name, cidr string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Annotations: map[string]string{LoadbalancerPoolCIDRAnnotation: cidr},
+			},
+		}
+	}
+	tests := []struct {
+		name     string
+		data     map[string]string
+		services []*v1.Service
+		service  *v1.Service
+		want     string
+		wantErr  string
+	}{
+		{
+			name:    "the pools of the configmap are bypassed",
+			data:    map[string]string{"cidr-test": "10.0.0.0/24"},
+			service: newService("svc", "10.5.0.0/24"),
+			want:    "10.5.0.1",
+		},
+		{
+			name: "the addresses in use by the services of all namespaces are skipped",
+			data: map[string]string{"cidr-test": "10.0.0.0/24"},
+			services: []*v1.Service{
+				newKubevipService("other", "other", "10.5.0.1"),
+			},
+			service: newService("svc", "10.5.0.0/24"),
+			want:    "10.5.0.2",
+		},
+		{
+			name:    "without a pool in the configmap",
+			data:    map[string]string{"search-order": "desc"},
+			service: newService("svc", "10.5.0.0/24"),
+			want:    "10.5.0.254",
+		},
+		{
+			name: "dual-stack cidrs",
+			service: func() *v1.Service {
+				svc := newService("svc", "10.5.0.0/24, fd00::/120")
+				svc.Spec.IPFamilyPolicy = ipFamilyPolicyPtr(v1.IPFamilyPolicyRequireDualStack)
+				svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+				return svc
+			}(),
+			want: "10.5.0.1,fd00::",
+		},
+		{
+			name: "the pool is out of addresses",
+			services: []*v1.Service{
+				newKubevipService("other", "first", "10.5.0.1"),
+				newKubevipService("other", "second", "10.5.0.2"),
+			},
+			service: newService("svc", "10.5.0.0/30"),
+			wantErr: "no addresses available in [test] cidr [10.5.0.0/30]",
+		},
+		{
+			name:    "malformed cidr",
+			service: newService("svc", "10.5.0.0/33"),
+			wantErr: "invalid value [10.5.0.0/33] for annotation [kube-vip.io/loadbalancerPoolCIDR]",
+		},
+		{
+			name:    "address instead of a cidr",
+			service: newService("svc", "10.5.0.1"),
+			wantErr: "invalid value [10.5.0.1] for annotation [kube-vip.io/loadbalancerPoolCIDR]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestLoadBalancer(t, tt.data, tt.services...)
+			got, err := syncNewService(t, mgr, tt.service)
+			if len(tt.wantErr) != 0 {
+				if err == nil {
+					t.Fatal("expected syncLoadBalancer() to fail")
+				}
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got)
+
+			svc, err := mgr.kubeClient.CoreV1().Services(tt.service.Namespace).Get(context.Background(), tt.service.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "pool:service-test-svc", svc.Annotations[AllocationSourceAnnotation])
+		})
+	}
+}
+
+func Test_syncLoadBalancerServicePoolWithoutConfigMap(t *testing.T) {
+	mgr := newLoadBalancer(fake.NewSimpleClientset(), KubeVipClientConfigNamespace, KubeVipClientConfig, record.NewFakeRecorder(100))
+	got, err := syncNewService(t, mgr, &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "svc",
+			Annotations: map[string]string{LoadbalancerPoolCIDRAnnotation: "10.5.0.0/24"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.5.0.1", got)
+}
@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+)
+
+// tracerName is the instrumentation scope of the allocation spans
+const tracerName = "github.com/kube-vip/kube-vip-cloud-provider/pkg/provider"
+
+// Attributes of the allocation spans
+const (
+	// namespaceAttribute is the namespace of the service
+	namespaceAttribute = attribute.Key("kubevip.namespace")
+	// serviceAttribute is the name of the service
+	serviceAttribute = attribute.Key("kubevip.service")
+	// poolAttribute is the configmap key of the pool, or the comma separated keys of the pools tried in order
+	poolAttribute = attribute.Key("kubevip.pool")
+	// familyAttribute is the comma separated IP families of the service
+	familyAttribute = attribute.Key("kubevip.family")
+	// addressesAttribute is the comma separated address(es) of the service
+	addressesAttribute = attribute.Key("kubevip.addresses")
+	// outcomeAttribute is the sync result of syncLoadBalancer, success or error for the other spans
+	outcomeAttribute = attribute.Key("kubevip.outcome")
+)
+
+// setupTracing installs the global tracer provider, exporting the allocation spans with OTLP over gRPC. The exporter
+// is configured with the OTEL_EXPORTER_OTLP_* environment variables. Without it the spans are no-ops.
+func setupTracing(ctx context.Context) error {
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to create the OTLP trace exporter: %v", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(ProviderName)))
+	if err != nil {
+		return fmt.Errorf("unable to create the trace resource: %v", err)
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)))
+	return nil
+}
+
+// familyNames returns the comma separated IP families
+func familyNames(ipFamilies []v1.IPFamily) string {
+	names := make([]string, 0, len(ipFamilies))
+	for _, family := range ipFamilies {
+		names = append(names, string(family))
+	}
+	return strings.Join(names, ",")
+}
+
+// poolKeys returns the comma separated configmap keys of the pools
+func poolKeys(pools []*ipPool) string {
+	keys := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		keys = append(keys, pool.key)
+	}
+	return strings.Join(keys, ",")
+}
+
+// endSpan records the outcome of the span and ends it, the outcome is success or error unless it is given
+func endSpan(span trace.Span, outcome string, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if len(outcome) == 0 {
+		outcome = "success"
+		if err != nil {
+			outcome = syncResultError
+		}
+	}
+	span.SetAttributes(outcomeAttribute.String(outcome))
+	span.End()
+}
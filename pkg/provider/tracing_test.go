@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_syncLoadBalancerTracing(t *testing.T) {
+	mgr := newTestLoadBalancer(t, map[string]string{"cidr-global": "10.0.0.0/24"})
+	recorder := tracetest.NewSpanRecorder()
+	mgr.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "name"},
+		Spec:       v1.ServiceSpec{IPFamilies: []v1.IPFamily{v1.IPv4Protocol}},
+	}
+	if _, err := syncNewService(t, mgr, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	got := map[string][]attribute.KeyValue{}
+	for _, span := range spans {
+		got[span.Name()] = span.Attributes()
+	}
+	assert.Equal(t, map[string][]attribute.KeyValue{
+		"discoverPool": {
+			namespaceAttribute.String("test"),
+			poolAttribute.String("cidr-global"),
+			outcomeAttribute.String("success"),
+		},
+		"discoverVIPs": {
+			namespaceAttribute.String("test"),
+			poolAttribute.String("cidr-global"),
+			familyAttribute.String("IPv4"),
+			addressesAttribute.String("10.0.0.1"),
+			outcomeAttribute.String("success"),
+		},
+		"syncLoadBalancer": {
+			namespaceAttribute.String("test"),
+			serviceAttribute.String("name"),
+			outcomeAttribute.String(syncResultAllocated),
+		},
+	}, got)
+
+	// The discovery spans are children of the span of the sync
+	for _, span := range spans {
+		if span.Name() != "syncLoadBalancer" {
+			assert.Equal(t, spans[len(spans)-1].SpanContext().SpanID(), span.Parent().SpanID())
+		}
+	}
+}